@@ -1,16 +1,66 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/sbraveyoung/GGmpeg/liblog"
 	"github.com/sbraveyoung/GGmpeg/librtmp"
 )
 
 func main() {
-	err := librtmp.NewServer(":1935", "live").WithHTTPFlv(":8080").WithHls(":8081").Handler()
-	if err != nil {
+	configPath := flag.String("config", "", "path to a JSON server config; without it the demo serves app \"live\" on :1935, HTTP-FLV on :8080 and HLS on :8081")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	if *configPath != "" {
+		err = runConfig(ctx, *configPath)
+	} else {
+		err = librtmp.NewServer(":1935", "live").
+			WithLogger(liblog.New(os.Stdout, liblog.LevelInfo)).
+			WithHTTPFlv(":8080").
+			WithHls(":8081").
+			Run(ctx)
+	}
+	if err != nil && err != context.Canceled {
 		fmt.Println("handle server error:", err)
 		return
 	}
 	return
 }
+
+func runConfig(ctx context.Context, path string) error {
+	cfg, err := librtmp.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	srv, err := librtmp.NewServerFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	//SIGHUP re-reads the file; see Reload for what can change live.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if err := srv.ReloadFile(); err != nil {
+					fmt.Println("reload config error:", err)
+				}
+			}
+		}
+	}()
+	return srv.Run(ctx)
+}
@@ -1,8 +1,128 @@
 package libamf
 
-import "github.com/SmartBrave/Athena/easyio"
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/SmartBrave/Athena/easyio"
+)
 
 type AMF interface {
 	Decode(easyio.EasyReader) ([]interface{}, error)
 	Encode(easyio.EasyWriter, interface{}) error
 }
+
+// ECMAArray is an AMF0 ECMA array, kept apart from anonymous objects,
+// which decode to map[string]interface{}, so that it encodes back the
+// same.
+type ECMAArray map[string]interface{}
+
+// TypedObject is an object of a named class.
+type TypedObject struct {
+	ClassName string
+	Object    map[string]interface{}
+}
+
+// XMLDocument is an XML document, AMF0's or AMF3's.
+type XMLDocument string
+
+// maxDepth bounds the nesting of decoded values, lest a message of
+// nested arrays exhaust the stack.
+const maxDepth = 1024
+
+var errDepth = errors.New("amf: values nested too deep")
+
+// isValueStruct tells the struct types encoded as values, not objects.
+func isValueStruct(t reflect.Type) bool {
+	return t == reflect.TypeOf(time.Time{}) || t == reflect.TypeOf(TypedObject{})
+}
+
+// readBytes reads n bytes, growing the buffer as they come rather than
+// trusting a length off the wire.
+func readBytes(r io.Reader, n uint32) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(b)) != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+// structFields returns the members a struct encodes to, named and
+// filtered by its amf tags:
+//
+//	Field int `amf:"name"`           as name
+//	Field int `amf:"name,omitempty"` as name, left out if zero
+//	Field int `amf:"-"`              left out
+//
+// Untagged exported fields go by their Go name; untagged embedded
+// structs are flattened.
+func structFields(v reflect.Value) (names []string, values []reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, tagged := field.Tag.Lookup("amf")
+		if tag == "-" {
+			continue
+		}
+		value := v.Field(i)
+		if field.Anonymous && !tagged {
+			if value.Kind() == reflect.Ptr {
+				if value.IsNil() {
+					continue
+				}
+				value = value.Elem()
+			}
+			if value.Kind() == reflect.Struct {
+				n, vs := structFields(value)
+				names, values = append(names, n...), append(values, vs...)
+				continue
+			}
+		}
+		if field.PkgPath != "" { //unexported
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.IndexByte(tag, ','); i >= 0 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if opts == "omitempty" && value.IsZero() {
+			continue
+		}
+		names, values = append(names, name), append(values, value)
+	}
+	return names, values
+}
+
+// refKey identifies a map, slice or pointer for the reference tables
+// of the encoders.
+type refKey struct {
+	t   reflect.Type
+	ptr uintptr
+	len int
+}
+
+// refOf returns the key of v if it can be referenced: a non-empty map
+// or slice, or a pointer.
+func refOf(v reflect.Value) (key refKey, ok bool) {
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Ptr:
+		if v.IsNil() || v.Kind() != reflect.Ptr && v.Len() == 0 {
+			return key, false
+		}
+		key = refKey{t: v.Type(), ptr: v.Pointer()}
+		if v.Kind() == reflect.Slice {
+			key.len = v.Len()
+		}
+		return key, true
+	}
+	return key, false
+}
@@ -3,9 +3,10 @@ package libamf
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
+	"math"
 	"reflect"
+	"sort"
 	"time"
 
 	"github.com/SmartBrave/Athena/easyerrors"
@@ -31,390 +32,483 @@ const (
 	UnSupportedMarker
 	RecordSetMarker //reserved, not supported
 	XMLDocumentMarker
-	TypedObjectMarker //complex types
+	TypedObjectMarker   //complex types
+	AvmPlusObjectMarker //an AMF3 value follows
 	InvalidMarker
 )
 
+// amf0 decodes
+//   - numbers to float64, booleans to bool, strings and long strings to
+//     string, null and undefined to nil
+//   - anonymous objects to map[string]interface{}, ECMA arrays to
+//     ECMAArray, typed objects to TypedObject, strict arrays to
+//     []interface{}
+//   - dates to time.Time in their time zone, XML documents to
+//     XMLDocument
+//   - avmplus objects to what AMF3 decodes them to
+//
+// and encodes those back the same. It also encodes other numbers,
+// other maps with string keys and structs, after their amf tags, as
+// anonymous objects, other slices and arrays as strict arrays, and
+// pointers and interfaces as what they point to. A map, slice or
+// pointer met again is encoded as a reference to it.
 type amf0 struct{}
 
 var AMF0 amf0
 
+// Decode decodes the values of a message, which share the reference
+// table.
 func (amf0) Decode(r easyio.EasyReader) (res []interface{}, err error) {
-	var referenceIndex []int
-	var i interface{}
-	var marker Marker
+	d := &amf0Decoder{r: r}
 	for {
-		marker, i, err = decodeamf0(r)
+		var i interface{}
+		_, i, err = d.decode()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return res, err
 		}
-		//NOTE:i should not be set to nil value and typed pointer such as `i=(int*)nil`
-		// if i != nil {
-		switch marker {
-		case ObjectMarker, EcmaArrayMarker, TypedObjectMarker:
-			referenceIndex = append(referenceIndex, len(res))
-		case ReferenceMarker:
-			index := i.(uint16)
-			if int(index) < len(referenceIndex) {
-				i = res[referenceIndex[index]]
-			}
-		default:
-			//do nothing
-		}
 		res = append(res, i)
-		// }
 	}
 	return res, nil
 }
 
-func decodeamf0(r easyio.EasyReader) (marker Marker, i interface{}, err error) {
+// Encode encodes a value. Its references count from its start, so it
+// has to be the first complex value of the message or refer to none;
+// EncodeAll encodes several values of a message.
+func (amf0) Encode(w easyio.EasyWriter, obj interface{}) (err error) {
+	return newAMF0Encoder(w).encode(reflect.ValueOf(obj))
+}
+
+// EncodeAll encodes the values of a message.
+func (amf0) EncodeAll(w easyio.EasyWriter, objs ...interface{}) (err error) {
+	e := newAMF0Encoder(w)
+	for _, obj := range objs {
+		if err = e.encode(reflect.ValueOf(obj)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncodeAvmPlus encodes obj as AMF3 behind the avmplus-object marker,
+// the way AMF3 values go in AMF0 command and data messages.
+func (amf0) EncodeAvmPlus(w easyio.EasyWriter, obj interface{}) (err error) {
+	if err = binary.Write(w, binary.BigEndian, AvmPlusObjectMarker); err != nil {
+		return err
+	}
+	return AMF3.Encode(w, obj)
+}
+
+type amf0Decoder struct {
+	r     easyio.EasyReader
+	depth int
+	//Objects, ECMA arrays, typed objects and strict arrays, in the
+	//order they start.
+	refs []interface{}
+}
+
+var errAMF0Reference = errors.New("invalid amf0 reference")
+
+// decode reads one value; io.EOF only if there is none.
+func (d *amf0Decoder) decode() (marker Marker, i interface{}, err error) {
 	var b []byte
-	b, err = r.ReadN(1)
+	b, err = d.r.ReadN(1)
 	if err != nil {
 		return InvalidMarker, nil, err
 	}
 
+	if d.depth++; d.depth > maxDepth {
+		return InvalidMarker, nil, errDepth
+	}
+	defer func() { d.depth-- }()
+
 	marker = Marker(b[0])
 	switch marker {
 	case NumberMarker:
-		i, err = decodeNumberamf0(r)
+		i, err = d.decodeNumber()
 	case BooleanMarker:
-		i, err = decodeBooleanamf0(r)
+		var boolean bool
+		err = binary.Read(d.r, binary.BigEndian, &boolean)
+		i = boolean
 	case StringMarker:
-		i, err = decodeStringamf0(r)
+		i, err = d.decodeString()
 	case ObjectMarker: //complex types
-		i, err = decodeObjectamf0(r)
+		obj := make(map[string]interface{})
+		d.refs = append(d.refs, obj)
+		i, err = obj, d.decodePairs(obj)
 	case MovieclipMarker: //not supported, do nothing
 	case NULLMarker:
 		i, err = nil, nil
 	case UndefinedMarker: //no futher information is encoded, do nothing
 	case ReferenceMarker:
-		i, err = decodeReferenceamf0(r)
+		var index uint16
+		if err = binary.Read(d.r, binary.BigEndian, &index); err == nil {
+			if int(index) >= len(d.refs) {
+				err = errAMF0Reference
+			} else {
+				i = d.refs[index]
+			}
+		}
 	case EcmaArrayMarker: //complex types
-		i, err = decodeEcmaArrayamf0(r)
+		//The count is only a hint, some encoders write 0.
+		if _, err = d.r.ReadN(4); err == nil {
+			arr := make(ECMAArray)
+			d.refs = append(d.refs, arr)
+			i, err = arr, d.decodePairs(arr)
+		}
 	case ObjectEndMarker: //no futher information is encoded, do nothing
 	case StrictArrayMarker:
-		i, err = decodeStrictArrayamf0(r)
+		i, err = d.decodeStrictArray()
 	case DateMarker:
-		i, err = decodeDateamf0(r)
+		i, err = d.decodeDate()
 	case LongStringMarker:
-		i, err = decodeLongStringamf0(r)
+		i, err = d.decodeLongString()
 	case UnSupportedMarker: //no futher information is encoded, do nothing
 	case RecordSetMarker: //not supported, do nothing
 	case XMLDocumentMarker:
-		i, err = decodeXMLDocumentamf0(r)
+		var xml string
+		xml, err = d.decodeLongString()
+		i = XMLDocument(xml)
 	case TypedObjectMarker: //complex types
-		//XXX: get className, then?
-		var className string
-		className, i, err = decodeTypedObjectamf0(r)
-		i = map[string]interface{}{
-			className: i,
+		obj := TypedObject{Object: make(map[string]interface{})}
+		if obj.ClassName, err = d.decodeString(); err == nil {
+			d.refs = append(d.refs, obj)
+			i, err = obj, d.decodePairs(obj.Object)
 		}
+	case AvmPlusObjectMarker:
+		i, err = (&amf3Decoder{r: d.r}).decode()
 	default:
 		return InvalidMarker, i, errors.New("invalid amf0 marker")
 	}
-	// fmt.Printf("marker:%x, value:%+v\n", marker, i)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	return marker, i, err
 }
 
-func decodeNumberamf0(r easyio.EasyReader) (num float64, err error) {
-	err = binary.Read(r, binary.BigEndian, &num)
+func (d *amf0Decoder) decodeNumber() (num float64, err error) {
+	err = binary.Read(d.r, binary.BigEndian, &num)
 	return num, err
 }
 
-func decodeBooleanamf0(r easyio.EasyReader) (boolean bool, err error) {
-	err = binary.Read(r, binary.BigEndian, &boolean)
-	return boolean, err
-}
-
-func decodeStringamf0(r easyio.EasyReader) (str string, err error) {
+func (d *amf0Decoder) decodeString() (str string, err error) {
 	var length uint16
-	err = binary.Read(r, binary.BigEndian, &length)
+	err = binary.Read(d.r, binary.BigEndian, &length)
 	if err != nil {
 		return str, err
 	}
 
 	var b []byte
-	b, err = readByteamf0(r, uint32(length))
+	b, err = readBytes(d.r, uint32(length))
 	return string(b), err
 }
 
-func decodeLongStringamf0(r easyio.EasyReader) (str string, err error) {
+func (d *amf0Decoder) decodeLongString() (str string, err error) {
 	var length uint32
-	err = binary.Read(r, binary.BigEndian, &length)
+	err = binary.Read(d.r, binary.BigEndian, &length)
 	if err != nil {
 		return str, err
 	}
 
 	var b []byte
-	b, err = readByteamf0(r, length)
+	b, err = readBytes(d.r, length)
 	return string(b), err
 }
 
-//TODO: utf-8 support
-func readByteamf0(r easyio.EasyReader, length uint32) (b []byte, err error) {
-	b, err = r.ReadN(uint32(length))
-	if err != nil {
-		return nil, err
-	}
-	return b, nil
-}
-
-func decodeObjectamf0(r easyio.EasyReader) (res map[string]interface{}, err error) {
-	var p *pair
-	res = make(map[string]interface{})
+// decodePairs reads the members of an object into res, up to the
+// empty key and the object end marker: 00 00 09.
+func (d *amf0Decoder) decodePairs(res map[string]interface{}) (err error) {
 	for {
-		p, err = readPairamf0(r)
+		var key string
+		key, err = d.decodeString()
 		if err != nil {
-			return res, err
+			return err
 		}
-		if p.key == "" {
-			break
+		if key == "" {
+			var b []byte
+			b, err = d.r.ReadN(1)
+			if err != nil {
+				return err
+			}
+			if Marker(b[0]) != ObjectEndMarker {
+				return errors.New("amf0: missing object end marker")
+			}
+			return nil
 		}
-		res[p.key] = p.value
-	}
-	return res, nil
-}
-
-func decodeTypedObjectamf0(r easyio.EasyReader) (className string, res map[string]interface{}, err error) {
-	className, err = decodeStringamf0(r)
-	if err != nil {
-		return className, res, err
-	}
-
-	res, err = decodeObjectamf0(r)
-	return className, res, err
-}
-
-type pair struct {
-	key   string
-	value interface{}
-}
-
-func readPairamf0(r easyio.EasyReader) (p *pair, err error) {
-	p = &pair{}
-	p.key, err = decodeStringamf0(r)
-	if err != nil {
-		return p, err
-	}
-	if p.key == "" {
-		return p, nil
-	}
-
-	_, p.value, err = decodeamf0(r)
-	if err != nil {
-		return p, err
-	}
-	return p, nil
-}
-
-func decodeReferenceamf0(r easyio.EasyReader) (index uint16, err error) {
-	err = binary.Read(r, binary.BigEndian, &index)
-	return index, err
-}
-
-func decodeEcmaArrayamf0(r easyio.EasyReader) (res map[string]interface{}, err error) {
-	var length uint32
-	err = binary.Read(r, binary.BigEndian, &length)
-	if err != nil {
-		return res, err
-	}
 
-	res = make(map[string]interface{})
-	var i uint32
-	var p *pair
-	for i = 0; i <= length; i++ { //length: 00 00 09
-		p, err = readPairamf0(r)
+		var value interface{}
+		_, value, err = d.decode()
 		if err != nil {
-			return res, err
-		}
-		if p.key == "" {
-			break
+			return err
 		}
-		res[p.key] = p.value
+		res[key] = value
 	}
-	return res, nil
 }
 
-func decodeStrictArrayamf0(r easyio.EasyReader) (res []interface{}, err error) {
+func (d *amf0Decoder) decodeStrictArray() (res []interface{}, err error) {
 	var length uint32
-	err = binary.Read(r, binary.BigEndian, &length)
+	err = binary.Read(d.r, binary.BigEndian, &length)
 	if err != nil {
 		return res, err
 	}
 
+	//Referred to from within, before it is complete, the array is nil.
+	index := len(d.refs)
+	d.refs = append(d.refs, nil)
+	res = []interface{}{}
 	var i uint32
 	var item interface{}
 	for i = 0; i < length; i++ {
-		_, item, err = decodeamf0(r)
+		_, item, err = d.decode()
 		if err != nil {
 			return res, err
 		}
 		res = append(res, item)
 	}
+	d.refs[index] = res
 	return res, nil
 }
 
-func decodeDateamf0(r easyio.EasyReader) (date time.Time, err error) {
+func (d *amf0Decoder) decodeDate() (date time.Time, err error) {
 	var timestamp float64
-	timestamp, err = decodeNumberamf0(r)
+	timestamp, err = d.decodeNumber()
 	if err != nil {
 		return time.Unix(0, 0), err
 	}
 
+	//Minutes east of UTC. The spec has it reserved and 0, but Flash
+	//and others fill it in.
 	var timeZone int16
-	err = binary.Read(r, binary.BigEndian, &timeZone)
+	err = binary.Read(d.r, binary.BigEndian, &timeZone)
 	if err != nil {
 		return time.Unix(0, 0), err
 	}
 
-	return time.Unix(0, int64(timestamp)*1e6), nil
-}
-
-func decodeXMLDocumentamf0(r easyio.EasyReader) (xml []byte, err error) {
-	var length uint32
-	err = binary.Read(r, binary.BigEndian, &length)
-	if err != nil {
-		return xml, err
+	date = time.Unix(0, int64(timestamp)*int64(time.Millisecond)).UTC()
+	if timeZone != 0 {
+		date = date.In(time.FixedZone("", int(timeZone)*60))
 	}
+	return date, nil
+}
 
-	return readByteamf0(r, length)
+type amf0Encoder struct {
+	w    easyio.EasyWriter
+	refs map[refKey]int
+	n    int //complex values written
 }
 
-func (amf0) Encode(w easyio.EasyWriter, obj interface{}) (err error) {
-	return encodeamf0(w, obj, true)
+func newAMF0Encoder(w easyio.EasyWriter) *amf0Encoder {
+	return &amf0Encoder{w: w, refs: map[refKey]int{}}
 }
 
-func encodeamf0(w easyio.EasyWriter, obj interface{}, encodeMarker bool) (err error) {
-	if obj == nil {
-		binary.Write(w, binary.BigEndian, NULLMarker)
-		return
+// ref writes a reference if the complex value keyed key was met
+// before, or takes note of it as the next one.
+func (e *amf0Encoder) ref(key refKey, ok bool) (done bool, err error) {
+	if ok {
+		if index, seen := e.refs[key]; seen {
+			var err1, err2 error
+			err1 = binary.Write(e.w, binary.BigEndian, ReferenceMarker)
+			err2 = binary.Write(e.w, binary.BigEndian, uint16(index))
+			return true, easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2)
+		}
+		if e.n <= math.MaxUint16 {
+			e.refs[key] = e.n
+		}
 	}
+	e.n++
+	return false, nil
+}
 
-	v := reflect.ValueOf(obj)
+func (e *amf0Encoder) encode(v reflect.Value) (err error) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
 	if !v.IsValid() {
-		binary.Write(w, binary.BigEndian, UndefinedMarker)
-		return
+		return binary.Write(e.w, binary.BigEndian, NULLMarker)
+	}
+
+	if v.CanInterface() {
+		switch obj := v.Interface().(type) {
+		case time.Time:
+			return e.encodeDate(obj)
+		case XMLDocument:
+			var err1, err2, err3 error
+			err1 = binary.Write(e.w, binary.BigEndian, XMLDocumentMarker)
+			err2 = binary.Write(e.w, binary.BigEndian, uint32(len(obj)))
+			_, err3 = e.w.Write([]byte(obj))
+			return easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2, err3)
+		case TypedObject:
+			if done, err := e.ref(refOf(reflect.ValueOf(obj.Object))); done || err != nil {
+				return err
+			}
+			var err1, err2 error
+			err1 = binary.Write(e.w, binary.BigEndian, TypedObjectMarker)
+			err2 = e.encodeKey(obj.ClassName)
+			if err = easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2); err != nil {
+				return err
+			}
+			return e.encodeMap(reflect.ValueOf(obj.Object))
+		case ECMAArray:
+			if done, err := e.ref(refOf(v)); done || err != nil {
+				return err
+			}
+			var err1, err2 error
+			err1 = binary.Write(e.w, binary.BigEndian, EcmaArrayMarker)
+			err2 = binary.Write(e.w, binary.BigEndian, uint32(len(obj)))
+			if err = easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2); err != nil {
+				return err
+			}
+			return e.encodeMap(v)
+		}
 	}
-	fmt.Printf("encode, object:%+v\n", obj)
 
-	//NOTE: not support ReferenceMarker yet
 	switch v.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		err = encodeNumberamf0(w, float64(v.Int()), encodeMarker)
+		err = e.encodeNumber(float64(v.Int()))
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		err = encodeNumberamf0(w, float64(v.Uint()), encodeMarker)
+		err = e.encodeNumber(float64(v.Uint()))
 	case reflect.Float32, reflect.Float64:
-		err = encodeNumberamf0(w, v.Float(), encodeMarker)
+		err = e.encodeNumber(v.Float())
 	case reflect.Bool:
-		err = encodeBooleanamf0(w, v.Bool(), encodeMarker)
+		var err1, err2 error
+		err1 = binary.Write(e.w, binary.BigEndian, BooleanMarker)
+		err2 = binary.Write(e.w, binary.BigEndian, v.Bool())
+		err = easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2)
 	case reflect.String:
-		err = encodeStringamf0(w, v.String(), encodeMarker)
-	case reflect.Struct: //TODO: has some problem
-	//TODO: XMLDocumentMarker
-	//TODO: DateMarker
-	//TypedObjectMarker
-	// binary.Write(w, binary.BigEndian, TypedObjectMarker)
-	// err = encodeamf0(w, v.Type().Name())
-	// if err != nil {
-	// return err
-	// }
-	// for i := 0; i < v.NumField(); i++ {
-	// err = encodeamf0(w, v.Field(i))
-	// if err != nil {
-	// return err
-	// }
-	// }
-	// binary.Write(w, binary.BigEndian, ObjectEndMarker)
+		err = e.encodeString(v.String())
+	case reflect.Struct: //ObjectMarker
+		if done, err := e.ref(refOf(v)); done || err != nil {
+			return err
+		}
+		err = e.encodeStruct(v)
 	case reflect.Map: //ObjectMarker
-		err = encodeObjectamf0(w, v, encodeMarker)
-	case reflect.Ptr, reflect.Interface:
-		err = encodeamf0(w, v.Elem(), encodeMarker)
-		if err != nil {
+		if v.Type().Key().Kind() != reflect.String {
+			return errors.New("invalid type")
+		}
+		if done, err := e.ref(refOf(v)); done || err != nil {
 			return err
 		}
-	case reflect.UnsafePointer: //XXX not support yet
-		fallthrough
-	case reflect.Uintptr: //XXX not support yet
-		return errors.New("invalid type")
-	case reflect.Slice, reflect.Array: //StrictArrayMarker, EcmaArrayMarker is not supported
-		// length := v.Len()
-		// binary.Write(w, binary.BigEndian, StrictArrayMarker)
-		// binary.Write(w, binary.BigEndian, uint32(length))
-		// for i := 0; i < length; i++ {
-		// err = encodeamf0(w, v.Index(i))
-		// if err != nil {
-		// return err
-		// }
-		// }
-		// binary.Write(w, binary.BigEndian, ObjectEndMarker)
+		if err = binary.Write(e.w, binary.BigEndian, ObjectMarker); err != nil {
+			return err
+		}
+		err = e.encodeMap(v)
+	case reflect.Ptr:
+		if v.IsNil() {
+			return binary.Write(e.w, binary.BigEndian, NULLMarker)
+		}
+		//Pointers to structs are what refer to them.
+		if v.Elem().Kind() == reflect.Struct && !isValueStruct(v.Elem().Type()) {
+			if done, err := e.ref(refOf(v)); done || err != nil {
+				return err
+			}
+			return e.encodeStruct(v.Elem())
+		}
+		err = e.encode(v.Elem())
+	case reflect.Slice, reflect.Array: //StrictArrayMarker
+		if done, err := e.ref(refOf(v)); done || err != nil {
+			return err
+		}
+		var err1, err2 error
+		err1 = binary.Write(e.w, binary.BigEndian, StrictArrayMarker)
+		err2 = binary.Write(e.w, binary.BigEndian, uint32(v.Len()))
+		if err = easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2); err != nil {
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err = e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
 	default:
-		//TODO
+		return errors.New("invalid type")
 	}
 	return err
 }
 
-func encodeNumberamf0(w easyio.EasyWriter, num float64, encodeMarker bool) (err error) {
+func (e *amf0Encoder) encodeNumber(num float64) (err error) {
 	var err1, err2 error
-	if encodeMarker {
-		err1 = binary.Write(w, binary.BigEndian, NumberMarker)
+	err1 = binary.Write(e.w, binary.BigEndian, NumberMarker)
+	err2 = binary.Write(e.w, binary.BigEndian, num)
+	return easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2)
+}
+
+func (e *amf0Encoder) encodeString(str string) (err error) {
+	if len(str) <= 0xffff {
+		if err = binary.Write(e.w, binary.BigEndian, StringMarker); err != nil {
+			return err
+		}
+		return e.encodeKey(str)
+	}
+	var err1, err2, err3 error
+	err1 = binary.Write(e.w, binary.BigEndian, LongStringMarker)
+	err2 = binary.Write(e.w, binary.BigEndian, uint32(len(str)))
+	_, err3 = e.w.Write([]byte(str))
+	return easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2, err3)
+}
+
+// encodeKey writes a string without a marker, as keys and class names
+// go.
+func (e *amf0Encoder) encodeKey(str string) (err error) {
+	if len(str) > 0xffff {
+		return errors.New("amf0: key too long")
 	}
-	err2 = binary.Write(w, binary.BigEndian, float64(num))
+	var err1, err2 error
+	err1 = binary.Write(e.w, binary.BigEndian, uint16(len(str)))
+	_, err2 = e.w.Write([]byte(str))
 	return easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2)
 }
 
-func encodeBooleanamf0(w easyio.EasyWriter, boolean bool, encodeMarker bool) (err error) {
+func (e *amf0Encoder) encodeObjectEnd() (err error) {
 	var err1, err2 error
-	if encodeMarker {
-		err1 = binary.Write(w, binary.BigEndian, BooleanMarker)
-	}
-	err2 = binary.Write(w, binary.BigEndian, boolean)
+	_, err1 = e.w.Write([]byte{0x00, 0x00})
+	err2 = binary.Write(e.w, binary.BigEndian, ObjectEndMarker)
 	return easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2)
 }
 
-func encodeStringamf0(w easyio.EasyWriter, str string, encodeMarker bool) (err error) {
-	var err1, err2, err3 error
-	if encodeMarker {
-		if len(str) <= 0xffff {
-			err1 = binary.Write(w, binary.BigEndian, StringMarker)
-		} else {
-			err1 = binary.Write(w, binary.BigEndian, LongStringMarker)
+// encodeMap writes the members of a map, keys sorted, and the object
+// end. The empty key, which would end the members, is left out.
+func (e *amf0Encoder) encodeMap(v reflect.Value) (err error) {
+	keys := make([]string, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		if key.String() != "" {
+			keys = append(keys, key.String())
 		}
 	}
-	if len(str) <= 0xffff {
-		err2 = binary.Write(w, binary.BigEndian, uint16(len(str)))
-	} else {
-		err2 = binary.Write(w, binary.BigEndian, uint32(len(str)))
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err = e.encodeKey(key); err != nil {
+			return err
+		}
+		if err = e.encode(v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))); err != nil {
+			return err
+		}
 	}
-	_, err3 = w.Write([]byte(str))
-	return easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2, err3)
+	return e.encodeObjectEnd()
 }
 
-func encodeObjectamf0(w easyio.EasyWriter, obj reflect.Value, encodeMarker bool) (err error) {
-	var err1, err2, err3 error
-	if encodeMarker {
-		err1 = binary.Write(w, binary.BigEndian, ObjectMarker)
+func (e *amf0Encoder) encodeStruct(v reflect.Value) (err error) {
+	if err = binary.Write(e.w, binary.BigEndian, ObjectMarker); err != nil {
+		return err
 	}
-	iter := obj.MapRange()
-	for iter.Next() {
-		key := iter.Key()
-		if key.Kind() != reflect.String {
-			return errors.New("invalid type")
-		}
-		err = encodeamf0(w, key.String(), false)
-		if err != nil {
+	names, values := structFields(v)
+	for i := range names {
+		if err = e.encodeKey(names[i]); err != nil {
 			return err
 		}
-		value := iter.Value()
-		err = encodeamf0(w, value.Interface(), true)
-		if err != nil {
+		if err = e.encode(values[i]); err != nil {
 			return err
 		}
 	}
-	_, err2 = w.Write([]byte{0x00, 0x00})
-	err3 = binary.Write(w, binary.BigEndian, ObjectEndMarker)
+	return e.encodeObjectEnd()
+}
+
+func (e *amf0Encoder) encodeDate(date time.Time) (err error) {
+	_, offset := date.Zone()
+	var err1, err2, err3 error
+	err1 = binary.Write(e.w, binary.BigEndian, DateMarker)
+	err2 = binary.Write(e.w, binary.BigEndian, float64(date.UnixNano()/int64(time.Millisecond)))
+	err3 = binary.Write(e.w, binary.BigEndian, int16(offset/60))
 	return easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2, err3)
 }
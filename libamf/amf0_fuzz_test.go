@@ -0,0 +1,41 @@
+//go:build go1.18
+// +build go1.18
+
+package libamf
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/SmartBrave/Athena/easyio"
+)
+
+// FuzzAMF0 checks that no message makes Decode panic, and that what it
+// decodes encodes to bytes which decode and encode back the same. The
+// first encoding may differ from the input: undefined becomes null,
+// counts get corrected, AMF3 values turn AMF0. Seeds are in
+// testdata/fuzz/FuzzAMF0.
+func FuzzAMF0(f *testing.F) {
+	f.Add([]byte{0x02, 0x00, 0x07, 'c', 'o', 'n', 'n', 'e', 'c', 't', 0x00, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		values, err := AMF0.Decode(easyio.NewEasyReader(bytes.NewReader(b)))
+		if err != nil {
+			return
+		}
+		first := &bytes.Buffer{}
+		if err = AMF0.EncodeAll(easyio.NewEasyWriter(first), values...); err != nil {
+			return //AMF3 dictionaries have no AMF0 form
+		}
+		again, err := AMF0.Decode(easyio.NewEasyReader(bytes.NewReader(first.Bytes())))
+		if err != nil {
+			t.Fatalf("decoding % x, encoded from % x: %v", first.Bytes(), b, err)
+		}
+		second := &bytes.Buffer{}
+		if err = AMF0.EncodeAll(easyio.NewEasyWriter(second), again...); err != nil {
+			t.Fatalf("encoding %v: %v", again, err)
+		}
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Fatalf("% x encoded to % x, then to % x", b, first.Bytes(), second.Bytes())
+		}
+	})
+}
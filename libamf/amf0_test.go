@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/SmartBrave/Athena/easyio"
 )
@@ -94,6 +95,21 @@ func TestAMF0_Object(t *testing.T) {
 	}
 }
 
+func TestAMF0_StrictArray(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := AMF0.Encode(easyio.NewEasyWriter(buf), map[string]interface{}{"fourCcList": []string{"hvc1", "av01"}}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	got, err := AMF0.Decode(easyio.NewEasyReader(buf))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := []interface{}{"hvc1", "av01"}
+	if list := got[0].(map[string]interface{})["fourCcList"]; !reflect.DeepEqual(list, want) {
+		t.Errorf("got %v, want %v", list, want)
+	}
+}
+
 func TestAMF0_Null(t *testing.T) {
 	buf := &bytes.Buffer{}
 	if err := AMF0.Encode(easyio.NewEasyWriter(buf), nil); err != nil {
@@ -112,11 +128,8 @@ func TestAMF0_DecodeRTMPConnect(t *testing.T) {
 	//Real bytes captured from an FFmpeg `connect` command. First
 	//element is the command name "connect", second is txn id 1,
 	//third is the connect command object with app/tcUrl/flashVer.
-	//
-	//Known quirk: readPairamf0 doesn't consume the trailing 0x09
-	//ObjectEnd marker, so the outer decode loop emits an extra nil
-	//element. Asserting the leading three are correct is sufficient
-	//for downstream callers that index by position.
+	//The trailing 0x09 ObjectEnd marker belongs to the object and
+	//must not show up as a fourth element.
 	raw := []byte{
 		0x02, 0x00, 0x07, 'c', 'o', 'n', 'n', 'e', 'c', 't',
 		0x00, 0x3F, 0xF0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, //txn=1
@@ -129,8 +142,8 @@ func TestAMF0_DecodeRTMPConnect(t *testing.T) {
 	if err != nil {
 		t.Fatalf("decode: %v", err)
 	}
-	if len(got) < 3 {
-		t.Fatalf("want at least 3 elements, got %d: %v", len(got), got)
+	if len(got) != 3 {
+		t.Fatalf("want 3 elements, got %d: %v", len(got), got)
 	}
 	if got[0].(string) != "connect" {
 		t.Errorf("cmd = %q", got[0])
@@ -162,7 +175,126 @@ func TestAMF0_DecodeMultiElement(t *testing.T) {
 	if got[0] != "onMetaData" {
 		t.Errorf("name = %v", got[0])
 	}
-	if m, ok := got[1].(map[string]interface{}); !ok || m["width"].(float64) != 720 {
+	if m, ok := got[1].(ECMAArray); !ok || m["width"].(float64) != 720 {
 		t.Errorf("array = %v", got[1])
 	}
 }
+
+func TestAMF0_Struct(t *testing.T) {
+	type base struct {
+		Level string `amf:"level"`
+	}
+	type status struct {
+		base
+		Code        string  `amf:"code"`
+		Description string  `amf:"description,omitempty"`
+		Internal    int     `amf:"-"`
+		Bytes       float64 //untagged, by name
+		hidden      int
+	}
+	buf := &bytes.Buffer{}
+	err := AMF0.Encode(easyio.NewEasyWriter(buf), &status{base: base{Level: "status"}, Code: "NetStream.Play.Start", Internal: 1, Bytes: 2, hidden: 3})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	got, err := AMF0.Decode(easyio.NewEasyReader(buf))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := map[string]interface{}{"level": "status", "code": "NetStream.Play.Start", "Bytes": 2.0}
+	if !reflect.DeepEqual(got[0], want) {
+		t.Errorf("got %v, want %v", got[0], want)
+	}
+}
+
+func TestAMF0_RoundTripTypes(t *testing.T) {
+	for _, v := range []interface{}{
+		ECMAArray{"duration": 0.0, "custom": "x"},
+		TypedObject{ClassName: "flex.Cue", Object: map[string]interface{}{"name": "ad"}},
+		XMLDocument("<cue/>"),
+		[]interface{}{1.0, "two", nil},
+		[]interface{}{},
+	} {
+		buf := &bytes.Buffer{}
+		if err := AMF0.Encode(easyio.NewEasyWriter(buf), v); err != nil {
+			t.Fatalf("encode %v: %v", v, err)
+		}
+		got, err := AMF0.Decode(easyio.NewEasyReader(buf))
+		if err != nil {
+			t.Fatalf("decode %v: %v", v, err)
+		}
+		if len(got) != 1 || !reflect.DeepEqual(got[0], v) {
+			t.Errorf("got %#v, want %#v", got, v)
+		}
+	}
+}
+
+func TestAMF0_Date(t *testing.T) {
+	date := time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("", 8*3600))
+	buf := &bytes.Buffer{}
+	if err := AMF0.Encode(easyio.NewEasyWriter(buf), date); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if b := buf.Bytes(); b[0] != byte(DateMarker) || b[9] != 0x01 || b[10] != 0xe0 { //480 minutes
+		t.Fatalf("date % x", b)
+	}
+	got, err := AMF0.Decode(easyio.NewEasyReader(buf))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	d := got[0].(time.Time)
+	if _, offset := d.Zone(); !d.Equal(date) || offset != 8*3600 {
+		t.Errorf("got %v, want %v", d, date)
+	}
+}
+
+func TestAMF0_References(t *testing.T) {
+	//An object, then an ECMA array holding a reference to it, then a
+	//reference to the array: references count complex values in the
+	//order they start, across the values of a message.
+	raw := []byte{
+		0x03, 0x00, 0x01, 'a', 0x00, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0, 0x00, 0x00, 0x09, //{a: 1}
+		0x08, 0x00, 0x00, 0x00, 0x00, //ECMA array, count 0 as some write it
+		0x00, 0x01, 'o', 0x07, 0x00, 0x00, //o: the object
+		0x00, 0x00, 0x09,
+		0x07, 0x00, 0x01, //the array
+	}
+	got, err := AMF0.Decode(easyio.NewEasyReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	obj := map[string]interface{}{"a": 1.0}
+	arr := ECMAArray{"o": obj}
+	if want := []interface{}{obj, arr, arr}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	buf := &bytes.Buffer{}
+	if err = AMF0.EncodeAll(easyio.NewEasyWriter(buf), got...); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	want := append([]byte(nil), raw...)
+	want[20] = 1 //the count written right
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("encoded % x, want % x", buf.Bytes(), want)
+	}
+
+	//A cycle is written as a reference instead of for ever.
+	cycle := map[string]interface{}{"name": "loop"}
+	cycle["self"] = cycle
+	buf.Reset()
+	if err = AMF0.Encode(easyio.NewEasyWriter(buf), cycle); err != nil {
+		t.Fatalf("encode cycle: %v", err)
+	}
+	got, err = AMF0.Decode(easyio.NewEasyReader(buf))
+	if err != nil {
+		t.Fatalf("decode cycle: %v", err)
+	}
+	m := got[0].(map[string]interface{})
+	if self, _ := m["self"].(map[string]interface{}); self["name"] != "loop" {
+		t.Errorf("cycle decoded to %v", m)
+	}
+
+	if _, err = AMF0.Decode(easyio.NewEasyReader(bytes.NewReader([]byte{0x07, 0x00, 0x00}))); err == nil {
+		t.Error("dangling reference decoded")
+	}
+}
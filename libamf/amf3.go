@@ -0,0 +1,790 @@
+package libamf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/SmartBrave/Athena/easyio"
+)
+
+// AMF3 markers, https://rtmp.veriskope.com/pdf/amf3-file-format-spec.pdf
+const (
+	amf3Undefined    = 0x00
+	amf3Null         = 0x01
+	amf3False        = 0x02
+	amf3True         = 0x03
+	amf3Integer      = 0x04
+	amf3Double       = 0x05
+	amf3String       = 0x06
+	amf3XMLDoc       = 0x07
+	amf3Date         = 0x08
+	amf3Array        = 0x09
+	amf3Object       = 0x0a
+	amf3XML          = 0x0b
+	amf3ByteArray    = 0x0c
+	amf3VectorInt    = 0x0d
+	amf3VectorUint   = 0x0e
+	amf3VectorDouble = 0x0f
+	amf3VectorObject = 0x10
+	amf3Dictionary   = 0x11
+)
+
+const (
+	amf3IntMin = -1 << 28
+	amf3IntMax = 1<<28 - 1
+)
+
+// amf3 decodes to and encodes from the same Go values as amf0, where
+// there is one: numbers, integers included, decode as float64; objects
+// of a named class as TypedObject; arrays with no associative part as
+// []interface{}, others as map[string]interface{} with the dense part
+// under its indexes; both XML types as XMLDocument. ByteArray is
+// []byte, the vectors []int32, []uint32, []float64 and []interface{},
+// and Dictionary map[interface{}]interface{}. ECMAArray encodes as an
+// array with only an associative part. A map, slice or pointer met
+// again is encoded as a reference to it.
+type amf3 struct{}
+
+var AMF3 amf3
+
+// Decode reads values until the end of r. String, object and trait
+// references may span them.
+func (amf3) Decode(r easyio.EasyReader) (res []interface{}, err error) {
+	d := &amf3Decoder{r: r}
+	for {
+		var i interface{}
+		i, err = d.decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+		res = append(res, i)
+	}
+	return res, nil
+}
+
+func (amf3) Encode(w easyio.EasyWriter, obj interface{}) (err error) {
+	return newAMF3Encoder(w).encode(reflect.ValueOf(obj))
+}
+
+type amf3Traits struct {
+	className      string
+	dynamic        bool
+	externalizable bool
+	members        []string
+}
+
+type amf3Decoder struct {
+	r       easyio.EasyReader
+	depth   int
+	strings []string
+	objects []interface{}
+	traits  []*amf3Traits
+}
+
+var errAMF3Reference = errors.New("invalid amf3 reference")
+
+func (d *amf3Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadN(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *amf3Decoder) readU29() (n uint32, err error) {
+	for i := 0; i < 4; i++ {
+		var b byte
+		if b, err = d.readByte(); err != nil {
+			return 0, err
+		}
+		if i == 3 {
+			return n<<8 | uint32(b), nil
+		}
+		n = n<<7 | uint32(b&0x7f)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return n, nil
+}
+
+// readRef reads a U29 header: a reference to an entry of a table, or
+// inline with the rest of its bits.
+func (d *amf3Decoder) readRef() (n uint32, inline bool, err error) {
+	if n, err = d.readU29(); err != nil {
+		return 0, false, err
+	}
+	return n >> 1, n&1 == 1, nil
+}
+
+func (d *amf3Decoder) object(n uint32) (interface{}, error) {
+	if int(n) >= len(d.objects) {
+		return nil, errAMF3Reference
+	}
+	return d.objects[n], nil
+}
+
+func (d *amf3Decoder) readString() (string, error) {
+	n, inline, err := d.readRef()
+	if err != nil {
+		return "", err
+	}
+	if !inline {
+		if int(n) >= len(d.strings) {
+			return "", errAMF3Reference
+		}
+		return d.strings[n], nil
+	}
+	b, err := readBytes(d.r, n)
+	if err != nil {
+		return "", err
+	}
+	if n > 0 {
+		d.strings = append(d.strings, string(b))
+	}
+	return string(b), nil
+}
+
+// decode reads one value; io.EOF only if there is none.
+func (d *amf3Decoder) decode() (i interface{}, err error) {
+	marker, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	if d.depth++; d.depth > maxDepth {
+		return nil, errDepth
+	}
+	defer func() { d.depth-- }()
+	if i, err = d.decodeValue(marker); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return i, err
+}
+
+func (d *amf3Decoder) decodeValue(marker byte) (i interface{}, err error) {
+	switch marker {
+	case amf3Undefined, amf3Null:
+		return nil, nil
+	case amf3False:
+		return false, nil
+	case amf3True:
+		return true, nil
+	case amf3Integer:
+		n, err := d.readU29()
+		if err != nil {
+			return nil, err
+		}
+		if n&0x10000000 != 0 {
+			return float64(int32(n) - 0x20000000), nil
+		}
+		return float64(n), nil
+	case amf3Double:
+		var f float64
+		err = binary.Read(d.r, binary.BigEndian, &f)
+		return f, err
+	case amf3String:
+		return d.readString()
+	case amf3XMLDoc, amf3XML:
+		n, inline, err := d.readRef()
+		if err != nil || !inline {
+			if err != nil {
+				return nil, err
+			}
+			return d.object(n)
+		}
+		b, err := readBytes(d.r, n)
+		if err != nil {
+			return nil, err
+		}
+		d.objects = append(d.objects, XMLDocument(b))
+		return XMLDocument(b), nil
+	case amf3Date:
+		n, inline, err := d.readRef()
+		if err != nil || !inline {
+			if err != nil {
+				return nil, err
+			}
+			return d.object(n)
+		}
+		var ms float64
+		if err = binary.Read(d.r, binary.BigEndian, &ms); err != nil {
+			return nil, err
+		}
+		date := time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC()
+		d.objects = append(d.objects, date)
+		return date, nil
+	case amf3Array:
+		return d.decodeArray()
+	case amf3Object:
+		return d.decodeObject()
+	case amf3ByteArray:
+		n, inline, err := d.readRef()
+		if err != nil || !inline {
+			if err != nil {
+				return nil, err
+			}
+			return d.object(n)
+		}
+		b, err := readBytes(d.r, n)
+		if err != nil {
+			return nil, err
+		}
+		d.objects = append(d.objects, b)
+		return b, nil
+	case amf3VectorInt, amf3VectorUint, amf3VectorDouble, amf3VectorObject:
+		return d.decodeVector(marker)
+	case amf3Dictionary:
+		return d.decodeDictionary()
+	}
+	return nil, fmt.Errorf("invalid amf3 marker %#x", marker)
+}
+
+func (d *amf3Decoder) decodeArray() (interface{}, error) {
+	n, inline, err := d.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return d.object(n)
+	}
+	index := len(d.objects)
+	d.objects = append(d.objects, nil)
+
+	assoc := map[string]interface{}{}
+	for {
+		key, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			break
+		}
+		if assoc[key], err = d.decode(); err != nil {
+			return nil, err
+		}
+	}
+	var dense []interface{}
+	for j := uint32(0); j < n; j++ {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		dense = append(dense, v)
+	}
+
+	var res interface{} = dense
+	if len(assoc) > 0 {
+		for j, v := range dense {
+			assoc[strconv.Itoa(j)] = v
+		}
+		res = assoc
+	}
+	d.objects[index] = res
+	return res, nil
+}
+
+func (d *amf3Decoder) decodeObject() (interface{}, error) {
+	n, inline, err := d.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return d.object(n)
+	}
+
+	var traits *amf3Traits
+	if n&1 == 0 {
+		if int(n>>1) >= len(d.traits) {
+			return nil, errAMF3Reference
+		}
+		traits = d.traits[n>>1]
+	} else {
+		traits = &amf3Traits{externalizable: n&2 != 0, dynamic: n&4 != 0}
+		if traits.className, err = d.readString(); err != nil {
+			return nil, err
+		}
+		if !traits.externalizable {
+			for j := uint32(0); j < n>>3; j++ {
+				member, err := d.readString()
+				if err != nil {
+					return nil, err
+				}
+				traits.members = append(traits.members, member)
+			}
+		}
+		d.traits = append(d.traits, traits)
+	}
+
+	index := len(d.objects)
+	d.objects = append(d.objects, nil)
+	if traits.externalizable {
+		//Only the Flex wrappers, whose form is known: one value.
+		switch traits.className {
+		case "flex.messaging.io.ArrayCollection", "flex.messaging.io.ObjectProxy":
+			v, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			d.objects[index] = v
+			return v, nil
+		}
+		return nil, fmt.Errorf("amf3 externalizable class %q not supported", traits.className)
+	}
+
+	members := map[string]interface{}{}
+	var res interface{} = members
+	if traits.className != "" {
+		res = TypedObject{ClassName: traits.className, Object: members}
+	}
+	d.objects[index] = res
+	for _, member := range traits.members {
+		if members[member], err = d.decode(); err != nil {
+			return nil, err
+		}
+	}
+	for traits.dynamic {
+		key, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			break
+		}
+		if members[key], err = d.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (d *amf3Decoder) decodeVector(marker byte) (interface{}, error) {
+	n, inline, err := d.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return d.object(n)
+	}
+	if _, err = d.readByte(); err != nil { //fixed-vector
+		return nil, err
+	}
+	if marker == amf3VectorObject {
+		if _, err = d.readString(); err != nil { //object-type-name
+			return nil, err
+		}
+	}
+	index := len(d.objects)
+	d.objects = append(d.objects, nil)
+
+	var res interface{}
+	switch marker {
+	case amf3VectorInt:
+		var v []int32
+		for j := uint32(0); j < n; j++ {
+			var x int32
+			if err = binary.Read(d.r, binary.BigEndian, &x); err != nil {
+				return nil, err
+			}
+			v = append(v, x)
+		}
+		res = v
+	case amf3VectorUint:
+		var v []uint32
+		for j := uint32(0); j < n; j++ {
+			var x uint32
+			if err = binary.Read(d.r, binary.BigEndian, &x); err != nil {
+				return nil, err
+			}
+			v = append(v, x)
+		}
+		res = v
+	case amf3VectorDouble:
+		var v []float64
+		for j := uint32(0); j < n; j++ {
+			var x float64
+			if err = binary.Read(d.r, binary.BigEndian, &x); err != nil {
+				return nil, err
+			}
+			v = append(v, x)
+		}
+		res = v
+	default:
+		var v []interface{}
+		for j := uint32(0); j < n; j++ {
+			x, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			v = append(v, x)
+		}
+		res = v
+	}
+	d.objects[index] = res
+	return res, nil
+}
+
+func (d *amf3Decoder) decodeDictionary() (interface{}, error) {
+	n, inline, err := d.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if !inline {
+		return d.object(n)
+	}
+	if _, err = d.readByte(); err != nil { //weak-keys
+		return nil, err
+	}
+	res := map[interface{}]interface{}{}
+	d.objects = append(d.objects, res)
+	for j := uint32(0); j < n; j++ {
+		key, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		if key != nil && !reflect.TypeOf(key).Comparable() {
+			return nil, errors.New("amf3 dictionary key not comparable")
+		}
+		res[key] = value
+	}
+	return res, nil
+}
+
+type amf3Encoder struct {
+	w          easyio.EasyWriter
+	strings    map[string]int
+	nStrings   int
+	objects    map[refKey]int
+	nObjects   int
+	anonTraits int //index of the anonymous dynamic traits, -1 before them
+	nTraits    int
+}
+
+func newAMF3Encoder(w easyio.EasyWriter) *amf3Encoder {
+	return &amf3Encoder{w: w, strings: map[string]int{}, objects: map[refKey]int{}, anonTraits: -1}
+}
+
+func (e *amf3Encoder) write(b ...byte) error {
+	return e.w.WriteFull(b)
+}
+
+func (e *amf3Encoder) writeU29(n uint32) error {
+	n &= 0x1fffffff
+	switch {
+	case n < 0x80:
+		return e.write(byte(n))
+	case n < 0x4000:
+		return e.write(byte(n>>7|0x80), byte(n&0x7f))
+	case n < 0x200000:
+		return e.write(byte(n>>14|0x80), byte(n>>7|0x80), byte(n&0x7f))
+	}
+	return e.write(byte(n>>22|0x80), byte(n>>15|0x80), byte(n>>8|0x80), byte(n))
+}
+
+func (e *amf3Encoder) writeString(s string) error {
+	if i, ok := e.strings[s]; ok {
+		return e.writeU29(uint32(i) << 1)
+	}
+	if s != "" {
+		e.strings[s] = e.nStrings
+		e.nStrings++
+	}
+	if err := e.writeU29(uint32(len(s))<<1 | 1); err != nil {
+		return err
+	}
+	return e.w.WriteFull([]byte(s))
+}
+
+func (e *amf3Encoder) writeDouble(f float64) error {
+	b := make([]byte, 9)
+	b[0] = amf3Double
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(f))
+	return e.w.WriteFull(b)
+}
+
+func (e *amf3Encoder) writeInt(i int64) error {
+	if i < amf3IntMin || i > amf3IntMax {
+		return e.writeDouble(float64(i))
+	}
+	if err := e.write(amf3Integer); err != nil {
+		return err
+	}
+	return e.writeU29(uint32(i))
+}
+
+// writeComplex writes the marker of a complex value, and a reference
+// to it if the value keyed key was met before; otherwise it takes note
+// of it and the value, inline, is the caller's to write.
+func (e *amf3Encoder) writeComplex(marker byte, key refKey, ok bool) (done bool, err error) {
+	if err = e.write(marker); err != nil {
+		return false, err
+	}
+	if ok {
+		if index, seen := e.objects[key]; seen {
+			return true, e.writeU29(uint32(index) << 1)
+		}
+		e.objects[key] = e.nObjects
+	}
+	e.nObjects++
+	return false, nil
+}
+
+func (e *amf3Encoder) encode(v reflect.Value) (err error) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return e.write(amf3Null)
+	}
+	if v.CanInterface() {
+		switch obj := v.Interface().(type) {
+		case time.Time:
+			if _, err = e.writeComplex(amf3Date, refKey{}, false); err != nil {
+				return err
+			}
+			if err = e.write(0x01); err != nil {
+				return err
+			}
+			return binary.Write(e.w, binary.BigEndian, float64(obj.UnixNano()/int64(time.Millisecond)))
+		case XMLDocument:
+			if _, err = e.writeComplex(amf3XML, refKey{}, false); err != nil {
+				return err
+			}
+			if err = e.writeU29(uint32(len(obj))<<1 | 1); err != nil {
+				return err
+			}
+			return e.w.WriteFull([]byte(obj))
+		case TypedObject:
+			key, ok := refOf(reflect.ValueOf(obj.Object))
+			if done, err := e.writeComplex(amf3Object, key, ok); done || err != nil {
+				return err
+			}
+			//Inline traits, dynamic, no sealed members.
+			e.nTraits++
+			if err = e.write(0x0b); err != nil {
+				return err
+			}
+			if err = e.writeString(obj.ClassName); err != nil {
+				return err
+			}
+			return e.writeMembers(reflect.ValueOf(obj.Object))
+		case ECMAArray:
+			//An associative part only.
+			key, ok := refOf(v)
+			if done, err := e.writeComplex(amf3Array, key, ok); done || err != nil {
+				return err
+			}
+			if err = e.writeU29(0<<1 | 1); err != nil {
+				return err
+			}
+			return e.writeMembers(v)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return e.write(amf3Null)
+		}
+		//Pointers to structs are what refer to them.
+		if v.Elem().Kind() == reflect.Struct && !isValueStruct(v.Elem().Type()) {
+			key, ok := refOf(v)
+			if done, err := e.writeComplex(amf3Object, key, ok); done || err != nil {
+				return err
+			}
+			return e.encodeStruct(v.Elem())
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return e.write(amf3True)
+		}
+		return e.write(amf3False)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() > amf3IntMax {
+			return e.writeDouble(float64(v.Uint()))
+		}
+		return e.writeInt(int64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return e.writeDouble(v.Float())
+	case reflect.String:
+		if err = e.write(amf3String); err != nil {
+			return err
+		}
+		return e.writeString(v.String())
+	case reflect.Slice, reflect.Array:
+		return e.encodeList(v)
+	case reflect.Struct:
+		if _, err = e.writeComplex(amf3Object, refKey{}, false); err != nil {
+			return err
+		}
+		return e.encodeStruct(v)
+	case reflect.Map:
+		key, ok := refOf(v)
+		if v.Type().Key().Kind() != reflect.String {
+			return e.encodeDictionary(v, key, ok)
+		}
+		if done, err := e.writeComplex(amf3Object, key, ok); done || err != nil {
+			return err
+		}
+		if err = e.writeAnonTraits(); err != nil {
+			return err
+		}
+		return e.writeMembers(v)
+	}
+	return errors.New("invalid type")
+}
+
+func (e *amf3Encoder) encodeList(v reflect.Value) (err error) {
+	n := uint32(v.Len())
+	key, ok := refOf(v)
+	switch v.Type().Elem().Kind() {
+	case reflect.Uint8:
+		if done, err := e.writeComplex(amf3ByteArray, key, ok); done || err != nil {
+			return err
+		}
+		if err = e.writeU29(n<<1 | 1); err != nil {
+			return err
+		}
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(v.Index(i).Uint())
+		}
+		return e.w.WriteFull(b)
+	case reflect.Int32, reflect.Uint32, reflect.Float64:
+		kind := v.Type().Elem().Kind()
+		marker := map[reflect.Kind]byte{reflect.Int32: amf3VectorInt, reflect.Uint32: amf3VectorUint, reflect.Float64: amf3VectorDouble}[kind]
+		if done, err := e.writeComplex(marker, key, ok); done || err != nil {
+			return err
+		}
+		if err = e.writeU29(n<<1 | 1); err != nil {
+			return err
+		}
+		if err = e.write(0x00); err != nil { //not fixed
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			switch kind {
+			case reflect.Int32:
+				err = binary.Write(e.w, binary.BigEndian, int32(v.Index(i).Int()))
+			case reflect.Uint32:
+				err = binary.Write(e.w, binary.BigEndian, uint32(v.Index(i).Uint()))
+			default:
+				err = binary.Write(e.w, binary.BigEndian, v.Index(i).Float())
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if done, err := e.writeComplex(amf3Array, key, ok); done || err != nil {
+		return err
+	}
+	if err = e.writeU29(n<<1 | 1); err != nil {
+		return err
+	}
+	if err = e.writeString(""); err != nil { //no associative part
+		return err
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err = e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAnonTraits writes the traits of anonymous dynamic objects,
+// inline the first time.
+func (e *amf3Encoder) writeAnonTraits() (err error) {
+	if e.anonTraits >= 0 {
+		return e.writeU29(uint32(e.anonTraits)<<2 | 1)
+	}
+	e.anonTraits = e.nTraits
+	e.nTraits++
+	//Inline traits, dynamic, no sealed members, no class name.
+	if err = e.write(0x0b); err != nil {
+		return err
+	}
+	return e.writeString("")
+}
+
+// writeMembers writes the members of a map as dynamic members, keys
+// sorted, and the empty string that ends them.
+func (e *amf3Encoder) writeMembers(v reflect.Value) (err error) {
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		if k.String() != "" { //would end the members
+			keys = append(keys, k.String())
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err = e.writeString(k); err != nil {
+			return err
+		}
+		if err = e.encode(v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))); err != nil {
+			return err
+		}
+	}
+	return e.writeString("")
+}
+
+// encodeStruct writes a struct, its marker written, as an anonymous
+// object of the members its amf tags give.
+func (e *amf3Encoder) encodeStruct(v reflect.Value) (err error) {
+	if err = e.writeAnonTraits(); err != nil {
+		return err
+	}
+	names, values := structFields(v)
+	for i := range names {
+		if names[i] == "" {
+			continue
+		}
+		if err = e.writeString(names[i]); err != nil {
+			return err
+		}
+		if err = e.encode(values[i]); err != nil {
+			return err
+		}
+	}
+	return e.writeString("")
+}
+
+func (e *amf3Encoder) encodeDictionary(v reflect.Value, key refKey, ok bool) (err error) {
+	if done, err := e.writeComplex(amf3Dictionary, key, ok); done || err != nil {
+		return err
+	}
+	if err = e.writeU29(uint32(v.Len())<<1 | 1); err != nil {
+		return err
+	}
+	if err = e.write(0x00); err != nil { //not weak-keys
+		return err
+	}
+	iter := v.MapRange()
+	for iter.Next() {
+		if err = e.encode(iter.Key()); err != nil {
+			return err
+		}
+		if err = e.encode(iter.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
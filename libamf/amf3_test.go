@@ -0,0 +1,141 @@
+package libamf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SmartBrave/Athena/easyio"
+)
+
+func TestAMF3_RoundTrip(t *testing.T) {
+	date := time.Unix(1700000000, 123000000).UTC()
+	for _, c := range []struct {
+		in, want interface{}
+	}{
+		{nil, nil},
+		{true, true},
+		{false, false},
+		{0, float64(0)},
+		{-1, float64(-1)},
+		{amf3IntMax, float64(amf3IntMax)},
+		{amf3IntMin, float64(amf3IntMin)},
+		{1 << 30, float64(1 << 30)}, //past U29, a double
+		{3.5, 3.5},
+		{"", ""},
+		{"connect", "connect"},
+		{date, date},
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+		{[]int32{-1, 2}, []int32{-1, 2}},
+		{[]uint32{1, 0xffffffff}, []uint32{1, 0xffffffff}},
+		{[]float64{0.5}, []float64{0.5}},
+		{[]interface{}{"a", 1}, []interface{}{"a", float64(1)}},
+		{map[string]interface{}{"app": "live", "objectEncoding": 3}, map[string]interface{}{"app": "live", "objectEncoding": float64(3)}},
+		{map[interface{}]interface{}{1.5: "x"}, map[interface{}]interface{}{1.5: "x"}},
+	} {
+		buf := &bytes.Buffer{}
+		if err := AMF3.Encode(easyio.NewEasyWriter(buf), c.in); err != nil {
+			t.Fatalf("encode %v: %v", c.in, err)
+		}
+		got, err := AMF3.Decode(easyio.NewEasyReader(buf))
+		if err != nil {
+			t.Fatalf("decode %v: %v", c.in, err)
+		}
+		if len(got) != 1 || !reflect.DeepEqual(got[0], c.want) {
+			t.Errorf("%#v: got %#v, want %#v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestAMF3_U29(t *testing.T) {
+	for _, n := range []uint32{0, 0x7f, 0x80, 0x3fff, 0x4000, 0x1fffff, 0x200000, 0x1fffffff} {
+		buf := &bytes.Buffer{}
+		e := &amf3Encoder{w: easyio.NewEasyWriter(buf)}
+		if err := e.writeU29(n); err != nil {
+			t.Fatal(err)
+		}
+		d := &amf3Decoder{r: easyio.NewEasyReader(buf)}
+		if got, err := d.readU29(); err != nil || got != n {
+			t.Errorf("U29 %#x: got %#x, %v", n, got, err)
+		}
+	}
+}
+
+func TestAMF3_References(t *testing.T) {
+	//Two objects sharing traits and strings, written by the encoder
+	//with references for the second.
+	buf := &bytes.Buffer{}
+	w := easyio.NewEasyWriter(buf)
+	e := newAMF3Encoder(w)
+	for i := 0; i < 2; i++ {
+		if err := e.encode(reflect.ValueOf(map[string]interface{}{"code": "NetStream.Play.Start"})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := []byte{amf3Object, 0x0b, 0x01, 0x09, 'c', 'o', 'd', 'e', amf3String, 0x29}
+	if !bytes.HasPrefix(buf.Bytes(), first) {
+		t.Fatalf("first object % x, want prefix % x", buf.Bytes(), first)
+	}
+	second := []byte{amf3Object, 0x01, 0x00, amf3String, 0x02, 0x01}
+	if !bytes.HasSuffix(buf.Bytes(), second) {
+		t.Fatalf("second object % x, want suffix % x", buf.Bytes(), second)
+	}
+	got, err := AMF3.Decode(easyio.NewEasyReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"code": "NetStream.Play.Start"}
+	if len(got) != 2 || !reflect.DeepEqual(got[0], want) || !reflect.DeepEqual(got[1], want) {
+		t.Errorf("got %#v", got)
+	}
+
+	//An object reference, a sealed typed object and an array with an
+	//associative part.
+	b := []byte{
+		amf3Array, 0x05, 0x03, 'k', amf3String, 0x03, 'v', 0x01, //k: v, then two items
+		amf3Object, 0x13, 0x05, 'P', 't', 0x03, 'x', amf3Integer, 0x07, //Pt{x: 7}
+		amf3Object, 0x02, //the Pt again
+	}
+	got, err = AMF3.Decode(easyio.NewEasyReader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := TypedObject{ClassName: "Pt", Object: map[string]interface{}{"x": float64(7)}}
+	wantArr := map[string]interface{}{"k": "v", "0": p, "1": p}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], wantArr) {
+		t.Errorf("got %#v, want %#v", got, wantArr)
+	}
+}
+
+func TestAMF3_Truncated(t *testing.T) {
+	for _, b := range [][]byte{
+		{amf3String, 0x09, 'a'},
+		{amf3Array, 0x03, 0x01},
+		{amf3Double, 0, 0},
+		{0x20},
+	} {
+		if _, err := AMF3.Decode(easyio.NewEasyReader(bytes.NewReader(b))); err == nil {
+			t.Errorf("% x decoded", b)
+		}
+	}
+}
+
+func TestAMF0_AvmPlus(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := easyio.NewEasyWriter(buf)
+	if err := AMF0.Encode(w, "_result"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AMF0.EncodeAvmPlus(w, map[string]interface{}{"level": "status"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := AMF0.Decode(easyio.NewEasyReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"_result", map[string]interface{}{"level": "status"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
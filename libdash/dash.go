@@ -23,6 +23,7 @@ import (
 
 	"github.com/SmartBrave/Athena/broadcast"
 	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 	"github.com/sbraveyoung/GGmpeg/libmp4"
 )
 
@@ -66,12 +67,23 @@ type DASH struct {
 	nextSeq     int
 	currentSamples []sampleWithTime
 	availabilityStart time.Time
+	onSegment         func(Segment)
+	logger            liblog.Logger
 
 	ready     chan struct{}
 	readyOnce sync.Once
 	stopped   int32
 }
 
+// Segment describes a finished .m4s fragment as reported to the
+// WithOnSegment callback.
+type Segment struct {
+	StreamID string
+	Path     string //full path on disk
+	Seq      int
+	Duration time.Duration
+}
+
 // sampleWithTime tracks a sample plus the absolute DTS that produced
 // it, so that durations (= next.DTS - this.DTS) and segment start time
 // can be computed at finalisation.
@@ -89,6 +101,7 @@ func NewDASH() *DASH {
 		windowSize:        6,
 		timescale:         defaultTimescale,
 		availabilityStart: time.Now().UTC(),
+		logger:            liblog.Nop,
 	}
 	d.cond = sync.NewCond(&d.mu)
 	d.ready = make(chan struct{})
@@ -104,6 +117,41 @@ func (d *DASH) WithDir(dir string) *DASH {
 }
 func (d *DASH) Dir() string { return d.dir }
 
+// WithTargetDuration sets the segment length to aim for; zero keeps the
+// 2 s default. WithWindowSize sets how many segments the manifest
+// lists; zero keeps the default of 6.
+func (d *DASH) WithTargetDuration(dur time.Duration) *DASH {
+	if dur > 0 {
+		d.targetDur = dur
+	}
+	return d
+}
+func (d *DASH) WithWindowSize(n int) *DASH {
+	if n > 0 {
+		d.windowSize = n
+	}
+	return d
+}
+
+// WithOnSegment registers fn to be called, from the segmenter
+// goroutine, after each media segment is written and published in the
+// manifest. fn must not block.
+func (d *DASH) WithOnSegment(fn func(Segment)) *DASH {
+	d.onSegment = fn
+	return d
+}
+
+// WithLogger routes the segmenter's diagnostics to l. The default is
+// silent.
+func (d *DASH) WithLogger(l liblog.Logger) *DASH {
+	d.logger = liblog.OrNop(l)
+	return d
+}
+
+func (d *DASH) log() liblog.Logger {
+	return d.logger.With(liblog.Stream(d.streamID), liblog.Protocol("dash"))
+}
+
 // InitSegment returns the bytes of the init segment (ftyp + moov) once
 // the AVC sequence header has been parsed. Returns nil before that.
 func (d *DASH) InitSegment() []byte {
@@ -197,11 +245,11 @@ func (d *DASH) Start(gopReader *broadcast.BroadcastReader) error {
 		case libflv.AVC_SEQUENCE_HEADER:
 			if v.CodecID == libflv.FLV_VIDEO_HEVC {
 				if err := d.handleHEVCSequenceHeader(v.Data()); err != nil {
-					fmt.Printf("dash: parse HEVC sequence header: %v\n", err)
+					d.log().Warn("parse hevc sequence header failed", liblog.Err(err))
 				}
 			} else {
 				if err := d.handleSequenceHeader(v.Data()); err != nil {
-					fmt.Printf("dash: parse AVC sequence header: %v\n", err)
+					d.log().Warn("parse avc sequence header failed", liblog.Err(err))
 				}
 			}
 			continue
@@ -223,7 +271,7 @@ func (d *DASH) Start(gopReader *broadcast.BroadcastReader) error {
 				curDur := dts - d.currentSamples[0].dts
 				if curDur*1000 >= uint64(d.targetDur/time.Millisecond)*1000 {
 					if err := d.flushCurrent(); err != nil {
-						fmt.Printf("dash: flush segment: %v\n", err)
+						d.log().Warn("flush segment failed", liblog.Err(err))
 					}
 				}
 			}
@@ -500,6 +548,17 @@ func (d *DASH) flushCurrent() error {
 	d.cond.Broadcast()
 	d.mu.Unlock()
 
+	segDur := time.Duration(endTime-startTime) * time.Second / time.Duration(d.timescale)
+	segmentsTotal.With().Inc()
+	segmentDuration.With().Observe(segDur.Seconds())
+	if d.onSegment != nil {
+		d.onSegment(Segment{
+			StreamID: d.streamID,
+			Path:     filepath.Join(d.dir, filename),
+			Seq:      seq,
+			Duration: segDur,
+		})
+	}
 	d.currentSamples = d.currentSamples[:0]
 	d.readyOnce.Do(func() { close(d.ready) })
 	return nil
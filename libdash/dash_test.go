@@ -106,3 +106,18 @@ func TestParseSPSDimensions_Smoke(t *testing.T) {
 		t.Logf("parseSPSDimensions returned %dx%d (acceptable)", w, h)
 	}
 }
+
+func TestAppendQuery(t *testing.T) {
+	in := []byte(`<SegmentTemplate timescale="1000" initialization="live1-init.mp4" media="live1-$Number$.m4s"/>`)
+	got := string(AppendQuery(in, "expires=1&sign=ab"))
+	wants := []string{
+		`initialization="live1-init.mp4?expires=1&amp;sign=ab"`,
+		`media="live1-$Number$.m4s?expires=1&amp;sign=ab"`,
+		`timescale="1000"`,
+	}
+	for _, w := range wants {
+		if !strings.Contains(got, w) {
+			t.Errorf("MPD missing %q: %s", w, got)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package libdash
+
+import "github.com/sbraveyoung/GGmpeg/libmetrics"
+
+var (
+	segmentsTotal = libmetrics.Default.NewCounterVec(
+		"ggmpeg_dash_segments_total", "DASH media segments written.")
+	segmentDuration = libmetrics.Default.NewHistogramVec(
+		"ggmpeg_dash_segment_duration_seconds", "Duration of written DASH media segments.",
+		[]float64{0.5, 1, 2, 3, 4, 6, 8, 10})
+)
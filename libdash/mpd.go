@@ -104,3 +104,43 @@ func buildMPD(in manifestInputs) []byte {
 
 	return []byte(sb.String())
 }
+
+// AppendQuery appends an encoded query string to the initialization
+// and media templates of every SegmentTemplate in the manifest, so a
+// signed manifest URL yields signed segment URLs. The query is XML-
+// escaped ('&' → "&amp;") since it lands inside an attribute value.
+// An empty query is a no-op.
+func AppendQuery(mpd []byte, query string) []byte {
+	if query == "" || len(mpd) == 0 {
+		return mpd
+	}
+	escaped := strings.ReplaceAll(query, "&", "&amp;")
+	out := string(mpd)
+	for _, attr := range []string{`initialization="`, `media="`} {
+		var sb strings.Builder
+		rest := out
+		for {
+			i := strings.Index(rest, attr)
+			if i < 0 {
+				sb.WriteString(rest)
+				break
+			}
+			i += len(attr)
+			j := strings.Index(rest[i:], `"`)
+			if j < 0 {
+				sb.WriteString(rest)
+				break
+			}
+			j += i
+			sep := "?"
+			if strings.Contains(rest[i:j], "?") {
+				sep = "&amp;"
+			}
+			sb.WriteString(rest[:j])
+			sb.WriteString(sep + escaped)
+			rest = rest[j:]
+		}
+		out = sb.String()
+	}
+	return []byte(out)
+}
@@ -0,0 +1,235 @@
+package libflv
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Enhanced RTMP, https://github.com/veovera/enhanced-rtmp: video tags
+// whose first byte has its top bit set carry the codec as a FourCC.
+
+const ( //video_packet_type
+	PACKET_TYPE_SEQUENCE_START         = 0
+	PACKET_TYPE_CODED_FRAMES           = 1 //with a composition time for avc1 and hvc1
+	PACKET_TYPE_SEQUENCE_END           = 2
+	PACKET_TYPE_CODED_FRAMES_X         = 3 //composition time 0
+	PACKET_TYPE_METADATA               = 4
+	PACKET_TYPE_MPEG2TS_SEQUENCE_START = 5
+	PACKET_TYPE_MULTITRACK             = 6
+	PACKET_TYPE_MODEX                  = 7
+)
+
+const ( //multitrack_type
+	MULTITRACK_ONE_TRACK              = 0
+	MULTITRACK_MANY_TRACKS            = 1
+	MULTITRACK_MANY_TRACKS_MANY_CODEC = 2
+)
+
+const (
+	FOURCC_AVC1 uint32 = 'a'<<24 | 'v'<<16 | 'c'<<8 | '1'
+	FOURCC_HVC1 uint32 = 'h'<<24 | 'v'<<16 | 'c'<<8 | '1'
+	FOURCC_AV01 uint32 = 'a'<<24 | 'v'<<16 | '0'<<8 | '1'
+	FOURCC_VP09 uint32 = 'v'<<24 | 'p'<<16 | '0'<<8 | '9'
+)
+
+var fourCCCodecs = map[uint32]uint8{
+	FOURCC_AVC1: FLV_VIDEO_AVC,
+	FOURCC_HVC1: FLV_VIDEO_HEVC,
+	FOURCC_AV01: FLV_VIDEO_AV1,
+	FOURCC_VP09: FLV_VIDEO_VP9,
+}
+
+// FourCCString returns fourCC as its four characters.
+func FourCCString(fourCC uint32) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, fourCC)
+	return string(b)
+}
+
+// ParseFourCC is the inverse of FourCCString; ok is false if s is not
+// four bytes long.
+func ParseFourCC(s string) (fourCC uint32, ok bool) {
+	if len(s) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32([]byte(s)), true
+}
+
+// CodecFourCC returns the FourCC of a codec ID, 0 if it has none.
+func CodecFourCC(codecID uint8) uint32 {
+	for fourCC, id := range fourCCCodecs {
+		if id == codecID {
+			return fourCC
+		}
+	}
+	return 0
+}
+
+var errExVideo = errors.New("invalid enhanced video format")
+
+func parseExVideoTag(tb TagBase, b []byte) (*VideoTag, error) {
+	video := &VideoTag{
+		TagBase:    tb,
+		FrameType:  (b[0] >> 4) & 0x07,
+		PacketType: b[0] & 0x0f,
+		Enhanced:   true,
+	}
+	body := b[1:]
+	take := func(n int) ([]byte, bool) {
+		if len(body) < n {
+			return nil, false
+		}
+		p := body[:n]
+		body = body[n:]
+		return p, true
+	}
+
+	//Modifiers, only a nanosecond timestamp offset so far, are kept
+	//in the raw tag but not otherwise used.
+	for video.PacketType == PACKET_TYPE_MODEX {
+		p, ok := take(1)
+		if !ok {
+			return nil, errExVideo
+		}
+		size := int(p[0]) + 1
+		if size == 256 {
+			if p, ok = take(2); !ok {
+				return nil, errExVideo
+			}
+			size = int(binary.BigEndian.Uint16(p)) + 1
+		}
+		if _, ok = take(size); !ok {
+			return nil, errExVideo
+		}
+		if p, ok = take(1); !ok {
+			return nil, errExVideo
+		}
+		video.PacketType = p[0] & 0x0f
+		video.raw = b
+	}
+
+	if video.PacketType == PACKET_TYPE_MULTITRACK {
+		//Only the first track is parsed; the others go along in raw.
+		p, ok := take(1)
+		if !ok {
+			return nil, errExVideo
+		}
+		multitrack := p[0] >> 4
+		video.PacketType = p[0] & 0x0f
+		if multitrack != MULTITRACK_MANY_TRACKS_MANY_CODEC {
+			if p, ok = take(4); !ok {
+				return nil, errExVideo
+			}
+			video.FourCC = binary.BigEndian.Uint32(p)
+		}
+		if p, ok = take(1); !ok {
+			return nil, errExVideo
+		}
+		video.TrackID = p[0]
+		if multitrack == MULTITRACK_MANY_TRACKS_MANY_CODEC {
+			if p, ok = take(4); !ok {
+				return nil, errExVideo
+			}
+			video.FourCC = binary.BigEndian.Uint32(p)
+		}
+		if multitrack != MULTITRACK_ONE_TRACK {
+			if p, ok = take(3); !ok {
+				return nil, errExVideo
+			}
+			size := int(p[0])<<16 | int(p[1])<<8 | int(p[2])
+			if size > len(body) {
+				return nil, errExVideo
+			}
+			body = body[:size]
+		}
+		video.raw = b
+	} else {
+		p, ok := take(4)
+		if !ok {
+			return nil, errExVideo
+		}
+		video.FourCC = binary.BigEndian.Uint32(p)
+	}
+	video.CodecID = fourCCCodecs[video.FourCC]
+
+	video.AVCPacketType = VIDEO_PACKET_OTHER
+	if video.FrameType == VIDEO_INFO_COMMAND_FRAME {
+		video.VideoData = body
+		return video, nil
+	}
+	switch video.PacketType {
+	case PACKET_TYPE_SEQUENCE_START:
+		video.AVCPacketType = AVC_SEQUENCE_HEADER
+	case PACKET_TYPE_CODED_FRAMES:
+		video.AVCPacketType = AVC_NALU
+		if video.FourCC == FOURCC_AVC1 || video.FourCC == FOURCC_HVC1 {
+			p, ok := take(3)
+			if !ok {
+				return nil, errExVideo
+			}
+			video.Cts = uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+		}
+	case PACKET_TYPE_CODED_FRAMES_X:
+		video.AVCPacketType = AVC_NALU
+	case PACKET_TYPE_SEQUENCE_END:
+		video.AVCPacketType = AVC_END_OF_SEQUENCE
+	}
+	video.VideoData = body
+	return video, nil
+}
+
+func (vt *VideoTag) marshalEx() (b []byte) {
+	if vt.raw != nil {
+		return append(b, vt.raw...)
+	}
+	b = append(b, 0x80|(vt.FrameType&0x07)<<4|vt.PacketType&0x0f)
+	b = append(b, byte(vt.FourCC>>24), byte(vt.FourCC>>16), byte(vt.FourCC>>8), byte(vt.FourCC))
+	if vt.FrameType != VIDEO_INFO_COMMAND_FRAME && vt.PacketType == PACKET_TYPE_CODED_FRAMES &&
+		(vt.FourCC == FOURCC_AVC1 || vt.FourCC == FOURCC_HVC1) {
+		b = append(b, uint8((vt.Cts>>16)&0xff), uint8((vt.Cts>>8)&0xff), uint8(vt.Cts&0xff))
+	}
+	return append(b, vt.VideoData...)
+}
+
+// Legacy returns vt in the form players without enhanced RTMP take,
+// with codec IDs 7, 12 and 13, or nil if it has none. A tag not
+// enhanced is returned as is.
+func (vt *VideoTag) Legacy() *VideoTag {
+	if !vt.Enhanced {
+		return vt
+	}
+	switch vt.CodecID {
+	case FLV_VIDEO_AVC, FLV_VIDEO_HEVC, FLV_VIDEO_AV1:
+	default:
+		return nil
+	}
+	if vt.AVCPacketType == VIDEO_PACKET_OTHER || vt.FrameType == VIDEO_INFO_COMMAND_FRAME {
+		return nil
+	}
+	legacy := *vt
+	legacy.Enhanced, legacy.FourCC, legacy.PacketType, legacy.TrackID, legacy.raw = false, 0, 0, 0, nil
+	return &legacy
+}
+
+// Enhance returns vt in the enhanced form, or vt itself if it already
+// is or its codec has no FourCC.
+func (vt *VideoTag) Enhance() *VideoTag {
+	fourCC := CodecFourCC(vt.CodecID)
+	if vt.Enhanced || fourCC == 0 || vt.AVCPacketType > AVC_END_OF_SEQUENCE {
+		return vt
+	}
+	enhanced := *vt
+	enhanced.Enhanced, enhanced.FourCC = true, fourCC
+	switch vt.AVCPacketType {
+	case AVC_SEQUENCE_HEADER:
+		enhanced.PacketType = PACKET_TYPE_SEQUENCE_START
+	case AVC_NALU:
+		enhanced.PacketType = PACKET_TYPE_CODED_FRAMES
+		if vt.Cts == 0 && (fourCC == FOURCC_AVC1 || fourCC == FOURCC_HVC1) {
+			enhanced.PacketType = PACKET_TYPE_CODED_FRAMES_X
+		}
+	case AVC_END_OF_SEQUENCE:
+		enhanced.PacketType = PACKET_TYPE_SEQUENCE_END
+	}
+	return &enhanced
+}
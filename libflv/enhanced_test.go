@@ -0,0 +1,67 @@
+package libflv
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseExVideoTag(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		b      []byte
+		codec  uint8
+		packet uint8
+		cts    uint32
+		data   []byte
+	}{
+		{"hvc1 sequence start", []byte{0x90, 'h', 'v', 'c', '1', 1, 2, 3},
+			FLV_VIDEO_HEVC, AVC_SEQUENCE_HEADER, 0, []byte{1, 2, 3}},
+		{"hvc1 coded frames", []byte{0x91, 'h', 'v', 'c', '1', 0, 0, 40, 0, 0, 0, 1},
+			FLV_VIDEO_HEVC, AVC_NALU, 40, []byte{0, 0, 0, 1}},
+		{"hvc1 coded frames x", []byte{0xa3, 'h', 'v', 'c', '1', 0, 0, 0, 1},
+			FLV_VIDEO_HEVC, AVC_NALU, 0, []byte{0, 0, 0, 1}},
+		{"av01 coded frames", []byte{0x91, 'a', 'v', '0', '1', 0x12, 0},
+			FLV_VIDEO_AV1, AVC_NALU, 0, []byte{0x12, 0}},
+		{"vp09 metadata", []byte{0x94, 'v', 'p', '0', '9', 2},
+			FLV_VIDEO_VP9, VIDEO_PACKET_OTHER, 0, []byte{2}},
+		{"one track", []byte{0x96, 0x01, 'h', 'v', 'c', '1', 0, 0, 0, 40, 9},
+			FLV_VIDEO_HEVC, AVC_NALU, 40, []byte{9}},
+		{"many tracks", []byte{0x96, 0x13, 'a', 'v', '0', '1', 0, 0, 0, 2, 7, 8, 1, 0, 0, 1, 6},
+			FLV_VIDEO_AV1, AVC_NALU, 0, []byte{7, 8}},
+		{"modex", []byte{0x97, 2, 0, 0, 1, 0x03, 'a', 'v', 'c', '1', 5},
+			FLV_VIDEO_AVC, AVC_NALU, 0, []byte{5}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			v, err := ParseVideoTag(TagBase{TagType: VIDEO_TAG}, c.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !v.Enhanced || v.CodecID != c.codec || v.AVCPacketType != c.packet || v.Cts != c.cts || !bytes.Equal(v.VideoData, c.data) {
+				t.Errorf("parsed %+v", v)
+			}
+			if b := v.Marshal(); !bytes.Equal(b, c.b) {
+				t.Errorf("marshalled %x, want %x", b, c.b)
+			}
+		})
+	}
+	if _, err := ParseVideoTag(TagBase{TagType: VIDEO_TAG}, []byte{0x91, 'h', 'v'}); err == nil {
+		t.Error("parsed a truncated FourCC")
+	}
+}
+
+func TestVideoTagLegacy(t *testing.T) {
+	v, _ := ParseVideoTag(TagBase{TagType: VIDEO_TAG}, []byte{0x91, 'h', 'v', 'c', '1', 0, 0, 40, 0, 0, 0, 1})
+	legacy := v.Legacy()
+	want := []byte{0x1c, AVC_NALU, 0, 0, 40, 0, 0, 0, 1}
+	if legacy == nil || !bytes.Equal(legacy.Marshal(), want) {
+		t.Fatalf("legacy form %x, want %x", legacy.Marshal(), want)
+	}
+	if b := legacy.Enhance().Marshal(); !bytes.Equal(b, v.Marshal()) {
+		t.Errorf("enhanced again %x, want %x", b, v.Marshal())
+	}
+
+	vp9, _ := ParseVideoTag(TagBase{TagType: VIDEO_TAG}, []byte{0x90, 'v', 'p', '0', '9', 1})
+	if vp9.Legacy() != nil {
+		t.Error("VP9 has a legacy form")
+	}
+}
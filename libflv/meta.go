@@ -2,10 +2,10 @@ package libflv
 
 import (
 	"bytes"
-	"fmt"
 	"io"
+	"reflect"
+	"strings"
 
-	"github.com/SmartBrave/Athena/easyerrors"
 	"github.com/SmartBrave/Athena/easyio"
 	"github.com/sbraveyoung/GGmpeg/libamf"
 	"github.com/fatih/structs"
@@ -39,6 +39,9 @@ type MetaTag struct {
 	VideoCodecID    float64 `mapstructure:"videocodecid" structs:"videocodecid"`
 	VideoDataRate   float64 `mapstructure:"videodatarate" structs:"videodatarate"`
 	Width           int     `mapstructure:"width" structs:"width"`
+
+	values []interface{}          //what followed the name, as Parse decoded it
+	parsed map[string]interface{} //the fields above as Parse set them
 }
 
 func ParseMetaTag(tb TagBase, amf libamf.AMF, b []byte) (meta *MetaTag, err error) {
@@ -50,43 +53,86 @@ func ParseMetaTag(tb TagBase, amf libamf.AMF, b []byte) (meta *MetaTag, err erro
 
 	meta = &MetaTag{TagBase: tb}
 	//Publishers emit data messages in two shapes:
-	//  - [string "onMetaData", ecma-array]
-	//  - [string "@setDataFrame", string "onMetaData", ecma-array]
-	//Canonicalise to always keep the onMetaData string in SecondField
-	//and the properties array in the last slot.
-	var props interface{}
-	switch {
-	case len(array) >= 3:
-		if s, ok := array[0].(string); ok {
+	//  - [string name, values...]
+	//  - [string "@setDataFrame", string name, values...]
+	//the name being onMetaData, onCuePoint or anything else. Keep the
+	//name in SecondField and the values as they came; onMetaData's
+	//properties also go in the fields above.
+	if len(array) > 0 {
+		if s, ok := array[0].(string); ok && strings.HasPrefix(s, "@") {
 			meta.FirstField = s
+			array = array[1:]
 		}
-		if s, ok := array[1].(string); ok {
-			meta.SecondField = s
-		}
-		props = array[2]
-	case len(array) == 2:
-		if s, ok := array[0].(string); ok {
-			meta.SecondField = s
+	}
+	if len(array) == 0 {
+		return meta, errors.New("invalid script data payload")
+	}
+	var ok bool
+	if meta.SecondField, ok = array[0].(string); !ok {
+		return meta, errors.New("invalid script data name")
+	}
+	meta.values = array[1:]
+
+	if !meta.IsMetaData() || len(meta.values) == 0 || meta.values[0] == nil {
+		return meta, nil
+	}
+	var decoder *mapstructure.Decoder
+	decoder, err = mapstructure.NewDecoder(&mapstructure.DecoderConfig{WeaklyTypedInput: true, Result: meta})
+	if err == nil {
+		err = decoder.Decode(meta.values[0])
+	}
+	if err != nil {
+		err = errors.Wrap(err, "mapstructure.Decode data")
+	}
+	meta.parsed = structs.Map(meta)
+	return meta, err
+}
+
+// IsMetaData tells onMetaData, the stream's properties, from cue points
+// and other script data that go along with the media.
+func (mt *MetaTag) IsMetaData() bool {
+	return mt.SecondField == "" || mt.SecondField == "onMetaData"
+}
+
+// props returns the onMetaData properties: those Parse decoded, with
+// the fields above for those set since, or that it had none of.
+func (mt *MetaTag) props() interface{} {
+	fields := structs.Map(mt)
+	var parsed map[string]interface{}
+	var ecma bool
+	if len(mt.values) > 0 {
+		switch p := mt.values[0].(type) {
+		case libamf.ECMAArray:
+			parsed, ecma = p, true
+		case map[string]interface{}:
+			parsed = p
 		}
-		props = array[1]
-	default:
-		return meta, errors.New("invalid onMetaData payload")
+	}
+	if parsed == nil {
+		return libamf.ECMAArray(fields)
 	}
 
-	if props != nil {
-		if err = mapstructure.Decode(props, meta); err != nil {
-			fmt.Printf("decode data error, err:%+v\n", err)
-			err = errors.Wrap(err, "mapstructure.Decode data")
+	props := make(map[string]interface{}, len(parsed)+len(fields))
+	for k, v := range parsed {
+		props[k] = v
+	}
+	for k, v := range fields {
+		if _, had := parsed[k]; had && reflect.DeepEqual(v, mt.parsed[k]) {
+			continue
 		}
+		props[k] = v
 	}
-	return meta, err
+	if ecma {
+		return libamf.ECMAArray(props)
+	}
+	return props
 }
 
-// Marshal serialises the metadata tag body in the form FLV players
-// expect: two AMF0 elements — the string "onMetaData" followed by the
-// ECMA array of properties. (RTMP's @setDataFrame wrapper is a command
-// verb, not part of the FLV script-data tag format, so we drop
-// FirstField even when Parse observed one.)
+// Marshal serialises the script data tag body in the form FLV players
+// expect: the name, "onMetaData" by default, followed by its values.
+// (RTMP's @setDataFrame wrapper is a command verb, not part of the FLV
+// script-data tag format, so we drop FirstField even when Parse
+// observed one.)
 func (mt *MetaTag) Marshal() (b []byte) {
 	buf := bytes.NewBuffer([]byte{})
 	writer := easyio.NewEasyWriter(buf)
@@ -96,12 +142,15 @@ func (mt *MetaTag) Marshal() (b []byte) {
 	if name == "" {
 		name = "onMetaData"
 	}
+	values := append([]interface{}{name}, mt.values...)
+	if mt.IsMetaData() {
+		if len(values) == 1 {
+			values = append(values, nil)
+		}
+		values[1] = mt.props()
+	}
 
-	var err1, err2 error
-	err1 = amf.Encode(writer, name)
-	err2 = amf.Encode(writer, structs.Map(mt))
-	if err := easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2); err != nil {
-		fmt.Println("HandleMultiError error:", err)
+	if err := amf.EncodeAll(writer, values...); err != nil {
 		return nil
 	}
 
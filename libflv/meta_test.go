@@ -0,0 +1,62 @@
+package libflv
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/SmartBrave/Athena/easyio"
+	"github.com/sbraveyoung/GGmpeg/libamf"
+)
+
+func encodeAMF0(t *testing.T, values ...interface{}) []byte {
+	buf := &bytes.Buffer{}
+	if err := libamf.AMF0.EncodeAll(easyio.NewEasyWriter(buf), values...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMetaTagRoundTrip(t *testing.T) {
+	//Custom properties survive, set fields win, FirstField goes.
+	props := libamf.ECMAArray{"width": 1280.0, "fps": 30.0, "x-origin": "studio-2", "cues": []interface{}{"a", "b"}}
+	meta, err := ParseMetaTag(TagBase{TagType: SCRIPT_DATA_TAG}, libamf.AMF0, encodeAMF0(t, "@setDataFrame", "onMetaData", props))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if meta.Width != 1280 || meta.Fps != "30" {
+		t.Errorf("width %d, fps %q", meta.Width, meta.Fps)
+	}
+	meta.Duration = 12
+	got, err := libamf.AMF0.Decode(easyio.NewEasyReader(bytes.NewReader(meta.Marshal())))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != 2 || got[0] != "onMetaData" {
+		t.Fatalf("marshalled %v", got)
+	}
+	out := got[1].(libamf.ECMAArray)
+	for k, v := range props {
+		if !reflect.DeepEqual(out[k], v) {
+			t.Errorf("%s: got %#v, want %#v", k, out[k], v)
+		}
+	}
+	if out["duration"] != 12.0 {
+		t.Errorf("duration %v, want the 12 set", out["duration"])
+	}
+
+	//Other script data comes back as it was.
+	cue := map[string]interface{}{"name": "ad-break", "time": 12.5, "type": "event",
+		"parameters": libamf.ECMAArray{"id": "42"}}
+	b := encodeAMF0(t, "onCuePoint", cue)
+	meta, err = ParseMetaTag(TagBase{TagType: SCRIPT_DATA_TAG}, libamf.AMF0, b)
+	if err != nil {
+		t.Fatalf("parse cue point: %v", err)
+	}
+	if meta.IsMetaData() {
+		t.Error("onCuePoint taken for metadata")
+	}
+	if !bytes.Equal(meta.Marshal(), b) {
+		t.Errorf("cue point marshalled to % x, want % x", meta.Marshal(), b)
+	}
+}
@@ -0,0 +1,255 @@
+package libflv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/SmartBrave/Athena/easyio"
+	"github.com/sbraveyoung/GGmpeg/libamf"
+)
+
+// ErrTruncated is returned by ReadTag when the file ends part way
+// through a tag. Every complete tag before it has been returned.
+var ErrTruncated = errors.New("flv: truncated file")
+
+// Keyframe is an entry of onMetaData's keyframes index.
+type Keyframe struct {
+	Time     time.Duration
+	Position int64 //file offset of the keyframe's tag
+}
+
+// Reader reads an FLV file (FLV v10.1 §E) one tag at a time. Each
+// tag's PreviousTagSize back-pointer is checked; where it doesn't
+// match, or a tag header makes no sense, the file is corrupt and the
+// reader skips ahead to the next tag that checks out.
+type Reader struct {
+	FLVHeader
+	r         io.Reader
+	buf       []byte //read from r but not consumed yet
+	offset    int64  //file offset of buf[0]
+	eof       bool
+	truncated bool
+	skipped   int64
+	keyframes []Keyframe
+}
+
+// NewReader reads the FLV header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	fr := &Reader{r: r}
+	head, err := fr.peek(9)
+	if err != nil || !bytes.Equal(head[:3], []byte("FLV")) {
+		return nil, errors.New("flv: not an FLV file")
+	}
+	fr.Version = int8(head[3])
+	fr.TypeFlagsAudio = head[4]&0x04 != 0
+	fr.TypeFlagsVideo = head[4]&0x01 != 0
+	//DataOffset is the header's size, 9 for version 1; then comes
+	//PreviousTagSize0, always 0.
+	dataOffset := int(binary.BigEndian.Uint32(head[5:]))
+	if dataOffset < 9 {
+		return nil, fmt.Errorf("flv: bad header size %d", dataOffset)
+	}
+	if _, err := fr.peek(dataOffset + 4); err != nil {
+		return nil, ErrTruncated
+	}
+	fr.consume(dataOffset + 4)
+	return fr, nil
+}
+
+// ReadTag returns the next tag: an *AudioTag, *VideoTag or *MetaTag.
+// It returns io.EOF at the end of the file, or ErrTruncated if the file
+// ends part way through a tag. A tag whose body doesn't parse is
+// reported with its offset; ReadTag can then be called again to carry
+// on past it.
+func (fr *Reader) ReadTag() (Tag, error) {
+	resyncing := false
+	for {
+		head, err := fr.peek(11)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		if err != nil {
+			if len(head) == 0 && !fr.truncated && !resyncing {
+				return nil, io.EOF
+			}
+			fr.consume(len(head))
+			return nil, ErrTruncated
+		}
+		if !validTagHeader(head) {
+			fr.skip(&resyncing)
+			continue
+		}
+		n := int(head[1])<<16 | int(head[2])<<8 | int(head[3])
+		b, err := fr.peek(11 + n + 4)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		switch {
+		case err == nil && int(binary.BigEndian.Uint32(b[11+n:])) != 11+n:
+			//The back-pointer disagrees: this isn't where a tag starts.
+			fr.skip(&resyncing)
+			continue
+		case err != nil && resyncing:
+			//Junk whose made-up size runs past the end of the file.
+			fr.skip(&resyncing)
+			continue
+		case err != nil && len(b) < 11+n:
+			fr.consume(len(b))
+			return nil, ErrTruncated
+		case err != nil:
+			//The body is all there, only the back-pointer is missing.
+			fr.truncated = true
+		}
+
+		at := fr.offset
+		body := append([]byte(nil), b[11:11+n]...)
+		fr.consume(len(b))
+		tb := TagBase{
+			TagType:   head[0],
+			DataSize:  uint32(n),
+			TimeStamp: uint32(head[7])<<24 | uint32(head[4])<<16 | uint32(head[5])<<8 | uint32(head[6]),
+		}
+		tag, err := fr.parse(tb, body)
+		if err != nil {
+			return nil, fmt.Errorf("flv: tag at offset %d: %w", at, err)
+		}
+		return tag, nil
+	}
+}
+
+// Keyframes returns the keyframe index from the onMetaData read so
+// far, if it had one.
+func (fr *Reader) Keyframes() []Keyframe {
+	return fr.keyframes
+}
+
+// Offset is the file offset of the next tag.
+func (fr *Reader) Offset() int64 {
+	return fr.offset
+}
+
+// SeekTo moves to the tag at file offset offset, such as a keyframe's
+// Position. The reader NewReader was given must be an io.Seeker.
+func (fr *Reader) SeekTo(offset int64) error {
+	seeker, ok := fr.r.(io.Seeker)
+	if !ok {
+		return errors.New("flv: reader can't seek")
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	fr.buf, fr.offset = nil, offset
+	fr.eof, fr.truncated = false, false
+	return nil
+}
+
+// Skipped is how many corrupt bytes have been skipped.
+func (fr *Reader) Skipped() int64 {
+	return fr.skipped
+}
+
+func (fr *Reader) parse(tb TagBase, body []byte) (Tag, error) {
+	switch tb.TagType {
+	case AUDIO_TAG:
+		return ParseAudioTag(tb, body)
+	case VIDEO_TAG:
+		return ParseVideoTag(tb, body)
+	default:
+		meta, err := ParseMetaTag(tb, libamf.AMF0, body)
+		if err == nil && meta.SecondField == "onMetaData" {
+			if keyframes := parseKeyframes(body); keyframes != nil {
+				fr.keyframes = keyframes
+			}
+		}
+		return meta, err
+	}
+}
+
+// validTagHeader rules out bytes that can't be a tag header.
+func validTagHeader(head []byte) bool {
+	switch head[0] {
+	case AUDIO_TAG, VIDEO_TAG, SCRIPT_DATA_TAG:
+	default:
+		return false
+	}
+	return head[8] == 0 && head[9] == 0 && head[10] == 0 //StreamID
+}
+
+// skip moves on a byte in search of the next tag.
+func (fr *Reader) skip(resyncing *bool) {
+	*resyncing = true
+	fr.consume(1)
+	fr.skipped++
+}
+
+// peek returns the next n bytes without consuming them, or fewer and
+// io.ErrUnexpectedEOF if the file ends first.
+func (fr *Reader) peek(n int) ([]byte, error) {
+	for len(fr.buf) < n && !fr.eof {
+		more := n - len(fr.buf)
+		if more < 4096 {
+			more = 4096
+		}
+		chunk := make([]byte, more)
+		got, err := io.ReadAtLeast(fr.r, chunk, n-len(fr.buf))
+		fr.buf = append(fr.buf, chunk[:got]...)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			fr.eof = true
+		} else if err != nil {
+			return fr.buf, err
+		}
+	}
+	if len(fr.buf) < n {
+		return fr.buf, io.ErrUnexpectedEOF
+	}
+	return fr.buf[:n], nil
+}
+
+func (fr *Reader) consume(n int) {
+	fr.buf = fr.buf[n:]
+	fr.offset += int64(n)
+}
+
+// parseKeyframes reads onMetaData's keyframes object, as written by
+// yamdi, FFmpeg and friends: {filepositions: [...], times: [...]}.
+func parseKeyframes(body []byte) []Keyframe {
+	values, _ := libamf.AMF0.Decode(easyio.NewEasyReader(bytes.NewReader(body)))
+	if len(values) == 0 {
+		return nil
+	}
+	props := amfObject(values[len(values)-1])
+	index := amfObject(props["keyframes"])
+	positions, _ := index["filepositions"].([]interface{})
+	times, _ := index["times"].([]interface{})
+	if len(positions) == 0 || len(positions) != len(times) {
+		return nil
+	}
+	keyframes := make([]Keyframe, 0, len(positions))
+	for i := range positions {
+		pos, ok1 := positions[i].(float64)
+		t, ok2 := times[i].(float64)
+		if !ok1 || !ok2 {
+			return nil
+		}
+		keyframes = append(keyframes, Keyframe{
+			Time:     time.Duration(t * float64(time.Second)),
+			Position: int64(pos),
+		})
+	}
+	return keyframes
+}
+
+// amfObject returns the members of an AMF0 object or ECMA array.
+func amfObject(v interface{}) map[string]interface{} {
+	switch obj := v.(type) {
+	case map[string]interface{}:
+		return obj
+	case libamf.ECMAArray:
+		return obj
+	}
+	return nil
+}
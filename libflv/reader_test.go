@@ -0,0 +1,173 @@
+package libflv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+// amfNumber, amfKey and amfArray hand-encode the AMF0 values an
+// onMetaData with a keyframes index needs.
+func amfNumber(f float64) []byte {
+	b := []byte{0x00, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(f))
+	return b
+}
+
+func amfKey(key string) []byte {
+	return append([]byte{0, byte(len(key))}, key...)
+}
+
+func amfArray(values ...float64) []byte {
+	b := []byte{0x0a, 0, 0, 0, byte(len(values))}
+	for _, v := range values {
+		b = append(b, amfNumber(v)...)
+	}
+	return b
+}
+
+func scriptTag(body []byte) []byte {
+	b := []byte{SCRIPT_DATA_TAG, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body)), 0, 0, 0, 0, 0, 0, 0}
+	b = append(b, body...)
+	size := 11 + len(body)
+	return append(b, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+}
+
+// testFile is an FLV file with onMetaData (indexing the keyframe at
+// 1000 ms) and an AAC frame, then a keyframe.
+func testFile() (file []byte, keyframeAt int) {
+	meta := []byte{0x02, 0, 10}
+	meta = append(meta, "onMetaData"...)
+	meta = append(meta, 0x08, 0, 0, 0, 2)
+	meta = append(meta, amfKey("duration")...)
+	meta = append(meta, amfNumber(1)...)
+	meta = append(meta, amfKey("keyframes")...)
+	meta = append(meta, 0x03)
+	meta = append(meta, amfKey("filepositions")...)
+	meta = append(meta, amfArray(0)...) //patched below
+	meta = append(meta, amfKey("times")...)
+	meta = append(meta, amfArray(1)...)
+	meta = append(meta, 0, 0, 0x09, 0, 0, 0x09)
+
+	file = []byte{'F', 'L', 'V', 1, 0x05, 0, 0, 0, 9, 0, 0, 0, 0}
+	file = append(file, scriptTag(meta)...)
+	file = append(file, FLVWrite(&AudioTag{TagBase: TagBase{TimeStamp: 20}, SoundFormat: FLV_AUDIO_AAC,
+		AACPacketType: AAC_RAW, SoundData: []byte{0x21}})...)
+	keyframeAt = len(file)
+	file = append(file, FLVWrite(&VideoTag{TagBase: TagBase{TimeStamp: 1000}, FrameType: KEY_FRAME, CodecID: FLV_VIDEO_AVC,
+		AVCPacketType: AVC_NALU, VideoData: []byte{0, 0, 0, 1, 0x65}})...)
+	//The filepositions array holds the one number before "times".
+	at := bytes.Index(file, []byte("filepositions")) + len("filepositions") + 5 + 1
+	binary.BigEndian.PutUint64(file[at:], math.Float64bits(float64(keyframeAt)))
+	return file, keyframeAt
+}
+
+func readAll(t *testing.T, b []byte) (tags []Tag, r *Reader, err error) {
+	t.Helper()
+	r, err = NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	for {
+		tag, err := r.ReadTag()
+		if err != nil {
+			return tags, r, err
+		}
+		tags = append(tags, tag)
+	}
+}
+
+func TestReader(t *testing.T) {
+	file, keyframeAt := testFile()
+	tags, r, err := readAll(t, file)
+	if err != io.EOF {
+		t.Fatalf("ReadTag = %v, want io.EOF", err)
+	}
+	if !r.TypeFlagsAudio || !r.TypeFlagsVideo {
+		t.Error("header flags not read")
+	}
+	if len(tags) != 3 {
+		t.Fatalf("read %d tags, want 3", len(tags))
+	}
+	if meta, ok := tags[0].(*MetaTag); !ok || meta.Duration != 1 {
+		t.Errorf("first tag = %+v, want onMetaData with duration 1", tags[0])
+	}
+	if audio, ok := tags[1].(*AudioTag); !ok || audio.TimeStamp != 20 || !bytes.Equal(audio.SoundData, []byte{0x21}) {
+		t.Errorf("second tag = %+v, want the AAC frame at 20 ms", tags[1])
+	}
+	if video, ok := tags[2].(*VideoTag); !ok || video.TimeStamp != 1000 || video.FrameType != KEY_FRAME {
+		t.Errorf("third tag = %+v, want the keyframe at 1000 ms", tags[2])
+	}
+	keyframes := r.Keyframes()
+	if len(keyframes) != 1 || keyframes[0].Time != time.Second || keyframes[0].Position != int64(keyframeAt) {
+		t.Errorf("keyframes = %+v, want one at 1s, offset %d", keyframes, keyframeAt)
+	}
+}
+
+func TestReader_Corrupt(t *testing.T) {
+	file, keyframeAt := testFile()
+	//Garbage, looking like the start of a video tag, in front of the
+	//keyframe; and a tag with a bad back-pointer after it.
+	junk := []byte{VIDEO_TAG, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	bad := FLVWrite(&AudioTag{TagBase: TagBase{TimeStamp: 1020}, SoundFormat: FLV_AUDIO_AAC, AACPacketType: AAC_RAW, SoundData: []byte{0x22}})
+	bad[len(bad)-1]++
+	good := FLVWrite(&AudioTag{TagBase: TagBase{TimeStamp: 1040}, SoundFormat: FLV_AUDIO_AAC, AACPacketType: AAC_RAW, SoundData: []byte{0x23}})
+	corrupt := append(append([]byte{}, file[:keyframeAt]...), junk...)
+	corrupt = append(corrupt, file[keyframeAt:]...)
+	corrupt = append(corrupt, bad...)
+	corrupt = append(corrupt, good...)
+
+	tags, r, err := readAll(t, corrupt)
+	if err != io.EOF {
+		t.Fatalf("ReadTag = %v, want io.EOF", err)
+	}
+	var stamps []uint32
+	for _, tag := range tags {
+		stamps = append(stamps, tag.GetTagInfo().TimeStamp)
+	}
+	if len(stamps) != 4 || stamps[2] != 1000 || stamps[3] != 1040 {
+		t.Errorf("timestamps %v, want [0 20 1000 1040]", stamps)
+	}
+	if r.Skipped() != int64(len(junk)+len(bad)) {
+		t.Errorf("skipped %d bytes, want %d", r.Skipped(), len(junk)+len(bad))
+	}
+}
+
+func TestReader_Truncated(t *testing.T) {
+	file, _ := testFile()
+	for _, cut := range []int{3, 4, 10} {
+		tags, _, err := readAll(t, file[:len(file)-cut])
+		if !errors.Is(err, ErrTruncated) {
+			t.Errorf("cut %d bytes: ReadTag = %v, want ErrTruncated", cut, err)
+		}
+		//Without its back-pointer the keyframe is still all there.
+		if want := map[bool]int{true: 3, false: 2}[cut <= 4]; len(tags) != want {
+			t.Errorf("cut %d bytes: read %d tags, want %d", cut, len(tags), want)
+		}
+	}
+}
+
+func TestReader_Seek(t *testing.T) {
+	file, keyframeAt := testFile()
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SeekTo(int64(keyframeAt)); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := r.ReadTag()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video, ok := tag.(*VideoTag); !ok || video.TimeStamp != 1000 {
+		t.Errorf("tag after seek = %+v, want the keyframe at 1000 ms", tag)
+	}
+	if _, err := r.ReadTag(); err != io.EOF {
+		t.Errorf("ReadTag = %v, want io.EOF", err)
+	}
+}
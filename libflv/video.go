@@ -22,12 +22,15 @@ const ( //codec_id
 	FLV_VIDEO_AVC  = 7
 	FLV_VIDEO_HEVC = 12 //https://github.com/CDN-Union/H265
 	FLV_VIDEO_AV1  = 13 //https://aomediacodec.github.io/av1-isobmff
+	FLV_VIDEO_VP9  = 14 //no legacy ID: enhanced RTMP only
 )
 
 const ( //avc_packet_type
 	AVC_SEQUENCE_HEADER = 0
 	AVC_NALU            = 1
 	AVC_END_OF_SEQUENCE = 2
+	//Enhanced packets with no legacy equivalent: metadata, commands.
+	VIDEO_PACKET_OTHER = 0xff
 )
 
 type VideoTag struct {
@@ -37,12 +40,24 @@ type VideoTag struct {
 	VideoData     []byte
 	AVCPacketType uint8
 	Cts           uint32 //CompositionTime, int24
+
+	//Enhanced RTMP: set for tags in the ExVideoTagHeader form, whose
+	//codec is FourCC and packet type PacketType. CodecID and
+	//AVCPacketType mirror them, so consumers need not care.
+	Enhanced   bool
+	FourCC     uint32
+	PacketType uint8
+	TrackID    uint8  //of a multitrack tag, the track the fields are of
+	raw        []byte //a multitrack or ModEx tag, marshalled as it came
 }
 
 func ParseVideoTag(tb TagBase, b []byte) (video *VideoTag, err error) {
 	if len(b) < 1 {
 		return nil, errors.New("invalid video format")
 	}
+	if b[0]&0x80 != 0 {
+		return parseExVideoTag(tb, b)
+	}
 
 	video = &VideoTag{
 		TagBase:   tb,
@@ -65,6 +80,9 @@ func ParseVideoTag(tb TagBase, b []byte) (video *VideoTag, err error) {
 }
 
 func (vt *VideoTag) Marshal() (b []byte) {
+	if vt.Enhanced {
+		return vt.marshalEx()
+	}
 	b = append(b, (vt.FrameType<<4)|(vt.CodecID&0x0f))
 	switch vt.CodecID {
 	case FLV_VIDEO_AVC, FLV_VIDEO_HEVC, FLV_VIDEO_AV1:
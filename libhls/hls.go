@@ -16,6 +16,7 @@ import (
 	"github.com/sbraveyoung/GGmpeg/libaac"
 	"github.com/sbraveyoung/GGmpeg/libavc"
 	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 	"github.com/sbraveyoung/GGmpeg/libmpeg"
 )
 
@@ -62,7 +63,10 @@ type HLS struct {
 	targetDur     time.Duration
 	windowSize    int
 	llEnabled     bool
+	audioOnly     bool
 	partTargetDur time.Duration
+	onSegment     func(Segment)
+	logger        liblog.Logger
 
 	// PAT/PMT template built at Start. Held read-only once populated.
 	Pat *libmpeg.PAT
@@ -100,6 +104,15 @@ type HLS struct {
 	stopped   int32 //atomic
 }
 
+// Segment describes a finished .ts segment as reported to the
+// WithOnSegment callback.
+type Segment struct {
+	StreamID string
+	Path     string //full path on disk
+	Seq      int
+	Duration time.Duration
+}
+
 // partInfo describes one LL-HLS partial segment. URI is always the
 // parent segment's filename; the player addresses the bytes via the
 // BYTERANGE attribute (length@offset).
@@ -125,6 +138,7 @@ func NewHls() *HLS {
 		audioCache: newAudioCache(),
 		align:      &align{},
 		ready:      make(chan struct{}),
+		logger:     liblog.Nop,
 	}
 	h.cond = sync.NewCond(&h.mu)
 	return h
@@ -139,6 +153,14 @@ func (hls *HLS) WithLowLatency(on bool) *HLS {
 	return hls
 }
 
+// WithAudioOnly drops video, for an audio-only rendition of an A/V
+// stream or a stream with no video at all. Segments are then cut on
+// the first audio frame past the target duration.
+func (hls *HLS) WithAudioOnly(on bool) *HLS {
+	hls.audioOnly = on
+	return hls
+}
+
 // PartTargetDur reports the configured LL-HLS partial-segment target
 // duration. Used by the playlist builder.
 func (hls *HLS) PartTargetDur() time.Duration { return hls.partTargetDur }
@@ -146,6 +168,25 @@ func (hls *HLS) PartTargetDur() time.Duration { return hls.partTargetDur }
 // LowLatency reports whether LL-HLS extensions are enabled.
 func (hls *HLS) LowLatency() bool { return hls.llEnabled }
 
+// WithOnSegment registers fn to be called, from the segmenter
+// goroutine, every time a segment is closed and added to the playlist.
+// fn must not block; hand slow work off to another goroutine.
+func (hls *HLS) WithOnSegment(fn func(Segment)) *HLS {
+	hls.onSegment = fn
+	return hls
+}
+
+// WithLogger routes the segmenter's diagnostics to l. The default is
+// silent.
+func (hls *HLS) WithLogger(l liblog.Logger) *HLS {
+	hls.logger = liblog.OrNop(l)
+	return hls
+}
+
+func (hls *HLS) log() liblog.Logger {
+	return hls.logger.With(liblog.Stream(hls.streamID), liblog.Protocol("hls"))
+}
+
 // WithStreamID sets the stream identifier used in the segment
 // filenames and served playlist.
 func (hls *HLS) WithStreamID(id string) *HLS {
@@ -162,6 +203,24 @@ func (hls *HLS) WithDir(dir string) *HLS {
 	return hls
 }
 
+// WithTargetDuration sets the segment length to aim for; segments are
+// cut on the first keyframe past it. Zero keeps the 2 s default.
+func (hls *HLS) WithTargetDuration(d time.Duration) *HLS {
+	if d > 0 {
+		hls.targetDur = d
+	}
+	return hls
+}
+
+// WithWindowSize sets how many segments the live playlist lists (and
+// keeps on disk). Zero keeps the default of 6.
+func (hls *HLS) WithWindowSize(n int) *HLS {
+	if n > 0 {
+		hls.windowSize = n
+	}
+	return hls
+}
+
 // Dir returns the segment directory (defaults to "./data").
 func (hls *HLS) Dir() string { return hls.dir }
 
@@ -193,7 +252,9 @@ func (hls *HLS) Playlist() []byte {
 // after timeout (returns the current playlist anyway, matching the
 // "respond with stale playlist" guidance from Apple's spec).
 func (hls *HLS) WaitForPlaylist(wantMSN int, wantPart int, timeout time.Duration) []byte {
-	deadline := time.Now().Add(timeout)
+	start := time.Now()
+	deadline := start.Add(timeout)
+	waited := false
 	hls.mu.Lock()
 	for {
 		if !hls.llEnabled || wantMSN < 0 {
@@ -222,12 +283,17 @@ func (hls *HLS) WaitForPlaylist(wantMSN int, wantPart int, timeout time.Duration
 			hls.mu.Unlock()
 			close(waitCh)
 		}(deadline.Sub(now))
+		waited = true
 		hls.cond.Wait()
 		select {
 		case <-waitCh:
 		default:
 		}
 	}
+	if waited {
+		blockingReloads.With().Inc()
+		blockingReloadWait.With().Observe(time.Since(start).Seconds())
+	}
 	if len(hls.segments) == 0 && !hls.llEnabled {
 		hls.mu.Unlock()
 		return nil
@@ -297,6 +363,9 @@ func (hls *HLS) Start(gopReader *broadcast.BroadcastReader) (err error) {
 	//to H.264 stream_type=0x1B; toPES upgrades video.StreamType to
 	//0x24 the moment we see an HEVC tag.
 	hls.Pat = newPAT(0x1B)
+	if hls.audioOnly {
+		hls.Pat = newAudioPAT()
+	}
 
 	defer func() {
 		//On graceful exit (publisher gone or Stop called) finalise the
@@ -305,7 +374,6 @@ func (hls *HLS) Start(gopReader *broadcast.BroadcastReader) (err error) {
 		hls.readyOnce.Do(func() { close(hls.ready) })
 	}()
 
-outer:
 	for {
 		if hls.stopRequested() {
 			return nil
@@ -316,7 +384,7 @@ outer:
 		}
 
 		tag, ok := p.(libflv.Tag)
-		if !ok {
+		if !ok || hls.audioOnly && tag.GetTagInfo().TagType == libflv.VIDEO_TAG {
 			continue
 		}
 
@@ -324,12 +392,14 @@ outer:
 		if skip {
 			continue
 		}
+		//Without video every audio frame starts a decodable segment.
+		cut := videoFrameKey || hls.audioOnly
 
 		//Segment rotation decision — performed on keyframes only so
 		//every .ts begins with an IDR frame and is independently
 		//decodable. Duration is tracked in 90 kHz PTS units because
 		//that's what we already multiply the FLV timestamps by.
-		if videoFrameKey {
+		if cut {
 			if hls.currentFile == nil {
 				if err := hls.openSegment(pes.DTS); err != nil {
 					return err
@@ -357,17 +427,9 @@ outer:
 			}
 		}
 
-		firstTS := true
-		for {
-			finish, muxErr := libmpeg.NewTs(pid, hls.Cc, firstTS).Mux(pes, videoFrameKey && firstTS, pes.DTS, hls.currentWriter)
-			if muxErr != nil {
-				fmt.Printf("ts.Mux pes error:%+v\n", muxErr)
-				continue outer
-			}
-			firstTS = false
-			if finish {
-				break
-			}
+		if muxErr := hls.writePES(pes, pid, cut); muxErr != nil {
+			hls.log().Warn("ts mux failed", liblog.Err(muxErr))
+			continue
 		}
 		if pes.DTS > hls.currentEndDTS {
 			hls.currentEndDTS = pes.DTS
@@ -400,7 +462,7 @@ func (hls *HLS) toPES(tag libflv.Tag) (pes *libmpeg.PES, pid uint16, videoKey bo
 		case libflv.FLV_AUDIO_AAC:
 			if pa.AACPacketType == libflv.AAC_SEQUENCE_HEADER {
 				if err := hls.Ah.Parse(pa.Data()); err != nil {
-					fmt.Printf("parse aac header error:%+v\n", err)
+					hls.log().Warn("parse aac header failed", liblog.Err(err))
 				}
 				return nil, 0, false, true
 			}
@@ -439,10 +501,13 @@ func (hls *HLS) toPES(tag libflv.Tag) (pes *libmpeg.PES, pid uint16, videoKey bo
 		case libflv.FLV_VIDEO_AVC:
 			if pv.FrameType == libflv.KEY_FRAME && pv.AVCPacketType == libflv.AVC_SEQUENCE_HEADER {
 				if err := hls.AvcParser.ParseSpecificInfo(pv.Data()); err != nil {
-					fmt.Printf("parse avc header error:%+v\n", err)
+					hls.log().Warn("parse avc header failed", liblog.Err(err))
 				}
 				return nil, 0, false, true
 			}
+			if pv.AVCPacketType != libflv.AVC_NALU {
+				return nil, 0, false, true
+			}
 			videoKey = pv.FrameType == libflv.KEY_FRAME
 			pid = libmpeg.VIDEO_PID
 			pes = hls.Pat.PMTs[libmpeg.PMT_PID].Streams[libmpeg.VIDEO_PID]
@@ -460,12 +525,12 @@ func (hls *HLS) toPES(tag libflv.Tag) (pes *libmpeg.PES, pid uint16, videoKey bo
 			} else {
 				buf := bytes.NewBuffer([]byte{})
 				if err := hls.AvcParser.GetAnnexbH264(pv.Data(), easyio.NewEasyWriter(buf)); err != nil {
-					fmt.Printf("AvcParser.GetAnnexbH264 error:%+v\n", err)
+					hls.log().Warn("convert avc to annexb failed", liblog.Err(err))
 					return nil, 0, false, true
 				}
 				data, err := io.ReadAll(buf)
 				if err != nil {
-					fmt.Printf("io.ReadAll error:%+v\n", err)
+					hls.log().Warn("read annexb failed", liblog.Err(err))
 					return nil, 0, false, true
 				}
 				pes.Data = data
@@ -489,6 +554,9 @@ func (hls *HLS) toPES(tag libflv.Tag) (pes *libmpeg.PES, pid uint16, videoKey bo
 				//need to memoise them for the muxer.
 				return nil, 0, false, true
 			}
+			if pv.AVCPacketType != libflv.AVC_NALU {
+				return nil, 0, false, true //end of sequence, enhanced metadata
+			}
 			videoKey = pv.FrameType == libflv.KEY_FRAME
 			pid = libmpeg.VIDEO_PID
 
@@ -512,6 +580,21 @@ func (hls *HLS) toPES(tag libflv.Tag) (pes *libmpeg.PES, pid uint16, videoKey bo
 	return nil, 0, false, true
 }
 
+// writePES muxes one PES into TS packets on the current segment.
+func (hls *HLS) writePES(pes *libmpeg.PES, pid uint16, videoKey bool) error {
+	firstTS := true
+	for {
+		finish, err := libmpeg.NewTs(pid, hls.Cc, firstTS).Mux(pes, videoKey && firstTS, pes.DTS, hls.currentWriter)
+		if err != nil {
+			return err
+		}
+		firstTS = false
+		if finish {
+			return nil
+		}
+	}
+}
+
 // newPAT builds the canonical PAT/PMT skeleton used by openSegment.
 // videoStreamType is the codec stream_type (0x1B for H.264, 0x24 for
 // HEVC); audio defaults to 0x0F (ADTS AAC).
@@ -554,6 +637,17 @@ func newPAT(videoStreamType uint8) *libmpeg.PAT {
 	}
 }
 
+// newAudioPAT is newPAT with the AAC stream alone, which also carries
+// the PCR.
+func newAudioPAT() *libmpeg.PAT {
+	pat := newPAT(0x1B)
+	pmt := pat.PMTs[libmpeg.PMT_PID]
+	delete(pmt.Streams, libmpeg.VIDEO_PID)
+	pmt.SectionLength -= 5 //one stream entry
+	pmt.PCR_PID = libmpeg.AUDIO_PID
+	return pat
+}
+
 // avccToAnnexB rewrites a 4-byte length-prefixed NAL stream into an
 // AnnexB stream (start code 0x00000001 between NALs). Codec-agnostic —
 // works for both H.264 and HEVC since both use the same AVCC framing
@@ -722,5 +816,15 @@ func (hls *HLS) finaliseCurrent() {
 	hls.cond.Broadcast()
 	hls.mu.Unlock()
 
+	segmentsTotal.With().Inc()
+	segmentDuration.With().Observe(duration)
+	if hls.onSegment != nil {
+		hls.onSegment(Segment{
+			StreamID: hls.streamID,
+			Path:     filepath.Join(hls.dir, name),
+			Seq:      seg.seq,
+			Duration: time.Duration(duration * float64(time.Second)),
+		})
+	}
 	hls.readyOnce.Do(func() { close(hls.ready) })
 }
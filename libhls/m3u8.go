@@ -139,3 +139,41 @@ func writePartTag(sb *strings.Builder, p partInfo, uri string) {
 	}
 	sb.WriteString("\n")
 }
+
+// AppendQuery appends an encoded query string to every URI in a media
+// playlist: the plain segment lines as well as the quoted URI="..."
+// attribute of EXT-X-PART, EXT-X-PRELOAD-HINT and EXT-X-MAP. Used to
+// carry signed-URL parameters from the playlist request onto the
+// segment requests a player makes next. An empty query is a no-op.
+func AppendQuery(playlist []byte, query string) []byte {
+	if query == "" || len(playlist) == 0 {
+		return playlist
+	}
+	withQuery := func(uri string) string {
+		if strings.Contains(uri, "?") {
+			return uri + "&" + query
+		}
+		return uri + "?" + query
+	}
+	lines := strings.Split(string(playlist), "\n")
+	for i, line := range lines {
+		switch {
+		case line == "":
+		case !strings.HasPrefix(line, "#"):
+			lines[i] = withQuery(line)
+		default:
+			start := strings.Index(line, `URI="`)
+			if start < 0 {
+				continue
+			}
+			start += len(`URI="`)
+			end := strings.Index(line[start:], `"`)
+			if end < 0 {
+				continue
+			}
+			end += start
+			lines[i] = line[:start] + withQuery(line[start:end]) + line[end:]
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
@@ -120,3 +120,25 @@ func TestBuildLLPlaylist_OnlyInProgress(t *testing.T) {
 		t.Errorf("missing preload hint:\n%s", got)
 	}
 }
+
+func TestAppendQuery(t *testing.T) {
+	in := []byte("#EXTM3U\n" +
+		"#EXT-X-PART:DURATION=0.333,URI=\"x-0.ts\",BYTERANGE=\"1000@0\"\n" +
+		"#EXTINF:2.000,\nx-0.ts\n" +
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"x-1.ts\",BYTERANGE-START=0\n")
+	got := string(AppendQuery(in, "expires=1&sign=ab"))
+	wants := []string{
+		`URI="x-0.ts?expires=1&sign=ab",BYTERANGE="1000@0"`,
+		"\nx-0.ts?expires=1&sign=ab\n",
+		`URI="x-1.ts?expires=1&sign=ab",BYTERANGE-START=0`,
+		"#EXTINF:2.000,\n",
+	}
+	for _, w := range wants {
+		if !strings.Contains(got, w) {
+			t.Errorf("playlist missing %q\n--- full ---\n%s", w, got)
+		}
+	}
+	if string(AppendQuery(in, "")) != string(in) {
+		t.Error("empty query should leave the playlist untouched")
+	}
+}
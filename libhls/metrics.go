@@ -0,0 +1,16 @@
+package libhls
+
+import "github.com/sbraveyoung/GGmpeg/libmetrics"
+
+var (
+	segmentsTotal = libmetrics.Default.NewCounterVec(
+		"ggmpeg_hls_segments_total", "HLS segments closed and published.")
+	segmentDuration = libmetrics.Default.NewHistogramVec(
+		"ggmpeg_hls_segment_duration_seconds", "Duration of closed HLS segments.",
+		[]float64{0.5, 1, 2, 3, 4, 6, 8, 10})
+	blockingReloads = libmetrics.Default.NewCounterVec(
+		"ggmpeg_hls_blocking_reloads_total", "LL-HLS playlist requests that had to wait for a newer part.")
+	blockingReloadWait = libmetrics.Default.NewHistogramVec(
+		"ggmpeg_hls_blocking_reload_wait_seconds", "Time LL-HLS blocking playlist reloads spent waiting.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2, 3, 5})
+)
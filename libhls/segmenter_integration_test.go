@@ -23,7 +23,10 @@ import (
 //     enough to span ≥2 target durations (2 s default → ≥6 s of media)
 func TestSegmenter_IntegrationFLVtoTS(t *testing.T) {
 	tmp := t.TempDir()
-	hls := NewHls().WithStreamID("integ").WithDir(tmp)
+	var reported []Segment
+	hls := NewHls().WithStreamID("integ").WithDir(tmp).WithOnSegment(func(seg Segment) {
+		reported = append(reported, seg)
+	})
 	hls.targetDur = 300 * time.Millisecond //rotate quickly so the test stays fast
 
 	bd := broadcast.NewBroadcast(2) //matches the 2 meta tags publishMeta sends
@@ -80,6 +83,16 @@ func TestSegmenter_IntegrationFLVtoTS(t *testing.T) {
 		t.Errorf("segments total only %d bytes — segmenter likely produced empty files", totalBytes)
 	}
 
+	//Start has returned, so reading the callback's slice is safe.
+	if len(reported) < 2 {
+		t.Errorf("OnSegment fired %d times, want ≥2", len(reported))
+	}
+	for i, seg := range reported {
+		if seg.StreamID != "integ" || seg.Seq != i || seg.Duration <= 0 || filepath.Dir(seg.Path) != tmp {
+			t.Errorf("OnSegment[%d] = %+v", i, seg)
+		}
+	}
+
 	playlist := string(hls.Playlist())
 	for _, want := range []string{"#EXTM3U", "#EXT-X-VERSION:3", "#EXTINF:", "integ-"} {
 		if !strings.Contains(playlist, want) {
@@ -150,6 +163,71 @@ func TestSegmenter_RollingWindowReap(t *testing.T) {
 	}
 }
 
+// TestSegmenter_AudioOnly feeds an A/V stream to an audio-only
+// segmenter and checks that segments are cut without video and carry
+// no video packets.
+func TestSegmenter_AudioOnly(t *testing.T) {
+	tmp := t.TempDir()
+	hls := NewHls().WithStreamID("radio").WithDir(tmp).WithAudioOnly(true)
+	hls.targetDur = 300 * time.Millisecond
+
+	bd := broadcast.NewBroadcast(2)
+	publishMeta(t, bd)
+	//Made here, not in the goroutine: a reader mustn't be made while
+	//the broadcast is reset.
+	reader := broadcast.NewBroadcastReader(bd)
+	done := make(chan error, 1)
+	go func() { done <- hls.Start(reader) }()
+
+	//A keyframe a second, so the A/V segmenter would cut only twice.
+	for i := 0; i < 100; i++ {
+		ts := uint32(i * 23)
+		if i%40 == 0 {
+			bd.Reset()
+			bd.Write(makeAVCKeyframe(ts))
+		}
+		at := &libflv.AudioTag{
+			TagBase:       libflv.TagBase{TagType: libflv.AUDIO_TAG, TimeStamp: ts},
+			SoundFormat:   libflv.FLV_AUDIO_AAC,
+			SoundRate:     3,
+			SoundSize:     libflv.SND_16_BIT,
+			SoundType:     libflv.SND_STEREO,
+			AACPacketType: libflv.AAC_RAW,
+			SoundData:     byteFiller(30),
+		}
+		at.DataSize = uint32(len(at.Data()))
+		bd.Write(at)
+		time.Sleep(time.Millisecond)
+	}
+	bd.DisAlive()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hls.Start hang")
+	}
+
+	entries, _ := os.ReadDir(tmp)
+	tsCount := 0
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".ts") {
+			continue
+		}
+		tsCount++
+		data, err := os.ReadFile(filepath.Join(tmp, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+188 <= len(data); i += 188 {
+			if pid := int(data[i+1]&0x1f)<<8 | int(data[i+2]); pid == 0x100 {
+				t.Fatalf("%s: video packet at %d", e.Name(), i)
+			}
+		}
+	}
+	if tsCount < 4 {
+		t.Errorf("expected ≥4 .ts segments of 2.3 s of audio, got %d", tsCount)
+	}
+}
+
 // publishMeta sends the AVC + AAC sequence headers as FLV meta tags
 // into the broadcast so toPES has decoder configuration before it
 // sees real samples.
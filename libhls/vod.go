@@ -0,0 +1,119 @@
+package libhls
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/libmpeg"
+)
+
+// VODSegment is the stretch of a recording served as one segment of a
+// VOD playlist.
+type VODSegment struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// SplitVOD cuts a recording into segments at its keyframes, each at
+// least target long but the last. Without keyframes, as for audio,
+// it cuts every target. A target of 0 means the live default.
+func SplitVOD(keyframes []time.Duration, duration, target time.Duration) []VODSegment {
+	if target <= 0 {
+		target = NewHls().targetDur
+	}
+	cuts := []time.Duration{0}
+	if len(keyframes) == 0 {
+		for t := target; t < duration; t += target {
+			cuts = append(cuts, t)
+		}
+	}
+	for _, k := range keyframes {
+		if k-cuts[len(cuts)-1] >= target && k < duration {
+			cuts = append(cuts, k)
+		}
+	}
+	segments := make([]VODSegment, len(cuts))
+	for i, start := range cuts {
+		segments[i] = VODSegment{Start: start, End: duration}
+		if i+1 < len(cuts) {
+			segments[i].End = cuts[i+1]
+		}
+	}
+	return segments
+}
+
+// VODPlaylist renders a complete playlist of the segments, segment i
+// being <i>.ts, ended by EXT-X-ENDLIST.
+func VODPlaylist(segments []VODSegment) []byte {
+	var maxDur float64
+	for _, s := range segments {
+		maxDur = math.Max(maxDur, (s.End - s.Start).Seconds())
+	}
+	target := int(math.Ceil(maxDur))
+	if target < 1 {
+		target = 1
+	}
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n")
+	sb.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&sb, "#EXT-X-TARGETDURATION:%d\n", target)
+	sb.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	sb.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for i, s := range segments {
+		fmt.Fprintf(&sb, "#EXTINF:%.3f,\n%d.ts\n", (s.End - s.Start).Seconds(), i)
+	}
+	sb.WriteString("#EXT-X-ENDLIST\n")
+	return []byte(sb.String())
+}
+
+// TSWriter muxes FLV tags into a single stand-alone MPEG-TS segment,
+// so a recording can be served as VOD without segmenting it to disk.
+type TSWriter struct {
+	hls     *HLS
+	started bool //PAT/PMT written
+}
+
+func NewTSWriter(w io.Writer) *TSWriter {
+	hls := NewHls()
+	hls.Pat = newPAT(0x1B)
+	hls.currentWriter = newCountingWriter(w, &hls.currentBytes)
+	return &TSWriter{hls: hls}
+}
+
+// WriteTag muxes tag. Sequence headers must come ahead of the frames
+// that need them.
+func (tw *TSWriter) WriteTag(tag libflv.Tag) error {
+	pes, pid, key, skip := tw.hls.toPES(tag)
+	if skip {
+		return nil
+	}
+	return tw.write(pes, pid, key)
+}
+
+// Close muxes the audio frames still held back to go in one PES.
+func (tw *TSWriter) Close() error {
+	if tw.hls.audioCache.CacheNum() == 0 {
+		return nil
+	}
+	pes := tw.hls.Pat.PMTs[libmpeg.PMT_PID].Streams[libmpeg.AUDIO_PID]
+	_, pes.PTS, pes.Data = tw.hls.audioCache.GetFrame()
+	pes.DTS = pes.PTS
+	pes.Index, pes.HeaderIndex = 0, 0
+	return tw.write(pes, libmpeg.AUDIO_PID, false)
+}
+
+func (tw *TSWriter) write(pes *libmpeg.PES, pid uint16, key bool) error {
+	if !tw.started {
+		//Not before the first frame: the PMT's video stream type is
+		//only known once the sequence header has been seen.
+		if err := tw.hls.writePSI(); err != nil {
+			return err
+		}
+		tw.started = true
+	}
+	return tw.hls.writePES(pes, pid, key)
+}
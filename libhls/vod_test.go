@@ -0,0 +1,86 @@
+package libhls
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/libmpeg"
+)
+
+func TestSplitVOD(t *testing.T) {
+	s := time.Second
+	got := SplitVOD([]time.Duration{0, s, 2 * s, 5 * s, 6 * s}, 7*s, 2*s)
+	want := []VODSegment{{0, 2 * s}, {2 * s, 5 * s}, {5 * s, 7 * s}}
+	if len(got) != len(want) {
+		t.Fatalf("segments = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("segment %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	//Audio only: every target.
+	if got := SplitVOD(nil, 5*s, 2*s); len(got) != 3 || got[2] != (VODSegment{4 * s, 5 * s}) {
+		t.Errorf("audio segments = %v", got)
+	}
+}
+
+func TestVODPlaylist(t *testing.T) {
+	out := string(VODPlaylist([]VODSegment{{0, 2500 * time.Millisecond}, {2500 * time.Millisecond, 4 * time.Second}}))
+	for _, want := range []string{
+		"#EXT-X-TARGETDURATION:3\n",
+		"#EXT-X-PLAYLIST-TYPE:VOD\n",
+		"#EXTINF:2.500,\n0.ts\n#EXTINF:1.500,\n1.ts\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("playlist missing %q:\n%s", want, out)
+		}
+	}
+	if !strings.HasSuffix(out, "#EXT-X-ENDLIST\n") {
+		t.Errorf("playlist not ended:\n%s", out)
+	}
+}
+
+func TestTSWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := NewTSWriter(buf)
+	tags := []libflv.Tag{makeAVCKeyframe(0), makeAVCInterFrame(33)}
+	for i := 0; i < 3; i++ {
+		tags = append(tags, &libflv.AudioTag{
+			TagBase:       libflv.TagBase{TagType: libflv.AUDIO_TAG, TimeStamp: uint32(i * 23)},
+			SoundFormat:   libflv.FLV_AUDIO_AAC,
+			AACPacketType: libflv.AAC_RAW,
+			SoundData:     byteFiller(10),
+		})
+	}
+	for _, tag := range tags {
+		if err := tw.WriteTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	if len(b) == 0 || len(b)%188 != 0 {
+		t.Fatalf("%d bytes, want whole TS packets", len(b))
+	}
+	pids := map[uint16]int{}
+	for i := 0; i < len(b); i += 188 {
+		if b[i] != 0x47 {
+			t.Fatalf("no sync byte at %d", i)
+		}
+		pids[uint16(b[i+1]&0x1f)<<8|uint16(b[i+2])]++
+	}
+	if pid := uint16(b[1]&0x1f)<<8 | uint16(b[2]); pid != libmpeg.PAT_PID {
+		t.Errorf("first packet has PID %d, want the PAT", pid)
+	}
+	//The three audio frames are held back for one PES, flushed by Close.
+	if pids[libmpeg.VIDEO_PID] == 0 || pids[libmpeg.AUDIO_PID] == 0 {
+		t.Errorf("packets by PID = %v, want video and audio", pids)
+	}
+}
@@ -0,0 +1,158 @@
+// Package liblog is the leveled, structured logger the GGmpeg packages
+// write to. Every server and muxer takes a Logger through a WithLogger
+// builder and defaults to Nop, so nothing is printed unless the
+// embedding program asks for it.
+package liblog
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int8
+
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+// Field is one key/value pair attached to a log line.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field { return Field{Key: key, Value: value} }
+
+func App(name string) Field      { return Field{Key: "app", Value: name} }
+func Stream(name string) Field   { return Field{Key: "stream", Value: name} }
+func Peer(addr string) Field     { return Field{Key: "peer", Value: addr} }
+func Protocol(name string) Field { return Field{Key: "protocol", Value: name} }
+func Session(id string) Field    { return Field{Key: "session", Value: id} }
+func Err(err error) Field        { return Field{Key: "error", Value: err} }
+
+// Logger is what the GGmpeg packages log through. With returns a child
+// logger that prepends fields to every line, e.g. the app and stream of
+// a connection.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	With(fields ...Field) Logger
+}
+
+type nop struct{}
+
+func (nop) Debug(string, ...Field) {}
+func (nop) Info(string, ...Field)  {}
+func (nop) Warn(string, ...Field)  {}
+func (nop) Error(string, ...Field) {}
+func (n nop) With(...Field) Logger { return n }
+
+// Nop discards everything. It is the default everywhere.
+var Nop Logger = nop{}
+
+// OrNop returns l, or Nop if l is nil.
+func OrNop(l Logger) Logger {
+	if l == nil {
+		return Nop
+	}
+	return l
+}
+
+// textLogger writes one logfmt line per call:
+//
+//	2006-01-02T15:04:05.000Z07:00 INFO publish start app=live stream=test
+type textLogger struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	min    Level
+	fields []Field
+}
+
+// New returns a Logger writing logfmt lines to w, dropping anything
+// below min.
+func New(w io.Writer, min Level) Logger {
+	return &textLogger{mu: &sync.Mutex{}, w: w, min: min}
+}
+
+func (l *textLogger) Debug(msg string, fields ...Field) { l.log(LevelDebug, msg, fields) }
+func (l *textLogger) Info(msg string, fields ...Field)  { l.log(LevelInfo, msg, fields) }
+func (l *textLogger) Warn(msg string, fields ...Field)  { l.log(LevelWarn, msg, fields) }
+func (l *textLogger) Error(msg string, fields ...Field) { l.log(LevelError, msg, fields) }
+
+func (l *textLogger) With(fields ...Field) Logger {
+	child := *l
+	child.fields = append(append([]Field{}, l.fields...), fields...)
+	return &child
+}
+
+func (l *textLogger) log(level Level, msg string, fields []Field) {
+	if level < l.min {
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(time.Now().Format("2006-01-02T15:04:05.000Z07:00"))
+	sb.WriteByte(' ')
+	sb.WriteString(level.String())
+	sb.WriteByte(' ')
+	sb.WriteString(msg)
+	for _, f := range l.fields {
+		writeField(&sb, f)
+	}
+	for _, f := range fields {
+		writeField(&sb, f)
+	}
+	sb.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = io.WriteString(l.w, sb.String())
+}
+
+func writeField(sb *strings.Builder, f Field) {
+	sb.WriteByte(' ')
+	sb.WriteString(f.Key)
+	sb.WriteByte('=')
+	var v string
+	switch x := f.Value.(type) {
+	case string:
+		v = x
+	case error:
+		if x == nil {
+			v = "<nil>"
+		} else {
+			v = x.Error()
+		}
+	case fmt.Stringer:
+		v = x.String()
+	default:
+		v = fmt.Sprint(x)
+	}
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		v = strconv.Quote(v)
+	}
+	sb.WriteString(v)
+}
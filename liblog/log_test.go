@@ -0,0 +1,32 @@
+package liblog
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTextLogger(t *testing.T) {
+	var sb strings.Builder
+	l := New(&sb, LevelInfo).With(App("live"), Stream("test"))
+	l.Debug("dropped")
+	l.Info("publish start", Peer("1.2.3.4:5"), Protocol("rtmp"))
+	l.Warn("bad thing", Err(errors.New("some error")), F("n", 3))
+
+	lines := strings.Split(strings.TrimRight(sb.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines:\n%s", len(lines), sb.String())
+	}
+	if !strings.HasSuffix(lines[0], " INFO publish start app=live stream=test peer=1.2.3.4:5 protocol=rtmp") {
+		t.Errorf("line 0: %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], ` WARN bad thing app=live stream=test error="some error" n=3`) {
+		t.Errorf("line 1: %q", lines[1])
+	}
+}
+
+func TestNop(t *testing.T) {
+	var l Logger
+	l = OrNop(l)
+	l.With(App("x")).Error("nothing happens")
+}
@@ -0,0 +1,298 @@
+// Package libmetrics is a minimal Prometheus-compatible metrics
+// registry: counters, gauges and histograms with labels, rendered in
+// the text exposition format (version 0.0.4). It covers exactly what
+// the GGmpeg servers export and pulls in no dependencies.
+package libmetrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry every GGmpeg package registers into.
+var Default = NewRegistry()
+
+// Registry owns a set of metric families.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+// family is one metric name with its HELP/TYPE and every labelled
+// series registered under it.
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64 //histograms only
+
+	mu     sync.Mutex
+	series map[string]interface{} //joined label values → *Counter / *Gauge / *Histogram
+}
+
+func (r *Registry) register(name, help string, k kind, labels []string, buckets []float64) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[name]; ok {
+		panic("libmetrics: duplicate metric " + name)
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    k,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]interface{}{},
+	}
+	r.families[name] = f
+	return f
+}
+
+// get returns the series for values, creating it with mk on first use.
+func (f *family) get(values []string, mk func() interface{}) interface{} {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("libmetrics: %s wants %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = mk()
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) delete(values []string) {
+	f.mu.Lock()
+	delete(f.series, strings.Join(values, "\xff"))
+	f.mu.Unlock()
+}
+
+func (f *family) reset() {
+	f.mu.Lock()
+	f.series = map[string]interface{}{}
+	f.mu.Unlock()
+}
+
+// atomicFloat is a float64 updated with CAS on its bit pattern.
+type atomicFloat struct{ bits uint64 }
+
+func (a *atomicFloat) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&a.bits)
+		next := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&a.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (a *atomicFloat) set(v float64) { atomic.StoreUint64(&a.bits, math.Float64bits(v)) }
+func (a *atomicFloat) load() float64 { return math.Float64frombits(atomic.LoadUint64(&a.bits)) }
+
+// Counter only goes up.
+type Counter struct{ v atomicFloat }
+
+func (c *Counter) Inc()          { c.v.add(1) }
+func (c *Counter) Add(v float64) { c.v.add(v) }
+
+// Set overwrites the value. Only meant for counters mirrored at scrape
+// time from a source that is itself monotonic (e.g. a byte meter).
+func (c *Counter) Set(v float64) { c.v.set(v) }
+
+// Gauge goes up and down.
+type Gauge struct{ v atomicFloat }
+
+func (g *Gauge) Inc()          { g.v.add(1) }
+func (g *Gauge) Dec()          { g.v.add(-1) }
+func (g *Gauge) Add(v float64) { g.v.add(v) }
+func (g *Gauge) Set(v float64) { g.v.set(v) }
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 //per bucket, non-cumulative; rendered cumulatively
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// CounterVec is a counter family partitioned by labels.
+type CounterVec struct{ f *family }
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: r.register(name, help, kindCounter, labels, nil)}
+}
+
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.f.get(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+func (v *CounterVec) Delete(values ...string) { v.f.delete(values) }
+func (v *CounterVec) Reset()                  { v.f.reset() }
+
+// GaugeVec is a gauge family partitioned by labels.
+type GaugeVec struct{ f *family }
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(name, help, kindGauge, labels, nil)}
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.f.get(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+func (v *GaugeVec) Delete(values ...string) { v.f.delete(values) }
+func (v *GaugeVec) Reset()                  { v.f.reset() }
+
+// HistogramVec is a histogram family partitioned by labels. buckets
+// are upper bounds in increasing order; +Inf is implicit.
+type HistogramVec struct{ f *family }
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{f: r.register(name, help, kindHistogram, labels, buckets)}
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.f.get(values, func() interface{} {
+		return &Histogram{buckets: v.f.buckets, counts: make([]uint64, len(v.f.buckets))}
+	}).(*Histogram)
+}
+
+// WriteTo renders every family in the Prometheus text format, sorted
+// by name and then by label values so the output is stable.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	families := make([]*family, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		families = append(families, r.families[name])
+	}
+	r.mu.Unlock()
+
+	var sb strings.Builder
+	for _, f := range families {
+		f.write(&sb)
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+// Handler serves the registry at whatever path it's mounted on.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+func (f *family) write(sb *strings.Builder) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]interface{}, len(keys))
+	for i, k := range keys {
+		series[i] = f.series[k]
+	}
+	f.mu.Unlock()
+
+	fmt.Fprintf(sb, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(sb, "# TYPE %s %s\n", f.name, f.kind)
+	for i, s := range series {
+		var values []string
+		if len(f.labels) > 0 {
+			values = strings.Split(keys[i], "\xff")
+		}
+		switch m := s.(type) {
+		case *Counter:
+			fmt.Fprintf(sb, "%s%s %s\n", f.name, labelString(f.labels, values, "", ""), formatFloat(m.v.load()))
+		case *Gauge:
+			fmt.Fprintf(sb, "%s%s %s\n", f.name, labelString(f.labels, values, "", ""), formatFloat(m.v.load()))
+		case *Histogram:
+			m.mu.Lock()
+			var cum uint64
+			for j, le := range m.buckets {
+				cum += m.counts[j]
+				fmt.Fprintf(sb, "%s_bucket%s %d\n", f.name, labelString(f.labels, values, "le", formatFloat(le)), cum)
+			}
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", f.name, labelString(f.labels, values, "le", "+Inf"), m.count)
+			fmt.Fprintf(sb, "%s_sum%s %s\n", f.name, labelString(f.labels, values, "", ""), formatFloat(m.sum))
+			fmt.Fprintf(sb, "%s_count%s %d\n", f.name, labelString(f.labels, values, "", ""), m.count)
+			m.mu.Unlock()
+		}
+	}
+}
+
+// labelString renders {a="x",b="y"}, optionally with one extra pair
+// (the histogram "le"). Returns "" when there are no labels at all.
+func labelString(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+escapeLabel(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
@@ -0,0 +1,77 @@
+package libmetrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistry_TextFormat(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("x_total", "Things seen.", "kind")
+	g := r.NewGaugeVec("y", "Current things.")
+	h := r.NewHistogramVec("z_seconds", "Durations.", []float64{1, 2})
+
+	c.With("a").Inc()
+	c.With("a").Add(2)
+	c.With(`q"uote`).Inc()
+	g.With().Set(5)
+	g.With().Dec()
+	h.With().Observe(0.5)
+	h.With().Observe(1.5)
+	h.With().Observe(9)
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	got := sb.String()
+	want := `# HELP x_total Things seen.
+# TYPE x_total counter
+x_total{kind="a"} 3
+x_total{kind="q\"uote"} 1
+# HELP y Current things.
+# TYPE y gauge
+y 4
+# HELP z_seconds Durations.
+# TYPE z_seconds histogram
+z_seconds_bucket{le="1"} 1
+z_seconds_bucket{le="2"} 2
+z_seconds_bucket{le="+Inf"} 3
+z_seconds_sum 11
+z_seconds_count 3
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestVec_DeleteAndReset(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGaugeVec("g", "help", "room")
+	g.With("a").Set(1)
+	g.With("b").Set(2)
+	g.Delete("a")
+
+	var sb strings.Builder
+	_, _ = r.WriteTo(&sb)
+	if strings.Contains(sb.String(), `room="a"`) || !strings.Contains(sb.String(), `g{room="b"} 2`) {
+		t.Errorf("after Delete:\n%s", sb.String())
+	}
+	g.Reset()
+	sb.Reset()
+	_, _ = r.WriteTo(&sb)
+	if strings.Contains(sb.String(), `room="b"`) {
+		t.Errorf("after Reset:\n%s", sb.String())
+	}
+}
+
+func TestRegister_DuplicatePanics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("dup", "")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic on duplicate name")
+		}
+	}()
+	r.NewGaugeVec("dup", "")
+}
@@ -1,7 +1,10 @@
 // Package libmp4 emits the subset of ISO/IEC 14496-12 (and 14496-15
 // for AVC-in-MP4) needed to produce CMAF-style fragmented MP4 streams:
 // an init segment (ftyp + moov) plus a sequence of media segments
-// (moof + mdat). Supports H.264 video and AAC-LC audio only.
+// (moof + mdat), and the head of a progressive file with full sample
+// tables (BuildMovie). ReadMovie goes the other way, indexing the
+// samples of an existing file. Supports H.264/H.265 video and AAC-LC
+// audio only.
 //
 // References:
 //   - ISO/IEC 14496-12:2015 (ISO Base Media File Format)
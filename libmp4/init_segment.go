@@ -1,9 +1,9 @@
 package libmp4
 
-// InitSegmentParams describes one video track's init-segment metadata.
-// Audio is intentionally omitted from this minimal implementation —
-// browsers like Shaka Player will play video-only DASH just fine, and
-// supporting audio doubles the box-set this file emits.
+// InitSegmentParams describes one video track's init-segment metadata,
+// plus an optional AAC track in Audio. Samples only matter to
+// BuildMovie: an init segment's sample tables are empty, the samples
+// being described by each fragment's trun instead.
 type InitSegmentParams struct {
 	TrackID  uint32 //must be > 0; conventionally 1
 	Timescale uint32 //units per second (e.g. 90000 for video PTS)
@@ -11,6 +11,9 @@ type InitSegmentParams struct {
 	Height    uint16
 	SPS       []byte //one SPS NAL (without the 0x000001 start code)
 	PPS       []byte //one PPS NAL (without the 0x000001 start code)
+	AVCCRecord []byte //publisher's AVCDecoderConfigurationRecord; when set, used as-is instead of SPS/PPS
+	Samples    []Sample
+	Audio      *AudioParams
 }
 
 // BuildInitSegment returns a CMAF-compliant initialisation segment
@@ -22,10 +25,46 @@ type InitSegmentParams struct {
 func BuildInitSegment(p InitSegmentParams) []byte {
 	out := []byte{}
 	out = append(out, ftyp()...)
-	out = append(out, moov(p)...)
+	out = append(out, moov(p.tracks(), true, 0)...)
 	return out
 }
 
+// track is what a trak box needs to know, whatever the codec.
+type track struct {
+	id        uint32
+	timescale uint32
+	sound     bool //audio track: smhd instead of vmhd, volume in tkhd
+	width     uint16
+	height    uint16
+	entry     []byte //SampleEntry for stsd
+	samples   []Sample
+}
+
+func (p InitSegmentParams) tracks() []track {
+	record := p.AVCCRecord
+	if record == nil {
+		record = avcCRecord(p.SPS, p.PPS)
+	}
+	return withAudio(track{
+		id:        p.TrackID,
+		timescale: p.Timescale,
+		width:     p.Width,
+		height:    p.Height,
+		entry:     visualSampleEntry("avc1", p.Width, p.Height, Box{Type: FourCC("avcC"), Body: record}.Bytes()),
+		samples:   p.Samples,
+	}, p.Audio)
+}
+
+// duration is the sum of the track's sample durations, in its own
+// timescale.
+func (t track) duration() uint64 {
+	var d uint64
+	for _, s := range t.samples {
+		d += uint64(s.Duration)
+	}
+	return d
+}
+
 // ftyp identifies this as a CMAF track file. Major brand "iso6" and
 // compatibility brands "iso6 mp41 cmfc" cover Shaka Player, dash.js,
 // hls.js, native macOS/iOS Safari (the last via fMP4-HLS).
@@ -39,24 +78,45 @@ func ftyp() []byte {
 	return Box{Type: FourCC("ftyp"), Body: body}.Bytes()
 }
 
-// moov is the top-level header for the init segment.
-func moov(p InitSegmentParams) []byte {
-	return container("moov",
-		mvhd(p.Timescale),
-		trak(p),
-		mvex(p.TrackID),
-	)
+// moov is the top-level header. Fragmented files get empty sample
+// tables and an mvex; progressive ones full tables, with chunk offsets
+// moved on by shift, and their durations. The first track's timescale
+// is the movie's.
+func moov(tracks []track, fragmented bool, shift uint64) []byte {
+	var duration uint64
+	children := [][]byte{nil}
+	var ids []uint32
+	next := uint32(1)
+	for _, t := range tracks {
+		var d uint64
+		if !fragmented {
+			d = t.duration() * uint64(tracks[0].timescale) / uint64(t.timescale)
+		}
+		if d > duration {
+			duration = d
+		}
+		children = append(children, trak(t, d, fragmented, shift))
+		ids = append(ids, t.id)
+		if t.id >= next {
+			next = t.id + 1
+		}
+	}
+	children[0] = mvhd(tracks[0].timescale, duration, next)
+	if fragmented {
+		children = append(children, mvex(ids))
+	}
+	return container("moov", children...)
 }
 
 // mvhd carries movie-wide defaults. We use version 1 so timestamp /
 // duration fields are 64 bits — useful when timescale is 90000 and
 // stream length isn't known up front.
-func mvhd(timescale uint32) []byte {
+func mvhd(timescale uint32, duration uint64, nextTrackID uint32) []byte {
 	body := FullBoxHeader(1, 0)
 	body = appendU64(body, 0)               //creation_time
 	body = appendU64(body, 0)               //modification_time
 	body = appendU32(body, timescale)       //timescale
-	body = appendU64(body, 0)               //duration (0 = unknown / live)
+	body = appendU64(body, duration)        //duration (0 = unknown / live)
 	body = appendU32(body, 0x00010000)      //rate (1.0)
 	body = appendU16(body, 0x0100)          //volume (1.0)
 	body = appendU16(body, 0)               //reserved
@@ -66,47 +126,60 @@ func mvhd(timescale uint32) []byte {
 		body = appendU32(body, v)
 	}
 	body = append(body, make([]byte, 24)...) //pre_defined (6 × uint32)
-	body = appendU32(body, 2)                //next_track_ID
+	body = appendU32(body, nextTrackID)      //next_track_ID
 	return Box{Type: FourCC("mvhd"), Body: body}.Bytes()
 }
 
-func trak(p InitSegmentParams) []byte {
-	return container("trak", tkhd(p), mdia(p))
+func trak(t track, duration uint64, fragmented bool, shift uint64) []byte {
+	return container("trak", tkhd(t, duration), mdia(t, fragmented, shift))
 }
 
-// tkhd flags 0x07 = enabled | in-movie | in-preview.
-func tkhd(p InitSegmentParams) []byte {
+// tkhd flags 0x07 = enabled | in-movie | in-preview. duration is in
+// the movie's timescale.
+func tkhd(t track, duration uint64) []byte {
+	var volume uint16
+	if t.sound {
+		volume = 0x0100 //1.0
+	}
 	body := FullBoxHeader(1, 0x000007)
-	body = appendU64(body, 0)         //creation_time
-	body = appendU64(body, 0)         //modification_time
-	body = appendU32(body, p.TrackID) //track_ID
-	body = appendU32(body, 0)         //reserved
-	body = appendU64(body, 0)         //duration
+	body = appendU64(body, 0)        //creation_time
+	body = appendU64(body, 0)        //modification_time
+	body = appendU32(body, t.id)     //track_ID
+	body = appendU32(body, 0)        //reserved
+	body = appendU64(body, duration) //duration
 	body = append(body, make([]byte, 8)...)
-	body = appendU16(body, 0) //layer
-	body = appendU16(body, 0) //alternate_group
-	body = appendU16(body, 0) //volume (audio only)
-	body = appendU16(body, 0) //reserved
+	body = appendU16(body, 0)      //layer
+	body = appendU16(body, 0)      //alternate_group
+	body = appendU16(body, volume) //volume (audio only)
+	body = appendU16(body, 0)      //reserved
 	for _, v := range [9]uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000} {
 		body = appendU32(body, v)
 	}
-	body = appendU32(body, uint32(p.Width)<<16)  //width as 16.16
-	body = appendU32(body, uint32(p.Height)<<16) //height as 16.16
+	body = appendU32(body, uint32(t.width)<<16)  //width as 16.16
+	body = appendU32(body, uint32(t.height)<<16) //height as 16.16
 	return Box{Type: FourCC("tkhd"), Body: body}.Bytes()
 }
 
-func mdia(p InitSegmentParams) []byte {
-	return container("mdia", mdhd(p.Timescale), hdlr("vide", "VideoHandler"), minf(p))
+func mdia(t track, fragmented bool, shift uint64) []byte {
+	var duration uint64
+	if !fragmented {
+		duration = t.duration()
+	}
+	handler := hdlr("vide", "VideoHandler")
+	if t.sound {
+		handler = hdlr("soun", "SoundHandler")
+	}
+	return container("mdia", mdhd(t.timescale, duration), handler, minf(t, shift))
 }
 
-func mdhd(timescale uint32) []byte {
+func mdhd(timescale uint32, duration uint64) []byte {
 	body := FullBoxHeader(1, 0)
 	body = appendU64(body, 0)
 	body = appendU64(body, 0)
 	body = appendU32(body, timescale)
-	body = appendU64(body, 0)         //duration
-	body = appendU16(body, 0x55c4)    //language code 'und' (5*32+0x800=0x55c4)
-	body = appendU16(body, 0)         //pre_defined
+	body = appendU64(body, duration) //duration
+	body = appendU16(body, 0x55c4)   //language code 'und' (5*32+0x800=0x55c4)
+	body = appendU16(body, 0)        //pre_defined
 	return Box{Type: FourCC("mdhd"), Body: body}.Bytes()
 }
 
@@ -120,8 +193,12 @@ func hdlr(handlerType, name string) []byte {
 	return Box{Type: FourCC("hdlr"), Body: body}.Bytes()
 }
 
-func minf(p InitSegmentParams) []byte {
-	return container("minf", vmhd(), dinf(), stbl(p))
+func minf(t track, shift uint64) []byte {
+	header := vmhd()
+	if t.sound {
+		header = smhd()
+	}
+	return container("minf", header, dinf(), stbl(t, shift))
 }
 
 func vmhd() []byte {
@@ -146,50 +223,40 @@ func dref() []byte {
 	return Box{Type: FourCC("dref"), Body: body}.Bytes()
 }
 
-func stbl(p InitSegmentParams) []byte {
-	//For fragmented MP4 the stsd describes the codec; the empty
+func stbl(t track, shift uint64) []byte {
+	//For fragmented MP4 the stsd describes the codec; the
 	//stts/stsc/stsz/stco lists are required by spec but contain
 	//zero entries because the actual sample tables live in moof/trun.
-	return container("stbl",
-		stsd(p),
-		emptyFullBox("stts"),
-		emptyFullBox("stsc"),
-		emptyStsz(),
-		emptyFullBox("stco"),
-	)
-}
-
-func emptyFullBox(typ string) []byte {
-	body := FullBoxHeader(0, 0)
-	body = appendU32(body, 0) //entry_count
-	return Box{Type: FourCC(typ), Body: body}.Bytes()
-}
-
-func emptyStsz() []byte {
-	body := FullBoxHeader(0, 0)
-	body = appendU32(body, 0) //sample_size (0 => per-sample sizes)
-	body = appendU32(body, 0) //sample_count
-	return Box{Type: FourCC("stsz"), Body: body}.Bytes()
+	//ctts and stss are only written when they say something.
+	children := [][]byte{stsd(t.entry), stts(t.samples)}
+	if b := ctts(t.samples); b != nil {
+		children = append(children, b)
+	}
+	if b := stss(t.samples); b != nil {
+		children = append(children, b)
+	}
+	children = append(children, stsc(t.samples), stsz(t.samples), stco(t.samples, shift))
+	return container("stbl", children...)
 }
 
-func stsd(p InitSegmentParams) []byte {
+func stsd(entry []byte) []byte {
 	body := FullBoxHeader(0, 0)
 	body = appendU32(body, 1) //entry_count
-	body = append(body, avc1(p)...)
+	body = append(body, entry...)
 	return Box{Type: FourCC("stsd"), Body: body}.Bytes()
 }
 
-// avc1 is the SampleEntry for H.264. It contains a fixed 78-byte
-// VisualSampleEntry header followed by an avcC sub-box describing the
-// SPS/PPS.
-func avc1(p InitSegmentParams) []byte {
+// visualSampleEntry is the SampleEntry for a video codec (avc1,
+// hev1…). It contains a fixed 78-byte VisualSampleEntry header
+// followed by the codec's configuration box (avcC, hvcC…).
+func visualSampleEntry(fourcc string, width, height uint16, config []byte) []byte {
 	body := []byte{}
 	body = append(body, make([]byte, 6)...) //reserved
 	body = appendU16(body, 1)               //data_reference_index
 
 	body = append(body, make([]byte, 16)...) //pre_defined + reserved + pre_defined
-	body = appendU16(body, p.Width)
-	body = appendU16(body, p.Height)
+	body = appendU16(body, width)
+	body = appendU16(body, height)
 	body = appendU32(body, 0x00480000) //horizresolution = 72 dpi
 	body = appendU32(body, 0x00480000) //vertresolution
 	body = appendU32(body, 0)          //reserved
@@ -198,14 +265,15 @@ func avc1(p InitSegmentParams) []byte {
 	body = appendU16(body, 0x0018)                  //depth (24)
 	body = appendU16(body, 0xffff)                  //pre_defined = -1
 
-	body = append(body, avcC(p.SPS, p.PPS)...)
-	return Box{Type: FourCC("avc1"), Body: body}.Bytes()
+	body = append(body, config...)
+	return Box{Type: FourCC(fourcc), Body: body}.Bytes()
 }
 
-// avcC packs an AVCDecoderConfigurationRecord per ISO 14496-15 §5.2.4.
-func avcC(sps, pps []byte) []byte {
+// avcCRecord packs an AVCDecoderConfigurationRecord per ISO 14496-15
+// §5.2.4.
+func avcCRecord(sps, pps []byte) []byte {
 	if len(sps) < 4 {
-		return Box{Type: FourCC("avcC")}.Bytes()
+		return nil
 	}
 	body := []byte{}
 	body = appendU8(body, 1)         //configurationVersion
@@ -219,11 +287,15 @@ func avcC(sps, pps []byte) []byte {
 	body = appendU8(body, 1) //numOfPictureParameterSets
 	body = appendU16(body, uint16(len(pps)))
 	body = append(body, pps...)
-	return Box{Type: FourCC("avcC"), Body: body}.Bytes()
+	return body
 }
 
-func mvex(trackID uint32) []byte {
-	return container("mvex", trex(trackID))
+func mvex(trackIDs []uint32) []byte {
+	children := [][]byte{}
+	for _, id := range trackIDs {
+		children = append(children, trex(id))
+	}
+	return container("mvex", children...)
 }
 
 // trex carries default sample values referenced by per-fragment trun.
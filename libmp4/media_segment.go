@@ -10,16 +10,28 @@ type Sample struct {
 	IsKey                 bool
 	CompositionTimeOffset int32 //may be negative on bidirectional GOPs
 	Data                  []byte
+	Offset                uint64 //BuildMovie only: where the sample starts in the media data
+	DecodeTime            uint64 //ReadMovie only
 }
 
 // MediaSegmentParams describes one fragment (moof + mdat). BaseDecodeTime
 // is the cumulative DTS in track timescale up to (but not including)
-// the first sample of this fragment.
+// the first sample of this fragment. Audio, when set, adds the audio
+// track's samples for the same stretch of time.
 type MediaSegmentParams struct {
 	TrackID         uint32
 	SequenceNumber  uint32
 	BaseDecodeTime  uint64
 	Samples         []Sample
+	Audio           *TrackFragment
+}
+
+// TrackFragment is a further track's share of a fragment: a traf of
+// its own, with the sample data after the previous track's in mdat.
+type TrackFragment struct {
+	TrackID        uint32
+	BaseDecodeTime uint64
+	Samples        []Sample
 }
 
 // BuildMediaSegment serialises a CMAF media segment — moof followed by
@@ -27,22 +39,31 @@ type MediaSegmentParams struct {
 // flag is set per CMAF rules so trun byte offsets are relative to the
 // start of moof.
 func BuildMediaSegment(p MediaSegmentParams) []byte {
-	if len(p.Samples) == 0 {
+	runs := []TrackFragment{}
+	if len(p.Samples) > 0 {
+		runs = append(runs, TrackFragment{TrackID: p.TrackID, BaseDecodeTime: p.BaseDecodeTime, Samples: p.Samples})
+	}
+	if p.Audio != nil && len(p.Audio.Samples) > 0 {
+		runs = append(runs, *p.Audio)
+	}
+	if len(runs) == 0 {
 		return nil
 	}
 
 	mdatBody := []byte{}
-	for _, s := range p.Samples {
-		mdatBody = append(mdatBody, s.Data...)
+	for _, run := range runs {
+		for _, s := range run.Samples {
+			mdatBody = append(mdatBody, s.Data...)
+		}
 	}
 	mdat := Box{Type: FourCC("mdat"), Body: mdatBody}.Bytes()
 
 	//Build moof first with a placeholder data_offset of 0, calculate
 	//the real offset (= len(moof) + 8 bytes for mdat size+type), then
 	//patch the trun's data_offset field. Cleaner than a 2-pass build.
-	moof := buildMoof(p, 0)
+	moof := buildMoof(p.SequenceNumber, runs, 0)
 	dataOffset := len(moof) + 8
-	moof = buildMoof(p, int32(dataOffset))
+	moof = buildMoof(p.SequenceNumber, runs, int32(dataOffset))
 
 	out := make([]byte, 0, len(moof)+len(mdat))
 	out = append(out, moof...)
@@ -50,11 +71,17 @@ func BuildMediaSegment(p MediaSegmentParams) []byte {
 	return out
 }
 
-func buildMoof(p MediaSegmentParams, dataOffset int32) []byte {
-	return container("moof",
-		mfhd(p.SequenceNumber),
-		traf(p, dataOffset),
-	)
+// buildMoof lays out one traf per run; each run's data follows the
+// previous run's, starting dataOffset bytes from the moof.
+func buildMoof(seq uint32, runs []TrackFragment, dataOffset int32) []byte {
+	children := [][]byte{mfhd(seq)}
+	for _, run := range runs {
+		children = append(children, traf(run, dataOffset))
+		for _, s := range run.Samples {
+			dataOffset += int32(len(s.Data))
+		}
+	}
+	return container("moof", children...)
 }
 
 func mfhd(seq uint32) []byte {
@@ -63,11 +90,11 @@ func mfhd(seq uint32) []byte {
 	return Box{Type: FourCC("mfhd"), Body: body}.Bytes()
 }
 
-func traf(p MediaSegmentParams, dataOffset int32) []byte {
+func traf(run TrackFragment, dataOffset int32) []byte {
 	return container("traf",
-		tfhd(p.TrackID),
-		tfdt(p.BaseDecodeTime),
-		trun(p.Samples, dataOffset),
+		tfhd(run.TrackID),
+		tfdt(run.BaseDecodeTime),
+		trun(run.Samples, dataOffset),
 	)
 }
 
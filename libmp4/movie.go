@@ -0,0 +1,324 @@
+package libmp4
+
+import (
+	"errors"
+	"math"
+)
+
+// AudioParams describes an AAC track carried alongside the video.
+// Timescale is the sample rate; see ParseAudioSpecificConfig.
+type AudioParams struct {
+	TrackID    uint32
+	SampleRate uint32
+	Channels   uint16
+	Config     []byte //AudioSpecificConfig, as in the FLV AAC sequence header
+	Samples    []Sample
+}
+
+// aacSampleRates indexes sampling_frequency_index, ISO 14496-3
+// §1.6.3.4.
+var aacSampleRates = [...]uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// ParseAudioSpecificConfig reads the sample rate and channel count out
+// of an AudioSpecificConfig (ISO 14496-3 §1.6.2.1).
+func ParseAudioSpecificConfig(b []byte) (sampleRate uint32, channels uint16, err error) {
+	if len(b) < 2 {
+		return 0, 0, errors.New("AudioSpecificConfig too short")
+	}
+	//audioObjectType(5) samplingFrequencyIndex(4) [samplingFrequency(24)]
+	//channelConfiguration(4)
+	bits := uint64(0)
+	for i := 0; i < 8; i++ {
+		bits <<= 8
+		if i < len(b) {
+			bits |= uint64(b[i])
+		}
+	}
+	index := bits >> 55 & 0x0f
+	bits <<= 9
+	switch {
+	case index == 0x0f:
+		if len(b) < 5 {
+			return 0, 0, errors.New("AudioSpecificConfig too short")
+		}
+		sampleRate = uint32(bits >> 40)
+		bits <<= 24
+	case int(index) < len(aacSampleRates):
+		sampleRate = aacSampleRates[index]
+	default:
+		return 0, 0, errors.New("reserved AAC sampling frequency index")
+	}
+	channels = uint16(bits >> 60)
+	if channels == 7 {
+		channels = 8 //configuration 7 is 7.1
+	}
+	return sampleRate, channels, nil
+}
+
+func withAudio(video track, audio *AudioParams) []track {
+	if audio == nil {
+		return []track{video}
+	}
+	return []track{video, {
+		id:        audio.TrackID,
+		timescale: audio.SampleRate,
+		sound:     true,
+		entry:     mp4a(*audio),
+		samples:   audio.Samples,
+	}}
+}
+
+// mp4a is the AudioSampleEntry for AAC: a 28-byte header followed by
+// an esds holding the AudioSpecificConfig.
+func mp4a(p AudioParams) []byte {
+	rate := p.SampleRate << 16 //16.16; rates past 65535 don't fit
+	if p.SampleRate > 0xffff {
+		rate = 0
+	}
+	body := []byte{}
+	body = append(body, make([]byte, 6)...) //reserved
+	body = appendU16(body, 1)               //data_reference_index
+	body = append(body, make([]byte, 8)...) //reserved (2 × uint32)
+	body = appendU16(body, p.Channels)
+	body = appendU16(body, 16) //samplesize
+	body = appendU16(body, 0)  //pre_defined
+	body = appendU16(body, 0)  //reserved
+	body = appendU32(body, rate)
+	body = append(body, esds(p.TrackID, p.Config)...)
+	return Box{Type: FourCC("mp4a"), Body: body}.Bytes()
+}
+
+// esds carries an ES_Descriptor (ISO 14496-1 §7.2.6.5) for an AAC
+// elementary stream.
+func esds(esID uint32, config []byte) []byte {
+	decoderConfig := []byte{}
+	decoderConfig = appendU8(decoderConfig, 0x40)      //objectTypeIndication: MPEG-4 audio
+	decoderConfig = appendU8(decoderConfig, 0x05<<2|1) //streamType audio, upStream 0, reserved 1
+	decoderConfig = appendU24(decoderConfig, 0)        //bufferSizeDB
+	decoderConfig = appendU32(decoderConfig, 0)        //maxBitrate
+	decoderConfig = appendU32(decoderConfig, 0)        //avgBitrate
+	decoderConfig = append(decoderConfig, descriptor(0x05, config)...)
+
+	es := []byte{}
+	es = appendU16(es, uint16(esID))
+	es = appendU8(es, 0) //no dependsOn, URL or OCR stream
+	es = append(es, descriptor(0x04, decoderConfig)...)
+	es = append(es, descriptor(0x06, []byte{0x02})...) //SLConfigDescriptor, predefined for MP4
+
+	body := FullBoxHeader(0, 0)
+	body = append(body, descriptor(0x03, es)...)
+	return Box{Type: FourCC("esds"), Body: body}.Bytes()
+}
+
+// descriptor emits an MPEG-4 descriptor: tag, size in 7-bit groups,
+// body.
+func descriptor(tag uint8, body []byte) []byte {
+	out := []byte{tag}
+	n := len(body)
+	for shift := 21; shift > 0; shift -= 7 {
+		if n>>shift > 0 {
+			out = append(out, byte(n>>shift&0x7f)|0x80)
+		}
+	}
+	out = append(out, byte(n&0x7f))
+	return append(out, body...)
+}
+
+func smhd() []byte {
+	body := FullBoxHeader(0, 0)
+	body = appendU16(body, 0) //balance
+	body = appendU16(body, 0) //reserved
+	return Box{Type: FourCC("smhd"), Body: body}.Bytes()
+}
+
+// stts run-length codes the sample durations.
+func stts(samples []Sample) []byte {
+	entries := []byte{}
+	count := uint32(0)
+	for i, s := range samples {
+		count++
+		if i+1 == len(samples) || samples[i+1].Duration != s.Duration {
+			entries = appendU32(entries, count)
+			entries = appendU32(entries, s.Duration)
+			count = 0
+		}
+	}
+	body := FullBoxHeader(0, 0)
+	body = appendU32(body, uint32(len(entries)/8)) //entry_count
+	body = append(body, entries...)
+	return Box{Type: FourCC("stts"), Body: body}.Bytes()
+}
+
+// ctts run-length codes composition offsets, or is nil if there are
+// none. Version 1 so offsets may be negative.
+func ctts(samples []Sample) []byte {
+	entries := []byte{}
+	reordered := false
+	count := uint32(0)
+	for i, s := range samples {
+		reordered = reordered || s.CompositionTimeOffset != 0
+		count++
+		if i+1 == len(samples) || samples[i+1].CompositionTimeOffset != s.CompositionTimeOffset {
+			entries = appendU32(entries, count)
+			entries = appendU32(entries, uint32(s.CompositionTimeOffset))
+			count = 0
+		}
+	}
+	if !reordered {
+		return nil
+	}
+	body := FullBoxHeader(1, 0)
+	body = appendU32(body, uint32(len(entries)/8)) //entry_count
+	body = append(body, entries...)
+	return Box{Type: FourCC("ctts"), Body: body}.Bytes()
+}
+
+// stss lists the sync samples, or is nil if every sample is one.
+func stss(samples []Sample) []byte {
+	entries := []byte{}
+	all := true
+	for i, s := range samples {
+		if s.IsKey {
+			entries = appendU32(entries, uint32(i+1))
+		} else {
+			all = false
+		}
+	}
+	if all {
+		return nil
+	}
+	body := FullBoxHeader(0, 0)
+	body = appendU32(body, uint32(len(entries)/4)) //entry_count
+	body = append(body, entries...)
+	return Box{Type: FourCC("stss"), Body: body}.Bytes()
+}
+
+// chunks splits samples into runs stored back to back, returning the
+// number of samples in each.
+func chunks(samples []Sample) []uint32 {
+	var out []uint32
+	for i, s := range samples {
+		if i == 0 || s.Offset != samples[i-1].Offset+uint64(samples[i-1].Size) {
+			out = append(out, 0)
+		}
+		out[len(out)-1]++
+	}
+	return out
+}
+
+// stsc maps chunks to their sample counts, one entry per change.
+func stsc(samples []Sample) []byte {
+	entries := []byte{}
+	prev := uint32(0)
+	for i, n := range chunks(samples) {
+		if n == prev {
+			continue
+		}
+		entries = appendU32(entries, uint32(i+1)) //first_chunk
+		entries = appendU32(entries, n)           //samples_per_chunk
+		entries = appendU32(entries, 1)           //sample_description_index
+		prev = n
+	}
+	body := FullBoxHeader(0, 0)
+	body = appendU32(body, uint32(len(entries)/12)) //entry_count
+	body = append(body, entries...)
+	return Box{Type: FourCC("stsc"), Body: body}.Bytes()
+}
+
+func stsz(samples []Sample) []byte {
+	body := FullBoxHeader(0, 0)
+	body = appendU32(body, 0) //sample_size (0 => per-sample sizes)
+	body = appendU32(body, uint32(len(samples)))
+	for _, s := range samples {
+		body = appendU32(body, s.Size)
+	}
+	return Box{Type: FourCC("stsz"), Body: body}.Bytes()
+}
+
+// stco lists where each chunk starts in the file, shift being where
+// the media data starts. It becomes a co64 once offsets pass 4 GiB.
+func stco(samples []Sample, shift uint64) []byte {
+	var offsets []uint64
+	at := 0
+	for _, n := range chunks(samples) {
+		offsets = append(offsets, shift+samples[at].Offset)
+		at += int(n)
+	}
+	large := len(offsets) > 0 && offsets[len(offsets)-1] > math.MaxUint32
+	body := FullBoxHeader(0, 0)
+	body = appendU32(body, uint32(len(offsets))) //entry_count
+	for _, off := range offsets {
+		if large {
+			body = appendU64(body, off)
+		} else {
+			body = appendU32(body, uint32(off))
+		}
+	}
+	if large {
+		return Box{Type: FourCC("co64"), Body: body}.Bytes()
+	}
+	return Box{Type: FourCC("stco"), Body: body}.Bytes()
+}
+
+// BuildMovie returns the head of a progressive MP4 with its moov ahead
+// of the media ("faststart"): ftyp, moov holding every sample's table
+// entries, and the mdat box header. All that is left to write after it
+// is the samples' data, laid out as their Offsets say; Offset counts
+// from the start of that data.
+func BuildMovie(p InitSegmentParams) []byte {
+	return buildMovie("avc1", p.tracks())
+}
+
+// BuildHEVCMovie is BuildMovie for H.265. The sample entry is hvc1,
+// the only HEVC flavour Safari plays from a progressive file.
+func BuildHEVCMovie(p HEVCInitParams) []byte {
+	return buildMovie("hvc1", p.tracks("hvc1"))
+}
+
+func buildMovie(brand string, tracks []track) []byte {
+	var size uint64
+	for _, t := range tracks {
+		for _, s := range t.samples {
+			if end := s.Offset + uint64(s.Size); end > size {
+				size = end
+			}
+		}
+	}
+	mdat := appendU32(nil, uint32(8+size))
+	mdat = append(mdat, "mdat"...)
+	if 8+size > math.MaxUint32 {
+		//size 1: the real one follows as a 64-bit largesize.
+		mdat = appendU32(nil, 1)
+		mdat = append(mdat, "mdat"...)
+		mdat = appendU64(mdat, 16+size)
+	}
+
+	head := progressiveFtyp(brand)
+	//Chunk offsets depend on the moov's size, which grows if they
+	//switch to 64 bits; settle it by rebuilding until it stops moving.
+	var movie []byte
+	for shift := uint64(0); ; {
+		movie = moov(tracks, false, shift)
+		next := uint64(len(head) + len(movie) + len(mdat))
+		if next == shift {
+			break
+		}
+		shift = next
+	}
+	out := make([]byte, 0, len(head)+len(movie)+len(mdat))
+	out = append(out, head...)
+	out = append(out, movie...)
+	return append(out, mdat...)
+}
+
+// progressiveFtyp is the ftyp of a plain, non-fragmented MP4.
+func progressiveFtyp(brand string) []byte {
+	body := []byte{}
+	body = append(body, []byte("isom")...) //major brand
+	body = appendU32(body, 0x200)          //minor version
+	body = append(body, []byte("isom")...) //compatible
+	body = append(body, []byte("iso2")...)
+	body = append(body, []byte(brand)...)
+	body = append(body, []byte("mp41")...)
+	return Box{Type: FourCC("ftyp"), Body: body}.Bytes()
+}
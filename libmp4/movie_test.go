@@ -0,0 +1,126 @@
+package libmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestBuildMovie_SampleTables(t *testing.T) {
+	//One chunk of two video samples, then one of two audio samples.
+	data := []byte("KEYxPxxxAAbb")
+	out := BuildMovie(InitSegmentParams{
+		TrackID:    1,
+		Timescale:  90000,
+		AVCCRecord: []byte{1, 0x4d, 0x40, 0x28, 0xff, 0xe0, 0},
+		Samples: []Sample{
+			{Duration: 3000, Size: 3, IsKey: true, Offset: 0},
+			{Duration: 3000, Size: 5, CompositionTimeOffset: 3000, Offset: 3},
+		},
+		Audio: &AudioParams{
+			TrackID:    2,
+			SampleRate: 44100,
+			Channels:   2,
+			Config:     []byte{0x12, 0x10},
+			Samples: []Sample{
+				{Duration: 1024, Size: 2, IsKey: true, Offset: 8},
+				{Duration: 1024, Size: 2, IsKey: true, Offset: 10},
+			},
+		},
+	})
+	file := append(out, data...)
+
+	typ, sz, _ := readBox(t, file, 0)
+	if typ != "ftyp" {
+		t.Fatalf("first box = %q, want ftyp", typ)
+	}
+	typ, moovSize, moovBody := readBox(t, file, int(sz))
+	if typ != "moov" {
+		t.Fatalf("second box = %q, want moov", typ)
+	}
+	if findBox(t, moovBody, "mvex") != nil {
+		t.Error("progressive moov has an mvex")
+	}
+	typ, _, mdat := readBox(t, file, int(sz+moovSize))
+	if typ != "mdat" || !bytes.Equal(mdat, data) {
+		t.Fatalf("moov isn't followed by an mdat of the sample data")
+	}
+	//mvhd v1: duration follows the header, two 64-bit times and the
+	//timescale.
+	if d := binary.BigEndian.Uint64(findBox(t, moovBody, "mvhd")[24:]); d != 6000 {
+		t.Errorf("movie duration = %d, want 6000", d)
+	}
+
+	var traks [][]byte
+	for off := 0; off < len(moovBody); {
+		typ, size, body := readBox(t, moovBody, off)
+		if typ == "trak" {
+			traks = append(traks, body)
+		}
+		off += int(size)
+	}
+	if len(traks) != 2 {
+		t.Fatalf("moov has %d traks, want video and audio", len(traks))
+	}
+	stbl := func(trak []byte) []byte {
+		return findBox(t, findBox(t, findBox(t, trak, "mdia"), "minf"), "stbl")
+	}
+	video, audio := stbl(traks[0]), stbl(traks[1])
+
+	for name, want := range map[string][]uint32{
+		"stts": {1, 2, 3000},       //entry_count, then count/delta
+		"stss": {1, 1},             //sample 1 is the only sync sample
+		"stsc": {1, 1, 2, 1},       //chunk 1 onwards: 2 samples each
+		"stsz": {0, 2, 3, 5},       //per-sample sizes
+		"ctts": {2, 1, 0, 1, 3000}, //entry_count, then count/offset
+	} {
+		box := findBox(t, video, name)
+		if box == nil {
+			t.Errorf("video stbl missing %s", name)
+			continue
+		}
+		for i, w := range want {
+			if got := binary.BigEndian.Uint32(box[4+4*i:]); got != w {
+				t.Errorf("%s field %d = %d, want %d", name, i, got, w)
+			}
+		}
+	}
+	if findBox(t, audio, "stss") != nil {
+		t.Error("audio stbl has an stss though every sample is a sync sample")
+	}
+	stsd := findBox(t, audio, "stsd")
+	if string(stsd[12:16]) != "mp4a" || !bytes.Contains(stsd, []byte{0x05, 2, 0x12, 0x10}) {
+		t.Error("audio sample entry isn't an mp4a carrying the AudioSpecificConfig")
+	}
+
+	for i, trak := range [][]byte{video, audio} {
+		stco := findBox(t, trak, "stco")
+		if n := binary.BigEndian.Uint32(stco[4:]); n != 1 {
+			t.Fatalf("track %d has %d chunks, want 1", i, n)
+		}
+		off := binary.BigEndian.Uint32(stco[8:])
+		if want := []string{"KEY", "AA"}[i]; !bytes.HasPrefix(file[off:], []byte(want)) {
+			t.Errorf("track %d chunk offset %d points at %q, want %q", i, off, file[off:off+3], want)
+		}
+	}
+}
+
+func TestParseAudioSpecificConfig(t *testing.T) {
+	for _, c := range []struct {
+		config   []byte
+		rate     uint32
+		channels uint16
+	}{
+		{[]byte{0x12, 0x10}, 44100, 2},
+		{[]byte{0x11, 0x88}, 48000, 1},
+		{[]byte{0x17, 0x80, 0x3e, 0x80, 0x10}, 32000, 2}, //explicit frequency
+	} {
+		rate, channels, err := ParseAudioSpecificConfig(c.config)
+		if err != nil || rate != c.rate || channels != c.channels {
+			t.Errorf("ParseAudioSpecificConfig(%x) = %d, %d, %v; want %d, %d", c.config, rate, channels, err, c.rate, c.channels)
+		}
+	}
+	if _, _, err := ParseAudioSpecificConfig([]byte{0x12}); err == nil {
+		t.Error("truncated config accepted")
+	}
+}
@@ -0,0 +1,538 @@
+package libmp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Track is one track of a file read by ReadMovie. Every sample's
+// Offset is where its data starts in the file and DecodeTime is its
+// DTS; both Data and the timings are in the track's timescale.
+type Track struct {
+	ID        uint32
+	Handler   string //"vide", "soun"…
+	Codec     string //sample entry type: avc1, hvc1, mp4a…
+	Timescale uint32
+	Width     uint16
+	Height    uint16
+	Config    []byte //avcC/hvcC record, or the AAC AudioSpecificConfig
+	Samples   []Sample
+}
+
+// errNoMovie is returned for a file without a moov box.
+var errNoMovie = errors.New("mp4: no moov box")
+
+// ReadMovie indexes the tracks of an MP4 file, progressive (sample
+// tables in moov) or fragmented (moof boxes after it), without reading
+// any sample data.
+func ReadMovie(r io.ReadSeeker) ([]Track, error) {
+	var (
+		tracks   []Track
+		defaults = map[uint32]fragmentDefaults{}
+		moofs    []fragment
+		offset   int64
+	)
+boxes:
+	for {
+		typ, size, header, err := readBoxHeader(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case "moov", "moof":
+			if size < 0 || size-header > 64<<20 {
+				return nil, fmt.Errorf("mp4: %s box at %d too large", typ, offset)
+			}
+			body := make([]byte, size-header)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return nil, fmt.Errorf("mp4: %s box at %d: %w", typ, offset, err)
+			}
+			if typ == "moof" {
+				moofs = append(moofs, fragment{offset: offset, body: body})
+			} else if tracks, err = parseMoov(body, defaults); err != nil {
+				return nil, err
+			}
+		default:
+			if size < 0 {
+				//Runs to the end of the file.
+				break boxes
+			}
+			if _, err := r.Seek(size-header, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		}
+		offset += size
+	}
+	if tracks == nil {
+		return nil, errNoMovie
+	}
+	for _, moof := range moofs {
+		if err := moof.apply(tracks, defaults); err != nil {
+			return nil, err
+		}
+	}
+	return tracks, nil
+}
+
+// readBoxHeader reads a box's size and type. size is the whole box,
+// header included, or -1 for a box that runs to the end of the file.
+func readBoxHeader(r io.Reader) (typ string, size, header int64, err error) {
+	var b [16]byte
+	if _, err = io.ReadFull(r, b[:8]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("mp4: truncated box header")
+		}
+		return "", 0, 0, err
+	}
+	typ, size, header = string(b[4:8]), int64(binary.BigEndian.Uint32(b[:4])), 8
+	switch size {
+	case 0:
+		size = -1
+	case 1:
+		if _, err = io.ReadFull(r, b[8:]); err != nil {
+			return "", 0, 0, errors.New("mp4: truncated box header")
+		}
+		size, header = int64(binary.BigEndian.Uint64(b[8:])), 16
+	}
+	if size >= 0 && size < header {
+		return "", 0, 0, fmt.Errorf("mp4: bad %s box size %d", typ, size)
+	}
+	return typ, size, header, nil
+}
+
+// children splits a container's body into its boxes, by type. Boxes
+// that don't fit are dropped.
+func children(body []byte) map[string][][]byte {
+	out := map[string][][]byte{}
+	for len(body) >= 8 {
+		n := int(binary.BigEndian.Uint32(body))
+		if n < 8 || n > len(body) {
+			break
+		}
+		typ := string(body[4:8])
+		out[typ] = append(out[typ], body[8:n])
+		body = body[n:]
+	}
+	return out
+}
+
+// child returns the body of the first box of type typ in body, nil if
+// there is none.
+func child(body []byte, path ...string) []byte {
+	for _, typ := range path {
+		boxes := children(body)[typ]
+		if len(boxes) == 0 {
+			return nil
+		}
+		body = boxes[0]
+	}
+	return body
+}
+
+// fragmentDefaults holds a track's fragment defaults from mvex.
+type fragmentDefaults struct {
+	duration, size, flags uint32
+}
+
+func parseMoov(moov []byte, defaults map[uint32]fragmentDefaults) ([]Track, error) {
+	for _, b := range children(child(moov, "mvex"))["trex"] {
+		if len(b) >= 24 {
+			defaults[be32(b[4:])] = fragmentDefaults{duration: be32(b[12:]), size: be32(b[16:]), flags: be32(b[20:])}
+		}
+	}
+	tracks := []Track{}
+	for _, trak := range children(moov)["trak"] {
+		t, err := parseTrak(trak)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, nil
+}
+
+func parseTrak(trak []byte) (t Track, err error) {
+	tkhd, mdhd := child(trak, "tkhd"), child(trak, "mdia", "mdhd")
+	hdlr, stbl := child(trak, "mdia", "hdlr"), child(trak, "mdia", "minf", "stbl")
+	if len(tkhd) < 24 || len(mdhd) < 24 || len(hdlr) < 12 || stbl == nil {
+		return t, errors.New("mp4: incomplete trak")
+	}
+	//tkhd and mdhd: version 1 has 64-bit creation and modification
+	//times ahead of the ID and timescale.
+	if tkhd[0] == 1 {
+		t.ID = be32(tkhd[20:])
+	} else {
+		t.ID = be32(tkhd[12:])
+	}
+	if mdhd[0] == 1 {
+		t.Timescale = be32(mdhd[20:])
+	} else {
+		t.Timescale = be32(mdhd[12:])
+	}
+	t.Handler = string(hdlr[8:12])
+	if t.Timescale == 0 {
+		return t, fmt.Errorf("mp4: track %d has no timescale", t.ID)
+	}
+	t.sampleEntry(child(stbl, "stsd"))
+	t.Samples, err = sampleTable(stbl)
+	if err != nil {
+		return t, fmt.Errorf("mp4: track %d: %w", t.ID, err)
+	}
+	return t, nil
+}
+
+// sampleEntry reads the codec and its configuration from the first
+// entry of stsd.
+func (t *Track) sampleEntry(stsd []byte) {
+	if len(stsd) < 16 {
+		return
+	}
+	entry := stsd[8:]
+	n := int(be32(entry))
+	if n < 8 || n > len(entry) {
+		return
+	}
+	t.Codec, entry = string(entry[4:8]), entry[8:n]
+	switch t.Handler {
+	case "vide":
+		//VisualSampleEntry: 78 bytes, then the configuration box.
+		if len(entry) < 78 {
+			return
+		}
+		t.Width, t.Height = be16(entry[24:]), be16(entry[26:])
+		boxes := children(entry[78:])
+		for _, typ := range []string{"avcC", "hvcC"} {
+			if b := boxes[typ]; len(b) > 0 {
+				t.Config = b[0]
+			}
+		}
+	case "soun":
+		//AudioSampleEntry: 28 bytes, 16 or 36 more in QuickTime's
+		//version 1 and 2.
+		if len(entry) < 28 {
+			return
+		}
+		skip := 28
+		switch be16(entry[8:]) {
+		case 1:
+			skip += 16
+		case 2:
+			skip += 36
+		}
+		if len(entry) < skip {
+			return
+		}
+		if esds := child(entry[skip:], "esds"); len(esds) > 4 {
+			t.Config = decoderSpecificInfo(esds[4:])
+		}
+	}
+}
+
+// decoderSpecificInfo digs the DecoderSpecificInfo out of an
+// ES_Descriptor (ISO 14496-1 §7.2.6.5).
+func decoderSpecificInfo(b []byte) []byte {
+	for len(b) > 0 {
+		tag, body, rest := readDescriptor(b)
+		switch tag {
+		case 0x03: //ES_Descriptor
+			if len(body) < 3 {
+				return nil
+			}
+			flags, skip := body[2], 3
+			if flags&0x80 != 0 {
+				skip += 2
+			}
+			if flags&0x40 != 0 && len(body) > skip {
+				skip += 1 + int(body[skip])
+			}
+			if flags&0x20 != 0 {
+				skip += 2
+			}
+			if len(body) < skip {
+				return nil
+			}
+			b = body[skip:]
+		case 0x04: //DecoderConfigDescriptor
+			if len(body) < 13 {
+				return nil
+			}
+			b = body[13:]
+		case 0x05:
+			return body
+		default:
+			b = rest
+		}
+	}
+	return nil
+}
+
+// readDescriptor splits off one MPEG-4 descriptor.
+func readDescriptor(b []byte) (tag uint8, body, rest []byte) {
+	if len(b) < 2 {
+		return 0, nil, nil
+	}
+	tag, n, i := b[0], 0, 1
+	for ; i < len(b) && i <= 4; i++ {
+		n = n<<7 | int(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			i++
+			break
+		}
+	}
+	if i+n > len(b) {
+		return tag, b[i:], nil
+	}
+	return tag, b[i : i+n], b[i+n:]
+}
+
+// sampleTable expands stbl's run-length tables into one Sample per
+// sample.
+func sampleTable(stbl []byte) ([]Sample, error) {
+	stsz := child(stbl, "stsz")
+	if len(stsz) < 12 {
+		return nil, nil
+	}
+	count, fixed := int(be32(stsz[8:])), be32(stsz[4:])
+	if fixed == 0 && len(stsz) < 12+4*count {
+		return nil, errors.New("short stsz")
+	}
+	samples := make([]Sample, count)
+	for i := range samples {
+		samples[i].Size = fixed
+		if fixed == 0 {
+			samples[i].Size = be32(stsz[12+4*i:])
+		}
+	}
+
+	//stts: decode time deltas.
+	var dts uint64
+	i := 0
+	for _, e := range entries(child(stbl, "stts"), 8) {
+		for n := be32(e); n > 0 && i < count; n-- {
+			samples[i].DecodeTime, samples[i].Duration = dts, be32(e[4:])
+			dts += uint64(samples[i].Duration)
+			i++
+		}
+	}
+	//ctts: composition offsets, signed in version 1 and in practice.
+	i = 0
+	for _, e := range entries(child(stbl, "ctts"), 8) {
+		for n := be32(e); n > 0 && i < count; n-- {
+			samples[i].CompositionTimeOffset = int32(be32(e[4:]))
+			i++
+		}
+	}
+	//stss: sync samples; without one, every sample is.
+	if stss := child(stbl, "stss"); stss == nil {
+		for i := range samples {
+			samples[i].IsKey = true
+		}
+	} else {
+		for _, e := range entries(stss, 4) {
+			if n := int(be32(e)); n >= 1 && n <= count {
+				samples[n-1].IsKey = true
+			}
+		}
+	}
+
+	//stsc and stco/co64: chunk offsets, and how many samples are in
+	//each chunk.
+	var offsets []uint64
+	if co64 := child(stbl, "co64"); co64 != nil {
+		for _, e := range entries(co64, 8) {
+			offsets = append(offsets, binary.BigEndian.Uint64(e))
+		}
+	} else {
+		for _, e := range entries(child(stbl, "stco"), 4) {
+			offsets = append(offsets, uint64(be32(e)))
+		}
+	}
+	stsc := entries(child(stbl, "stsc"), 12)
+	i = 0
+	for chunk := range offsets {
+		perChunk := 0
+		for _, e := range stsc {
+			if int(be32(e))-1 > chunk {
+				break
+			}
+			perChunk = int(be32(e[4:]))
+		}
+		at := offsets[chunk]
+		for n := 0; n < perChunk && i < count; n++ {
+			samples[i].Offset = at
+			at += uint64(samples[i].Size)
+			i++
+		}
+	}
+	if i < count {
+		return nil, errors.New("sample table describes more samples than its chunks hold")
+	}
+	return samples, nil
+}
+
+// entries splits a full box with an entry count into its fixed-size
+// entries.
+func entries(box []byte, size int) [][]byte {
+	if len(box) < 8 {
+		return nil
+	}
+	n := int(be32(box[4:]))
+	if n > (len(box)-8)/size {
+		n = (len(box) - 8) / size
+	}
+	out := make([][]byte, n)
+	for i := range out {
+		out[i] = box[8+i*size : 8+(i+1)*size]
+	}
+	return out
+}
+
+// fragment is a moof box and where it starts in the file.
+type fragment struct {
+	offset int64
+	body   []byte
+}
+
+// tfhd flags (ISO 14496-12 §8.8.7).
+const (
+	tfhdBaseDataOffset   = 0x000001
+	tfhdDescriptionIndex = 0x000002
+	tfhdDefaultDuration  = 0x000008
+	tfhdDefaultSize      = 0x000010
+	tfhdDefaultFlags     = 0x000020
+)
+
+// trunFlagFirstSampleFlags overrides the first sample's flags.
+const trunFlagFirstSampleFlags = 0x000004
+
+// apply appends the fragment's samples to their tracks.
+func (f fragment) apply(tracks []Track, defaults map[uint32]fragmentDefaults) error {
+	for _, traf := range children(f.body)["traf"] {
+		tfhd := child(traf, "tfhd")
+		if len(tfhd) < 8 {
+			return errors.New("mp4: traf without tfhd")
+		}
+		var t *Track
+		for i := range tracks {
+			if tracks[i].ID == be32(tfhd[4:]) {
+				t = &tracks[i]
+			}
+		}
+		if t == nil {
+			continue
+		}
+		def := defaults[t.ID]
+		flags, rest := be32(tfhd)&0xffffff, tfhd[8:]
+		base := uint64(f.offset)
+		field := func(present uint32, size int) (v uint64, ok bool) {
+			if flags&present == 0 || len(rest) < size {
+				return 0, false
+			}
+			if size == 8 {
+				v = binary.BigEndian.Uint64(rest)
+			} else {
+				v = uint64(be32(rest))
+			}
+			rest = rest[size:]
+			return v, true
+		}
+		if v, ok := field(tfhdBaseDataOffset, 8); ok {
+			base = v
+		}
+		field(tfhdDescriptionIndex, 4)
+		if v, ok := field(tfhdDefaultDuration, 4); ok {
+			def.duration = uint32(v)
+		}
+		if v, ok := field(tfhdDefaultSize, 4); ok {
+			def.size = uint32(v)
+		}
+		if v, ok := field(tfhdDefaultFlags, 4); ok {
+			def.flags = uint32(v)
+		}
+
+		var dts uint64
+		if n := len(t.Samples); n > 0 {
+			dts = t.Samples[n-1].DecodeTime + uint64(t.Samples[n-1].Duration)
+		}
+		if tfdt := child(traf, "tfdt"); len(tfdt) >= 8 {
+			if tfdt[0] == 1 && len(tfdt) >= 12 {
+				dts = binary.BigEndian.Uint64(tfdt[4:])
+			} else {
+				dts = uint64(be32(tfdt[4:]))
+			}
+		}
+		at := base
+		for _, trun := range children(traf)["trun"] {
+			var err error
+			if at, dts, err = t.run(trun, base, at, dts, def); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// run appends a trun's samples; at and dts are where the previous run
+// left off, returned updated.
+func (t *Track) run(trun []byte, base, at, dts uint64, def fragmentDefaults) (uint64, uint64, error) {
+	if len(trun) < 8 {
+		return at, dts, errors.New("mp4: short trun")
+	}
+	flags, count, b := be32(trun)&0xffffff, int(be32(trun[4:])), trun[8:]
+	if flags&trunFlagDataOffset != 0 {
+		if len(b) < 4 {
+			return at, dts, errors.New("mp4: short trun")
+		}
+		at = uint64(int64(base) + int64(int32(be32(b))))
+		b = b[4:]
+	}
+	firstFlags, hasFirst := uint32(0), flags&trunFlagFirstSampleFlags != 0
+	if hasFirst {
+		if len(b) < 4 {
+			return at, dts, errors.New("mp4: short trun")
+		}
+		firstFlags, b = be32(b), b[4:]
+	}
+	per := 0
+	for _, f := range []uint32{trunFlagSampleDuration, trunFlagSampleSize, trunFlagSampleFlags, trunFlagSampleCTSOffsets} {
+		if flags&f != 0 {
+			per += 4
+		}
+	}
+	if len(b) < count*per {
+		return at, dts, errors.New("mp4: short trun")
+	}
+	for i := 0; i < count; i++ {
+		s := Sample{Duration: def.duration, Size: def.size, DecodeTime: dts, Offset: at}
+		sampleFlags := def.flags
+		if i == 0 && hasFirst {
+			sampleFlags = firstFlags
+		}
+		if flags&trunFlagSampleDuration != 0 {
+			s.Duration, b = be32(b), b[4:]
+		}
+		if flags&trunFlagSampleSize != 0 {
+			s.Size, b = be32(b), b[4:]
+		}
+		if flags&trunFlagSampleFlags != 0 {
+			sampleFlags, b = be32(b), b[4:]
+		}
+		if flags&trunFlagSampleCTSOffsets != 0 {
+			s.CompositionTimeOffset, b = int32(be32(b)), b[4:]
+		}
+		//sample_is_non_sync_sample; audio samples are all sync.
+		s.IsKey = sampleFlags&0x00010000 == 0 || t.Handler == "soun"
+		t.Samples = append(t.Samples, s)
+		at += uint64(s.Size)
+		dts += uint64(s.Duration)
+	}
+	return at, dts, nil
+}
+
+func be16(b []byte) uint16 { return binary.BigEndian.Uint16(b) }
+func be32(b []byte) uint32 { return binary.BigEndian.Uint32(b) }
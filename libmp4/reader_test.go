@@ -0,0 +1,107 @@
+package libmp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadMovie_Progressive(t *testing.T) {
+	data := []byte("KEYxPxxxAAbb")
+	head := BuildMovie(InitSegmentParams{
+		TrackID:    1,
+		Timescale:  90000,
+		Width:      640,
+		Height:     360,
+		AVCCRecord: []byte{1, 0x4d, 0x40, 0x28, 0xff, 0xe0, 0},
+		Samples: []Sample{
+			{Duration: 3000, Size: 3, IsKey: true, Offset: 0},
+			{Duration: 3000, Size: 5, CompositionTimeOffset: 3000, Offset: 3},
+		},
+		Audio: &AudioParams{
+			TrackID:    2,
+			SampleRate: 44100,
+			Channels:   2,
+			Config:     []byte{0x12, 0x10},
+			Samples: []Sample{
+				{Duration: 1024, Size: 2, IsKey: true, Offset: 8},
+				{Duration: 1024, Size: 2, IsKey: true, Offset: 10},
+			},
+		},
+	})
+	file := append(head, data...)
+
+	tracks, err := ReadMovie(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 {
+		t.Fatalf("%d tracks, want 2", len(tracks))
+	}
+	video, audio := tracks[0], tracks[1]
+	if video.Handler != "vide" || video.Codec != "avc1" || video.Timescale != 90000 || video.Width != 640 ||
+		!bytes.Equal(video.Config, []byte{1, 0x4d, 0x40, 0x28, 0xff, 0xe0, 0}) {
+		t.Errorf("video track = %+v", video)
+	}
+	if audio.Handler != "soun" || audio.Codec != "mp4a" || audio.Timescale != 44100 || !bytes.Equal(audio.Config, []byte{0x12, 0x10}) {
+		t.Errorf("audio track = %+v", audio)
+	}
+	if len(video.Samples) != 2 || len(audio.Samples) != 2 {
+		t.Fatalf("%d video and %d audio samples, want 2 and 2", len(video.Samples), len(audio.Samples))
+	}
+	second := video.Samples[1]
+	if second.DecodeTime != 3000 || second.IsKey || second.CompositionTimeOffset != 3000 || !video.Samples[0].IsKey {
+		t.Errorf("video samples = %+v", video.Samples)
+	}
+	for _, c := range []struct {
+		s    Sample
+		want string
+	}{{video.Samples[0], "KEY"}, {second, "xPxxx"}, {audio.Samples[1], "bb"}} {
+		if got := file[c.s.Offset : c.s.Offset+uint64(c.s.Size)]; string(got) != c.want {
+			t.Errorf("sample at %d = %q, want %q", c.s.Offset, got, c.want)
+		}
+	}
+}
+
+func TestReadMovie_Fragmented(t *testing.T) {
+	file := BuildInitSegment(InitSegmentParams{
+		TrackID:    1,
+		Timescale:  90000,
+		AVCCRecord: []byte{1, 0x4d, 0x40, 0x28, 0xff, 0xe0, 0},
+	})
+	for i, frames := range [][]string{{"K1", "p1"}, {"K2"}} {
+		var samples []Sample
+		for j, f := range frames {
+			samples = append(samples, Sample{Duration: 3000, Size: uint32(len(f)), IsKey: j == 0, Data: []byte(f)})
+		}
+		file = append(file, BuildMediaSegment(MediaSegmentParams{
+			TrackID:        1,
+			SequenceNumber: uint32(i + 1),
+			BaseDecodeTime: uint64(i) * 6000,
+			Samples:        samples,
+		})...)
+	}
+
+	tracks, err := ReadMovie(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 1 || len(tracks[0].Samples) != 3 {
+		t.Fatalf("tracks = %+v, want one with 3 samples", tracks)
+	}
+	for i, want := range []struct {
+		data string
+		dts  uint64
+		key  bool
+	}{{"K1", 0, true}, {"p1", 3000, false}, {"K2", 6000, true}} {
+		s := tracks[0].Samples[i]
+		if got := string(file[s.Offset : s.Offset+uint64(s.Size)]); got != want.data || s.DecodeTime != want.dts || s.IsKey != want.key {
+			t.Errorf("sample %d = %q at %d (key %v), want %q at %d (key %v)", i, got, s.DecodeTime, s.IsKey, want.data, want.dts, want.key)
+		}
+	}
+}
+
+func TestReadMovie_NotMP4(t *testing.T) {
+	if _, err := ReadMovie(bytes.NewReader([]byte("FLV\x01\x05\x00\x00\x00\x09\x00\x00\x00\x00"))); err == nil {
+		t.Error("ReadMovie accepted an FLV file")
+	}
+}
@@ -0,0 +1,444 @@
+package librecord
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SmartBrave/Athena/broadcast"
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
+)
+
+// flvHeader is the 9-byte FLV header (audio and video flags set)
+// followed by PreviousTagSize0.
+var flvHeader = []byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
+
+// FLV records one stream into <dir>/<name>.flv, then <name>-1.flv,
+// <name>-2.flv… as files rotate. Each file starts with onMetaData and
+// the sequence headers, and each video file on a keyframe, so every
+// file plays on its own. onMetaData's duration and filesize are filled
+// in when the file is closed.
+//
+// Record may be called again with a new reader after the previous one
+// ends, e.g. when the publisher reconnects: recording continues in the
+// same file with timestamps carrying on from where they stopped.
+type FLV struct {
+	// config — set once before Record().
+	dir         string
+	name        string
+	mode        Mode
+	maxDuration time.Duration //0: no duration rotation
+	maxSize     int64         //0: no size rotation
+	onFile      func(path string)
+	logger      liblog.Logger
+
+	mu        sync.Mutex
+	closed    bool
+	session   int //bumped by every Record; older sessions stop writing
+	file      *os.File
+	path      string
+	index     int   //suffix of the current file, 0 for <name>.flv
+	size      int64 //bytes in the current file
+	fileStart uint32
+	clock     timeline
+	patchAt   [2]int64
+	meta      *libflv.MetaTag
+	video     *libflv.VideoTag //sequence header
+	audio     *libflv.AudioTag //sequence header
+}
+
+func NewFLV() *FLV {
+	return &FLV{
+		dir:    "./record",
+		logger: liblog.Nop,
+	}
+}
+
+// WithDir sets the directory files are written to. It is created on
+// the first write if it does not exist.
+func (r *FLV) WithDir(dir string) *FLV {
+	if dir != "" {
+		r.dir = dir
+	}
+	return r
+}
+
+// WithName sets the file name stem, usually the stream ID.
+func (r *FLV) WithName(name string) *FLV {
+	r.name = name
+	return r
+}
+
+func (r *FLV) WithMode(mode Mode) *FLV {
+	r.mode = mode
+	return r
+}
+
+// WithMaxDuration rotates to a new file on the first keyframe past d.
+// Zero never rotates on duration.
+func (r *FLV) WithMaxDuration(d time.Duration) *FLV {
+	r.maxDuration = d
+	return r
+}
+
+// WithMaxSize rotates to a new file on the first keyframe past n bytes.
+// Zero never rotates on size.
+func (r *FLV) WithMaxSize(n int64) *FLV {
+	r.maxSize = n
+	return r
+}
+
+// WithOnFile registers fn to be called with the path of every file
+// once it is complete.
+func (r *FLV) WithOnFile(fn func(path string)) *FLV {
+	r.onFile = fn
+	return r
+}
+
+// WithLogger routes the recorder's diagnostics to l. The default is
+// silent.
+func (r *FLV) WithLogger(l liblog.Logger) *FLV {
+	r.logger = liblog.OrNop(l)
+	return r
+}
+
+func (r *FLV) log() liblog.Logger {
+	return r.logger.With(liblog.Stream(r.name), liblog.Protocol("flv-record"))
+}
+
+// Path reports the file currently being written, if any.
+func (r *FLV) Path() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.path
+}
+
+// Record writes every tag read from gopReader until the stream ends or
+// Close is called. A later Record call takes over from this one.
+func (r *FLV) Record(gopReader *broadcast.BroadcastReader) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	if err := CheckName(r.dir, r.name); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	if r.mode == Append && r.session == 0 {
+		r.resume()
+	}
+	r.session++
+	session := r.session
+	r.clock.restart()
+	r.mu.Unlock()
+
+	for {
+		//Headers come back with alive=false once the stream has
+		//ended; keep them, the tags after them still need writing.
+		p, alive := gopReader.Read()
+		if !alive && p == nil {
+			return nil
+		}
+		tag, ok := p.(libflv.Tag)
+		if !ok {
+			continue
+		}
+		r.mu.Lock()
+		if r.closed || r.session != session {
+			r.mu.Unlock()
+			return nil
+		}
+		err := r.write(tag)
+		r.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close finalises the current file. Safe to call more than once.
+func (r *FLV) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.finalise()
+}
+
+func (r *FLV) write(tag libflv.Tag) error {
+	switch t := tag.(type) {
+	case *libflv.MetaTag:
+		if t.IsMetaData() {
+			r.meta = t
+			return nil
+		}
+		//Cue points are kept in the file they fall in.
+		if r.file == nil {
+			return nil
+		}
+		return r.writeTag(t, r.clock.at(t.TimeStamp, r.fileStart))
+	case *libflv.VideoTag:
+		if t.AVCPacketType == libflv.AVC_SEQUENCE_HEADER && isSequenced(t.CodecID) {
+			r.video = t
+			return r.writeHeader(t)
+		}
+	case *libflv.AudioTag:
+		if t.SoundFormat == libflv.FLV_AUDIO_AAC && t.AACPacketType == libflv.AAC_SEQUENCE_HEADER {
+			r.audio = t
+			return r.writeHeader(t)
+		}
+	default:
+		return nil
+	}
+
+	video, isVideo := tag.(*libflv.VideoTag)
+	//Files holding video must start on a keyframe to be seekable.
+	cut := !isVideo && r.video == nil || isVideo && video.FrameType == libflv.KEY_FRAME
+	if r.file == nil && !cut {
+		return nil
+	}
+	//Audio a few ms behind the video that opened the file is moved up.
+	ts := r.clock.at(tag.GetTagInfo().TimeStamp, r.fileStart)
+	if r.file == nil {
+		if err := r.open(ts); err != nil {
+			return err
+		}
+	} else if cut && r.full(ts) {
+		if err := r.finalise(); err != nil {
+			return err
+		}
+		r.index++
+		if err := r.open(ts); err != nil {
+			return err
+		}
+	}
+	return r.writeTag(tag, ts)
+}
+
+func (r *FLV) full(ts uint32) bool {
+	if r.maxDuration > 0 && time.Duration(ts-r.fileStart)*time.Millisecond >= r.maxDuration {
+		return true
+	}
+	return r.maxSize > 0 && r.size >= r.maxSize
+}
+
+// writeHeader writes a sequence header that changed mid-file; new
+// files get the cached ones from open.
+func (r *FLV) writeHeader(tag libflv.Tag) error {
+	if r.file == nil {
+		return nil
+	}
+	return r.writeTag(tag, r.clock.last)
+}
+
+func (r *FLV) writeTag(tag libflv.Tag, ts uint32) error {
+	return r.writeRaw(libflv.FLVWrite(tag), ts)
+}
+
+// writeRaw writes a tag serialised by FLVWrite. FLVWrite stamps the
+// tag's own timestamp; the tag is shared with every other subscriber,
+// so the copy in b is restamped with ts instead.
+func (r *FLV) writeRaw(b []byte, ts uint32) error {
+	b[4], b[5], b[6], b[7] = byte(ts>>16), byte(ts>>8), byte(ts), byte(ts>>24)
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", r.path, err)
+	}
+	return nil
+}
+
+func (r *FLV) filePath(index int) string {
+	if index == 0 {
+		return filepath.Join(r.dir, r.name+".flv")
+	}
+	return filepath.Join(r.dir, r.name+"-"+strconv.Itoa(index)+".flv")
+}
+
+// open starts the file for r.index.
+func (r *FLV) open(ts uint32) error {
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", r.dir, err)
+	}
+	r.path = r.filePath(r.index)
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", r.path, err)
+	}
+	r.file, r.size, r.fileStart = f, 0, ts
+	r.patchAt = [2]int64{-1, -1}
+	if _, err := f.Write(flvHeader); err != nil {
+		return fmt.Errorf("write %s: %w", r.path, err)
+	}
+	r.size = int64(len(flvHeader))
+
+	meta := &libflv.MetaTag{TagBase: libflv.TagBase{TagType: libflv.SCRIPT_DATA_TAG}}
+	if r.meta != nil {
+		copied := *r.meta
+		meta = &copied
+	}
+	//Placeholders, patched in place on close.
+	meta.Duration, meta.FileSize = 0, 0
+	//Property order changes from one serialisation to the next, so
+	//look for the values in the bytes actually written.
+	b := libflv.FLVWrite(meta)
+	r.patchAt = findMetaValues(b[11:len(b)-4], r.size+11)
+	if err := r.writeRaw(b, ts); err != nil {
+		return err
+	}
+	if r.video != nil {
+		if err := r.writeTag(r.video, ts); err != nil {
+			return err
+		}
+	}
+	if r.audio != nil {
+		if err := r.writeTag(r.audio, ts); err != nil {
+			return err
+		}
+	}
+	r.log().Info("record file opened", liblog.F("path", r.path))
+	return nil
+}
+
+// resume picks up the newest existing file for Append, carrying the
+// timeline on from its last tag. With nothing to append to, the first
+// file is created as usual.
+func (r *FLV) resume() {
+	for {
+		if _, err := os.Stat(r.filePath(r.index + 1)); err != nil {
+			break
+		}
+		r.index++
+	}
+	if err := r.reopen(r.filePath(r.index)); err != nil && !os.IsNotExist(err) {
+		r.log().Warn("can't append, starting a new file", liblog.F("path", r.filePath(r.index)), liblog.Err(err))
+		r.index++
+	}
+}
+
+func (r *FLV) reopen(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	lastTS, patchAt, err := scanFLV(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.path, r.file, r.size, r.fileStart, r.patchAt = path, f, size, 0, patchAt
+	r.clock.resume(lastTS)
+	r.log().Info("record file reopened", liblog.F("path", r.path))
+	return nil
+}
+
+// finalise patches onMetaData and closes the current file.
+func (r *FLV) finalise() error {
+	if r.file == nil {
+		return nil
+	}
+	f, path := r.file, r.path
+	r.file = nil
+	var b [8]byte
+	var err error
+	if r.patchAt[0] >= 0 {
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(float64(r.clock.last-r.fileStart)/1000))
+		_, err = f.WriteAt(b[:], r.patchAt[0])
+	}
+	if r.patchAt[1] >= 0 && err == nil {
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(float64(r.size)))
+		_, err = f.WriteAt(b[:], r.patchAt[1])
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("finalise %s: %w", path, err)
+	}
+	r.log().Info("record file closed", liblog.F("path", path), liblog.F("bytes", r.size))
+	if r.onFile != nil {
+		r.onFile(path)
+	}
+	return nil
+}
+
+func isSequenced(codecID uint8) bool {
+	return codecID == libflv.FLV_VIDEO_AVC || codecID == libflv.FLV_VIDEO_HEVC || codecID == libflv.FLV_VIDEO_AV1 || codecID == libflv.FLV_VIDEO_VP9
+}
+
+// findMetaValues returns the file offsets of the 8-byte AMF0 numbers
+// holding duration and filesize in an onMetaData body found at base,
+// or -1 for a key that isn't there as a number.
+func findMetaValues(body []byte, base int64) (at [2]int64) {
+	for i, key := range []string{"duration", "filesize"} {
+		at[i] = -1
+		needle := append([]byte{0, byte(len(key))}, key...)
+		needle = append(needle, 0x00) //AMF0 number marker
+		if j := bytes.Index(body, needle); j >= 0 && j+len(needle)+8 <= len(body) {
+			at[i] = base + int64(j+len(needle))
+		}
+	}
+	return at
+}
+
+// scanFLV checks f is an FLV file ending on a tag boundary and returns
+// the last tag's timestamp and where its onMetaData values are.
+func scanFLV(f *os.File) (lastTS uint32, patchAt [2]int64, err error) {
+	patchAt = [2]int64{-1, -1}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, patchAt, err
+	}
+	size := info.Size()
+	head := make([]byte, len(flvHeader)+11)
+	if _, err := f.ReadAt(head, 0); err != nil || !bytes.Equal(head[:3], []byte("FLV")) {
+		return 0, patchAt, errors.New("not an FLV file")
+	}
+	if head[13] == libflv.SCRIPT_DATA_TAG {
+		n := int64(head[14])<<16 | int64(head[15])<<8 | int64(head[16])
+		if 24+n <= size {
+			body := make([]byte, n)
+			if _, err := f.ReadAt(body, 24); err == nil {
+				patchAt = findMetaValues(body, 24)
+			}
+		}
+	}
+
+	var b [11]byte
+	if _, err := f.ReadAt(b[:4], size-4); err != nil {
+		return 0, patchAt, err
+	}
+	prev := int64(binary.BigEndian.Uint32(b[:4]))
+	if prev == 0 {
+		return 0, patchAt, nil //header only
+	}
+	at := size - 4 - prev
+	if at < int64(len(flvHeader)) {
+		return 0, patchAt, errors.New("truncated FLV file")
+	}
+	if _, err := f.ReadAt(b[:], at); err != nil {
+		return 0, patchAt, err
+	}
+	if b[0] != libflv.AUDIO_TAG && b[0] != libflv.VIDEO_TAG && b[0] != libflv.SCRIPT_DATA_TAG {
+		return 0, patchAt, errors.New("truncated FLV file")
+	}
+	lastTS = uint32(b[7])<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	return lastTS, patchAt, nil
+}
@@ -0,0 +1,211 @@
+package librecord
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SmartBrave/Athena/broadcast"
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+type fileTag struct {
+	typ  uint8
+	ts   uint32
+	body []byte
+}
+
+func readFLV(t *testing.T, path string) (tags []fileTag, size int64) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:3]) != "FLV" {
+		t.Fatalf("%s: no FLV header", path)
+	}
+	for i := len(flvHeader); i < len(b); {
+		n := int(b[i+1])<<16 | int(b[i+2])<<8 | int(b[i+3])
+		ts := uint32(b[i+7])<<24 | uint32(b[i+4])<<16 | uint32(b[i+5])<<8 | uint32(b[i+6])
+		tags = append(tags, fileTag{typ: b[i], ts: ts, body: b[i+11 : i+11+n]})
+		if prev := binary.BigEndian.Uint32(b[i+11+n:]); int(prev) != 11+n {
+			t.Fatalf("%s: PreviousTagSize %d, want %d", path, prev, 11+n)
+		}
+		i += 11 + n + 4
+	}
+	return tags, int64(len(b))
+}
+
+func metaValues(t *testing.T, tag fileTag) (duration, filesize float64) {
+	t.Helper()
+	at := findMetaValues(tag.body, 0)
+	if tag.typ != libflv.SCRIPT_DATA_TAG || at[0] < 0 || at[1] < 0 {
+		t.Fatalf("first tag isn't onMetaData with duration and filesize")
+	}
+	duration = math.Float64frombits(binary.BigEndian.Uint64(tag.body[at[0]:]))
+	filesize = math.Float64frombits(binary.BigEndian.Uint64(tag.body[at[1]:]))
+	return duration, filesize
+}
+
+// stream is a publisher's GOP broadcast with its three header slots
+// filled.
+func stream() *broadcast.Broadcast {
+	bd := broadcast.NewBroadcast(3)
+	bd.WriteMeta(&libflv.MetaTag{TagBase: libflv.TagBase{TagType: libflv.SCRIPT_DATA_TAG}, Width: 640})
+	bd.WriteMeta(&libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG}, FrameType: libflv.KEY_FRAME,
+		CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_SEQUENCE_HEADER, VideoData: []byte{1, 2}})
+	bd.WriteMeta(&libflv.AudioTag{TagBase: libflv.TagBase{TagType: libflv.AUDIO_TAG}, SoundFormat: libflv.FLV_AUDIO_AAC,
+		AACPacketType: libflv.AAC_SEQUENCE_HEADER, SoundData: []byte{0x12, 0x10}})
+	return bd
+}
+
+func video(ts uint32, key bool) *libflv.VideoTag {
+	frame := uint8(libflv.INTER_FRAME)
+	if key {
+		frame = libflv.KEY_FRAME
+	}
+	return &libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG, TimeStamp: ts}, FrameType: frame,
+		CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_NALU, VideoData: []byte{0, 0, 0, 1, 0x65}}
+}
+
+func audio(ts uint32) *libflv.AudioTag {
+	return &libflv.AudioTag{TagBase: libflv.TagBase{TagType: libflv.AUDIO_TAG, TimeStamp: ts}, SoundFormat: libflv.FLV_AUDIO_AAC,
+		AACPacketType: libflv.AAC_RAW, SoundData: []byte{0x21}}
+}
+
+// record runs one publisher session of tags through r.
+func record(t *testing.T, r Recorder, tags ...libflv.Tag) {
+	t.Helper()
+	bd := stream()
+	reader := broadcast.NewBroadcastReader(bd)
+	for _, tag := range tags {
+		bd.Write(tag)
+	}
+	bd.DisAlive()
+	done := make(chan error, 1)
+	go func() { done <- r.Record(reader) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Record didn't return after the stream ended")
+	}
+}
+
+func TestFLV_Record(t *testing.T) {
+	dir := t.TempDir()
+	r := NewFLV().WithDir(dir).WithName("x")
+	//Starts mid-stream: the leading inter frame is dropped and the
+	//timeline starts at the first keyframe.
+	record(t, r, video(960, false), video(1000, true), audio(1020), video(1040, false), video(3000, true))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tags, size := readFLV(t, filepath.Join(dir, "x.flv"))
+	if len(tags) != 7 {
+		t.Fatalf("got %d tags, want meta + 2 headers + 4 media", len(tags))
+	}
+	duration, filesize := metaValues(t, tags[0])
+	if duration != 2 || filesize != float64(size) {
+		t.Errorf("onMetaData duration=%v filesize=%v, want 2 and %d", duration, filesize, size)
+	}
+	if tags[1].typ != libflv.VIDEO_TAG || tags[2].typ != libflv.AUDIO_TAG {
+		t.Error("sequence headers don't follow onMetaData")
+	}
+	for i, want := range []uint32{0, 20, 40, 2000} {
+		if got := tags[3+i].ts; got != want {
+			t.Errorf("tag %d at %d ms, want %d", 3+i, got, want)
+		}
+	}
+}
+
+func TestRecord_BadName(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "a", "live")
+	for _, name := range []string{"../../x", "../x", "sub/x", `sub\x`, "..", ""} {
+		for _, r := range []Recorder{NewFLV().WithDir(dir).WithName(name), NewMP4().WithDir(dir).WithName(name)} {
+			bd := stream()
+			reader := broadcast.NewBroadcastReader(bd)
+			bd.Write(video(0, true))
+			bd.DisAlive()
+			if err := r.Record(reader); err == nil {
+				t.Errorf("%T recorded %q", r, name)
+			}
+		}
+	}
+	//Nothing was written, in dir or out of it.
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("files written: %v", entries)
+	}
+}
+
+func TestFLV_RotateAndReconnect(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	r := NewFLV().WithDir(dir).WithName("x").WithMaxDuration(time.Second).
+		WithOnFile(func(path string) { files = append(files, filepath.Base(path)) })
+	record(t, r, video(0, true), video(500, false), video(1500, true), video(1600, false))
+	//The publisher comes back with its clock reset.
+	record(t, r, video(0, true), video(100, false))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 || files[0] != "x.flv" || files[1] != "x-1.flv" {
+		t.Fatalf("files = %v, want [x.flv x-1.flv]", files)
+	}
+	tags, _ := readFLV(t, filepath.Join(dir, "x-1.flv"))
+	if tags[1].typ != libflv.VIDEO_TAG || tags[2].typ != libflv.AUDIO_TAG {
+		t.Error("rotated file doesn't start with the sequence headers")
+	}
+	var last uint32
+	for _, tag := range tags[3:] {
+		if tag.ts < last {
+			t.Errorf("timestamp went back from %d to %d across the reconnect", last, tag.ts)
+		}
+		last = tag.ts
+	}
+	if duration, _ := metaValues(t, tags[0]); duration != float64(last-1500)/1000 {
+		t.Errorf("duration = %v, want %v", duration, float64(last-1500)/1000)
+	}
+}
+
+func TestFLV_Append(t *testing.T) {
+	dir := t.TempDir()
+	first := NewFLV().WithDir(dir).WithName("x")
+	record(t, first, video(0, true), video(2000, true))
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := NewFLV().WithDir(dir).WithName("x").WithMode(Append)
+	record(t, second, video(0, true), video(1000, true))
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tags, size := readFLV(t, filepath.Join(dir, "x.flv"))
+	last := tags[len(tags)-1].ts
+	if last <= 2000 {
+		t.Errorf("appended tags restart the timeline (last at %d ms)", last)
+	}
+	duration, filesize := metaValues(t, tags[0])
+	if duration != float64(last)/1000 || filesize != float64(size) {
+		t.Errorf("onMetaData duration=%v filesize=%v, want %v and %d", duration, filesize, float64(last)/1000, size)
+	}
+
+	overwrite := NewFLV().WithDir(dir).WithName("x")
+	record(t, overwrite, video(0, true))
+	if err := overwrite.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tags, _ := readFLV(t, filepath.Join(dir, "x.flv")); len(tags) != 4 {
+		t.Errorf("record mode kept %d tags, want a fresh file of 4", len(tags))
+	}
+}
@@ -0,0 +1,574 @@
+package librecord
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SmartBrave/Athena/broadcast"
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
+	"github.com/sbraveyoung/GGmpeg/libmp4"
+)
+
+const (
+	mp4VideoTrack     = 1
+	mp4AudioTrack     = 2
+	mp4VideoTimescale = 90000
+	aacFrameSamples   = 1024 //an AAC-LC frame's duration in its sample rate
+)
+
+// MP4 records one stream into <dir>/<name>.mp4, then <name>-1.mp4,
+// <name>-2.mp4… as files rotate. Files are written as fragmented MP4,
+// one fragment per GOP, so a crash loses no more than the GOP being
+// recorded. WithFaststart rewrites each complete file as a progressive
+// MP4 with its moov ahead of the media.
+//
+// Only H.264 and H.265 video, with or without AAC audio, is recorded.
+// A new file is started when the sequence headers change. Append
+// never rewrites an existing file: recording goes on in a new one
+// after the newest.
+//
+// Record may be called again after the previous one ends, as for FLV.
+type MP4 struct {
+	// config — set once before Record().
+	dir         string
+	name        string
+	mode        Mode
+	maxDuration time.Duration //0: no duration rotation
+	maxSize     int64         //0: no size rotation
+	faststart   bool
+	onFile      func(path string)
+	logger      liblog.Logger
+
+	mu        sync.Mutex
+	closed    bool
+	session   int //bumped by every Record; older sessions stop writing
+	file      *os.File
+	path      string
+	index     int   //suffix of the current file, 0 for <name>.mp4
+	size      int64 //bytes in the current file
+	fileStart uint32
+	clock     timeline
+	meta      *libflv.MetaTag
+	video     *libflv.VideoTag //sequence header
+	audio     *libflv.AudioTag //sequence header
+	skipped   bool             //unsupported codec reported
+	movie     *mp4Movie        //tracks of the current file
+}
+
+// mp4Movie is what the current file was started with, and its
+// samples so far.
+type mp4Movie struct {
+	video    *libflv.VideoTag
+	audio    *libflv.AudioTag
+	width    uint16
+	height   uint16
+	aac      *libmp4.AudioParams //nil: no audio track
+	tracks   []*mp4Track         //video, then audio if any
+	sequence uint32
+	media    []mp4Section //every fragment's sample data, in order
+	length   uint64       //total bytes of sample data
+}
+
+type mp4Section struct {
+	at, n int64
+}
+
+type mp4Track struct {
+	id        uint32
+	timescale uint32
+	held      *libmp4.Sample //newest sample, waiting on the next for its duration
+	heldDTS   uint64
+	lastDur   uint32
+	pending   []libmp4.Sample //complete samples for the next fragment
+	baseDTS   uint64          //decode time of pending[0]
+	samples   []libmp4.Sample //written so far, for faststart; no Data
+}
+
+func NewMP4() *MP4 {
+	return &MP4{
+		dir:    "./record",
+		logger: liblog.Nop,
+	}
+}
+
+// WithDir sets the directory files are written to. It is created on
+// the first write if it does not exist.
+func (r *MP4) WithDir(dir string) *MP4 {
+	if dir != "" {
+		r.dir = dir
+	}
+	return r
+}
+
+// WithName sets the file name stem, usually the stream ID.
+func (r *MP4) WithName(name string) *MP4 {
+	r.name = name
+	return r
+}
+
+func (r *MP4) WithMode(mode Mode) *MP4 {
+	r.mode = mode
+	return r
+}
+
+// WithMaxDuration rotates to a new file on the first keyframe past d.
+// Zero never rotates on duration.
+func (r *MP4) WithMaxDuration(d time.Duration) *MP4 {
+	r.maxDuration = d
+	return r
+}
+
+// WithMaxSize rotates to a new file on the first keyframe past n bytes.
+// Zero never rotates on size.
+func (r *MP4) WithMaxSize(n int64) *MP4 {
+	r.maxSize = n
+	return r
+}
+
+// WithFaststart rewrites every complete file as a progressive MP4,
+// for players and editors that don't handle fragmented ones well.
+func (r *MP4) WithFaststart(on bool) *MP4 {
+	r.faststart = on
+	return r
+}
+
+// WithOnFile registers fn to be called with the path of every file
+// once it is complete.
+func (r *MP4) WithOnFile(fn func(path string)) *MP4 {
+	r.onFile = fn
+	return r
+}
+
+// WithLogger routes the recorder's diagnostics to l. The default is
+// silent.
+func (r *MP4) WithLogger(l liblog.Logger) *MP4 {
+	r.logger = liblog.OrNop(l)
+	return r
+}
+
+func (r *MP4) log() liblog.Logger {
+	return r.logger.With(liblog.Stream(r.name), liblog.Protocol("mp4-record"))
+}
+
+// Path reports the file currently being written, if any.
+func (r *MP4) Path() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.path
+}
+
+// Record writes every tag read from gopReader until the stream ends or
+// Close is called. A later Record call takes over from this one.
+func (r *MP4) Record(gopReader *broadcast.BroadcastReader) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	if err := CheckName(r.dir, r.name); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	if r.mode == Append && r.session == 0 {
+		for {
+			if _, err := os.Stat(r.filePath(r.index)); err != nil {
+				break
+			}
+			r.index++
+		}
+	}
+	r.session++
+	session := r.session
+	r.clock.restart()
+	r.mu.Unlock()
+
+	for {
+		//Headers come back with alive=false once the stream has
+		//ended; keep them, the tags after them still need writing.
+		p, alive := gopReader.Read()
+		if !alive && p == nil {
+			return nil
+		}
+		tag, ok := p.(libflv.Tag)
+		if !ok {
+			continue
+		}
+		r.mu.Lock()
+		if r.closed || r.session != session {
+			r.mu.Unlock()
+			return nil
+		}
+		err := r.write(tag)
+		r.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close finalises the current file. Safe to call more than once.
+func (r *MP4) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.finalise()
+}
+
+func (r *MP4) write(tag libflv.Tag) error {
+	switch t := tag.(type) {
+	case *libflv.MetaTag:
+		if t.IsMetaData() {
+			r.meta = t
+		}
+		return nil
+	case *libflv.VideoTag:
+		if t.AVCPacketType == libflv.AVC_SEQUENCE_HEADER && isSequenced(t.CodecID) {
+			r.video = t
+			return r.headerChanged()
+		}
+		if t.AVCPacketType != libflv.AVC_NALU || len(t.VideoData) == 0 {
+			return nil
+		}
+	case *libflv.AudioTag:
+		if t.SoundFormat != libflv.FLV_AUDIO_AAC {
+			return nil
+		}
+		if t.AACPacketType == libflv.AAC_SEQUENCE_HEADER {
+			r.audio = t
+			return r.headerChanged()
+		}
+		if len(t.SoundData) == 0 {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	if !r.supported() {
+		return nil
+	}
+	video, isVideo := tag.(*libflv.VideoTag)
+	cut := isVideo && video.FrameType == libflv.KEY_FRAME
+	if r.file == nil && !cut {
+		return nil
+	}
+	ts := r.clock.at(tag.GetTagInfo().TimeStamp, r.fileStart)
+	if r.file == nil {
+		if err := r.open(ts); err != nil {
+			return err
+		}
+	} else if cut && r.full(ts) {
+		//The keyframe ends the last frame of the file.
+		r.movie.tracks[0].settle(r.dts(r.movie.tracks[0], ts))
+		if err := r.finalise(); err != nil {
+			return err
+		}
+		r.index++
+		if err := r.open(ts); err != nil {
+			return err
+		}
+	}
+
+	if !isVideo {
+		if len(r.movie.tracks) > 1 {
+			audio := r.movie.tracks[1]
+			audio.hold(libmp4.Sample{IsKey: true, Data: tag.(*libflv.AudioTag).SoundData}, audio.settle(r.dts(audio, ts)))
+		}
+		return nil
+	}
+	track := r.movie.tracks[0]
+	dts := track.settle(r.dts(track, ts))
+	if cut {
+		//A fragment per GOP: the previous one is complete now its
+		//last frame's duration is known.
+		if err := r.flush(); err != nil {
+			return err
+		}
+	}
+	cts := int32(video.Cts<<8) >> 8 //signed 24 bits
+	track.hold(libmp4.Sample{
+		IsKey:                 cut,
+		CompositionTimeOffset: int32(int64(cts) * mp4VideoTimescale / 1000),
+		Data:                  video.VideoData,
+	}, dts)
+	return nil
+}
+
+// supported reports whether the stream's video can be recorded, saying
+// so once if it can't.
+func (r *MP4) supported() bool {
+	if r.video != nil && (r.video.CodecID == libflv.FLV_VIDEO_AVC || r.video.CodecID == libflv.FLV_VIDEO_HEVC) {
+		return true
+	}
+	if !r.skipped {
+		r.skipped = true
+		r.log().Warn("mp4 recording needs H.264 or H.265 video; not recording")
+	}
+	return false
+}
+
+// headerChanged closes the current file if it was started with
+// different sequence headers; they are in its moov, so the next
+// keyframe starts a new file.
+func (r *MP4) headerChanged() error {
+	if r.file == nil || sameHeader(r.movie.video, r.video) && sameHeader(r.movie.audio, r.audio) {
+		return nil
+	}
+	if err := r.finalise(); err != nil {
+		return err
+	}
+	r.index++
+	return nil
+}
+
+func sameHeader(a, b libflv.Tag) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Equal(libflv.FLVWrite(a)[11:], libflv.FLVWrite(b)[11:])
+}
+
+// dts converts a timeline timestamp to t's decode time in the file.
+func (r *MP4) dts(t *mp4Track, ts uint32) uint64 {
+	return uint64(ts-r.fileStart) * uint64(t.timescale) / 1000
+}
+
+// settle gives the held sample its duration now the next one is due
+// at dts. A repeated timestamp is moved on a tick rather than leave
+// the held sample without a duration; the dts to use is returned.
+func (t *mp4Track) settle(dts uint64) uint64 {
+	if t.held == nil {
+		return dts
+	}
+	if dts <= t.heldDTS {
+		dts = t.heldDTS + 1
+	}
+	t.lastDur = uint32(dts - t.heldDTS)
+	t.held.Duration = t.lastDur
+	t.push(*t.held, t.heldDTS)
+	t.held = nil
+	return dts
+}
+
+func (t *mp4Track) hold(s libmp4.Sample, dts uint64) {
+	s.Size = uint32(len(s.Data))
+	t.held, t.heldDTS = &s, dts
+}
+
+func (t *mp4Track) push(s libmp4.Sample, dts uint64) {
+	if len(t.pending) == 0 {
+		t.baseDTS = dts
+	}
+	t.pending = append(t.pending, s)
+}
+
+// flush writes the pending samples out as a fragment.
+func (r *MP4) flush() error {
+	m := r.movie
+	video := m.tracks[0]
+	params := libmp4.MediaSegmentParams{
+		TrackID:        video.id,
+		SequenceNumber: m.sequence + 1,
+		BaseDecodeTime: video.baseDTS,
+		Samples:        video.pending,
+	}
+	var length uint64
+	if len(m.tracks) > 1 {
+		audio := m.tracks[1]
+		params.Audio = &libmp4.TrackFragment{TrackID: audio.id, BaseDecodeTime: audio.baseDTS, Samples: audio.pending}
+	}
+	for _, t := range m.tracks {
+		for _, s := range t.pending {
+			length += uint64(s.Size)
+		}
+	}
+	frag := libmp4.BuildMediaSegment(params)
+	if frag == nil {
+		return nil
+	}
+	if err := r.writeFile(frag); err != nil {
+		return err
+	}
+	m.sequence++
+	//BuildMediaSegment lays the tracks' data out in order at the end.
+	m.media = append(m.media, mp4Section{at: r.size - int64(length), n: int64(length)})
+	for _, t := range m.tracks {
+		for _, s := range t.pending {
+			if r.faststart {
+				s.Data, s.Offset = nil, m.length
+				t.samples = append(t.samples, s)
+			}
+			m.length += uint64(s.Size)
+		}
+		t.pending = nil
+	}
+	return nil
+}
+
+func (r *MP4) writeFile(b []byte) error {
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", r.path, err)
+	}
+	return nil
+}
+
+func (r *MP4) full(ts uint32) bool {
+	if r.maxDuration > 0 && time.Duration(ts-r.fileStart)*time.Millisecond >= r.maxDuration {
+		return true
+	}
+	return r.maxSize > 0 && r.size >= r.maxSize
+}
+
+func (r *MP4) filePath(index int) string {
+	if index == 0 {
+		return filepath.Join(r.dir, r.name+".mp4")
+	}
+	return filepath.Join(r.dir, r.name+"-"+strconv.Itoa(index)+".mp4")
+}
+
+// open starts the file for r.index with the current sequence headers.
+func (r *MP4) open(ts uint32) error {
+	m := &mp4Movie{video: r.video, audio: r.audio, tracks: []*mp4Track{{id: mp4VideoTrack, timescale: mp4VideoTimescale}}}
+	if r.meta != nil {
+		m.width, m.height = uint16(r.meta.Width), uint16(r.meta.Height)
+	}
+	if r.audio != nil {
+		rate, channels, err := libmp4.ParseAudioSpecificConfig(r.audio.SoundData)
+		if err != nil {
+			r.log().Warn("recording without audio", liblog.Err(err))
+		} else {
+			m.aac = &libmp4.AudioParams{TrackID: mp4AudioTrack, SampleRate: rate, Channels: channels, Config: r.audio.SoundData}
+			m.tracks = append(m.tracks, &mp4Track{id: mp4AudioTrack, timescale: rate})
+		}
+	}
+	init := m.head(nil)
+
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", r.dir, err)
+	}
+	r.path = r.filePath(r.index)
+	//Read back by faststart.
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", r.path, err)
+	}
+	r.file, r.size, r.fileStart, r.movie = f, 0, ts, m
+	if err := r.writeFile(init); err != nil {
+		return err
+	}
+	r.log().Info("record file opened", liblog.F("path", r.path))
+	return nil
+}
+
+// finalise writes out the samples still held, remuxes the file if
+// faststart is on and closes it.
+func (r *MP4) finalise() error {
+	if r.file == nil {
+		return nil
+	}
+	for _, t := range r.movie.tracks {
+		if t.held == nil {
+			continue
+		}
+		//Nothing follows the last sample: assume it lasts as long as
+		//the one before.
+		t.held.Duration = t.lastDur
+		if t.lastDur == 0 {
+			t.held.Duration = t.timescale / 30
+			if t.id == mp4AudioTrack {
+				t.held.Duration = aacFrameSamples
+			}
+		}
+		t.push(*t.held, t.heldDTS)
+		t.held = nil
+	}
+	err := r.flush()
+	if err == nil && r.faststart {
+		err = r.remux()
+	}
+	f, path := r.file, r.path
+	r.file, r.movie = nil, nil
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("finalise %s: %w", path, err)
+	}
+	r.log().Info("record file closed", liblog.F("path", path), liblog.F("bytes", r.size))
+	if r.onFile != nil {
+		r.onFile(path)
+	}
+	return nil
+}
+
+// remux rewrites the fragmented file as a progressive one: moov first,
+// then the samples' data in the order it was recorded.
+func (r *MP4) remux() error {
+	m := r.movie
+	head := m.head(m.tracks)
+	tmp := r.path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("faststart: %w", err)
+	}
+	_, err = out.Write(head)
+	for _, sec := range m.media {
+		if err != nil {
+			break
+		}
+		_, err = io.Copy(out, io.NewSectionReader(r.file, sec.at, sec.n))
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, r.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("faststart: %w", err)
+	}
+	r.size = int64(len(head)) + int64(m.length)
+	return nil
+}
+
+// head builds the init segment of the fragmented file, or with the
+// recorded tracks the head of the progressive one.
+func (m *mp4Movie) head(recorded []*mp4Track) []byte {
+	var video []libmp4.Sample
+	audio := m.aac
+	if recorded != nil {
+		video = recorded[0].samples
+		if audio != nil {
+			copied := *audio
+			copied.Samples = recorded[1].samples
+			audio = &copied
+		}
+	}
+	if m.video.CodecID == libflv.FLV_VIDEO_HEVC {
+		p := libmp4.HEVCInitParams{TrackID: mp4VideoTrack, Timescale: mp4VideoTimescale,
+			Width: m.width, Height: m.height, HVCCRecord: m.video.VideoData, Samples: video, Audio: audio}
+		if recorded != nil {
+			return libmp4.BuildHEVCMovie(p)
+		}
+		return libmp4.BuildHEVCInitSegment(p)
+	}
+	p := libmp4.InitSegmentParams{TrackID: mp4VideoTrack, Timescale: mp4VideoTimescale,
+		Width: m.width, Height: m.height, AVCCRecord: m.video.VideoData, Samples: video, Audio: audio}
+	if recorded != nil {
+		return libmp4.BuildMovie(p)
+	}
+	return libmp4.BuildInitSegment(p)
+}
@@ -0,0 +1,149 @@
+package librecord
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// boxes lists the top-level boxes of b and their bodies.
+func boxes(t *testing.T, b []byte) (types []string, bodies [][]byte) {
+	t.Helper()
+	for i := 0; i < len(b); {
+		if i+8 > len(b) {
+			t.Fatalf("truncated box at %d", i)
+		}
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		if n < 8 || i+n > len(b) {
+			t.Fatalf("bad box size %d at %d", n, i)
+		}
+		types = append(types, string(b[i+4:i+8]))
+		bodies = append(bodies, b[i+8:i+n])
+		i += n
+	}
+	return types, bodies
+}
+
+// child returns the body of the first box of type typ in body.
+func child(body []byte, typ string) []byte {
+	for i := 0; i+8 <= len(body); {
+		n := int(binary.BigEndian.Uint32(body[i:]))
+		if n < 8 || i+n > len(body) {
+			return nil
+		}
+		if string(body[i+4:i+8]) == typ {
+			return body[i+8 : i+n]
+		}
+		i += n
+	}
+	return nil
+}
+
+func TestMP4_Fragmented(t *testing.T) {
+	dir := t.TempDir()
+	r := NewMP4().WithDir(dir).WithName("x")
+	record(t, r, video(0, true), audio(20), video(40, false), video(2000, true), audio(2020))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "x.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, bodies := boxes(t, b)
+	want := []string{"ftyp", "moov", "moof", "mdat", "moof", "mdat"}
+	if len(types) != len(want) {
+		t.Fatalf("boxes = %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("boxes = %v, want %v", types, want)
+		}
+	}
+	if child(bodies[1], "mvex") == nil {
+		t.Error("fragmented file's moov has no mvex")
+	}
+	//One GOP per fragment. An audio frame waits for the next to know
+	//its duration, so both land in the second.
+	if len(bodies[3]) != 5+5 || len(bodies[5]) != 5+1+1 {
+		t.Errorf("mdat sizes %d and %d, want 10 and 7", len(bodies[3]), len(bodies[5]))
+	}
+}
+
+func TestMP4_Faststart(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	r := NewMP4().WithDir(dir).WithName("x").WithFaststart(true).
+		WithOnFile(func(path string) { files = append(files, path) })
+	record(t, r, video(0, true), audio(20), video(40, false), video(2000, true), audio(2020))
+	//A reconnect carries on in the same file.
+	record(t, r, video(0, true), video(40, false))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("files = %v, want one", files)
+	}
+
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, bodies := boxes(t, b)
+	if len(types) != 3 || types[0] != "ftyp" || types[1] != "moov" || types[2] != "mdat" {
+		t.Fatalf("boxes = %v, want [ftyp moov mdat]", types)
+	}
+	var traks [][]byte
+	for i := 0; i < len(bodies[1]); {
+		n := int(binary.BigEndian.Uint32(bodies[1][i:]))
+		if string(bodies[1][i+4:i+8]) == "trak" {
+			traks = append(traks, bodies[1][i+8:i+n])
+		}
+		i += n
+	}
+	if len(traks) != 2 {
+		t.Fatalf("%d traks, want video and audio", len(traks))
+	}
+	mdatAt := len(b) - len(bodies[2])
+	for i, want := range []struct {
+		samples uint32
+		first   byte
+	}{{5, 0}, {2, 0x21}} {
+		stbl := child(child(child(traks[i], "mdia"), "minf"), "stbl")
+		if n := binary.BigEndian.Uint32(child(stbl, "stsz")[8:]); n != want.samples {
+			t.Errorf("track %d has %d samples, want %d", i, n, want.samples)
+		}
+		stco := child(stbl, "stco")
+		if off := int(binary.BigEndian.Uint32(stco[8:])); off < mdatAt || b[off] != want.first {
+			t.Errorf("track %d first chunk at %d, not on its data in mdat (at %d)", i, off, mdatAt)
+		}
+	}
+	//Keyframes at 0 and 2000, then the reconnect's.
+	if n := binary.BigEndian.Uint32(child(child(child(child(traks[0], "mdia"), "minf"), "stbl"), "stss")[4:]); n != 3 {
+		t.Errorf("%d sync samples, want 3", n)
+	}
+	if _, err := os.Stat(files[0] + ".tmp"); !os.IsNotExist(err) {
+		t.Error("faststart left its temporary file behind")
+	}
+}
+
+func TestMP4_RotateOnHeaderChange(t *testing.T) {
+	dir := t.TempDir()
+	r := NewMP4().WithDir(dir).WithName("x")
+	record(t, r, video(0, true), video(40, false))
+	changed := &libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG, TimeStamp: 80}, FrameType: libflv.KEY_FRAME,
+		CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_SEQUENCE_HEADER, VideoData: []byte{1, 3}}
+	record(t, r, changed, video(80, true))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"x.mp4", "x-1.mp4"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s not recorded: %v", name, err)
+		}
+	}
+}
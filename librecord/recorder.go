@@ -0,0 +1,36 @@
+// Package librecord writes published streams to files.
+package librecord
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/SmartBrave/Athena/broadcast"
+)
+
+type Mode uint8
+
+const (
+	Record Mode = iota //start over: the first file is truncated
+	Append             //continue the newest existing file
+)
+
+// Recorder records a stream read from a room's GOP broadcast. FLV and
+// MP4 implement it.
+type Recorder interface {
+	Record(gopReader *broadcast.BroadcastReader) error
+	Path() string
+	Close() error
+}
+
+// CheckName returns an error unless name, a stream's, makes files
+// right in dir: no separators, no "..".
+func CheckName(dir, name string) error {
+	full := filepath.Join(dir, name)
+	rel, err := filepath.Rel(dir, full)
+	if name == "" || err != nil || rel != name || strings.ContainsAny(name, `/\`) || rel == "." || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("bad recording name %q", name)
+	}
+	return nil
+}
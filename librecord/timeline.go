@@ -0,0 +1,47 @@
+package librecord
+
+import "math"
+
+// timeline maps a publisher's timestamps onto a recording's, which
+// starts at 0 and keeps going up across publisher sessions.
+type timeline struct {
+	rebase bool  //the next timestamp starts a new session
+	offset int64 //added to incoming timestamps
+	last   uint32
+	seen   bool
+}
+
+// restart makes the next timestamp carry on just after the last one,
+// whatever the publisher's clock says.
+func (tl *timeline) restart() {
+	tl.rebase = true
+}
+
+// resume carries the timeline on from last, e.g. the end of a file
+// being appended to.
+func (tl *timeline) resume(last uint32) {
+	tl.last, tl.seen = last, true
+}
+
+// at maps ts onto the timeline, no earlier than floor.
+func (tl *timeline) at(ts, floor uint32) uint32 {
+	if tl.rebase {
+		tl.rebase = false
+		next := int64(0)
+		if tl.seen {
+			next = int64(tl.last) + 1
+		}
+		tl.offset = next - int64(ts)
+	}
+	out := int64(ts) + tl.offset
+	if out < int64(floor) {
+		out = int64(floor)
+	}
+	if out > math.MaxUint32 {
+		out = math.MaxUint32
+	}
+	if uint32(out) > tl.last || !tl.seen {
+		tl.last, tl.seen = uint32(out), true
+	}
+	return uint32(out)
+}
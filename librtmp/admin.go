@@ -0,0 +1,276 @@
+package librtmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// WithAdminAPI starts a JSON admin listener on address:
+//
+//	GET    /api/apps                                    apps and their rooms
+//	GET    /api/apps/<app>/rooms/<room>                 one room, with sessions
+//	DELETE /api/apps/<app>/rooms/<room>                 kick the publisher
+//	GET    /api/apps/<app>/rooms/<room>/sessions        subscribers
+//	DELETE /api/apps/<app>/rooms/<room>/sessions/<id>   kick one subscriber
+//	GET    /api/pushes                                  push destinations and their state
+//	POST   /api/reload                                  re-read the config file
+//	GET    /metrics                                     Prometheus text format
+//
+// The listener has no authentication of its own; bind it to a private
+// interface.
+func (s *server) WithAdminAPI(address string) *server {
+	s.adminAddress = address
+	return s
+}
+
+func (s *server) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/apps", s.adminListApps)
+	mux.HandleFunc("/api/apps/", s.adminRoom)
+	mux.HandleFunc("/api/pushes", s.adminListPushes)
+	mux.HandleFunc("/api/reload", s.adminReload)
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	return mux
+}
+
+type videoInfo struct {
+	Codec  string `json:"codec"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+type audioInfo struct {
+	Codec      string `json:"codec"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Channels   int    `json:"channels"`
+}
+
+type publisherInfo struct {
+	Peer     string   `json:"peer"`
+	Protocol Protocol `json:"protocol"`
+}
+
+type sessionInfo struct {
+	ID            string   `json:"id"`
+	Protocol      Protocol `json:"protocol"`
+	Peer          string   `json:"peer"`
+	UptimeSeconds float64  `json:"uptime_seconds"`
+	Kickable      bool     `json:"kickable"`
+	DroppedFrames int64    `json:"dropped_frames"` //see SendQueueConfig
+	Skips         int64    `json:"skips"`
+}
+
+type roomInfo struct {
+	App           string        `json:"app"`
+	Stream        string        `json:"stream"`
+	Publisher     publisherInfo `json:"publisher"`
+	UptimeSeconds float64       `json:"uptime_seconds"`
+	BytesIn       int64         `json:"bytes_in"`
+	BytesOut      int64         `json:"bytes_out"`
+	BitrateKbps   float64       `json:"bitrate_kbps"`
+	CacheBytes    int64         `json:"cache_bytes"` //media held for viewers; see GOPCacheConfig
+	Video         *videoInfo    `json:"video,omitempty"`
+	Audio         *audioInfo    `json:"audio,omitempty"`
+	Subscribers   int           `json:"subscribers"`
+	Sessions      []sessionInfo `json:"sessions,omitempty"`
+}
+
+type appInfo struct {
+	Name  string     `json:"name"`
+	Rooms []roomInfo `json:"rooms"`
+}
+
+func (s *server) adminListApps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	appList := s.appList()
+	apps := make([]appInfo, 0, len(appList))
+	for _, app := range appList {
+		info := appInfo{Name: app.appName, Rooms: []roomInfo{}}
+		app.Range(func(roomID string, room *Room) bool {
+			info.Rooms = append(info.Rooms, describeRoom(app.appName, room, false))
+			return true
+		})
+		sort.Slice(info.Rooms, func(i, j int) bool { return info.Rooms[i].Stream < info.Rooms[j].Stream })
+		apps = append(apps, info)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"apps": apps})
+}
+
+// adminListPushes reports every running push; see Pushes.
+func (s *server) adminListPushes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"pushes": s.Pushes()})
+}
+
+// adminReload applies the config file again; see ReloadFile.
+func (s *server) adminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.ReloadFile(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminRoom serves everything under /api/apps/<app>/rooms/<room>.
+func (s *server) adminRoom(w http.ResponseWriter, r *http.Request) {
+	//app, "rooms", room[, "sessions"[, id]]
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/apps/"), "/"), "/")
+	if len(parts) < 3 || len(parts) > 5 || parts[1] != "rooms" || (len(parts) > 3 && parts[3] != "sessions") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	app, ok := s.app(parts[0])
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+		return
+	}
+	room := app.Load(parts[2])
+	if room == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "room not found"})
+		return
+	}
+
+	switch {
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, describeRoom(parts[0], room, true))
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		if room.Publisher == nil || !room.Publisher.kick() {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "publisher can't be kicked"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 4 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": describeSessions(room)})
+	case len(parts) == 5 && r.Method == http.MethodDelete:
+		sess := room.session(parts[4])
+		if sess == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+			return
+		}
+		if sess.kick == nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "session can't be kicked"})
+			return
+		}
+		sess.kick()
+		room.removeSession(sess)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func describeRoom(app string, room *Room, withSessions bool) roomInfo {
+	bytesIn, bps := room.bytesIn.snapshot()
+	bytesOut, _ := room.bytesOut.snapshot()
+	sessions := describeSessions(room)
+	info := roomInfo{
+		App:           app,
+		Stream:        room.RoomID,
+		Publisher:     publisherInfo{Protocol: room.protocol},
+		UptimeSeconds: time.Since(room.startTime).Seconds(),
+		BytesIn:       bytesIn,
+		BytesOut:      bytesOut,
+		BitrateKbps:   bps / 1000,
+		CacheBytes:    room.cacheBytes(),
+		Subscribers:   len(sessions),
+	}
+	if room.Publisher != nil {
+		info.Publisher.Peer = room.Publisher.peer
+	}
+	if withSessions {
+		info.Sessions = sessions
+	}
+
+	meta, video, audio := room.snapshotHeaders()
+	if video != nil {
+		info.Video = &videoInfo{Codec: videoCodecName(video.CodecID)}
+		if meta != nil {
+			info.Video.Width, info.Video.Height = meta.Width, meta.Height
+		}
+	}
+	if audio != nil {
+		info.Audio = &audioInfo{Codec: audioCodecName(audio.SoundFormat), Channels: 1}
+		if audio.SoundType == libflv.SND_STEREO {
+			info.Audio.Channels = 2
+		}
+		if meta != nil {
+			info.Audio.SampleRate = meta.AudioSampleRate
+		}
+	}
+	return info
+}
+
+func describeSessions(room *Room) []sessionInfo {
+	out := []sessionInfo{}
+	for _, sess := range room.Sessions() {
+		out = append(out, sessionInfo{
+			ID:            sess.ID,
+			Protocol:      sess.Protocol,
+			Peer:          sess.Peer,
+			UptimeSeconds: time.Since(sess.Start).Seconds(),
+			Kickable:      sess.kick != nil,
+			DroppedFrames: atomic.LoadInt64(&sess.dropped),
+			Skips:         atomic.LoadInt64(&sess.skips),
+		})
+	}
+	return out
+}
+
+func videoCodecName(id uint8) string {
+	switch id {
+	case libflv.FLV_VIDEO_AVC:
+		return "h264"
+	case libflv.FLV_VIDEO_HEVC:
+		return "h265"
+	case libflv.FLV_VIDEO_AV1:
+		return "av1"
+	case libflv.FLV_VIDEO_VP9:
+		return "vp9"
+	case libflv.FLV_VIDEO_VP6:
+		return "vp6"
+	case libflv.FLV_VIDEO_SORENSON_H263:
+		return "h263"
+	default:
+		return fmt.Sprintf("unknown(%d)", id)
+	}
+}
+
+func audioCodecName(format uint8) string {
+	switch format {
+	case libflv.FLV_AUDIO_AAC:
+		return "aac"
+	case libflv.FLV_AUDIO_MP3, libflv.FLV_AUDIO_MP3_8K:
+		return "mp3"
+	case libflv.FLV_AUDIO_OPUS:
+		return "opus"
+	case libflv.FLV_AUDIO_G711A:
+		return "pcma"
+	case libflv.FLV_AUDIO_G711U:
+		return "pcmu"
+	default:
+		return fmt.Sprintf("unknown(%d)", format)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,217 @@
+package librtmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/libmetrics"
+)
+
+func TestAdminAPI_ListAndKick(t *testing.T) {
+	srv := NewServer(":0", "live")
+	pubConn, peerConn := net.Pipe()
+	defer peerConn.Close()
+	pub := &RTMP{conn: pubConn, server: srv, app: "live", role: rolePublisher, peer: "10.0.0.1:1935"}
+	room := NewRoom(pub, "x")
+	pub.room = room
+	srv.apps["live"].Store("x", room)
+
+	room.setVideoSequenceHeader(&libflv.VideoTag{CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_SEQUENCE_HEADER})
+	room.setAudioSequenceHeader(&libflv.AudioTag{SoundFormat: libflv.FLV_AUDIO_AAC, SoundType: libflv.SND_STEREO})
+	room.setMeta(&libflv.MetaTag{Width: 1280, Height: 720, AudioSampleRate: 44100})
+	room.writeTag(&libflv.VideoTag{TagBase: libflv.TagBase{DataSize: 1000}}, true)
+
+	kw := &kickableWriter{w: discardWriter{}}
+	flv := room.addSession(ProtocolFLV, "10.0.0.2:4000", kw.kick)
+	room.touchSession(ProtocolHLS, "10.0.0.3:4001")
+
+	api := httptest.NewServer(srv.adminMux())
+	defer api.Close()
+
+	var apps struct {
+		Apps []appInfo `json:"apps"`
+	}
+	getJSON(t, api.URL+"/api/apps", &apps)
+	if len(apps.Apps) != 1 || len(apps.Apps[0].Rooms) != 1 {
+		t.Fatalf("apps = %+v", apps)
+	}
+	ri := apps.Apps[0].Rooms[0]
+	if ri.Stream != "x" || ri.Publisher.Protocol != ProtocolRTMP || ri.Publisher.Peer != "10.0.0.1:1935" {
+		t.Errorf("room = %+v", ri)
+	}
+	if ri.Video == nil || ri.Video.Codec != "h264" || ri.Video.Width != 1280 || ri.Video.Height != 720 {
+		t.Errorf("video = %+v", ri.Video)
+	}
+	if ri.Audio == nil || ri.Audio.Codec != "aac" || ri.Audio.Channels != 2 || ri.Audio.SampleRate != 44100 {
+		t.Errorf("audio = %+v", ri.Audio)
+	}
+	if ri.BytesIn != 1000 || ri.Subscribers != 2 {
+		t.Errorf("bytes_in = %d, subscribers = %d", ri.BytesIn, ri.Subscribers)
+	}
+
+	var sessions struct {
+		Sessions []sessionInfo `json:"sessions"`
+	}
+	getJSON(t, api.URL+"/api/apps/live/rooms/x/sessions", &sessions)
+	if len(sessions.Sessions) != 2 || sessions.Sessions[0].Protocol != ProtocolFLV || sessions.Sessions[1].Protocol != ProtocolHLS {
+		t.Fatalf("sessions = %+v", sessions)
+	}
+	hlsID := sessions.Sessions[1].ID
+
+	if code := doDelete(t, api.URL+"/api/apps/live/rooms/x/sessions/"+flv.ID); code != http.StatusNoContent {
+		t.Errorf("kick flv: status %d", code)
+	}
+	if _, err := kw.Write([]byte{0}); err != errKicked {
+		t.Errorf("kicked writer still writable: %v", err)
+	}
+	if code := doDelete(t, api.URL+"/api/apps/live/rooms/x/sessions/"+hlsID); code != http.StatusConflict {
+		t.Errorf("kick hls: status %d, want 409", code)
+	}
+	if code := doDelete(t, api.URL+"/api/apps/live/rooms/x"); code != http.StatusNoContent {
+		t.Errorf("kick publisher: status %d", code)
+	}
+	if _, err := peerConn.Write([]byte{0}); err == nil {
+		t.Error("publisher connection still open after kick")
+	}
+	if code := doDelete(t, api.URL+"/api/apps/live/rooms/missing"); code != http.StatusNotFound {
+		t.Errorf("missing room: status %d", code)
+	}
+}
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decode %s: %v", url, err)
+	}
+}
+
+func doDelete(t *testing.T, url string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodDelete, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE %s: %v", url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAdminAPI_Metrics(t *testing.T) {
+	srv := NewServer(":0", "live")
+	room := NewRoom(&RTMP{server: srv, app: "live"}, "m")
+	room.protocol = ProtocolSRT
+	srv.apps["live"].Store("m", room)
+	room.writeTag(&libflv.AudioTag{TagBase: libflv.TagBase{DataSize: 321}}, false)
+	room.addSession(ProtocolRTSP, "10.0.0.9:1", nil)
+
+	api := httptest.NewServer(srv.adminMux())
+	defer api.Close()
+	resp, err := http.Get(api.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`ggmpeg_publishers{protocol="srt"} 1`,
+		`ggmpeg_players{protocol="rtsp"} 1`,
+		`ggmpeg_room_bytes_in_total{app="live",stream="m"} 321`,
+		`# TYPE ggmpeg_hls_segments_total counter`,
+		`# TYPE ggmpeg_srt_naks_sent_total counter`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+
+}
+
+func TestAdminAPI_MetricsConcurrentScrapes(t *testing.T) {
+	srv := NewServer(":0", "live")
+	for i := 0; i < 500; i++ {
+		room := NewRoom(&RTMP{server: srv, app: "live"}, fmt.Sprint(i))
+		room.protocol = ProtocolSRT
+		srv.apps["live"].Store(room.RoomID, room)
+	}
+	api := httptest.NewServer(srv.adminMux())
+	defer api.Close()
+
+	//None sees another's series half rebuilt.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				resp, err := http.Get(api.URL + "/metrics")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if !strings.Contains(string(body), `ggmpeg_publishers{protocol="srt"} 500`+"\n") {
+					t.Error("a concurrent scrape got a wrong publisher count")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestAdminAPI_MetricsPerServer(t *testing.T) {
+	scrape := func(srv *server) string {
+		api := httptest.NewServer(srv.adminMux())
+		defer api.Close()
+		resp, err := http.Get(api.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	a, b := NewServer(":0", "live"), NewServer(":0", "live")
+	a.apps["live"].Store("a", NewRoom(&RTMP{server: a, app: "live"}, "a"))
+	b.apps["live"].Store("b", NewRoom(&RTMP{server: b, app: "live"}, "b"))
+
+	bodyA, bodyB := scrape(a), scrape(b)
+	if !strings.Contains(bodyA, `ggmpeg_room_bytes_in_total{app="live",stream="a"}`) || strings.Contains(bodyA, `stream="b"`) {
+		t.Errorf("first server's metrics:\n%s", bodyA)
+	}
+	if !strings.Contains(bodyB, `ggmpeg_room_bytes_in_total{app="live",stream="b"}`) || strings.Contains(bodyB, `stream="a"`) {
+		t.Errorf("second server's metrics:\n%s", bodyB)
+	}
+	if !strings.Contains(bodyA, "# TYPE ggmpeg_rtmp_parse_errors_total counter") {
+		t.Error("process-wide series missing")
+	}
+
+	//Scraping one server leaves the other's series alone.
+	var sb strings.Builder
+	_, _ = a.metrics.registry.WriteTo(&sb)
+	if !strings.Contains(sb.String(), `stream="a"`) {
+		t.Error("scraping the second server reset the first one's rooms")
+	}
+	sb.Reset()
+	_, _ = libmetrics.Default.WriteTo(&sb)
+	if strings.Contains(sb.String(), "ggmpeg_room_bytes_in_total") {
+		t.Error("room series in the process-wide registry")
+	}
+}
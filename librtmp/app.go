@@ -2,31 +2,50 @@ package librtmp
 
 import (
 	"sync"
+	"time"
 
 	"github.com/sbraveyoung/GGmpeg/libdash"
 	"github.com/sbraveyoung/GGmpeg/libhls"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 )
 
 type App struct {
-	appName     string
-	rooms       *sync.Map //roomID, *Room
-	hlsMode     libhls.HLS_MODE
-	hlsDir      string
-	hls         *sync.Map //roomID, *libhls.HLS
-	dashEnabled bool
-	dashDir     string
-	dash        *sync.Map //roomID, *libdash.DASH
+	appName        string
+	rooms          *sync.Map //roomID, *Room
+	hlsMode        libhls.HLS_MODE
+	hlsDir         string
+	hlsTargetDur   time.Duration //0: libhls default
+	hlsWindowSize  int           //0: libhls default
+	hlsLowLatency  bool
+	hls            *sync.Map //roomID, *libhls.HLS
+	hlsAudio       *sync.Map //roomID, *libhls.HLS: audio-only renditions
+	dashEnabled    bool
+	dashDir        string
+	dashTargetDur  time.Duration    //0: libdash default
+	dashWindowSize int              //0: libdash default
+	dash           *sync.Map        //roomID, *libdash.DASH
+	token          *TokenConfig     //nil: no signed-URL check
+	record         *RecordConfig    //nil: no recording
+	vod            *VODConfig       //nil: no VOD playback
+	dvr            *DVRConfig       //nil: no time-shift window
+	edge           *EdgeConfig      //nil: not an edge
+	gopCache       *GOPCacheConfig  //nil: start at the latest keyframe
+	sendQueue      *SendQueueConfig //nil: the defaults
+	recordings     *recordings
 }
 
 func NewApp(appName string) *App {
 	return &App{
-		appName: appName,
-		rooms:   &sync.Map{},
-		hlsMode: libhls.NONE,
-		hlsDir:  "./data",
-		hls:     &sync.Map{},
-		dashDir: "./data",
-		dash:    &sync.Map{},
+		appName:  appName,
+		rooms:    &sync.Map{},
+		hlsMode:  libhls.NONE,
+		hlsDir:   "./data",
+		hls:      &sync.Map{},
+		hlsAudio: &sync.Map{},
+		dashDir:  "./data",
+		dash:     &sync.Map{},
+		//Shared with the App that replaces this one on Reload.
+		recordings: newRecordings(),
 	}
 }
 
@@ -38,6 +57,13 @@ func (app *App) Load(roomID string) *Room {
 	return room.(*Room)
 }
 
+// Range calls fn for every live room until fn returns false.
+func (app *App) Range(fn func(roomID string, room *Room) bool) {
+	app.rooms.Range(func(k, v interface{}) bool {
+		return fn(k.(string), v.(*Room))
+	})
+}
+
 func (app *App) Store(roomID string, room *Room) {
 	app.rooms.Store(roomID, room)
 }
@@ -48,6 +74,11 @@ func (app *App) Delete(roomID string) {
 			hls.Stop()
 		}
 	}
+	if h, ok := app.hlsAudio.LoadAndDelete(roomID); ok {
+		if hls, ok := h.(*libhls.HLS); ok {
+			hls.Stop()
+		}
+	}
 	if d, ok := app.dash.LoadAndDelete(roomID); ok {
 		if dash, ok := d.(*libdash.DASH); ok {
 			dash.Stop()
@@ -79,3 +110,26 @@ func (app *App) LoadDASH(roomID string) *libdash.DASH {
 func (app *App) StoreDASH(roomID string, dash *libdash.DASH) {
 	app.dash.Store(roomID, dash)
 }
+
+// newHLS builds the HLS segmenter for one of app's rooms.
+func (s *server) newHLS(app *App, roomID string) *libhls.HLS {
+	return libhls.NewHls().
+		WithStreamID(roomID).
+		WithDir(app.hlsDir).
+		WithTargetDuration(app.hlsTargetDur).
+		WithWindowSize(app.hlsWindowSize).
+		WithLowLatency(app.hlsLowLatency).
+		WithOnSegment(s.hlsSegmentHook(app.appName)).
+		WithLogger(s.logger.With(liblog.App(app.appName)))
+}
+
+// newDASH builds the DASH segmenter for one of app's rooms.
+func (s *server) newDASH(app *App, roomID string) *libdash.DASH {
+	return libdash.NewDASH().
+		WithStreamID(roomID).
+		WithDir(app.dashDir).
+		WithTargetDuration(app.dashTargetDur).
+		WithWindowSize(app.dashWindowSize).
+		WithOnSegment(s.dashSegmentHook(app.appName)).
+		WithLogger(s.logger.With(liblog.App(app.appName)))
+}
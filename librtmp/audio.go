@@ -1,10 +1,8 @@
 package librtmp
 
 import (
-	"fmt"
-	"time"
-
 	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 )
 
 type AudioCodec float64
@@ -81,16 +79,19 @@ func (am *AudioMessage) Parse() (err error) {
 }
 
 func (am *AudioMessage) Do() (err error) {
+	if am.rtmp.onTag != nil {
+		am.rtmp.onTag(am.audioTag)
+		return nil
+	}
 	if am.rtmp.room == nil {
 		return nil
 	}
 	if am.audioTag.SoundFormat == libflv.FLV_AUDIO_AAC && am.audioTag.AACPacketType == libflv.AAC_SEQUENCE_HEADER {
 		am.rtmp.room.setAudioSequenceHeader(am.audioTag)
 		am.rtmp.room.GOP.WriteMeta(am.audioTag)
-		fmt.Printf("write packet audio :%+v\n", am.audioTag)
+		am.rtmp.log().Debug("audio sequence header", liblog.F("format", am.audioTag.SoundFormat))
 		return nil
 	}
-	fmt.Printf("[gop receive audio] message time(dts):%d, now:%+v\n", am.messageTime, time.Now())
-	am.rtmp.room.GOP.Write(am.audioTag)
+	am.rtmp.room.writeTag(am.audioTag, false)
 	return nil
 }
@@ -0,0 +1,161 @@
+package librtmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libsrt"
+)
+
+func TestSplitStreamName(t *testing.T) {
+	cases := []struct {
+		in, name, token string
+	}{
+		{"room", "room", ""},
+		{"room?token=abc", "room", "abc"},
+		{"room?token=abc&x=1", "room", "abc"},
+		{"room?", "room", ""},
+	}
+	for _, c := range cases {
+		name, q := splitStreamName(c.in)
+		if name != c.name || q.Get("token") != c.token {
+			t.Errorf("splitStreamName(%q) = %q, %v; want %q, token=%q", c.in, name, q, c.name, c.token)
+		}
+	}
+}
+
+func TestMergeQuery_StreamNameWins(t *testing.T) {
+	dst := url.Values{"token": {"stream"}}
+	src := url.Values{"token": {"tcurl"}, "user": {"u"}}
+	got := mergeQuery(dst, src)
+	if got.Get("token") != "stream" || got.Get("user") != "u" {
+		t.Errorf("mergeQuery = %v", got)
+	}
+}
+
+// TestRTSP_DescribeUnauthorized asserts a rejecting Authorizer turns
+// DESCRIBE into 401 and sees the URL query the client sent.
+func TestRTSP_DescribeUnauthorized(t *testing.T) {
+	var gotQuery url.Values
+	var gotAction Action
+	srv := NewServer(":0", "live").WithAuthorizer(func(ctx context.Context, action Action, app, stream string, query url.Values, peer string) error {
+		gotAction, gotQuery = action, query
+		return ErrUnauthorized
+	})
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go newRTSPSession(a, srv).run()
+
+	send(t, b, "DESCRIBE rtsp://example/live/x?token=bad RTSP/1.0\r\nCSeq: 1\r\n\r\n")
+	resp := readResponse(t, b)
+	if !strings.Contains(resp, "401") {
+		t.Fatalf("expected 401; got %q", resp)
+	}
+	if gotAction != ActionPlay || gotQuery.Get("token") != "bad" {
+		t.Errorf("authorizer saw action=%v query=%v", gotAction, gotQuery)
+	}
+}
+
+// TestAuthorizerRejects asserts a rejecting Authorizer turns every
+// publish and play away, each in its protocol's own way.
+func TestAuthorizerRejects(t *testing.T) {
+	rtmpAddr, flvAddr, hlsAddr, rtspAddr, srtAddr := freeAddr(t), freeAddr(t), freeAddr(t), freeAddr(t), freeAddr(t)
+	srv := NewServer(rtmpAddr, "live").WithHTTPFlv(flvAddr).WithHls(hlsAddr).WithDASH().
+		WithRTSP(rtspAddr).WithSRT(srtAddr, "live", "s").
+		WithAuthorizer(func(ctx context.Context, action Action, app, stream string, query url.Values, peer string) error {
+			return ErrUnauthorized
+		})
+	runServer(t, srv)
+
+	//RTMP: an error onStatus.
+	var se *StatusError
+	pub, err := Dial("rtmp://"+rtmpAddr+"/live", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if err := pub.Publish("x"); !errors.As(err, &se) || se.Code != "NetStream.Publish.BadName" {
+		t.Errorf("rtmp publish: %v", err)
+	}
+	play, err := Dial("rtmp://"+rtmpAddr+"/live", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer play.Close()
+	if err := play.Play("x"); !errors.As(err, &se) || se.Code != "NetStream.Play.Unauthorized" {
+		t.Errorf("rtmp play: %v", err)
+	}
+
+	//HTTP-FLV, HLS and DASH: 403.
+	for _, u := range []string{
+		"http://" + flvAddr + "/live/x.flv",
+		"http://" + hlsAddr + "/live/x/index.m3u8",
+		"http://" + hlsAddr + "/live/x/index.mpd",
+	} {
+		if code, _ := get(t, u); code != http.StatusForbidden {
+			t.Errorf("GET %s: %d, want 403", u, code)
+		}
+	}
+
+	//RTSP ANNOUNCE: 401.
+	rtsp, err := net.Dial("tcp", rtspAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtsp.Close()
+	sdp := "v=0\r\n"
+	send(t, rtsp, fmt.Sprintf("ANNOUNCE rtsp://%s/live/x RTSP/1.0\r\nCSeq: 1\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%s", rtspAddr, len(sdp), sdp))
+	if resp := readResponse(t, rtsp); !strings.HasPrefix(resp, "RTSP/1.0 401") {
+		t.Errorf("rtsp announce: %q", resp)
+	}
+
+	//SRT: the handshake's conclusion is rejected.
+	udpAddr, err := net.ResolveUDPAddr("udp", srtAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srt, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srt.Close()
+	_ = srt.SetReadDeadline(time.Now().Add(2 * time.Second))
+	handshake := func(hs *libsrt.Handshake, dest uint32) *libsrt.Handshake {
+		body := hs.Marshal()
+		out := make([]byte, libsrt.HeaderSize+len(body))
+		libsrt.MarshalControlHeader(out, libsrt.CtrlHandshake, 0, 0, 0, dest)
+		copy(out[libsrt.HeaderSize:], body)
+		if _, err := srt.Write(out); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		n, err := srt.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, body, err = libsrt.ParseHeader(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := libsrt.ParseHandshake(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	induction := handshake(&libsrt.Handshake{Version: 5, HandshakeType: libsrt.HSTypeAgreement, SrtSocketID: 7}, 0)
+	conclusion := handshake(&libsrt.Handshake{Version: 5, HandshakeType: libsrt.HSTypeConclusion, SrtSocketID: 7,
+		SyncCookie: induction.SyncCookie, InitialSequence: 1}, induction.SrtSocketID)
+	if conclusion.HandshakeType != libsrt.HSTypeRejection {
+		t.Errorf("srt conclusion answered with type %d, want a rejection", conclusion.HandshakeType)
+	}
+}
@@ -2,12 +2,12 @@ package librtmp
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	"github.com/SmartBrave/Athena/easyerrors"
@@ -16,10 +16,10 @@ import (
 )
 
 // pullSpec is one pre-configured upstream stream to pull. The server
-// dials it on Handler() startup and forwards every received tag into
+// dials it when Run starts and forwards every received tag into
 // apps[App]/rooms[StreamID] as if it were a local publish.
 type pullSpec struct {
-	remoteURL string //rtmp://host[:port]/app/stream
+	remoteURL string //rtmp[s]://host[:port]/app/stream
 	app       string //local app to inject under
 	streamID  string //local stream id
 }
@@ -30,10 +30,11 @@ type pullSpec struct {
 type PullClient struct {
 	spec   pullSpec
 	server *server
+	stop   <-chan struct{} //closing it drops the upstream connection
 }
 
-func newPullClient(srv *server, ps pullSpec) *PullClient {
-	return &PullClient{spec: ps, server: srv}
+func newPullClient(srv *server, ps pullSpec, stop <-chan struct{}) *PullClient {
+	return &PullClient{spec: ps, server: srv, stop: stop}
 }
 
 // Run dials the upstream and drives the pull session synchronously.
@@ -44,17 +45,27 @@ func (pc *PullClient) Run() error {
 	if err != nil {
 		return fmt.Errorf("parse remote URL: %w", err)
 	}
-	host := u.Host
-	if !strings.Contains(host, ":") {
-		host += ":1935"
-	}
-	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	conn, err := dialURL(u, 10*time.Second, nil)
 	if err != nil {
-		return fmt.Errorf("dial %s: %w", host, err)
+		return err
+	}
+	if !pc.server.trackConn(conn) {
+		_ = conn.Close()
+		return ErrServerClosed
 	}
+	defer pc.server.untrackConn(conn)
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-pc.stop:
+			_ = conn.Close()
+		case <-finished:
+		}
+	}()
 
-	rtmp := NewRTMP(conn, host, pc.server)
-	app, ok := pc.server.apps[pc.spec.app]
+	rtmp := NewRTMP(conn, rtmpHost(u), pc.server)
+	app, ok := pc.server.app(pc.spec.app)
 	if !ok {
 		_ = conn.Close()
 		return fmt.Errorf("local app %q not configured", pc.spec.app)
@@ -65,7 +76,11 @@ func (pc *PullClient) Run() error {
 	}
 	rtmp.app = pc.spec.app
 	rtmp.room = NewRoom(rtmp, pc.spec.streamID)
+	rtmp.room.cache = newGOPCache(app.gopCache)
+	pc.server.startDVR(app, rtmp.room)
 	app.Store(pc.spec.streamID, rtmp.room)
+	pc.server.startRecording(app, rtmp.room, publishLive)
+	pc.server.startPushes(app, rtmp.room)
 	//We act as publisher into the local broadcast — when the upstream
 	//disconnects, cleanup() should tear the local room down so HLS /
 	//FLV viewers exit cleanly.
@@ -97,18 +112,19 @@ func (rtmp *RTMP) runClientCommands() error {
 		"videoCodecs":    252.0,
 		"videoFunction":  1.0,
 		"objectEncoding": 0.0,
+		"fourCcList":     enhancedFourCCs,
 	}
 	if err := rtmp.sendCommandRaw("connect", 1, connectObj, nil); err != nil {
 		return fmt.Errorf("send connect: %w", err)
 	}
-	if err := rtmp.expectResult(15 * time.Second); err != nil {
+	if err := rtmp.expectReply(1, 15*time.Second); err != nil {
 		return fmt.Errorf("connect: %w", err)
 	}
 
 	if err := rtmp.sendCommandRaw("createStream", 2, nil, nil); err != nil {
 		return fmt.Errorf("send createStream: %w", err)
 	}
-	if err := rtmp.expectResult(15 * time.Second); err != nil {
+	if err := rtmp.expectReply(2, 15*time.Second); err != nil {
 		return fmt.Errorf("createStream: %w", err)
 	}
 
@@ -176,23 +192,49 @@ func (rtmp *RTMP) sendCommandRaw(name string, txnID int, cmdObject map[string]in
 	return nil
 }
 
-// expectResult pumps ParseMessage until rtmp.resultCount advances —
-// CommandMessage.Do bumps it on every _result/_error. Returns ErrTimeout
-// if the deadline is reached without progress.
-func (rtmp *RTMP) expectResult(timeout time.Duration) error {
-	start := atomic.LoadUint32(&rtmp.resultCount)
-	deadline := time.Now().Add(timeout)
+// expectReply pumps ParseMessage until the peer answers the command
+// of transaction txnID with _result or _error, or, for txnID 0, until
+// the next onStatus. An _error or an error-level onStatus fails it with
+// a *StatusError; a deadline passing without an answer fails it too.
+func (rtmp *RTMP) expectReply(txnID int, timeout time.Duration) error {
+	if rtmp.conn != nil {
+		_ = rtmp.conn.SetReadDeadline(time.Now().Add(timeout))
+		defer rtmp.conn.SetReadDeadline(time.Time{})
+	}
 	for {
+		seen := rtmp.replies
 		if err := ParseMessage(rtmp); err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return fmt.Errorf("timeout waiting for a reply")
+			}
 			return err
 		}
-		if atomic.LoadUint32(&rtmp.resultCount) > start {
-			return nil
+		if rtmp.replies == seen {
+			continue
+		}
+		reply := rtmp.reply
+		switch {
+		case txnID == 0 && reply.CommandName != ON_STATUS,
+			txnID != 0 && (reply.CommandName == ON_STATUS || reply.TranscationID != txnID):
+			continue
+		case reply.CommandName == _ERROR, reply.Info.Level == "error":
+			return &StatusError{Code: reply.Info.Code, Description: reply.Info.Description}
 		}
-		if time.Now().After(deadline) {
-			return fmt.Errorf("timeout waiting for _result")
+		return nil
+	}
+}
+
+// rtmpHost returns u's host:port, the port defaulting to 1935, or 443
+// for rtmps://.
+func rtmpHost(u *url.URL) string {
+	if u.Port() == "" {
+		if u.Scheme == "rtmps" {
+			return net.JoinHostPort(u.Hostname(), "443")
 		}
+		return net.JoinHostPort(u.Hostname(), "1935")
 	}
+	return u.Host
 }
 
 // parseAppName plucks the app component out of an RTMP URL path:
@@ -2,17 +2,15 @@ package librtmp
 
 import (
 	"bytes"
-	"fmt"
+	"context"
 	"io"
-	"reflect"
-	"sync/atomic"
+	"net/url"
+	"time"
 
-	"github.com/SmartBrave/Athena/broadcast"
 	"github.com/SmartBrave/Athena/easyerrors"
 	"github.com/SmartBrave/Athena/easyio"
 	"github.com/sbraveyoung/GGmpeg/libamf"
-	"github.com/sbraveyoung/GGmpeg/libdash"
-	"github.com/sbraveyoung/GGmpeg/libhls"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 	"github.com/fatih/structs"
 	"github.com/goinggo/mapstructure"
 	"github.com/pkg/errors"
@@ -54,6 +52,7 @@ type ConnectReqCommandObject struct {
 	ObjectEncoding float64       `mapstructure:"objectEncoding"`
 	Type           string        `mapstructure:"type"`
 	Capabilities   float64       `mapstructure:"capabilities"`
+	FourCcList     []string      `mapstructure:"fourCcList"` //enhanced RTMP codecs, "*" for all
 }
 
 type CommandMessage struct {
@@ -63,9 +62,10 @@ type CommandMessage struct {
 	CommandObject  ConnectReqCommandObject
 	PublishingName string //releaseStream,FCPublish,publish
 	//Type of publishing. Set to "live", "record", or "append".
-	//TODO:record: The stream is published and the data is recorded to a new file. The file is stored on the server in a subdirectory within the directory that contains the server application. If the file already exists, it is overwritten.
-	//TODO:append: The stream is published and the data is appended to a file. If no file is found, it is created.
+	//record: The stream is published and the data is recorded to a new file. The file is stored on the server in a subdirectory within the directory that contains the server application. If the file already exists, it is overwritten.
+	//append: The stream is published and the data is appended to a file. If no file is found, it is created.
 	//live: Live data is published without recording it in a file.
+	//record and append need recording enabled on the app; see RecordConfig.
 	PublishingType string  //publish
 	StreamName     string  //play
 	Start          float64 //play
@@ -78,6 +78,13 @@ type CommandMessage struct {
 
 	// Reader flag toggles for receiveAudio / receiveVideo.
 	BoolFlag bool
+
+	// The information object of a reply, as received by the outbound
+	// client: _result, _error, onStatus.
+	Info ConnectRespCommandObject
+	// The stream ID of createStream's _result, as received by the
+	// outbound client.
+	StreamID float64
 }
 
 func NewCommandMessage(mb MessageBase, fields ...interface{} /*commandName string, transcationID int, others*/) (cm *CommandMessage) {
@@ -105,7 +112,7 @@ func (cm *CommandMessage) Send() (err error) {
 
 func (cm *CommandMessage) Parse() (err error) {
 	var array []interface{}
-	array, err = cm.amf.Decode(easyio.NewEasyReader(bytes.NewReader(cm.messagePayload)))
+	array, err = cm.amf.Decode(easyio.NewEasyReader(bytes.NewReader(cm.amfPayload())))
 	if err != nil {
 		return errors.Wrap(err, "amf.Decode")
 	}
@@ -113,9 +120,6 @@ func (cm *CommandMessage) Parse() (err error) {
 	if len(array) < 3 {
 		return errors.New("invalid data")
 	}
-	for index, a := range array {
-		fmt.Println("index:", index, " a.type:", reflect.TypeOf(a), " a.Value:", reflect.ValueOf(a))
-	}
 
 	cm.CommandName = array[0].(string)
 	cm.TranscationID = int(array[1].(float64))
@@ -148,6 +152,9 @@ func (cm *CommandMessage) Parse() (err error) {
 			return errors.New("invalid play command")
 		}
 		cm.PublishingName, _ = array[3].(string)
+		if len(array) >= 5 {
+			cm.Start, _ = array[4].(float64)
+		}
 	case PAUSE:
 		//pause(cmd, txn, null, pauseFlag, milliSeconds)
 		if len(array) >= 5 {
@@ -162,6 +169,30 @@ func (cm *CommandMessage) Parse() (err error) {
 		if len(array) >= 4 {
 			cm.BoolFlag, _ = array[3].(bool)
 		}
+	case _RESULT, _ERROR, ON_STATUS:
+		//The properties and information objects, which some servers
+		//merge into one; createStream answers with a stream ID instead.
+		for _, v := range array[2:] {
+			if id, ok := v.(float64); ok {
+				cm.StreamID = id
+			}
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for key, field := range map[string]*string{"level": &cm.Info.Level, "code": &cm.Info.Code, "description": &cm.Info.Description} {
+				if s, ok := obj[key].(string); ok {
+					*field = s
+				}
+			}
+			if list, ok := obj["fourCcList"].([]interface{}); ok {
+				for _, fourCC := range list {
+					if s, ok := fourCC.(string); ok {
+						cm.Info.FourCcList = append(cm.Info.FourCcList, s)
+					}
+				}
+			}
+		}
 	}
 	return nil
 }
@@ -171,10 +202,26 @@ func (cm *CommandMessage) Do() (err error) {
 	var err1, err2, err3, err4, err5 error
 	switch cm.CommandName {
 	case CONNECT:
-		if _, ok := cm.rtmp.server.apps[cm.CommandObject.App]; !ok {
-			return errors.Errorf("unknown app: %s", cm.CommandObject.App)
+		//Encoders that can't add URL parameters anywhere else append
+		//them to the app ("live?token=…"); strip them before lookup.
+		appName, query := splitStreamName(cm.CommandObject.App)
+		if _, ok := cm.rtmp.server.app(appName); !ok {
+			return errors.Errorf("unknown app: %s", appName)
+		}
+		cm.rtmp.app = appName
+		if u, err := url.Parse(cm.CommandObject.TcURL); err == nil {
+			query = mergeQuery(query, u.Query())
+		}
+		cm.rtmp.connectQuery = query
+		cm.rtmp.objectEncoding = cm.CommandObject.ObjectEncoding
+		var fourCCs []string
+		if cm.CommandObject.FourCcList != nil {
+			//Enhanced RTMP: answer with the codecs we take, and send
+			//the client those it listed in the enhanced form.
+			cm.rtmp.setFourCCs(cm.CommandObject.FourCcList)
+			fourCCs = enhancedFourCCs
 		}
-		cm.rtmp.app = cm.CommandObject.App
+		cm.rtmp.server.notify(WebhookPayload{Action: EventConnect, App: appName, Peer: cm.rtmp.peer, Query: query.Encode()})
 		err1 = NewWindowAcknowledgeSizeMessage(cm.MessageBase, uint32(2500000)).Send()
 		cm.rtmp.ownWindowAckSize = 2500000
 		err2 = NewSetPeerBandWidthMessage(cm.MessageBase, uint32(2500000), DYNAMIC).Send()
@@ -194,6 +241,7 @@ func (cm *CommandMessage) Do() (err error) {
 				Code:           "NetConnection.Connect.Success",
 				Description:    "Connection succeeded",
 				ObjectEncoding: cm.CommandObject.ObjectEncoding,
+				FourCcList:     fourCCs,
 			},
 		}).Send()
 		err = easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2, err3, err4, err5)
@@ -235,13 +283,31 @@ func (cm *CommandMessage) Do() (err error) {
 		}).Send()
 
 	case PUBLISH:
-		app, ok := cm.rtmp.server.apps[cm.rtmp.app]
+		app, ok := cm.rtmp.server.app(cm.rtmp.app)
 		if !ok {
 			return errors.Errorf("app not found: %s", cm.rtmp.app)
 		}
+		var query url.Values
+		cm.PublishingName, query = splitStreamName(cm.PublishingName)
+		query = mergeQuery(query, cm.rtmp.connectQuery)
+		if authErr := cm.rtmp.server.admit(context.Background(), ActionPublish, cm.rtmp.app, cm.PublishingName, query, cm.rtmp.peer); authErr != nil {
+			cm.rtmp.log().Info("publish rejected", liblog.Stream(cm.PublishingName), liblog.Err(authErr))
+			return (&CommandMessageResponse{
+				MessageBase:     cm.MessageBase,
+				CommandName:     cm.CommandName,
+				CommandRespName: ON_STATUS,
+				TranscationID:   cm.TranscationID,
+				CommandObject: ConnectRespCommandObject{
+					Level:       "error",
+					Code:        "NetStream.Publish.BadName",
+					Description: authErr.Error(),
+				},
+			}).Send()
+		}
 		if existing := app.Load(cm.PublishingName); existing != nil {
 			//Refuse a second publish to the same stream — replacing the
 			//publisher mid-stream would desync every viewer.
+			cm.rtmp.log().Info("publish rejected", liblog.Stream(cm.PublishingName), liblog.Err(errors.New("stream already publishing")))
 			return (&CommandMessageResponse{
 				MessageBase:     cm.MessageBase,
 				CommandName:     cm.CommandName,
@@ -255,8 +321,11 @@ func (cm *CommandMessage) Do() (err error) {
 			}).Send()
 		}
 		cm.rtmp.room = NewRoom(cm.rtmp, cm.PublishingName)
+		cm.rtmp.room.cache = newGOPCache(app.gopCache)
 		cm.rtmp.role = rolePublisher
+		cm.rtmp.server.startDVR(app, cm.rtmp.room)
 		app.Store(cm.PublishingName, cm.rtmp.room)
+		cm.rtmp.log().Info("publish start")
 
 		err = (&CommandMessageResponse{
 			MessageBase:     cm.MessageBase,
@@ -270,24 +339,41 @@ func (cm *CommandMessage) Do() (err error) {
 			},
 		}).Send()
 
-		if app.hlsMode == libhls.IMMEDIATELY {
-			hls := libhls.NewHls().WithStreamID(cm.PublishingName).WithDir(app.hlsDir)
-			app.hls.Store(cm.PublishingName, hls)
-			go hls.Start(broadcast.NewBroadcastReader(cm.rtmp.room.GOP))
-		}
-		if app.dashEnabled {
-			dash := libdash.NewDASH().WithStreamID(cm.PublishingName).WithDir(app.dashDir)
-			app.StoreDASH(cm.PublishingName, dash)
-			go dash.Start(broadcast.NewBroadcastReader(cm.rtmp.room.GOP))
+		cm.rtmp.server.startSegmenters(app, cm.rtmp.room)
+		cm.rtmp.server.startRecording(app, cm.rtmp.room, cm.PublishingType)
+		cm.rtmp.server.startPushes(app, cm.rtmp.room)
+		if app.edge != nil {
+			cm.rtmp.server.forwardToOrigin(app, cm.rtmp.room, query)
 		}
 
 	case PLAY:
-		app, ok := cm.rtmp.server.apps[cm.rtmp.app]
+		app, ok := cm.rtmp.server.app(cm.rtmp.app)
 		if !ok {
 			return errors.Errorf("app not found: %s", cm.rtmp.app)
 		}
-		cm.rtmp.room = app.Load(cm.PublishingName)
+		var query url.Values
+		cm.PublishingName, query = splitStreamName(cm.PublishingName)
+		query = mergeQuery(query, cm.rtmp.connectQuery)
+		if authErr := cm.rtmp.server.admit(context.Background(), ActionPlay, cm.rtmp.app, cm.PublishingName, query, cm.rtmp.peer); authErr != nil {
+			cm.rtmp.log().Info("play rejected", liblog.Stream(cm.PublishingName), liblog.Err(authErr))
+			return (&CommandMessageResponse{
+				MessageBase:     cm.MessageBase,
+				CommandName:     cm.CommandName,
+				CommandRespName: ON_STATUS,
+				TranscationID:   cm.TranscationID,
+				CommandObject: ConnectRespCommandObject{
+					Level:       "error",
+					Code:        "NetStream.Play.Unauthorized",
+					Description: authErr.Error(),
+				},
+			}).Send()
+		}
+		cm.rtmp.room = cm.rtmp.server.playRoom(app, cm.PublishingName, query)
 		if cm.rtmp.room == nil {
+			if media, ok := cm.rtmp.server.openVOD(app, cm.PublishingName); ok {
+				return cm.playVOD(media)
+			}
+			cm.rtmp.server.notify(WebhookPayload{Action: EventStop, App: cm.rtmp.app, Stream: cm.PublishingName, Peer: cm.rtmp.peer})
 			return (&CommandMessageResponse{
 				MessageBase:     cm.MessageBase,
 				CommandName:     cm.CommandName,
@@ -301,7 +387,13 @@ func (cm *CommandMessage) Do() (err error) {
 			}).Send()
 		}
 		cm.rtmp.role = rolePlayer
-		cm.rtmp.room.RTMPJoin(cm.rtmp)
+		cm.rtmp.session = cm.rtmp.room.addSession(ProtocolRTMP, cm.rtmp.peer, func() { cm.rtmp.kick() })
+		cm.rtmp.log().Info("play start")
+		if cm.rtmp.room.dvr != nil {
+			cm.playDVR(cm.rtmp.room)
+		} else {
+			cm.rtmp.room.RTMPJoin(cm.rtmp)
+		}
 
 		err1 = (&CommandMessageResponse{
 			MessageBase:     cm.MessageBase,
@@ -354,6 +446,9 @@ func (cm *CommandMessage) Do() (err error) {
 		if cm.PauseFlag {
 			code = "NetStream.Pause.Notify"
 		}
+		if cm.rtmp.player != nil {
+			cm.rtmp.player.Pause(cm.PauseFlag)
+		}
 		err = (&CommandMessageResponse{
 			MessageBase:     cm.MessageBase,
 			CommandName:     cm.CommandName,
@@ -367,6 +462,12 @@ func (cm *CommandMessage) Do() (err error) {
 		}).Send()
 
 	case SEEK:
+		if cm.rtmp.player != nil {
+			//The player answers once it has found the keyframe; in a
+			//DVR window, past the live edge is the live edge.
+			cm.rtmp.player.SeekTo(time.Duration(cm.MilliSeconds) * time.Millisecond)
+			break
+		}
 		//We don't support true seeks on a live broadcast. Acknowledge so
 		//the client doesn't hang waiting for a response.
 		err = (&CommandMessageResponse{
@@ -382,8 +483,13 @@ func (cm *CommandMessage) Do() (err error) {
 		}).Send()
 
 	case RECEIVE_AUDIO, RECEIVE_VIDEO:
-		//No-op ack; we don't implement per-track toggling for live GOP
-		//replay.
+		//Takes effect on the next tag sent; video comes back on at a
+		//keyframe.
+		if cm.CommandName == RECEIVE_AUDIO {
+			cm.rtmp.tracks.setAudio(cm.BoolFlag)
+		} else {
+			cm.rtmp.tracks.setVideo(cm.BoolFlag)
+		}
 		err = (&CommandMessageResponse{
 			MessageBase:     cm.MessageBase,
 			CommandName:     cm.CommandName,
@@ -409,13 +515,12 @@ func (cm *CommandMessage) Do() (err error) {
 			},
 		}).Send()
 
-	case _RESULT:
-		//Outbound-client path: bump the response counter so the
-		//connect/createStream sender can move on. No-op for the more
-		//common server-side case.
-		atomic.AddUint32(&cm.rtmp.resultCount, 1)
-	case _ERROR:
-		atomic.AddUint32(&cm.rtmp.resultCount, 1)
+	case _RESULT, _ERROR, ON_STATUS:
+		//Outbound-client path: note the reply so the command sender
+		//can move on; see expectReply. No-op for the more common
+		//server-side case.
+		cm.rtmp.reply = cm
+		cm.rtmp.replies++
 	default:
 	}
 
@@ -423,12 +528,13 @@ func (cm *CommandMessage) Do() (err error) {
 }
 
 type ConnectRespCommandObject struct {
-	FmsVer         string  `structs:"fmsVer,omitempty"`
-	Level          string  `structs:"level,omitempty"`
-	Code           string  `structs:"code,omitempty"`
-	Description    string  `structs:"description,omitempty"`
-	Capabilities   float64 `structs:"capabilities,omitempty"`
-	ObjectEncoding float64 `structs:"object_encoding,omitempty"`
+	FmsVer         string   `structs:"fmsVer,omitempty"`
+	Level          string   `structs:"level,omitempty"`
+	Code           string   `structs:"code,omitempty"`
+	Description    string   `structs:"description,omitempty"`
+	Capabilities   float64  `structs:"capabilities,omitempty"`
+	ObjectEncoding float64  `structs:"objectEncoding,omitempty"`
+	FourCcList     []string `structs:"fourCcList,omitempty"`
 }
 
 type CommandMessageResponse struct {
@@ -449,6 +555,16 @@ func (cmr *CommandMessageResponse) Send() (err error) {
 	writer := easyio.NewEasyWriter(buf)
 	amf := libamf.AMF0
 
+	//Clients that negotiated objectEncoding 3 get AMF3 command messages,
+	//the objects in AMF3.
+	messageType := MessageType(COMMAND_MESSAGE_AMF0)
+	encodeObject := amf.Encode
+	if cmr.rtmp.objectEncoding == 3 {
+		messageType = COMMAND_MESSAGE_AMF3
+		writer.Write([]byte{0x00})
+		encodeObject = amf.EncodeAvmPlus
+	}
+
 	var err1, err2, err3, err4 error
 	err1 = amf.Encode(writer, cmr.CommandRespName)
 	err2 = amf.Encode(writer, cmr.TranscationID)
@@ -457,7 +573,7 @@ func (cmr *CommandMessageResponse) Send() (err error) {
 		err3 = amf.Encode(writer, nil)
 		err4 = amf.Encode(writer, nil)
 	case cmr.CommandName == CONNECT:
-		err3 = amf.Encode(writer, structs.Map(cmr.CommandObject))
+		err3 = encodeObject(writer, structs.Map(cmr.CommandObject))
 	case cmr.CommandName == CREATE_STREAM:
 		err3 = amf.Encode(writer, nil)
 		err4 = amf.Encode(writer, cmr.StreamID)
@@ -466,11 +582,10 @@ func (cmr *CommandMessageResponse) Send() (err error) {
 		cmr.CommandName == DELETE_STREAM, cmr.CommandName == CLOSE_STREAM,
 		cmr.CommandName == FCUNPUBLISH:
 		err3 = amf.Encode(writer, nil)
-		err4 = amf.Encode(writer, structs.Map(cmr.CommandObject))
+		err4 = encodeObject(writer, structs.Map(cmr.CommandObject))
 	}
 	err = easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2, err3, err4)
 	if err != nil {
-		fmt.Println("HandleMultiError error:", err)
 		return err
 	}
 
@@ -493,7 +608,7 @@ func (cmr *CommandMessageResponse) Send() (err error) {
 		if i != 0 {
 			fmtType = FMT3
 		}
-		if sendErr := NewChunk(COMMAND_MESSAGE_AMF0, uint32(len(b)), cmr.messageTime, fmtType, csidCommand, b[lIndex:rIndex]).Send(cmr.rtmp); sendErr != nil {
+		if sendErr := NewChunk(messageType, uint32(len(b)), cmr.messageTime, fmtType, csidCommand, b[lIndex:rIndex]).Send(cmr.rtmp); sendErr != nil {
 			return sendErr
 		}
 	}
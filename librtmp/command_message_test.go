@@ -0,0 +1,76 @@
+package librtmp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/SmartBrave/Athena/easyio"
+	"github.com/sbraveyoung/GGmpeg/libamf"
+)
+
+func TestCommandMessageAMF3(t *testing.T) {
+	rtmp, buf := fakeRTMP()
+
+	//As Flash sends them: a format byte, then AMF0 switching to AMF3
+	//for the values.
+	payload := &bytes.Buffer{}
+	w := easyio.NewEasyWriter(payload)
+	payload.WriteByte(0x00)
+	libamf.AMF0.Encode(w, "connect")
+	libamf.AMF0.Encode(w, 1)
+	libamf.AMF0.EncodeAvmPlus(w, map[string]interface{}{"app": "live", "objectEncoding": 3})
+	cm := NewCommandMessage(MessageBase{rtmp: rtmp, messageType: COMMAND_MESSAGE_AMF3, amf: libamf.AMF0, messagePayload: payload.Bytes()})
+	if err := cm.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if cm.CommandName != CONNECT || cm.CommandObject.App != "live" || cm.CommandObject.ObjectEncoding != 3 {
+		t.Fatalf("parsed %q %+v", cm.CommandName, cm.CommandObject)
+	}
+
+	payload.Reset()
+	payload.WriteByte(0x00)
+	libamf.AMF0.Encode(w, "play")
+	libamf.AMF0.Encode(w, 4)
+	libamf.AMF0.Encode(w, nil)
+	libamf.AMF0.EncodeAvmPlus(w, "room")
+	libamf.AMF0.EncodeAvmPlus(w, -2)
+	cm = NewCommandMessage(MessageBase{rtmp: rtmp, messageType: COMMAND_MESSAGE_AMF3, amf: libamf.AMF0, messagePayload: payload.Bytes()})
+	if err := cm.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if cm.PublishingName != "room" || cm.Start != -2 {
+		t.Errorf("play %q from %v, want room from -2", cm.PublishingName, cm.Start)
+	}
+
+	//Answered in AMF3 once negotiated.
+	rtmp.objectEncoding = 3
+	err := (&CommandMessageResponse{
+		MessageBase:     MessageBase{rtmp: rtmp},
+		CommandName:     PLAY,
+		CommandRespName: ON_STATUS,
+		CommandObject:   ConnectRespCommandObject{Level: "status", Code: "NetStream.Play.Start"},
+	}).Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, err := ParseChunk(rtmp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk.MessageType != COMMAND_MESSAGE_AMF3 || chunk.Payload[0] != 0x00 {
+		t.Fatalf("type %d, payload % x", chunk.MessageType, chunk.Payload)
+	}
+	array, err := libamf.AMF0.Decode(easyio.NewEasyReader(bytes.NewReader(chunk.Payload[1:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(array) != 4 || array[0] != ON_STATUS {
+		t.Fatalf("decoded %v", array)
+	}
+	if info, _ := array[3].(map[string]interface{}); info["code"] != "NetStream.Play.Start" {
+		t.Errorf("info object %v", array[3])
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left over", buf.Len())
+	}
+}
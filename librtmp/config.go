@@ -0,0 +1,696 @@
+package librtmp
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libhls"
+	"github.com/sbraveyoung/GGmpeg/liblog"
+)
+
+// Config is the declarative form of the NewServer(...).With*(...)
+// chain, loaded from a JSON file by LoadConfig. Every listener but
+// RTMP is off unless its address is set. A minimal file:
+//
+//	{
+//	  "rtmp": ":1935",
+//	  "hls": ":8081",
+//	  "apps": [{"name": "live", "hls": {"mode": "immediately"}}]
+//	}
+type Config struct {
+	path string //set by LoadConfig; see ReloadFile
+
+	RTMP     string       `json:"rtmp"` //default ":1935"
+	HTTPFLV  string       `json:"http_flv"`
+	HLS      string       `json:"hls"` //also serves DASH
+	RTSP     string       `json:"rtsp"`
+	Admin    string       `json:"admin"`
+	RTMPS    *RTMPSConfig `json:"rtmps"`     //nil: no RTMPS listener
+	LogLevel string       `json:"log_level"` //debug, info, warn or error; empty is silent
+
+	Apps     []AppConfig    `json:"apps"`
+	SRT      []SRTConfig    `json:"srt"`
+	Pulls    []PullConfig   `json:"pulls"`
+	Pushes   []PushConfig   `json:"pushes"`
+	Webhooks *WebhookConfig `json:"webhooks"`
+}
+
+// RTMPSConfig is an RTMP-over-TLS listener; see WithRTMPS.
+type RTMPSConfig struct {
+	Address string `json:"address"`
+	Cert    string `json:"cert"` //PEM certificate chain file
+	Key     string `json:"key"`  //PEM private key file
+}
+
+type AppConfig struct {
+	Name      string           `json:"name"`
+	HLS       *HLSConfig       `json:"hls"`        //nil: no HLS for this app
+	DASH      *DASHConfig      `json:"dash"`       //nil: no DASH for this app
+	Token     *AppTokenConfig  `json:"token"`      //nil: no signed-URL check
+	Record    *RecordConfig    `json:"record"`     //nil: no recording
+	VOD       *VODConfig       `json:"vod"`        //nil: no VOD playback
+	DVR       *DVRConfig       `json:"dvr"`        //nil: no time-shift window
+	Edge      *EdgeConfig      `json:"edge"`       //nil: not an edge
+	GOPCache  *GOPCacheConfig  `json:"gop_cache"`  //nil: start at the latest keyframe
+	SendQueue *SendQueueConfig `json:"send_queue"` //nil: the defaults
+}
+
+type HLSConfig struct {
+	Mode           string   `json:"mode"` //immediately (default), delay or none
+	Dir            string   `json:"dir"`  //default "./data"
+	TargetDuration Duration `json:"target_duration"`
+	WindowSize     int      `json:"window_size"`
+	LowLatency     bool     `json:"low_latency"`
+}
+
+type DASHConfig struct {
+	Dir            string   `json:"dir"` //default "./data"
+	TargetDuration Duration `json:"target_duration"`
+	WindowSize     int      `json:"window_size"`
+}
+
+// AppTokenConfig is the file form of TokenConfig. Sign lists the parts
+// covered by the signature: "path", "expiry", "ip"; it defaults to
+// path and expiry.
+type AppTokenConfig struct {
+	Secret string   `json:"secret"`
+	Skew   Duration `json:"skew"`
+	Sign   []string `json:"sign"`
+}
+
+type SRTConfig struct {
+	Address string `json:"address"`
+	App     string `json:"app"`
+	Stream  string `json:"stream"`
+}
+
+type PullConfig struct {
+	URL    string `json:"url"` //rtmp[s]://host[:port]/app/stream
+	App    string `json:"app"`
+	Stream string `json:"stream"`
+}
+
+// PushConfig republishes the rooms of App matching Stream, a name or
+// a pattern such as "*", to every URL; see WithRTMPPush.
+type PushConfig struct {
+	App    string   `json:"app"`
+	Stream string   `json:"stream"`
+	URLs   []string `json:"urls"` //rtmp[s]://host[:port]/app[/stream]
+}
+
+// WebhookConfig maps event names ("on_publish", …) to the URLs notified
+// for them. Unset policy fields keep the WithWebhookPolicy defaults.
+type WebhookConfig struct {
+	Hooks   map[string][]string `json:"hooks"`
+	Timeout Duration            `json:"timeout"`
+	Retries *int                `json:"retries"`
+	Backoff Duration            `json:"backoff"`
+}
+
+// Duration is a time.Duration written in JSON either as a Go duration
+// string ("2s", "500ms") or as a number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(v)
+		return nil
+	}
+	var secs float64
+	if err := json.Unmarshal(b, &secs); err != nil {
+		return fmt.Errorf("duration must be a string like \"2s\" or a number of seconds")
+	}
+	*d = Duration(secs * float64(time.Second))
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ConfigError lists every problem Validate found, one per line.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid config:\n\t" + strings.Join(e.Problems, "\n\t")
+}
+
+func (e *ConfigError) add(field, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, field+": "+fmt.Sprintf(format, args...))
+}
+
+// LoadConfig reads and validates the JSON config at path. Unknown keys
+// are rejected so a typo doesn't silently fall back to a default.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, err := ParseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.path = path
+	return cfg, nil
+}
+
+// ParseConfig is LoadConfig for an already opened file.
+func ParseConfig(r io.Reader) (*Config, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	cfg := &Config{}
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+var logLevels = map[string]liblog.Level{
+	"debug": liblog.LevelDebug,
+	"info":  liblog.LevelInfo,
+	"warn":  liblog.LevelWarn,
+	"error": liblog.LevelError,
+}
+
+var recordFormats = map[string]struct{}{
+	"":    {},
+	"flv": {},
+	"mp4": {},
+}
+
+var hlsModes = map[string]libhls.HLS_MODE{
+	"":            libhls.IMMEDIATELY,
+	"immediately": libhls.IMMEDIATELY,
+	"delay":       libhls.DELAY,
+	"none":        libhls.NONE,
+}
+
+var tokenSignParts = map[string]TokenSign{
+	"path":   SignPath,
+	"expiry": SignExpiry,
+	"ip":     SignIP,
+}
+
+var webhookEvents = map[Event]bool{
+	EventConnect:     true,
+	EventPublish:     true,
+	EventUnpublish:   true,
+	EventPlay:        true,
+	EventStop:        true,
+	EventHLSSegment:  true,
+	EventDASHSegment: true,
+}
+
+// Validate checks the whole config and reports every problem at once
+// as a *ConfigError.
+func (c *Config) Validate() error {
+	e := &ConfigError{}
+
+	checkAddress(e, "rtmp", c.RTMP, false)
+	checkAddress(e, "http_flv", c.HTTPFLV, false)
+	checkAddress(e, "hls", c.HLS, false)
+	checkAddress(e, "rtsp", c.RTSP, false)
+	checkAddress(e, "admin", c.Admin, false)
+	if r := c.RTMPS; r != nil {
+		checkAddress(e, "rtmps.address", r.Address, true)
+		switch {
+		case r.Cert == "":
+			e.add("rtmps.cert", "required")
+		case r.Key == "":
+			e.add("rtmps.key", "required")
+		default:
+			if _, err := tls.LoadX509KeyPair(r.Cert, r.Key); err != nil {
+				e.add("rtmps.cert", "%v", err)
+			}
+		}
+	}
+	if _, ok := logLevels[c.LogLevel]; c.LogLevel != "" && !ok {
+		e.add("log_level", "unknown level %q (want debug, info, warn or error)", c.LogLevel)
+	}
+
+	if len(c.Apps) == 0 {
+		e.add("apps", "at least one app is required")
+	}
+	apps := map[string]bool{}
+	for i, a := range c.Apps {
+		field := fmt.Sprintf("apps[%d]", i)
+		switch {
+		case a.Name == "":
+			e.add(field+".name", "required")
+		case strings.ContainsAny(a.Name, "/?"):
+			e.add(field+".name", "%q must not contain '/' or '?'", a.Name)
+		case apps[a.Name]:
+			e.add(field+".name", "duplicate app %q", a.Name)
+		}
+		apps[a.Name] = true
+
+		if a.HLS != nil {
+			mode, ok := hlsModes[a.HLS.Mode]
+			if !ok {
+				e.add(field+".hls.mode", "unknown mode %q (want immediately, delay or none)", a.HLS.Mode)
+			}
+			if ok && mode != libhls.NONE && c.HLS == "" {
+				e.add(field+".hls", "needs the top-level hls listener address")
+			}
+			if a.HLS.TargetDuration < 0 {
+				e.add(field+".hls.target_duration", "must not be negative")
+			}
+			if a.HLS.WindowSize < 0 {
+				e.add(field+".hls.window_size", "must not be negative")
+			}
+		}
+		if a.DASH != nil {
+			if c.HLS == "" {
+				e.add(field+".dash", "needs the top-level hls listener address, which also serves DASH")
+			}
+			if a.DASH.TargetDuration < 0 {
+				e.add(field+".dash.target_duration", "must not be negative")
+			}
+			if a.DASH.WindowSize < 0 {
+				e.add(field+".dash.window_size", "must not be negative")
+			}
+		}
+		if a.Token != nil {
+			if a.Token.Secret == "" {
+				e.add(field+".token.secret", "required")
+			}
+			if a.Token.Skew < 0 {
+				e.add(field+".token.skew", "must not be negative")
+			}
+			for j, part := range a.Token.Sign {
+				if _, ok := tokenSignParts[part]; !ok {
+					e.add(fmt.Sprintf("%s.token.sign[%d]", field, j), "unknown part %q (want path, expiry or ip)", part)
+				}
+			}
+		}
+		if a.Record != nil {
+			if a.Record.MaxDuration < 0 {
+				e.add(field+".record.max_duration", "must not be negative")
+			}
+			if a.Record.MaxSize < 0 {
+				e.add(field+".record.max_size", "must not be negative")
+			}
+			if _, ok := recordFormats[a.Record.Format]; !ok {
+				e.add(field+".record.format", "unknown format %q (want flv or mp4)", a.Record.Format)
+			}
+			if a.Record.Faststart && a.Record.Format != "mp4" {
+				e.add(field+".record.faststart", "only applies to mp4")
+			}
+		}
+		if a.DVR != nil && a.DVR.Window < 0 {
+			e.add(field+".dvr.window", "must not be negative")
+		}
+		if ec := a.Edge; ec != nil {
+			if len(ec.Origins) == 0 {
+				e.add(field+".edge.origins", "at least one origin is required")
+			}
+			for j, raw := range ec.Origins {
+				if u, err := url.Parse(raw); err != nil || !isRTMPURL(raw) || strings.Trim(u.Path, "/") != "" {
+					e.add(fmt.Sprintf("%s.edge.origins[%d]", field, j), "%q is not an rtmp[s]://host[:port] URL", raw)
+				}
+			}
+			if ec.IdleTimeout < 0 {
+				e.add(field+".edge.idle_timeout", "must not be negative")
+			}
+		}
+		if gc := a.GOPCache; gc != nil {
+			switch gc.Mode {
+			case "", GOPCacheLatest, GOPCacheNone:
+				if gc.GOPs != 0 || gc.Duration != 0 || gc.Bytes != 0 {
+					e.add(field+".gop_cache", "gops, duration and bytes only apply to mode gops")
+				}
+			case GOPCacheGOPs:
+			default:
+				e.add(field+".gop_cache.mode", "unknown mode %q (want latest, gops or none)", gc.Mode)
+			}
+			if gc.GOPs < 0 {
+				e.add(field+".gop_cache.gops", "must not be negative")
+			}
+			if gc.Duration < 0 {
+				e.add(field+".gop_cache.duration", "must not be negative")
+			}
+			if gc.Bytes < 0 {
+				e.add(field+".gop_cache.bytes", "must not be negative")
+			}
+		}
+		if sq := a.SendQueue; sq != nil {
+			for _, d := range []struct {
+				name string
+				d    Duration
+			}{{"drop_lag", sq.DropLag}, {"skip_lag", sq.SkipLag}, {"close_lag", sq.CloseLag}, {"write_timeout", sq.WriteTimeout}} {
+				if d.d < 0 {
+					e.add(field+".send_queue."+d.name, "must not be negative")
+				}
+			}
+			if sq.MaxTags < 0 {
+				e.add(field+".send_queue.max_tags", "must not be negative")
+			}
+			if sq.MaxBytes < 0 {
+				e.add(field+".send_queue.max_bytes", "must not be negative")
+			}
+			if q := newSendQueue(sq, nil, nil); q.dropLag >= q.skipLag || q.skipLag >= q.closeLag {
+				e.add(field+".send_queue", "drop_lag, skip_lag and close_lag must increase (%v, %v, %v with the defaults)", q.dropLag, q.skipLag, q.closeLag)
+			}
+		}
+	}
+
+	//Every stream has at most one source.
+	sources := map[string]string{}
+	checkSource := func(field, app, stream string) {
+		switch {
+		case app == "":
+			e.add(field+".app", "required")
+		case !apps[app]:
+			e.add(field+".app", "unknown app %q", app)
+		}
+		if stream == "" {
+			e.add(field+".stream", "required")
+			return
+		}
+		key := app + "/" + stream
+		if prev, ok := sources[key]; ok {
+			e.add(field, "stream %q is already fed by %s", key, prev)
+		}
+		sources[key] = field
+	}
+	srtAddresses := map[string]bool{}
+	for i, s := range c.SRT {
+		field := fmt.Sprintf("srt[%d]", i)
+		checkAddress(e, field+".address", s.Address, true)
+		if srtAddresses[s.Address] {
+			e.add(field+".address", "duplicate listener %q", s.Address)
+		}
+		srtAddresses[s.Address] = true
+		checkSource(field, s.App, s.Stream)
+	}
+	for i, p := range c.Pulls {
+		field := fmt.Sprintf("pulls[%d]", i)
+		if !isRTMPURL(p.URL) {
+			e.add(field+".url", "%q is not an rtmp[s]://host/app/stream URL", p.URL)
+		}
+		checkSource(field, p.App, p.Stream)
+	}
+	for i, p := range c.Pushes {
+		field := fmt.Sprintf("pushes[%d]", i)
+		switch {
+		case p.App == "":
+			e.add(field+".app", "required")
+		case !apps[p.App]:
+			e.add(field+".app", "unknown app %q", p.App)
+		}
+		if p.Stream == "" {
+			e.add(field+".stream", "required")
+		} else if _, err := path.Match(p.Stream, ""); err != nil {
+			e.add(field+".stream", "%q is not a valid pattern", p.Stream)
+		}
+		if len(p.URLs) == 0 {
+			e.add(field+".urls", "at least one URL is required")
+		}
+		for j, raw := range p.URLs {
+			if !isRTMPURL(raw) {
+				e.add(fmt.Sprintf("%s.urls[%d]", field, j), "%q is not an rtmp[s]://host/app URL", raw)
+			}
+		}
+	}
+
+	if w := c.Webhooks; w != nil {
+		//Sorted so the report reads the same on every run.
+		events := make([]string, 0, len(w.Hooks))
+		for event := range w.Hooks {
+			events = append(events, event)
+		}
+		sort.Strings(events)
+		for _, event := range events {
+			urls := w.Hooks[event]
+			field := "webhooks.hooks." + event
+			if !webhookEvents[Event(event)] {
+				e.add(field, "unknown event")
+			}
+			for j, raw := range urls {
+				if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					e.add(fmt.Sprintf("%s[%d]", field, j), "%q is not an http(s) URL", raw)
+				}
+			}
+		}
+		if w.Timeout < 0 {
+			e.add("webhooks.timeout", "must not be negative")
+		}
+		if w.Retries != nil && *w.Retries < 0 {
+			e.add("webhooks.retries", "must not be negative")
+		}
+		if w.Backoff < 0 {
+			e.add("webhooks.backoff", "must not be negative")
+		}
+	}
+
+	if len(e.Problems) > 0 {
+		return e
+	}
+	return nil
+}
+
+// checkAddress validates a host:port listen address. Empty is allowed
+// unless required.
+func isRTMPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "rtmp" || u.Scheme == "rtmps") && u.Host != ""
+}
+
+func checkAddress(e *ConfigError, field, address string, required bool) {
+	if address == "" {
+		if required {
+			e.add(field, "required")
+		}
+		return
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		e.add(field, "%q is not a host:port address", address)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		e.add(field, "%q has an invalid port", address)
+	}
+}
+
+// NewServerFromConfig validates cfg and builds the server it
+// describes. Call Run on the result.
+func NewServerFromConfig(cfg *Config) (*server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	rtmpAddress := cfg.RTMP
+	if rtmpAddress == "" {
+		rtmpAddress = ":1935"
+	}
+	s := NewServer(rtmpAddress)
+	s.config = cfg
+	if cfg.LogLevel != "" {
+		s.WithLogger(liblog.New(os.Stdout, logLevels[cfg.LogLevel]))
+	}
+	if cfg.HTTPFLV != "" {
+		s.WithHTTPFlv(cfg.HTTPFLV)
+	}
+	s.hlsAddress = cfg.HLS //HLS/DASH are switched on per app below
+	if cfg.RTSP != "" {
+		s.WithRTSP(cfg.RTSP)
+	}
+	if cfg.Admin != "" {
+		s.WithAdminAPI(cfg.Admin)
+	}
+	if r := cfg.RTMPS; r != nil {
+		cert, err := tls.LoadX509KeyPair(r.Cert, r.Key)
+		if err != nil {
+			return nil, err
+		}
+		s.WithRTMPS(r.Address, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	for _, a := range cfg.Apps {
+		s.apps[a.Name] = newAppFromConfig(a)
+	}
+
+	for _, srt := range cfg.SRT {
+		s.WithSRT(srt.Address, srt.App, srt.Stream)
+	}
+	for _, p := range cfg.Pulls {
+		s.WithRTMPPull(p.URL, p.App, p.Stream)
+	}
+	for _, p := range cfg.Pushes {
+		s.WithRTMPPush(p.App, p.Stream, p.URLs...)
+	}
+
+	if w := cfg.Webhooks; w != nil {
+		for event, urls := range w.Hooks {
+			for _, u := range urls {
+				s.WithWebhook(Event(event), u)
+			}
+		}
+		if s.webhooks == nil {
+			s.webhooks = newWebhooks()
+		}
+		if w.Timeout > 0 {
+			s.webhooks.timeout = time.Duration(w.Timeout)
+		}
+		if w.Retries != nil {
+			s.webhooks.retries = *w.Retries
+		}
+		if w.Backoff > 0 {
+			s.webhooks.backoff = time.Duration(w.Backoff)
+		}
+	}
+	return s, nil
+}
+
+// newAppFromConfig builds a detached App carrying a's settings.
+func newAppFromConfig(a AppConfig) *App {
+	app := NewApp(a.Name)
+	if h := a.HLS; h != nil {
+		app.hlsMode = hlsModes[h.Mode]
+		if h.Dir != "" {
+			app.hlsDir = h.Dir
+		}
+		app.hlsTargetDur = time.Duration(h.TargetDuration)
+		app.hlsWindowSize = h.WindowSize
+		app.hlsLowLatency = h.LowLatency
+	}
+	if d := a.DASH; d != nil {
+		app.dashEnabled = true
+		if d.Dir != "" {
+			app.dashDir = d.Dir
+		}
+		app.dashTargetDur = time.Duration(d.TargetDuration)
+		app.dashWindowSize = d.WindowSize
+	}
+	if t := a.Token; t != nil {
+		tc := TokenConfig{Secret: []byte(t.Secret), Skew: time.Duration(t.Skew), Sign: SignPath | SignExpiry}
+		if len(t.Sign) > 0 {
+			tc.Sign = 0
+			for _, part := range t.Sign {
+				tc.Sign |= tokenSignParts[part]
+			}
+		}
+		app.token = &tc
+	}
+	if a.Record != nil {
+		rc := *a.Record
+		app.record = &rc
+	}
+	if a.VOD != nil {
+		vc := *a.VOD
+		app.vod = &vc
+	}
+	if a.DVR != nil {
+		dc := *a.DVR
+		app.dvr = &dc
+	}
+	if a.Edge != nil {
+		ec := *a.Edge
+		app.edge = &ec
+	}
+	if a.GOPCache != nil {
+		gc := *a.GOPCache
+		app.gopCache = &gc
+	}
+	if a.SendQueue != nil {
+		sq := *a.SendQueue
+		app.sendQueue = &sq
+	}
+	return app
+}
+
+// appConfigOf is the AppConfig newAppFromConfig would build app from,
+// for apps set up with the With* options rather than a config.
+func appConfigOf(app *App) AppConfig {
+	a := AppConfig{Name: app.appName}
+	if app.hlsMode != libhls.NONE || app.hlsDir != "./data" || app.hlsTargetDur != 0 || app.hlsWindowSize != 0 || app.hlsLowLatency {
+		h := HLSConfig{TargetDuration: Duration(app.hlsTargetDur), WindowSize: app.hlsWindowSize, LowLatency: app.hlsLowLatency}
+		switch app.hlsMode {
+		case libhls.DELAY:
+			h.Mode = "delay"
+		case libhls.NONE:
+			h.Mode = "none"
+		}
+		if app.hlsDir != "./data" {
+			h.Dir = app.hlsDir
+		}
+		a.HLS = &h
+	}
+	if app.dashEnabled {
+		d := DASHConfig{TargetDuration: Duration(app.dashTargetDur), WindowSize: app.dashWindowSize}
+		if app.dashDir != "./data" {
+			d.Dir = app.dashDir
+		}
+		a.DASH = &d
+	}
+	if t := app.token; t != nil {
+		tc := AppTokenConfig{Secret: string(t.Secret), Skew: Duration(t.Skew)}
+		if t.Sign != SignPath|SignExpiry {
+			for _, part := range []string{"path", "expiry", "ip"} {
+				if t.Sign&tokenSignParts[part] != 0 {
+					tc.Sign = append(tc.Sign, part)
+				}
+			}
+		}
+		a.Token = &tc
+	}
+	a.Record, a.VOD, a.DVR, a.Edge, a.GOPCache, a.SendQueue = app.record, app.vod, app.dvr, app.edge, app.gopCache, app.sendQueue
+	return a
+}
+
+// orRunning fills the sections a leaves out with those of running, the
+// config of the app it replaces.
+func (a AppConfig) orRunning(running AppConfig) AppConfig {
+	if a.HLS == nil {
+		a.HLS = running.HLS
+	}
+	if a.DASH == nil {
+		a.DASH = running.DASH
+	}
+	if a.Token == nil {
+		a.Token = running.Token
+	}
+	if a.Record == nil {
+		a.Record = running.Record
+	}
+	if a.VOD == nil {
+		a.VOD = running.VOD
+	}
+	if a.DVR == nil {
+		a.DVR = running.DVR
+	}
+	if a.Edge == nil {
+		a.Edge = running.Edge
+	}
+	if a.GOPCache == nil {
+		a.GOPCache = running.GOPCache
+	}
+	if a.SendQueue == nil {
+		a.SendQueue = running.SendQueue
+	}
+	return a
+}
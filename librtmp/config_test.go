@@ -0,0 +1,134 @@
+package librtmp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libhls"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig(strings.NewReader(`{
+		"rtmp": ":1935",
+		"hls": ":8081",
+		"log_level": "info",
+		"apps": [
+			{"name": "live", "hls": {"mode": "delay", "dir": "/tmp/hls", "target_duration": "4s", "window_size": 6, "low_latency": true},
+			 "dash": {"target_duration": 2}, "gop_cache": {"mode": "gops", "gops": 2, "bytes": 4000000}},
+			{"name": "secure", "token": {"secret": "k", "skew": "30s", "sign": ["path", "ip"]}, "send_queue": {"drop_lag": "1s", "write_timeout": 5}},
+			{"name": "edge", "edge": {"origins": ["rtmp://origin-a", "rtmps://origin-b:443/"], "idle_timeout": "10s"}}
+		],
+		"srt": [{"address": ":9000", "app": "live", "stream": "srt"}],
+		"pulls": [{"url": "rtmp://origin/live/a", "app": "live", "stream": "a"}],
+		"pushes": [{"app": "live", "stream": "*", "urls": ["rtmp://yt/live2/key", "rtmp://twitch/app/key", "rtmps://fb:443/rtmp/key"]}],
+		"webhooks": {"hooks": {"on_publish": ["http://hooks/publish"]}, "retries": 0}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServerFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := srv.apps["live"]
+	if live.hlsMode != libhls.DELAY || live.hlsDir != "/tmp/hls" || live.hlsTargetDur != 4*time.Second ||
+		live.hlsWindowSize != 6 || !live.hlsLowLatency {
+		t.Errorf("live hls = %v %q %v %d %v", live.hlsMode, live.hlsDir, live.hlsTargetDur, live.hlsWindowSize, live.hlsLowLatency)
+	}
+	if !live.dashEnabled || live.dashTargetDur != 2*time.Second || live.dashDir != "./data" {
+		t.Errorf("live dash = %v %v %q", live.dashEnabled, live.dashTargetDur, live.dashDir)
+	}
+	if gc := live.gopCache; gc == nil || gc.Mode != GOPCacheGOPs || gc.GOPs != 2 || gc.Bytes != 4000000 {
+		t.Errorf("live gop_cache = %+v", gc)
+	}
+	secure := srv.apps["secure"]
+	if secure.hlsMode != libhls.NONE || secure.dashEnabled {
+		t.Error("secure app got HLS/DASH without asking for it")
+	}
+	if secure.token == nil || string(secure.token.Secret) != "k" || secure.token.Skew != 30*time.Second ||
+		secure.token.Sign != SignPath|SignIP {
+		t.Errorf("secure token = %+v", secure.token)
+	}
+	if sq := secure.sendQueue; sq == nil || time.Duration(sq.DropLag) != time.Second || time.Duration(sq.WriteTimeout) != 5*time.Second {
+		t.Errorf("secure send_queue = %+v", sq)
+	}
+	if edge := srv.apps["edge"].edge; edge == nil || len(edge.Origins) != 2 || edge.idleTimeout() != 10*time.Second ||
+		edge.originURLs("edge", "x")[1] != "rtmps://origin-b:443/edge/x" {
+		t.Errorf("edge = %+v", edge)
+	}
+	if len(srv.srtSpecs) != 1 || len(srv.pulls) != 1 {
+		t.Errorf("srt = %d, pulls = %d", len(srv.srtSpecs), len(srv.pulls))
+	}
+	if len(srv.pushes) != 3 || !srv.pushes[1].matches("live", "any") || srv.pushes[1].remoteURL != "rtmp://twitch/app/key" {
+		t.Errorf("pushes = %+v", srv.pushes)
+	}
+	if srv.webhooks == nil || srv.webhooks.retries != 0 || srv.webhooks.timeout != 3*time.Second {
+		t.Errorf("webhooks = %+v", srv.webhooks)
+	}
+}
+
+func TestParseConfig_Invalid(t *testing.T) {
+	_, err := ParseConfig(strings.NewReader(`{
+		"rtmp": "1935",
+		"log_level": "loud",
+		"rtmps": {"address": ":443"},
+		"apps": [
+			{"name": "live", "hls": {"mode": "fast"}, "dash": {}, "gop_cache": {"mode": "fast"}},
+			{"name": "live", "token": {"sign": ["path", "host"]}, "record": {"format": "mkv", "faststart": true}},
+			{"name": "edge", "edge": {"origins": ["rtmp://origin/live"]}, "send_queue": {"skip_lag": "30s", "write_timeout": -1, "max_bytes": -1}},
+			{"name": "edge2", "edge": {}, "gop_cache": {"mode": "none", "gops": -1}}
+		],
+		"srt": [{"address": ":9000", "app": "vod", "stream": "x"}, {"address": ":9000", "app": "live", "stream": "x"}],
+		"pulls": [{"url": "http://origin/live/a", "app": "live", "stream": "x"}],
+		"pushes": [{"app": "vod", "stream": "[", "urls": ["rtmp:///app"]}, {"app": "live", "stream": "x"}],
+		"webhooks": {"hooks": {"on_record": ["http://hooks"], "on_play": ["hooks"]}}
+	}`))
+	var cerr *ConfigError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("ParseConfig = %v, want *ConfigError", err)
+	}
+	for _, want := range []string{
+		`rtmp: "1935" is not a host:port address`,
+		`log_level: unknown level "loud"`,
+		`rtmps.cert: required`,
+		`apps[0].hls.mode: unknown mode "fast"`,
+		`apps[0].dash: needs the top-level hls listener`,
+		`apps[1].name: duplicate app "live"`,
+		`apps[1].token.secret: required`,
+		`apps[1].token.sign[1]: unknown part "host"`,
+		`apps[1].record.format: unknown format "mkv"`,
+		`apps[1].record.faststart: only applies to mp4`,
+		`apps[2].edge.origins[0]: "rtmp://origin/live" is not an rtmp[s]://host[:port] URL`,
+		`apps[3].edge.origins: at least one origin is required`,
+		`apps[0].gop_cache.mode: unknown mode "fast"`,
+		`apps[3].gop_cache: gops, duration and bytes only apply to mode gops`,
+		`apps[3].gop_cache.gops: must not be negative`,
+		`apps[2].send_queue.write_timeout: must not be negative`,
+		`apps[2].send_queue.max_bytes: must not be negative`,
+		`apps[2].send_queue: drop_lag, skip_lag and close_lag must increase`,
+		`srt[0].app: unknown app "vod"`,
+		`srt[1].address: duplicate listener ":9000"`,
+		`pulls[0].url: "http://origin/live/a" is not an rtmp[s]://`,
+		`pulls[0]: stream "live/x" is already fed by srt[1]`,
+		`pushes[0].app: unknown app "vod"`,
+		`pushes[0].stream: "[" is not a valid pattern`,
+		`pushes[0].urls[0]: "rtmp:///app" is not an rtmp[s]://host/app URL`,
+		`pushes[1].urls: at least one URL is required`,
+		`webhooks.hooks.on_play[0]: "hooks" is not an http(s) URL`,
+		`webhooks.hooks.on_record: unknown event`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error lacks %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestParseConfig_UnknownField(t *testing.T) {
+	_, err := ParseConfig(strings.NewReader(`{"apps": [{"name": "live"}], "hsl": ":8081"}`))
+	if err == nil || !strings.Contains(err.Error(), "hsl") {
+		t.Errorf("ParseConfig = %v, want unknown field error", err)
+	}
+}
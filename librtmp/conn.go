@@ -0,0 +1,372 @@
+package librtmp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// DialOptions tunes Dial. The zero value is usable.
+type DialOptions struct {
+	Timeout   time.Duration //for the dial, the handshake and each command; default 10 s
+	ChunkSize int           //size of the chunks we send; default 4096
+	FlashVer  string        //default "FMLE/3.0 (compatible; GGmpeg)"
+	TLSConfig *tls.Config   //for rtmps://; nil verifies the server against the system roots
+}
+
+// StatusError is the server refusing a command, with the code and
+// description of its _error or error-level onStatus.
+type StatusError struct {
+	Code        string //e.g. "NetStream.Publish.BadName"
+	Description string
+}
+
+func (e *StatusError) Error() string {
+	if e.Code == "" {
+		return "rtmp: command rejected"
+	}
+	return "rtmp: " + e.Code + ": " + e.Description
+}
+
+// Conn is a client connection to an RTMP server, made by Dial. Use it
+// either to Publish a stream and WriteTag to it, or to Play one and
+// ReadTag from it. Only Close may be called concurrently with the other
+// methods.
+type Conn struct {
+	conn net.Conn
+	rtmp *RTMP
+	opts DialOptions
+	url  *url.URL
+	txn  int
+
+	publishing bool
+	playing    bool
+	published  string       //stream name, for FCUnpublish
+	streamID   float64      //from createStream, for deleteStream
+	tags       []libflv.Tag //played, not read yet
+
+	//While publishing, a goroutine reads what the server sends; it
+	//stops at the first error, which WriteTag then returns.
+	mu       sync.Mutex
+	readErr  error
+	readDone chan struct{}
+
+	closeOnce sync.Once
+}
+
+// Dial connects to the RTMP server of rawURL, rtmp://host[:port]/app,
+// optionally followed by /stream, or to the RTMPS one of
+// rtmps://host[:port]/app: the complex handshake, then connect to app. Chunk sizes are negotiated both ways and the server's window
+// acknowledged.
+func Dial(rawURL string, opts DialOptions) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse URL: %w", err)
+	}
+	opts = opts.withDefaults()
+	conn, err := dialURL(u, opts.Timeout, opts.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newConn(conn, u, opts, nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialURL opens the transport to u's host: TCP for rtmp://, TLS over
+// TCP for rtmps://, verified with config, nil for the system roots.
+// timeout covers the TLS handshake too.
+func dialURL(u *url.URL, timeout time.Duration, config *tls.Config) (net.Conn, error) {
+	host := rtmpHost(u)
+	var conn net.Conn
+	var err error
+	switch u.Scheme {
+	case "rtmp":
+		conn, err = net.DialTimeout("tcp", host, timeout)
+	case "rtmps":
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", host, config)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", host, err)
+	}
+	return conn, nil
+}
+
+func (opts DialOptions) withDefaults() DialOptions {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 4096
+	}
+	if opts.FlashVer == "" {
+		opts.FlashVer = "FMLE/3.0 (compatible; GGmpeg)"
+	}
+	return opts
+}
+
+// newConn handshakes and connects over conn, already dialled to u's
+// host. srv, if not nil, is the server the connection is made for, and
+// gets its logs.
+func newConn(conn net.Conn, u *url.URL, opts DialOptions, srv *server) (*Conn, error) {
+	opts = opts.withDefaults()
+	c := &Conn{
+		conn: conn,
+		rtmp: NewRTMP(conn, conn.RemoteAddr().String(), srv),
+		opts: opts,
+		url:  u,
+	}
+	c.rtmp.connectApp = parseAppName(u.Path)
+	c.rtmp.tcURL = u.Scheme + "://" + u.Host + "/" + c.rtmp.connectApp
+
+	_ = conn.SetDeadline(time.Now().Add(opts.Timeout))
+	err := HandshakeClient(c.rtmp)
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) nextTxn() int {
+	c.txn++
+	return c.txn
+}
+
+// command sends a command and, unless wait is false, waits for the
+// server's answer; see expectReply.
+func (c *Conn) command(name string, object map[string]interface{}, args []interface{}, wait bool) error {
+	txn := c.nextTxn()
+	if err := c.rtmp.sendCommandRaw(name, txn, object, args); err != nil {
+		return fmt.Errorf("send %s: %w", name, err)
+	}
+	if !wait {
+		return nil
+	}
+	if err := c.rtmp.expectReply(txn, c.opts.Timeout); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func (c *Conn) connect() error {
+	err := c.command(CONNECT, map[string]interface{}{
+		"app":            c.rtmp.connectApp,
+		"type":           "nonprivate",
+		"flashVer":       c.opts.FlashVer,
+		"tcUrl":          c.rtmp.tcURL,
+		"fpad":           false,
+		"capabilities":   15.0,
+		"audioCodecs":    4071.0,
+		"videoCodecs":    252.0,
+		"videoFunction":  1.0,
+		"objectEncoding": 0.0,
+		"fourCcList":     enhancedFourCCs,
+	}, nil, true)
+	if err != nil {
+		return err
+	}
+	//Enhanced RTMP: send in the enhanced form only the codecs the
+	//server listed.
+	if list := c.rtmp.reply.Info.FourCcList; list != nil {
+		c.rtmp.setFourCCs(list)
+	}
+	mb := MessageBase{rtmp: c.rtmp}
+	if err := NewWindowAcknowledgeSizeMessage(mb, c.rtmp.ownWindowAckSize).Send(); err != nil {
+		return fmt.Errorf("send window acknowledgement size: %w", err)
+	}
+	if err := NewSetChunkSizeMessage(mb, uint32(c.opts.ChunkSize)).Send(); err != nil {
+		return fmt.Errorf("send set chunk size: %w", err)
+	}
+	c.rtmp.ownMaxChunkSize = c.opts.ChunkSize
+	return nil
+}
+
+// streamName is stream, or if it is empty the stream of the URL Dial
+// was given, with its query.
+func (c *Conn) streamName(stream string) string {
+	if stream != "" {
+		return stream
+	}
+	stream = parsePlayName(c.url.Path)
+	if stream != "" && c.url.RawQuery != "" {
+		stream += "?" + c.url.RawQuery
+	}
+	return stream
+}
+
+// Publish starts publishing stream, live: releaseStream, FCPublish,
+// createStream, then publish, as encoders do. An empty stream is the
+// one of the URL. If the server refuses, the error is a *StatusError.
+func (c *Conn) Publish(stream string) error {
+	if c.publishing || c.playing {
+		return fmt.Errorf("already publishing or playing")
+	}
+	name := c.streamName(stream)
+	if name == "" {
+		return fmt.Errorf("no stream to publish")
+	}
+	//Hints most servers answer, and some don't: nothing waits on them.
+	if err := c.command(RELEASE_STREAM, nil, []interface{}{name}, false); err != nil {
+		return err
+	}
+	if err := c.command(FCPUBLISH, nil, []interface{}{name}, false); err != nil {
+		return err
+	}
+	if err := c.command(CREATE_STREAM, nil, nil, true); err != nil {
+		return err
+	}
+	streamID := c.rtmp.reply.StreamID
+	if err := c.command(PUBLISH, nil, []interface{}{name, publishLive}, false); err != nil {
+		return err
+	}
+	if err := c.rtmp.expectReply(0, c.opts.Timeout); err != nil {
+		return fmt.Errorf("publish: %w", err)
+	}
+	c.publishing, c.published, c.streamID = true, name, streamID
+	c.readDone = make(chan struct{})
+	go c.readWhilePublishing()
+	return nil
+}
+
+// readWhilePublishing handles the server's acknowledgements, pings and
+// status messages until the connection fails or the server turns the
+// stream down.
+func (c *Conn) readWhilePublishing() {
+	defer close(c.readDone)
+	for {
+		seen := c.rtmp.replies
+		err := ParseMessage(c.rtmp)
+		if err == nil && c.rtmp.replies != seen {
+			if reply := c.rtmp.reply; reply.CommandName == ON_STATUS && reply.Info.Level == "error" {
+				err = &StatusError{Code: reply.Info.Code, Description: reply.Info.Description}
+			}
+		}
+		if err != nil {
+			c.mu.Lock()
+			c.readErr = err
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+// WriteTag sends one tag of the stream being published.
+func (c *Conn) WriteTag(tag libflv.Tag) error {
+	if !c.publishing {
+		return fmt.Errorf("not publishing")
+	}
+	c.mu.Lock()
+	err := c.readErr
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return sendTag(c.rtmp, tag)
+}
+
+// Play starts playing stream: createStream, then play. An empty stream
+// is the one of the URL. If the server refuses, the error is a
+// *StatusError.
+func (c *Conn) Play(stream string) error {
+	if c.publishing || c.playing {
+		return fmt.Errorf("already publishing or playing")
+	}
+	name := c.streamName(stream)
+	if name == "" {
+		return fmt.Errorf("no stream to play")
+	}
+	if err := c.command(CREATE_STREAM, nil, nil, true); err != nil {
+		return err
+	}
+	//Tags may come before the onStatus that starts them.
+	c.rtmp.onTag = func(tag libflv.Tag) { c.tags = append(c.tags, tag) }
+	if err := c.command(PLAY, nil, []interface{}{name}, false); err != nil {
+		return err
+	}
+	if err := c.rtmp.expectReply(0, c.opts.Timeout); err != nil {
+		return fmt.Errorf("play: %w", err)
+	}
+	c.playing = true
+	return nil
+}
+
+// ReadTag returns the next tag of the stream being played: audio,
+// video or script data, as the server sent it. It returns io.EOF once
+// the server reports the stream over.
+func (c *Conn) ReadTag() (libflv.Tag, error) {
+	if !c.playing {
+		return nil, fmt.Errorf("not playing")
+	}
+	for len(c.tags) == 0 {
+		seen := c.rtmp.replies
+		if err := ParseMessage(c.rtmp); err != nil {
+			return nil, err
+		}
+		if c.rtmp.replies == seen || c.rtmp.reply.CommandName != ON_STATUS {
+			continue
+		}
+		switch info := c.rtmp.reply.Info; {
+		case info.Level == "error":
+			return nil, &StatusError{Code: info.Code, Description: info.Description}
+		case info.Code == "NetStream.Play.UnpublishNotify", info.Code == "NetStream.Play.Stop", info.Code == "NetStream.Play.Complete":
+			if len(c.tags) == 0 {
+				return nil, io.EOF
+			}
+		}
+	}
+	tag := c.tags[0]
+	c.tags[0] = nil
+	c.tags = c.tags[1:]
+	return tag, nil
+}
+
+// Close ends the stream, if any, and the connection.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		if c.publishing {
+			//Best effort: the server drops the stream with the
+			//connection anyway.
+			_ = c.rtmp.sendCommandRaw(FCUNPUBLISH, 0, nil, []interface{}{c.published})
+			_ = c.rtmp.sendCommandRaw(DELETE_STREAM, 0, nil, []interface{}{c.streamID})
+		}
+		err = c.conn.Close()
+		if c.readDone != nil {
+			<-c.readDone
+		}
+	})
+	return err
+}
+
+func sendTag(rtmp *RTMP, tag libflv.Tag) error {
+	mb := MessageBase{
+		rtmp:          rtmp,
+		messageTime:   tag.GetTagInfo().TimeStamp,
+		messageLength: tag.GetTagInfo().DataSize,
+		messageType:   MessageType(tag.GetTagInfo().TagType),
+	}
+	switch t := tag.(type) {
+	case *libflv.AudioTag:
+		return NewAudioMessage(mb, t).Send()
+	case *libflv.VideoTag:
+		return NewVideoMessage(mb, t).Send()
+	case *libflv.MetaTag:
+		return NewDataMessage(mb, t).Send()
+	}
+	return fmt.Errorf("unsupported tag %T", tag)
+}
@@ -0,0 +1,213 @@
+package librtmp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+var testKeyframe = []byte{0, 0, 0, 1, 0x65, 0x88}
+
+// writeTestStream publishes metadata, AVC and AAC sequence headers,
+// then a keyframe at 40 ms.
+func writeTestStream(t *testing.T, c *Conn) {
+	for _, tag := range []libflv.Tag{
+		&libflv.MetaTag{TagBase: libflv.TagBase{TagType: libflv.SCRIPT_DATA_TAG}, Width: 1280},
+		&libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG}, FrameType: libflv.KEY_FRAME,
+			CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_SEQUENCE_HEADER, VideoData: []byte{1, 0x4d, 0x40, 0x28, 0xff, 0xe0, 0}},
+		&libflv.AudioTag{TagBase: libflv.TagBase{TagType: libflv.AUDIO_TAG}, SoundFormat: libflv.FLV_AUDIO_AAC, SoundRate: 3, SoundSize: 1,
+			SoundType: libflv.SND_STEREO, AACPacketType: libflv.AAC_SEQUENCE_HEADER, SoundData: []byte{0x12, 0x10}},
+		&libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG, TimeStamp: 40}, FrameType: libflv.KEY_FRAME,
+			CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_NALU, VideoData: testKeyframe},
+	} {
+		if err := c.WriteTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnPublishPlay(t *testing.T) {
+	addr := freeAddr(t)
+	runServer(t, NewServer(addr, "live"))
+
+	pub, err := Dial("rtmp://"+addr+"/live/x", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if pub.rtmp.handshakeMode != COMPLEX1 {
+		t.Errorf("handshake mode %v, want COMPLEX1", pub.rtmp.handshakeMode)
+	}
+	if err := pub.Publish(""); err != nil {
+		t.Fatal(err)
+	}
+	//What Close unpublishes.
+	if pub.published != "x" {
+		t.Errorf("published %q, want x", pub.published)
+	}
+	writeTestStream(t, pub)
+
+	//A second publisher of the stream is turned down.
+	dup, err := Dial("rtmp://"+addr+"/live", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dup.Close()
+	var se *StatusError
+	if err := dup.Publish("x"); !errors.As(err, &se) || se.Code != "NetStream.Publish.BadName" {
+		t.Errorf("publishing x twice: %v", err)
+	}
+
+	play, err := Dial("rtmp://"+addr+"/live", DialOptions{ChunkSize: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer play.Close()
+	if err := play.Play("nope"); !errors.As(err, &se) || se.Code != "NetStream.Play.StreamNotFound" {
+		t.Errorf("playing a missing stream: %v", err)
+	}
+	play, err = Dial("rtmp://"+addr+"/live", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer play.Close()
+	if err := play.Play("x"); err != nil {
+		t.Fatal(err)
+	}
+	var meta, header bool
+	for keyframeSeen := false; !keyframeSeen; {
+		tag, err := play.ReadTag()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch tag := tag.(type) {
+		case *libflv.MetaTag:
+			meta = tag.Width == 1280
+		case *libflv.VideoTag:
+			if tag.AVCPacketType == libflv.AVC_SEQUENCE_HEADER {
+				header = true
+				continue
+			}
+			if !bytes.Equal(tag.VideoData, testKeyframe) || tag.TimeStamp != 40 {
+				t.Errorf("keyframe: % x at %d", tag.VideoData, tag.TimeStamp)
+			}
+			keyframeSeen = true
+		}
+	}
+	if !meta || !header {
+		t.Errorf("before the keyframe: metadata %v, video header %v", meta, header)
+	}
+
+	//The publisher leaving ends the play.
+	pub.Close()
+	for {
+		_, err := play.ReadTag()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("after the publisher left: %v", err)
+		}
+	}
+}
+
+// selfSigned returns a certificate for 127.0.0.1, and a pool trusting it.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+func TestConnRTMPS(t *testing.T) {
+	cert, roots := selfSigned(t)
+	addr, tlsAddr := freeAddr(t), freeAddr(t)
+	runServer(t, NewServer(addr, "live").WithRTMPS(tlsAddr, &tls.Config{Certificates: []tls.Certificate{cert}}))
+
+	//The certificate is checked.
+	if _, err := Dial("rtmps://"+tlsAddr+"/live", DialOptions{}); err == nil {
+		t.Error("Dial trusted a self-signed certificate")
+	}
+
+	pub, err := Dial("rtmps://"+tlsAddr+"/live/x", DialOptions{TLSConfig: &tls.Config{RootCAs: roots}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if _, ok := pub.conn.(*tls.Conn); !ok {
+		t.Errorf("rtmps:// dialled %T", pub.conn)
+	}
+	if err := pub.Publish(""); err != nil {
+		t.Fatal(err)
+	}
+	if pub.rtmp.tcURL != "rtmps://"+tlsAddr+"/live" {
+		t.Errorf("tcUrl %q", pub.rtmp.tcURL)
+	}
+	writeTestStream(t, pub)
+
+	//Plain RTMP players see the stream published over TLS.
+	play, err := Dial("rtmp://"+addr+"/live", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer play.Close()
+	if err := play.Play("x"); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		tag, err := play.ReadTag()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if video, ok := tag.(*libflv.VideoTag); ok && bytes.Equal(video.VideoData, testKeyframe) {
+			break
+		}
+	}
+}
+
+func TestRTMPHost(t *testing.T) {
+	for in, want := range map[string]string{
+		"rtmp://h/live":       "h:1935",
+		"rtmps://h/live":      "h:443",
+		"rtmps://h:8443/live": "h:8443",
+		"rtmp://[::1]/live/x": "[::1]:1935",
+	} {
+		u, _ := url.Parse(in)
+		if got := rtmpHost(u); got != want {
+			t.Errorf("rtmpHost(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package librtmp
 import (
 	"encoding/binary"
 	"fmt"
+
+	"github.com/sbraveyoung/GGmpeg/liblog"
 )
 
 // CSIDs used by the protocol-control path. The values here predate the
@@ -45,7 +47,7 @@ func (wasm *WindowAcknowledgeSizeMessage) Send() (err error) {
 
 func (wasm *WindowAcknowledgeSizeMessage) Parse() (err error) {
 	wasm.AcknowledgementWindowSize = binary.BigEndian.Uint32(wasm.messagePayload)
-	fmt.Println("windowAcknowledgeSize:", wasm.AcknowledgementWindowSize)
+	wasm.rtmp.log().Debug("window acknowledgement size", liblog.F("size", wasm.AcknowledgementWindowSize))
 	return nil
 }
 
@@ -98,8 +100,7 @@ func (spbwm *SetPeerBandWidthMessage) Parse() (err error) {
 	}
 	spbwm.AcknowledgementWindowSize = binary.BigEndian.Uint32(spbwm.messagePayload[:4])
 	spbwm.LimitType = LimitType(spbwm.messagePayload[4])
-	fmt.Println("peerBandWidth:", spbwm.AcknowledgementWindowSize)
-	fmt.Println("limitType:", spbwm.LimitType)
+	spbwm.rtmp.log().Debug("set peer bandwidth", liblog.F("size", spbwm.AcknowledgementWindowSize), liblog.F("limit", spbwm.LimitType))
 	return nil
 }
 
@@ -189,7 +190,7 @@ func (ucm *UserControlMessage) Parse() (err error) {
 	}
 	ucm.EventType = EventType(binary.BigEndian.Uint16(ucm.messagePayload[0:2]))
 	ucm.EventData = ucm.messagePayload[2:]
-	fmt.Println("----------ucm.EventType:", ucm.EventType)
+	ucm.rtmp.log().Debug("user control", liblog.F("event", ucm.EventType))
 	return nil
 }
 
@@ -233,7 +234,7 @@ func (scsm *SetChunkSizeMessage) Send() error {
 
 func (scsm *SetChunkSizeMessage) Parse() (err error) {
 	scsm.NewChunkSize = binary.BigEndian.Uint32(scsm.messagePayload)
-	fmt.Println("new chunk size of peer::", scsm.NewChunkSize)
+	scsm.rtmp.log().Debug("set chunk size", liblog.F("size", scsm.NewChunkSize))
 	return nil
 }
 
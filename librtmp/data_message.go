@@ -1,9 +1,8 @@
 package librtmp
 
 import (
-	"fmt"
-
 	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 )
 
 type DataMessage struct {
@@ -55,7 +54,7 @@ func (dm *DataMessage) Parse() (err error) {
 		DataSize:  dm.messageLength,
 		TimeStamp: dm.messageTime,
 		StreamID:  0,
-	}, dm.amf, dm.messagePayload)
+	}, dm.amf, dm.amfPayload())
 	if err != nil {
 		return err
 	}
@@ -64,12 +63,22 @@ func (dm *DataMessage) Parse() (err error) {
 }
 
 func (dm *DataMessage) Do() (err error) {
+	if dm.rtmp.onTag != nil {
+		dm.rtmp.onTag(dm.metaTag)
+		return nil
+	}
 	if dm.rtmp.room == nil {
 		return nil
 	}
+	if !dm.metaTag.IsMetaData() {
+		//Cue points and the like go along with the media, to players
+		//and recordings.
+		dm.rtmp.room.writeTag(dm.metaTag, false)
+		return nil
+	}
 	dm.rtmp.room.setMeta(dm.metaTag)
 	dm.rtmp.room.GOP.WriteMeta(dm.metaTag)
-	fmt.Printf("write packet data :%+v\n", dm.metaTag)
+	dm.rtmp.log().Debug("metadata", liblog.F("width", dm.metaTag.Width), liblog.F("height", dm.metaTag.Height))
 
 	return nil
 }
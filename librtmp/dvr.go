@@ -0,0 +1,405 @@
+package librtmp
+
+import (
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SmartBrave/Athena/easyio"
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
+)
+
+// dvrLive is the seek target of the live edge: the latest keyframe.
+const dvrLive = time.Duration(math.MaxInt64)
+
+// DVRConfig keeps the last Window of every live stream of an app, so
+// RTMP players can pause, seek back within it and seek forward to the
+// live edge again, and HTTP-FLV players can start in it with
+// ?start=<seconds>, negative seconds counting back from the live edge.
+// With a Dir the window is kept in files there rather than in memory.
+type DVRConfig struct {
+	Window Duration `json:"window"` //default 5 minutes
+	Dir    string   `json:"dir"`    //empty: in memory
+}
+
+// WithDVR enables the time-shift window on appName. See DVRConfig.
+func (s *server) WithDVR(appName string, cfg DVRConfig) *server {
+	if _, ok := s.apps[appName]; !ok {
+		panic("appName does not exist.")
+	}
+	s.apps[appName].dvr = &cfg
+	return s
+}
+
+func (c *DVRConfig) window() time.Duration {
+	if c.Window <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(c.Window)
+}
+
+// dvrBuffer is a room's time-shift window. It is kept in chunks, each
+// starting on a keyframe, and trimmed a whole chunk at a time, so it
+// holds between the window and a quarter more.
+type dvrBuffer struct {
+	window time.Duration
+	dir    string
+	prefix string //of chunk file names
+
+	mu      sync.Mutex
+	chunks  []*dvrChunk
+	end     int64         //index of the next tag
+	wake    chan struct{} //closed and replaced on every tag
+	done    chan struct{} //closed with the room
+	closed  bool
+	video   bool //seen a video tag: only keyframes are seek points
+	readers int
+}
+
+type dvrChunk struct {
+	base    int64 //index of its first tag
+	entries []dvrEntry
+	file    *os.File //nil in memory
+	size    int64
+}
+
+type dvrEntry struct {
+	ts  uint32
+	key bool
+	tag libflv.Tag //in memory, or where the file write failed
+
+	//On disk: the tag body.
+	tagType uint8
+	offset  int64
+	length  uint32
+}
+
+func newDVRBuffer(cfg *DVRConfig, appName, roomID string) *dvrBuffer {
+	return &dvrBuffer{
+		window: cfg.window(),
+		dir:    cfg.Dir,
+		prefix: strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(appName + "-" + roomID),
+		wake:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// startDVR sets up room's window if app keeps one. Call it before the
+// room is stored, so players never see room.dvr change.
+func (s *server) startDVR(app *App, room *Room) {
+	if app.dvr == nil {
+		return
+	}
+	buf := newDVRBuffer(app.dvr, app.appName, room.RoomID)
+	room.dvr = buf
+	if buf.dir != "" {
+		if err := os.MkdirAll(buf.dir, 0o755); err != nil {
+			s.logger.Warn("dvr falls back to memory", liblog.App(app.appName), liblog.Stream(room.RoomID), liblog.Err(err))
+			buf.dir = ""
+		}
+	}
+	reader := room.newGOPReader()
+	if !s.goTracked(&s.streams, func() {
+		for {
+			p, alive := reader.Read()
+			if !alive {
+				break
+			}
+			buf.write(p.(libflv.Tag))
+		}
+		buf.close()
+	}) {
+		buf.close()
+	}
+}
+
+// write appends a media tag; sequence headers and metadata are the
+// room's to replay.
+func (b *dvrBuffer) write(tag libflv.Tag) {
+	var key bool
+	switch t := tag.(type) {
+	case *libflv.VideoTag:
+		if t.AVCPacketType == libflv.AVC_SEQUENCE_HEADER {
+			return
+		}
+		b.video = true
+		key = t.FrameType == libflv.KEY_FRAME
+	case *libflv.AudioTag:
+		if t.SoundFormat == libflv.FLV_AUDIO_AAC && t.AACPacketType == libflv.AAC_SEQUENCE_HEADER {
+			return
+		}
+		key = !b.video
+	default:
+		return
+	}
+	ts := tag.GetTagInfo().TimeStamp
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	var last *dvrChunk
+	if len(b.chunks) > 0 {
+		last = b.chunks[len(b.chunks)-1]
+	}
+	switch {
+	case key && (last == nil || time.Duration(ts-last.entries[0].ts)*time.Millisecond >= b.window/4):
+		last = &dvrChunk{base: b.end}
+		if b.dir != "" {
+			//A file that can't be made leaves the chunk in memory.
+			last.file, _ = os.CreateTemp(b.dir, b.prefix+"-*.dvr")
+		}
+		b.chunks = append(b.chunks, last)
+	case last == nil:
+		return //nothing to start playing from yet
+	}
+
+	e := dvrEntry{ts: ts, key: key, tag: tag}
+	if last.file != nil {
+		body := tag.Marshal()
+		if _, err := last.file.WriteAt(body, last.size); err == nil {
+			e.tag, e.tagType, e.offset, e.length = nil, tag.GetTagInfo().TagType, last.size, uint32(len(body))
+			last.size += int64(len(body))
+		}
+	}
+	last.entries = append(last.entries, e)
+	b.end++
+
+	for len(b.chunks) > 1 && time.Duration(ts-b.chunks[1].entries[0].ts)*time.Millisecond >= b.window {
+		b.chunks[0].release()
+		b.chunks = b.chunks[1:]
+	}
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// release drops the chunk's file. A reader still on it gets an error
+// and moves on to the start of the window.
+func (c *dvrChunk) release() {
+	if c.file != nil {
+		_ = c.file.Close()
+		_ = os.Remove(c.file.Name())
+	}
+}
+
+// close ends the window with its room. The files go once the last
+// reader is done with them.
+func (b *dvrBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	close(b.wake)
+	close(b.done)
+	if b.readers == 0 {
+		b.releaseAll()
+	}
+}
+
+func (b *dvrBuffer) releaseAll() {
+	for _, c := range b.chunks {
+		c.release()
+	}
+	b.chunks = nil
+}
+
+// liveEdge returns the time of the latest tag.
+func (b *dvrBuffer) liveEdge() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.chunks) == 0 {
+		return 0
+	}
+	last := b.chunks[len(b.chunks)-1]
+	return time.Duration(last.entries[len(last.entries)-1].ts) * time.Millisecond
+}
+
+// dvrCursor plays a room's window from a position in it.
+type dvrCursor struct {
+	buf  *dvrBuffer
+	room *Room
+	pos  int64
+}
+
+func (b *dvrBuffer) newCursor(room *Room) *dvrCursor {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readers++
+	return &dvrCursor{buf: b, room: room, pos: b.end}
+}
+
+func (c *dvrCursor) next() (libflv.Tag, <-chan struct{}, error) {
+	b := c.buf
+	for {
+		b.mu.Lock()
+		if len(b.chunks) > 0 && c.pos < b.chunks[0].base {
+			c.pos = b.chunks[0].base //fell out of the window
+		}
+		if c.pos >= b.end || len(b.chunks) == 0 {
+			wake, closed := b.wake, b.closed
+			b.mu.Unlock()
+			if closed {
+				return nil, nil, io.EOF
+			}
+			return nil, wake, nil
+		}
+		i := sort.Search(len(b.chunks), func(i int) bool { return b.chunks[i].base > c.pos }) - 1
+		chunk := b.chunks[i]
+		e := chunk.entries[c.pos-chunk.base]
+		c.pos++
+		b.mu.Unlock()
+
+		if e.tag != nil {
+			return e.tag, nil, nil
+		}
+		body := make([]byte, e.length)
+		if _, err := chunk.file.ReadAt(body, e.offset); err != nil {
+			continue //trimmed meanwhile
+		}
+		tb := libflv.TagBase{TagType: e.tagType, DataSize: e.length, TimeStamp: e.ts}
+		var tag libflv.Tag
+		var err error
+		if e.tagType == libflv.VIDEO_TAG {
+			tag, err = libflv.ParseVideoTag(tb, body)
+		} else {
+			tag, err = libflv.ParseAudioTag(tb, body)
+		}
+		return tag, nil, err
+	}
+}
+
+// seekTo moves to the last keyframe at or before t, the first one if t
+// is before the window.
+func (c *dvrCursor) seekTo(t time.Duration) (time.Duration, error) {
+	b := c.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.chunks) == 0 {
+		c.pos = b.end
+		return 0, nil
+	}
+	ms := uint32(math.MaxUint32)
+	if t < 0 {
+		ms = 0
+	} else if t < time.Duration(math.MaxUint32)*time.Millisecond {
+		ms = uint32(t / time.Millisecond)
+	}
+	i := sort.Search(len(b.chunks), func(i int) bool { return b.chunks[i].entries[0].ts > ms }) - 1
+	if i < 0 {
+		i = 0
+	}
+	chunk := b.chunks[i]
+	at := 0
+	for j, e := range chunk.entries {
+		if e.ts > ms {
+			break
+		}
+		if e.key {
+			at = j
+		}
+	}
+	c.pos = chunk.base + int64(at)
+	return time.Duration(chunk.entries[at].ts) * time.Millisecond, nil
+}
+
+func (c *dvrCursor) headers() []libflv.Tag {
+	meta, video, audio := c.room.snapshotHeaders()
+	var tags []libflv.Tag
+	if meta != nil {
+		tags = append(tags, meta)
+	}
+	if video != nil {
+		tags = append(tags, video)
+	}
+	if audio != nil {
+		tags = append(tags, audio)
+	}
+	return tags
+}
+
+func (c *dvrCursor) close() {
+	b := c.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readers--
+	if b.closed && b.readers == 0 {
+		b.releaseAll()
+	}
+}
+
+// playDVR starts an RTMP player on room's window, at the live edge or
+// at the play command's start, in milliseconds.
+func (cm *CommandMessage) playDVR(room *Room) {
+	start := dvrLive
+	if cm.Start > 0 {
+		start = time.Duration(cm.Start) * time.Millisecond
+	}
+	player := newPacedPlayer(cm.rtmp, room.dvr.newCursor(room), cm.PublishingName, true)
+	player.ended = room.dvr.done
+	cm.rtmp.player = player
+	//Tracked with the streams, like RTMPJoin: it ends with the room.
+	if !cm.rtmp.server.goTracked(&cm.rtmp.server.streams, func() { player.run(start) }) {
+		player.src.close()
+	}
+}
+
+// dvrFLVJoin is flvJoin from start seconds into room's window, or
+// before its live edge if negative. It writes as fast as the client
+// reads, so a client that stops reading pauses until it drops out of
+// the window.
+func (room *Room) dvrFLVJoin(writer easyio.EasyWriter, start string, tracks *trackFilter, done <-chan struct{}) {
+	secs, _ := strconv.ParseFloat(start, 64)
+	at := time.Duration(secs * float64(time.Second))
+	if secs < 0 {
+		at += room.dvr.liveEdge()
+	}
+	cursor := room.dvr.newCursor(room)
+	defer cursor.close()
+	if _, err := cursor.seekTo(at); err != nil {
+		return
+	}
+
+	if err := writer.WriteFull([]byte{0x46, 0x4c, 0x56, 0x01, tracks.flvFlags(true, true), 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}); err != nil {
+		return
+	}
+	for _, tag := range cursor.headers() {
+		if ok, _ := tracks.pass(tag); !ok {
+			continue
+		}
+		if err := writer.WriteFull(libflv.FLVWrite(tag)); err != nil {
+			return
+		}
+	}
+	for {
+		tag, more, err := cursor.next()
+		if err != nil {
+			return
+		}
+		if tag == nil {
+			select {
+			case <-more:
+				continue
+			case <-done:
+				return
+			}
+		}
+		if ok, _ := tracks.pass(tag); !ok {
+			continue
+		}
+		b := libflv.FLVWrite(tag)
+		if err := writer.WriteFull(b); err != nil {
+			return
+		}
+		room.bytesOut.add(len(b))
+	}
+}
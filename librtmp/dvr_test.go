@@ -0,0 +1,108 @@
+package librtmp
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/SmartBrave/Athena/easyio"
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// feedDVR writes 20 s of video with a keyframe a second, and AAC.
+func feedDVR(buf *dvrBuffer) {
+	for ts := uint32(0); ts < 20000; ts += 250 {
+		frame := uint8(libflv.INTER_FRAME)
+		if ts%1000 == 0 {
+			frame = libflv.KEY_FRAME
+		}
+		buf.write(&libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG, TimeStamp: ts}, FrameType: frame,
+			CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_NALU, VideoData: []byte{0, 0, 0, 1, byte(ts / 1000)}})
+		buf.write(&libflv.AudioTag{TagBase: libflv.TagBase{TagType: libflv.AUDIO_TAG, TimeStamp: ts + 10},
+			SoundFormat: libflv.FLV_AUDIO_AAC, AACPacketType: libflv.AAC_RAW, SoundData: []byte{0x21}})
+	}
+}
+
+func TestDVRBuffer(t *testing.T) {
+	for name, dir := range map[string]string{"memory": "", "disk": t.TempDir()} {
+		t.Run(name, func(t *testing.T) {
+			buf := newDVRBuffer(&DVRConfig{Window: Duration(8 * time.Second), Dir: dir}, "live", "x")
+			room := &Room{RoomID: "x", dvr: buf}
+			feedDVR(buf)
+
+			//Chunks of 2 s: 8 to 10 s are kept, from 10 s on.
+			c := buf.newCursor(room)
+			at, err := c.seekTo(0)
+			if err != nil || at != 10*time.Second {
+				t.Fatalf("seek before the window = %v, %v; want its start, 10s", at, err)
+			}
+			at, _ = c.seekTo(13700 * time.Millisecond)
+			if at != 13*time.Second {
+				t.Errorf("seek to 13.7s landed on %v, want the keyframe at 13s", at)
+			}
+			tag, _, err := c.next()
+			v, ok := tag.(*libflv.VideoTag)
+			if err != nil || !ok || v.TimeStamp != 13000 || v.FrameType != libflv.KEY_FRAME || !bytes.Equal(v.VideoData, []byte{0, 0, 0, 1, 13}) {
+				t.Fatalf("first tag = %+v, %v; want the keyframe at 13s", tag, err)
+			}
+			if at, _ := c.seekTo(dvrLive); at != 19*time.Second {
+				t.Errorf("live edge = %v, want the keyframe at 19s", at)
+			}
+			n := 0
+			for {
+				tag, more, err := c.next()
+				if err != nil || tag == nil {
+					if more == nil {
+						t.Error("no wake-up channel at the live edge")
+					}
+					break
+				}
+				n++
+			}
+			if n != 8 {
+				t.Errorf("read %d tags from the live edge, want 8", n)
+			}
+
+			buf.close()
+			if _, _, err := c.next(); err == nil {
+				t.Error("no end after the room closed")
+			}
+			c.close()
+			if dir != "" {
+				if files, _ := os.ReadDir(dir); len(files) != 0 {
+					t.Errorf("%d chunk files left behind", len(files))
+				}
+			}
+		})
+	}
+}
+
+func TestDVRFLVJoin(t *testing.T) {
+	buf := newDVRBuffer(&DVRConfig{Window: Duration(time.Minute)}, "live", "x")
+	room := &Room{RoomID: "x", dvr: buf}
+	feedDVR(buf)
+
+	//Gone by the time the live edge is reached.
+	done := make(chan struct{})
+	close(done)
+	out := &bytes.Buffer{}
+	room.dvrFLVJoin(easyio.NewEasyWriter(out), "-3.5", nil, done)
+	b := out.Bytes()
+	var first uint32
+	frames := 0
+	for i := 13; i+11 <= len(b); {
+		n := int(b[i+1])<<16 | int(b[i+2])<<8 | int(b[i+3])
+		if b[i] == libflv.VIDEO_TAG {
+			if frames == 0 {
+				first = uint32(b[i+7])<<24 | uint32(b[i+4])<<16 | uint32(b[i+5])<<8 | uint32(b[i+6])
+			}
+			frames++
+		}
+		i += 11 + n + 4
+	}
+	//3.5 s before the live edge at 19.76 s: from the keyframe at 16 s.
+	if first != 16000 || frames != 16 {
+		t.Errorf("%d frames from %d ms, want 16 from 16000", frames, first)
+	}
+}
@@ -0,0 +1,278 @@
+package librtmp
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
+)
+
+// EdgeConfig makes an app the edge of a cluster of origin servers. A
+// stream played on the edge but not published there is pulled from the
+// first origin that has it, over one connection shared by every local
+// viewer, and dropped once it has had no viewer for IdleTimeout. A
+// stream published on the edge is served locally and forwarded to the
+// first origin that takes it. Origins serve the same app name.
+type EdgeConfig struct {
+	Origins     []string `json:"origins"`      //rtmp[s]://host[:port], tried in order
+	IdleTimeout Duration `json:"idle_timeout"` //default 30 s
+}
+
+// WithEdge makes appName an edge of cfg.Origins. See EdgeConfig.
+func (s *server) WithEdge(appName string, cfg EdgeConfig) *server {
+	if _, ok := s.apps[appName]; !ok {
+		panic("appName does not exist.")
+	}
+	s.apps[appName].edge = &cfg
+	return s
+}
+
+func (c *EdgeConfig) idleTimeout() time.Duration {
+	if c.IdleTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.IdleTimeout)
+}
+
+// originURLs returns the URL of app's stream on each origin; an empty
+// stream leaves it off, for publishes named after the room.
+func (c *EdgeConfig) originURLs(app, stream string) []string {
+	urls := make([]string, 0, len(c.Origins))
+	for _, origin := range c.Origins {
+		u := strings.TrimSuffix(origin, "/") + "/" + app
+		if stream != "" {
+			u += "/" + stream
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// edgePull is a pull from the origins started by a viewer. Viewers
+// arriving while it connects wait on ready and share its room; those
+// arriving once it's closing wait on done and start another.
+type edgePull struct {
+	ready   chan struct{}
+	done    chan struct{}
+	room    *Room //nil if no origin had the stream
+	closing bool  //under s.mu: the room is out of the app, the pull ending
+}
+
+// playRoom returns roomID's room for a viewer on app: the one published
+// here or, on an edge, the one pulled from the origins, waiting for the
+// pull to start if need be. A pull plays with query, the query of the
+// viewer who starts it, for the origin to authorize it. nil means
+// there's no such stream.
+func (s *server) playRoom(app *App, roomID string, query url.Values) *Room {
+	if app.edge == nil {
+		return app.Load(roomID)
+	}
+	key := app.appName + "/" + roomID
+	for {
+		s.mu.Lock()
+		if room := app.Load(roomID); room != nil {
+			s.mu.Unlock()
+			return room
+		}
+		pull, ok := s.edgePulls[key]
+		if ok && pull.closing {
+			s.mu.Unlock()
+			<-pull.done
+			continue
+		}
+		if !ok {
+			if s.closing() {
+				s.mu.Unlock()
+				return nil
+			}
+			pull = &edgePull{ready: make(chan struct{}), done: make(chan struct{})}
+			s.edgePulls[key] = pull
+		}
+		s.mu.Unlock()
+		if !ok && !s.goTracked(&s.workers, func() { s.runEdgePull(app, roomID, query, key, pull) }) {
+			s.endEdgePull(key, pull)
+		}
+		<-pull.ready
+		return pull.room
+	}
+}
+
+// closeEdgePull takes pull's room out of app before its upstream goes,
+// so that viewers from then on wait for the pull to end and start
+// another rather than join a room about to lose its feed.
+func (s *server) closeEdgePull(app *App, roomID string, pull *edgePull) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !pull.closing {
+		pull.closing = true
+		app.Delete(roomID)
+	}
+}
+
+// endEdgePull forgets pull, letting the next viewer start another.
+func (s *server) endEdgePull(key string, pull *edgePull) {
+	s.mu.Lock()
+	if s.edgePulls[key] == pull {
+		delete(s.edgePulls, key)
+	}
+	s.mu.Unlock()
+	for _, ch := range []chan struct{}{pull.ready, pull.done} {
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+	}
+}
+
+// runEdgePull plays roomID from the first origin that has it into a
+// local room, until the origin drops it, the viewers have been gone for
+// the idle timeout, or the server shuts down.
+func (s *server) runEdgePull(app *App, roomID string, query url.Values, key string, pull *edgePull) {
+	log := s.logger.With(liblog.App(app.appName), liblog.Stream(roomID))
+	c, err := s.dialEdgeOrigins(app, roomID, query)
+	if err != nil {
+		log.Info("edge pull failed", liblog.Err(err))
+		s.endEdgePull(key, pull)
+		return
+	}
+	defer s.untrackConn(c.conn)
+	defer c.conn.Close()
+
+	//The pulled stream is published here, as PullClient does it.
+	rtmp := c.rtmp
+	rtmp.app = app.appName
+	rtmp.role = rolePublisher
+	rtmp.room = NewRoom(rtmp, roomID)
+	rtmp.room.cache = newGOPCache(app.gopCache)
+	s.startDVR(app, rtmp.room)
+	app.Store(roomID, rtmp.room)
+	s.startSegmenters(app, rtmp.room)
+	s.startRecording(app, rtmp.room, publishLive)
+	s.startPushes(app, rtmp.room)
+	//Media from now on goes to the room, starting with whatever came
+	//along with the answer to play.
+	rtmp.onTag = nil
+	for _, tag := range c.tags {
+		_ = rtmp.absorb(tag)
+	}
+	c.tags = nil
+	pull.room = rtmp.room
+	close(pull.ready)
+	log.Info("edge pull start", liblog.F("url", c.url.String()))
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go s.dropIdleEdgePull(app, rtmp.room, c, pull, finished)
+	for {
+		if err := ParseMessage(rtmp); err != nil {
+			log.Info("edge pull stop", liblog.Err(err))
+			break
+		}
+	}
+	s.closeEdgePull(app, roomID, pull)
+	rtmp.cleanup()
+	s.endEdgePull(key, pull)
+}
+
+// dialEdgeOrigins plays roomID, with query, from the first of app's
+// origins that has it. The connection is tracked for Shutdown.
+func (s *server) dialEdgeOrigins(app *App, roomID string, query url.Values) (*Conn, error) {
+	var errs []string
+	for _, rawURL := range app.edge.originURLs(app.appName, roomID) {
+		c, err := s.dialEdgeOrigin(rawURL, query)
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("no origin has the stream: %s", strings.Join(errs, "; "))
+}
+
+func (s *server) dialEdgeOrigin(rawURL string, query url.Values) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	opts := DialOptions{Timeout: 5 * time.Second}
+	conn, err := dialURL(u, opts.Timeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !s.trackConn(conn) {
+		_ = conn.Close()
+		return nil, ErrServerClosed
+	}
+	c, err := newConn(conn, u, opts, s)
+	if err == nil {
+		//Not in the URL, which is logged.
+		name := parsePlayName(u.Path)
+		if q := mergeQuery(mergeQuery(nil, query), u.Query()); len(q) > 0 {
+			name += "?" + q.Encode()
+		}
+		err = c.Play(name)
+	}
+	if err != nil {
+		s.untrackConn(conn)
+		_ = conn.Close()
+		return nil, fmt.Errorf("%s: %w", rawURL, err)
+	}
+	return c, nil
+}
+
+// dropIdleEdgePull closes pull's connection c once room has had no
+// viewer for the idle timeout, checking until finished is closed.
+func (s *server) dropIdleEdgePull(app *App, room *Room, c *Conn, pull *edgePull, finished chan struct{}) {
+	idle := app.edge.idleTimeout()
+	every := idle / 4
+	if every > time.Second {
+		every = time.Second
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	watched := time.Now()
+	for {
+		select {
+		case <-finished:
+			return
+		case <-ticker.C:
+		}
+		if len(room.Sessions()) > 0 {
+			watched = time.Now()
+		} else if time.Since(watched) >= idle {
+			s.logger.Info("edge pull idle", liblog.App(app.appName), liblog.Stream(room.RoomID))
+			s.closeEdgePull(app, room.RoomID, pull)
+			_ = c.conn.Close()
+			return
+		}
+	}
+}
+
+// forwardToOrigin forwards room, published on app, an edge, to the
+// first of its origins that takes it, with query, the publisher's, for
+// the origin to authorize it.
+func (s *server) forwardToOrigin(app *App, room *Room, query url.Values) {
+	urls := app.edge.originURLs(app.appName, "")
+	if len(urls) == 0 {
+		return
+	}
+	spec := pushSpec{app: app.appName, stream: room.RoomID, remoteURL: urls[0], query: query.Encode()}
+	s.startPush(spec, room, urls[1:]...)
+}
+
+// absorb does what receiving tag does: feed it to the room.
+func (rtmp *RTMP) absorb(tag libflv.Tag) error {
+	mb := MessageBase{rtmp: rtmp}
+	switch t := tag.(type) {
+	case *libflv.AudioTag:
+		return (&AudioMessage{MessageBase: mb, audioTag: t}).Do()
+	case *libflv.VideoTag:
+		return (&VideoMessage{MessageBase: mb, videoTag: t}).Do()
+	case *libflv.MetaTag:
+		return (&DataMessage{MessageBase: mb, metaTag: t}).Do()
+	}
+	return nil
+}
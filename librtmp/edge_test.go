@@ -0,0 +1,222 @@
+package librtmp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// playKeyframe plays stream from rawURL until the keyframe of
+// writeTestStream arrives.
+func playKeyframe(t *testing.T, rawURL, stream string) *Conn {
+	t.Helper()
+	c, err := Dial(rawURL, DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Play(stream); err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	for {
+		tag, err := c.ReadTag()
+		if err != nil {
+			c.Close()
+			t.Fatal(err)
+		}
+		if video, ok := tag.(*libflv.VideoTag); ok && bytes.Equal(video.VideoData, testKeyframe) {
+			return c
+		}
+	}
+}
+
+func TestEdge(t *testing.T) {
+	originAddr, edgeAddr := freeAddr(t), freeAddr(t)
+	origin := NewServer(originAddr, "live")
+	runServer(t, origin)
+	//The first origin is down: the edge moves on to the next.
+	edge := NewServer(edgeAddr, "live").WithEdge("live", EdgeConfig{
+		Origins:     []string{"rtmp://" + freeAddr(t), "rtmp://" + originAddr},
+		IdleTimeout: Duration(200 * time.Millisecond),
+	})
+	runServer(t, edge)
+	originLive, _ := origin.app("live")
+	edgeLive, _ := edge.app("live")
+
+	pub, err := Dial("rtmp://"+originAddr+"/live/x", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if err := pub.Publish(""); err != nil {
+		t.Fatal(err)
+	}
+	writeTestStream(t, pub)
+
+	//Two viewers on the edge, one upstream connection.
+	a := playKeyframe(t, "rtmp://"+edgeAddr+"/live", "x")
+	defer a.Close()
+	b := playKeyframe(t, "rtmp://"+edgeAddr+"/live", "x")
+	defer b.Close()
+	if n := len(originLive.Load("x").Sessions()); n != 1 {
+		t.Errorf("the origin has %d viewers, want the edge alone", n)
+	}
+	if n := len(edgeLive.Load("x").Sessions()); n != 2 {
+		t.Errorf("the edge has %d viewers, want 2", n)
+	}
+
+	//A stream no origin has isn't there either.
+	c, err := Dial("rtmp://"+edgeAddr+"/live", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var se *StatusError
+	if err := c.Play("nope"); !errors.As(err, &se) || se.Code != "NetStream.Play.StreamNotFound" {
+		t.Errorf("playing a stream no origin has: %v", err)
+	}
+
+	//The upstream outlives the first viewer to leave, not the last.
+	a.Close()
+	time.Sleep(400 * time.Millisecond)
+	if edgeLive.Load("x") == nil {
+		t.Fatal("the edge dropped the stream with a viewer left")
+	}
+	b.Close()
+	waitFor(t, "the edge to drop the stream", func() bool { return edgeLive.Load("x") == nil })
+	waitFor(t, "the origin to lose its viewer", func() bool { return len(originLive.Load("x").Sessions()) == 0 })
+
+	//Viewers from then on pull it again.
+	playKeyframe(t, "rtmp://"+edgeAddr+"/live", "x").Close()
+
+	//Publishes on the edge reach the origin.
+	edgePub, err := Dial("rtmp://"+edgeAddr+"/live/y", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer edgePub.Close()
+	if err := edgePub.Publish(""); err != nil {
+		t.Fatal(err)
+	}
+	writeTestStream(t, edgePub)
+	waitFor(t, "the origin to get the edge's stream", func() bool {
+		room := originLive.Load("y")
+		if room == nil {
+			return false
+		}
+		_, video, _ := room.snapshotHeaders()
+		return video != nil
+	})
+	playKeyframe(t, "rtmp://"+edgeAddr+"/live", "y").Close()
+	edgePub.Close()
+	waitFor(t, "the stream to end at the origin", func() bool { return originLive.Load("y") == nil })
+}
+
+func TestEdgeForwardsQuery(t *testing.T) {
+	originAddr, edgeAddr := freeAddr(t), freeAddr(t)
+	//The origin takes publishes and plays with the token alone.
+	origin := NewServer(originAddr, "live").WithAuthorizer(func(ctx context.Context, action Action, app, stream string, query url.Values, peer string) error {
+		if query.Get("token") != "k" {
+			return ErrUnauthorized
+		}
+		return nil
+	})
+	runServer(t, origin)
+	edge := NewServer(edgeAddr, "live").WithEdge("live", EdgeConfig{Origins: []string{"rtmp://" + originAddr}})
+	runServer(t, edge)
+	originLive, _ := origin.app("live")
+
+	for _, stream := range []string{"y?token=k", "z?token=no"} {
+		pub, err := Dial("rtmp://"+edgeAddr+"/live", DialOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pub.Close()
+		if err := pub.Publish(stream); err != nil {
+			t.Fatal(err)
+		}
+		writeTestStream(t, pub)
+	}
+	waitFor(t, "the origin to get the stream with the token", func() bool { return originLive.Load("y") != nil })
+	waitFor(t, "the origin to turn the other down", func() bool {
+		for _, push := range edge.Pushes() {
+			if push.Stream == "z" && push.State == PushRetrying {
+				return true
+			}
+		}
+		return false
+	})
+	if originLive.Load("z") != nil {
+		t.Error("the origin took the stream with a wrong token")
+	}
+
+	//Viewers' pulls too.
+	pub, err := Dial("rtmp://"+originAddr+"/live", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if err := pub.Publish("w?token=k"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestStream(t, pub)
+	c, err := Dial("rtmp://"+edgeAddr+"/live", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var se *StatusError
+	if err := c.Play("w?token=no"); !errors.As(err, &se) || se.Code != "NetStream.Play.StreamNotFound" {
+		t.Errorf("pulling with a wrong token: %v", err)
+	}
+	playKeyframe(t, "rtmp://"+edgeAddr+"/live", "w?token=k").Close()
+}
+
+func TestEdgeClosingPull(t *testing.T) {
+	originAddr, edgeAddr := freeAddr(t), freeAddr(t)
+	origin := NewServer(originAddr, "live")
+	runServer(t, origin)
+	edge := NewServer(edgeAddr, "live").WithEdge("live", EdgeConfig{Origins: []string{"rtmp://" + originAddr}})
+	runServer(t, edge)
+	edgeLive, _ := edge.app("live")
+
+	pub, err := Dial("rtmp://"+originAddr+"/live/x", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if err := pub.Publish(""); err != nil {
+		t.Fatal(err)
+	}
+	writeTestStream(t, pub)
+	playKeyframe(t, "rtmp://"+edgeAddr+"/live", "x").Close()
+
+	//The pull is going, as it does when idle: a viewer arriving then
+	//waits for it to end and gets a room of its own.
+	edge.mu.Lock()
+	pull := edge.edgePulls["live/x"]
+	edge.mu.Unlock()
+	old := pull.room
+	edge.closeEdgePull(edgeLive, "x", pull)
+	got := make(chan *Room, 1)
+	go func() { got <- edge.playRoom(edgeLive, "x", nil) }()
+	select {
+	case room := <-got:
+		t.Fatalf("a viewer got room %p while the pull was closing", room)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_ = old.Publisher.conn.Close()
+	select {
+	case room := <-got:
+		if room == nil || room == old {
+			t.Errorf("after the pull ended, a viewer got %p, want a new room", room)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the viewer is still waiting")
+	}
+}
@@ -0,0 +1,215 @@
+package librtmp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SmartBrave/Athena/broadcast"
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// GOP cache modes; see GOPCacheConfig.
+const (
+	GOPCacheLatest = "latest"
+	GOPCacheGOPs   = "gops"
+	GOPCacheNone   = "none"
+)
+
+// gopMetaSlots is how many tags a room's broadcast replays to every
+// reader before its GOP: metadata and the two sequence headers.
+const gopMetaSlots = 3
+
+// GOPCacheConfig sets where the RTMP, HTTP-FLV and RTSP viewers of an
+// app's streams start:
+//
+//   - latest, the default: at the latest keyframe, so the picture shows
+//     at once but lags the live edge by up to a GOP;
+//   - gops: further back, with as many earlier GOPs as fit the limits,
+//     for players that fill a buffer before they start; with no limit
+//     set it keeps 3;
+//   - none: at the next keyframe, on the live edge, after a wait of up
+//     to a GOP.
+//
+// Whatever the mode, the GOP being written is held for the viewers
+// still reading it.
+type GOPCacheConfig struct {
+	Mode     string   `json:"mode"`     //latest (default), gops or none
+	GOPs     int      `json:"gops"`     //at most this many, the live one included
+	Duration Duration `json:"duration"` //at most this long from the oldest keyframe to the live edge
+	Bytes    int64    `json:"bytes"`    //at most this many bytes of media, the live GOP included
+}
+
+// WithGOPCache sets where appName's viewers start. See GOPCacheConfig.
+func (s *server) WithGOPCache(appName string, cfg GOPCacheConfig) *server {
+	if _, ok := s.apps[appName]; !ok {
+		panic("appName does not exist.")
+	}
+	s.apps[appName].gopCache = &cfg
+	return s
+}
+
+// gopCache keeps a room's account of the GOPs it holds and, in mode
+// gops, the GOPs before the live one, which the broadcast doesn't
+// keep. Its lock also makes writing a tag and joining a viewer atomic.
+type gopCache struct {
+	cfg GOPCacheConfig
+
+	mu    sync.Mutex
+	gops  []*cachedGOP //complete, oldest first; mode gops only
+	live  cachedGOP    //being written
+	bytes int64        //of gops and live
+	video bool         //seen a video tag
+}
+
+type cachedGOP struct {
+	tags       []libflv.Tag //mode gops only
+	count      int
+	start, end uint32 //timestamps of the first and last tags
+	bytes      int64
+}
+
+// newGOPCache returns the cache of a room of an app with cfg, nil for
+// the default.
+func newGOPCache(cfg *GOPCacheConfig) *gopCache {
+	c := &gopCache{cfg: GOPCacheConfig{Mode: GOPCacheLatest}}
+	if cfg != nil {
+		c.cfg = *cfg
+	}
+	if c.cfg.Mode == "" {
+		c.cfg.Mode = GOPCacheLatest
+	}
+	if c.cfg.Mode == GOPCacheGOPs && c.cfg.GOPs <= 0 && c.cfg.Duration <= 0 && c.cfg.Bytes <= 0 {
+		c.cfg.GOPs = 3
+	}
+	return c
+}
+
+// add records tag, a new GOP first if it's a keyframe. Call with mu
+// held.
+func (c *gopCache) add(tag libflv.Tag, keyframe bool) {
+	if _, ok := tag.(*libflv.VideoTag); ok {
+		c.video = true
+	}
+	if keyframe {
+		if c.cfg.Mode == GOPCacheGOPs && c.live.count > 0 {
+			done := c.live
+			c.gops = append(c.gops, &done)
+		} else {
+			c.bytes -= c.live.bytes
+		}
+		c.live = cachedGOP{}
+	}
+	info := tag.GetTagInfo()
+	if c.live.count == 0 {
+		c.live.start = info.TimeStamp
+	}
+	c.live.end = info.TimeStamp
+	c.live.count++
+	c.live.bytes += int64(info.DataSize)
+	c.bytes += int64(info.DataSize)
+	if c.cfg.Mode != GOPCacheGOPs {
+		return
+	}
+	c.live.tags = append(c.live.tags, tag)
+	for len(c.gops) > 0 && c.over() {
+		c.bytes -= c.gops[0].bytes
+		c.gops[0] = nil
+		c.gops = c.gops[1:]
+	}
+}
+
+// over tells whether the GOPs held break one of the limits.
+func (c *gopCache) over() bool {
+	if c.cfg.GOPs > 0 && len(c.gops)+1 > c.cfg.GOPs {
+		return true
+	}
+	if c.cfg.Duration > 0 && time.Duration(c.live.end-c.gops[0].start)*time.Millisecond > time.Duration(c.cfg.Duration) {
+		return true
+	}
+	return c.cfg.Bytes > 0 && c.bytes > c.cfg.Bytes
+}
+
+// cacheBytes returns the bytes of media room holds for its viewers.
+func (room *Room) cacheBytes() int64 {
+	c := room.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// gopSubscriber reads a room for a viewer starting where the room's
+// GOP cache says: the broadcast's metadata slots, then the cached GOPs
+// before the live one, then the broadcast, less what came before the
+// next keyframe in mode none.
+type gopSubscriber struct {
+	reader  *broadcast.BroadcastReader
+	meta    int //metadata slots still to read
+	backlog []libflv.Tag
+	waitKey bool //drop tags until a keyframe
+	skip    int  //drop this many tags, or until a keyframe
+}
+
+// newGOPReader returns a reader of room's broadcast from its latest
+// keyframe, for consumers other than viewers. It's made under the
+// cache's lock, which writeTag holds while it resets the broadcast.
+func (room *Room) newGOPReader() *broadcast.BroadcastReader {
+	room.cache.mu.Lock()
+	defer room.cache.mu.Unlock()
+	return broadcast.NewBroadcastReader(room.GOP)
+}
+
+// subscribe starts a viewer on room.
+func (room *Room) subscribe() *gopSubscriber {
+	c := room.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sub := &gopSubscriber{reader: broadcast.NewBroadcastReader(room.GOP), meta: gopMetaSlots}
+	switch c.cfg.Mode {
+	case GOPCacheGOPs:
+		for _, g := range c.gops {
+			sub.backlog = append(sub.backlog, g.tags...)
+		}
+	case GOPCacheNone:
+		//Audio alone has no keyframes: it starts on the next tag.
+		if c.video {
+			sub.waitKey = true
+		} else {
+			sub.skip = c.live.count
+		}
+	}
+	return sub
+}
+
+// read returns the next tag for the viewer, or false once the room is
+// gone.
+func (sub *gopSubscriber) read() (libflv.Tag, bool) {
+	if sub.meta > 0 {
+		sub.meta--
+		p, alive := sub.reader.Read()
+		tag, _ := p.(libflv.Tag)
+		return tag, alive && tag != nil
+	}
+	if len(sub.backlog) > 0 {
+		tag := sub.backlog[0]
+		sub.backlog[0] = nil
+		sub.backlog = sub.backlog[1:]
+		return tag, true
+	}
+	for {
+		p, alive := sub.reader.Read()
+		if !alive {
+			return nil, false
+		}
+		tag := p.(libflv.Tag)
+		if sub.waitKey || sub.skip > 0 {
+			if video, ok := tag.(*libflv.VideoTag); !ok || video.FrameType != libflv.KEY_FRAME || video.AVCPacketType == libflv.AVC_SEQUENCE_HEADER {
+				if sub.skip > 0 {
+					sub.skip--
+				}
+				continue
+			}
+			sub.waitKey, sub.skip = false, 0
+		}
+		return tag, true
+	}
+}
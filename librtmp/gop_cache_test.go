@@ -0,0 +1,130 @@
+package librtmp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// gopTestRoom returns a room of an app with cfg, its headers written,
+// and three 80 ms GOPs of a keyframe and an inter frame, 10 bytes each.
+func gopTestRoom(cfg *GOPCacheConfig) *Room {
+	room := NewRoom(nil, "x")
+	room.cache = newGOPCache(cfg)
+	for i := 0; i < gopMetaSlots; i++ {
+		room.GOP.WriteMeta(&libflv.MetaTag{TagBase: libflv.TagBase{TagType: libflv.SCRIPT_DATA_TAG}})
+	}
+	for ts := uint32(0); ts < 240; ts += 40 {
+		writeTestFrame(room, ts, ts%80 == 0)
+	}
+	return room
+}
+
+func writeTestFrame(room *Room, ts uint32, key bool) {
+	frame := uint8(libflv.INTER_FRAME)
+	if key {
+		frame = libflv.KEY_FRAME
+	}
+	room.writeTag(&libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG, TimeStamp: ts, DataSize: 10},
+		FrameType: frame, CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_NALU}, key)
+}
+
+// readTimes reads the metadata slots, then n tags, and returns the
+// timestamps of the tags.
+func readTimes(t *testing.T, sub *gopSubscriber, n int) []uint32 {
+	t.Helper()
+	var times []uint32
+	for i := 0; i < gopMetaSlots+n; i++ {
+		tag, alive := sub.read()
+		if !alive {
+			t.Fatalf("the room ended after %d tags", i)
+		}
+		if i >= gopMetaSlots {
+			times = append(times, tag.GetTagInfo().TimeStamp)
+		}
+	}
+	return times
+}
+
+func TestGOPCache(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   *GOPCacheConfig
+		times []uint32
+		bytes int64
+	}{
+		{"default", nil, []uint32{160, 200}, 20},
+		{"latest", &GOPCacheConfig{Mode: GOPCacheLatest}, []uint32{160, 200}, 20},
+		{"gops", &GOPCacheConfig{Mode: GOPCacheGOPs}, []uint32{0, 40, 80, 120, 160, 200}, 60},
+		{"gops count", &GOPCacheConfig{Mode: GOPCacheGOPs, GOPs: 2}, []uint32{80, 120, 160, 200}, 40},
+		{"gops duration", &GOPCacheConfig{Mode: GOPCacheGOPs, Duration: Duration(150 * time.Millisecond)}, []uint32{80, 120, 160, 200}, 40},
+		{"gops bytes", &GOPCacheConfig{Mode: GOPCacheGOPs, Bytes: 50}, []uint32{80, 120, 160, 200}, 40},
+		{"gops one", &GOPCacheConfig{Mode: GOPCacheGOPs, GOPs: 1}, []uint32{160, 200}, 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			room := gopTestRoom(tc.cfg)
+			if got := room.cacheBytes(); got != tc.bytes {
+				t.Errorf("cacheBytes = %d, want %d", got, tc.bytes)
+			}
+			sub := room.subscribe()
+			if got := readTimes(t, sub, len(tc.times)); !equalTimes(got, tc.times) {
+				t.Errorf("viewer got %v, want %v", got, tc.times)
+			}
+			//Then the live edge, once it's written.
+			writeTestFrame(room, 240, true)
+			if tag, _ := sub.read(); tag == nil || tag.GetTagInfo().TimeStamp != 240 {
+				t.Errorf("after the cache, viewer got %+v", tag)
+			}
+			room.Close()
+			if _, alive := sub.read(); alive {
+				t.Error("read after the room closed")
+			}
+		})
+	}
+}
+
+func TestGOPCacheNone(t *testing.T) {
+	room := gopTestRoom(&GOPCacheConfig{Mode: GOPCacheNone})
+	sub := room.subscribe()
+	//What comes before the next keyframe is dropped.
+	writeTestFrame(room, 240, false)
+	writeTestFrame(room, 280, true)
+	writeTestFrame(room, 320, false)
+	if got := readTimes(t, sub, 2); !equalTimes(got, []uint32{280, 320}) {
+		t.Errorf("viewer got %v, want [280 320]", got)
+	}
+	if got := room.cacheBytes(); got != 20 {
+		t.Errorf("cacheBytes = %d, want the live GOP, 20", got)
+	}
+
+	//Audio alone starts on the next tag.
+	room = NewRoom(nil, "a")
+	room.cache = newGOPCache(&GOPCacheConfig{Mode: GOPCacheNone})
+	for i := 0; i < gopMetaSlots; i++ {
+		room.GOP.WriteMeta(&libflv.MetaTag{TagBase: libflv.TagBase{TagType: libflv.SCRIPT_DATA_TAG}})
+	}
+	audio := func(ts uint32) {
+		room.writeTag(&libflv.AudioTag{TagBase: libflv.TagBase{TagType: libflv.AUDIO_TAG, TimeStamp: ts, DataSize: 4},
+			SoundFormat: libflv.FLV_AUDIO_AAC, AACPacketType: libflv.AAC_RAW}, false)
+	}
+	audio(0)
+	audio(23)
+	sub = room.subscribe()
+	audio(46)
+	if got := readTimes(t, sub, 1); got[0] != 46 {
+		t.Errorf("audio viewer got %v, want [46]", got)
+	}
+}
+
+func equalTimes(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -10,6 +10,8 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/sbraveyoung/GGmpeg/liblog"
 )
 
 const (
@@ -101,6 +103,12 @@ func HandshakeServer(rtmp *RTMP) (err error) {
 	p := &Peer{
 		serverVersion: 3,
 	}
+	mode := "unknown" //until C1 tells us
+	defer func() {
+		if err != nil {
+			handshakeFailures.With("server", mode, "error").Inc()
+		}
+	}()
 	err = rtmp.readerConn.ReadFull(c0)
 	if err != nil {
 		return errors.Wrap(err, "read c0 from conn")
@@ -118,6 +126,8 @@ func HandshakeServer(rtmp *RTMP) (err error) {
 	s0 := p.makeS0()
 
 	p.parseC1(c1)
+	mode = handshakeModeLabel(p.handshakeMode)
+	rtmp.handshakeMode = p.handshakeMode
 
 	err = rtmp.writerConn.WriteFull(s0)
 	if err != nil {
@@ -145,37 +155,35 @@ func HandshakeServer(rtmp *RTMP) (err error) {
 		//echo fields) yet proceed with the session. Rejecting them
 		//would be strictly spec-correct but breaks too much in the
 		//wild — matches FFmpeg's leniency.
-		fmt.Println("parseC2 warning:", err)
+		rtmp.log().Warn("c2 mismatch", liblog.Err(err))
+		handshakeFailures.With("server", mode, "c2_mismatch").Inc()
 	}
 
 	return nil
 }
 
-// HandshakeClient drives the outbound (client-side) RTMP handshake.
-// Sends C0+C1 then reads S0+S1+S2 then sends C2. Implements only the
-// SIMPLE handshake — most permissive servers accept it. The complex
-// digest variants are server-side niceties for Flash compatibility.
+// HandshakeClient drives the outbound (client-side) RTMP handshake:
+// C0+C1, then S0+S1+S2, then C2. C1 carries a scheme 1 digest, as Flash
+// Player's does, which servers that check it insist on. If S1 answers
+// with a digest of its own the handshake is complex and C2 is signed
+// with it; otherwise the server took it for a simple one and C2 echoes
+// S1.
 func HandshakeClient(rtmp *RTMP) (err error) {
 	p := &Peer{
 		clientVersion: 3,
-		handshakeMode: SIMPLE,
+		handshakeMode: COMPLEX1,
 	}
+	defer func() {
+		if err != nil {
+			handshakeFailures.With("client", handshakeModeLabel(p.handshakeMode), "error").Inc()
+		}
+	}()
 
-	//C0
-	if err := rtmp.writerConn.WriteFull([]byte{p.clientVersion}); err != nil {
-		return errors.Wrap(err, "write c0")
+	//C0+C1
+	if err := rtmp.writerConn.WriteFull(append([]byte{p.clientVersion}, p.makeC1()...)); err != nil {
+		return errors.Wrap(err, "write c0c1")
 	}
 
-	//C1: 4-byte timestamp + 4 zero bytes + 1528 random bytes.
-	p.clientTimeStamp = uint32(time.Now().Unix())
-	c1 := make([]byte, C1_LEN)
-	binary.BigEndian.PutUint32(c1[:4], p.clientTimeStamp)
-	_, _ = rand.Read(c1[8:])
-	if err := rtmp.writerConn.WriteFull(c1); err != nil {
-		return errors.Wrap(err, "write c1")
-	}
-	p.clientRandom = c1[8:]
-
 	//S0
 	s0 := make([]byte, S0_LEN)
 	if err := rtmp.readerConn.ReadFull(s0); err != nil {
@@ -192,28 +200,117 @@ func HandshakeClient(rtmp *RTMP) (err error) {
 	if err := rtmp.readerConn.ReadFull(s1); err != nil {
 		return errors.Wrap(err, "read s1")
 	}
-	p.serverTimeStamp = binary.BigEndian.Uint32(s1[:4])
-	p.serverRandom = s1[8:]
+	p.parseS1(s1)
 
-	//S2 — server's echo of C1. We accept whatever it says; some
-	//implementations zero parts of it.
+	//S2
 	s2 := make([]byte, S2_LEN)
 	if err := rtmp.readerConn.ReadFull(s2); err != nil {
 		return errors.Wrap(err, "read s2")
 	}
+	if err := p.parseS2(s2); err != nil {
+		//As lenient as the server side is with C2.
+		rtmp.log().Warn("s2 mismatch", liblog.Err(err))
+		handshakeFailures.With("client", handshakeModeLabel(p.handshakeMode), "s2_mismatch").Inc()
+	}
 
-	//C2 — echo S1's timestamp + random back so the server can verify
-	//round-trip. Per spec we should also include our own timestamp at
-	//bytes 4..8; FFmpeg writes zeros there and most servers accept.
-	c2 := make([]byte, C2_LEN)
-	binary.BigEndian.PutUint32(c2[:4], p.serverTimeStamp)
-	copy(c2[8:], p.serverRandom)
-	if err := rtmp.writerConn.WriteFull(c2); err != nil {
+	//C2
+	if err := rtmp.writerConn.WriteFull(p.makeC2()); err != nil {
 		return errors.Wrap(err, "write c2")
 	}
+	rtmp.handshakeMode = p.handshakeMode
 	return nil
 }
 
+// digestAt returns where the digest of a C1 or S1 sits, given where its
+// digest block starts.
+func digestAt(b []byte, blockOffset int) int {
+	return blockOffset + 4 + (int(b[blockOffset])+int(b[blockOffset+1])+int(b[blockOffset+2])+int(b[blockOffset+3]))%handshakeDigestSpread
+}
+
+// handshakeDigest is the HMAC-SHA256 under key of b without the digest
+// at offset.
+func handshakeDigest(b []byte, offset int, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b[:offset])
+	mac.Write(b[offset+handshakeDigestSize:])
+	return mac.Sum(nil)
+}
+
+// makeC1 makes a scheme 1 C1: time, a non-zero version, which asks for
+// the complex handshake, the key block, then the digest block.
+func (p *Peer) makeC1() []byte {
+	p.clientTimeStamp = uint32(time.Now().Unix())
+	c1 := make([]byte, C1_LEN)
+	binary.BigEndian.PutUint32(c1[:4], p.clientTimeStamp)
+	copy(c1[4:8], []byte{0x80, 0x00, 0x07, 0x02})
+	_, _ = rand.Read(c1[8:])
+	offset := digestAt(c1, 8+handshakeBlockSize)
+	p.clientDigest = handshakeDigest(c1, offset, FPkey[:30])
+	copy(c1[offset:], p.clientDigest)
+	p.clientRandom = c1[8:]
+	return c1
+}
+
+// parseS1 takes the server's digest from S1, in either scheme, falling
+// back to SIMPLE if it has none.
+func (p *Peer) parseS1(s1 []byte) {
+	p.serverTimeStamp = binary.BigEndian.Uint32(s1[:4])
+	p.serverRandom = s1[8:]
+	for _, mode := range []HandshakeMode{COMPLEX1, COMPLEX2} {
+		blockOffset := 8
+		if mode == COMPLEX1 {
+			blockOffset += handshakeBlockSize
+		}
+		offset := digestAt(s1, blockOffset)
+		if hmac.Equal(handshakeDigest(s1, offset, FMSKey[:36]), s1[offset:offset+handshakeDigestSize]) {
+			p.handshakeMode = mode
+			p.serverDigest = append([]byte{}, s1[offset:offset+handshakeDigestSize]...)
+			return
+		}
+	}
+	p.handshakeMode = SIMPLE
+}
+
+// parseS2 checks S2 the way parseC2 checks C2: the echo of C1's random
+// for the simple handshake, for the complex one an HMAC-SHA256 over
+// S2[:1504] keyed by HMAC(FMSKey, clientDigest).
+func (p *Peer) parseS2(s2 []byte) error {
+	switch p.handshakeMode {
+	case SIMPLE:
+		if !bytes.Equal(s2[8:], p.clientRandom) {
+			return errors.New("simple S2 random mismatch")
+		}
+	case COMPLEX1, COMPLEX2:
+		mac := hmac.New(sha256.New, FMSKey)
+		mac.Write(p.clientDigest)
+		mac = hmac.New(sha256.New, mac.Sum(nil))
+		mac.Write(s2[:S2_LEN-handshakeDigestSize])
+		if !hmac.Equal(mac.Sum(nil), s2[S2_LEN-handshakeDigestSize:]) {
+			return errors.New("complex S2 digest mismatch")
+		}
+	}
+	return nil
+}
+
+// makeC2 answers S1: with its time and random echoed for the simple
+// handshake, with random bytes signed by HMAC(FPkey, serverDigest) for
+// the complex one.
+func (p *Peer) makeC2() []byte {
+	c2 := make([]byte, C2_LEN)
+	if p.handshakeMode == SIMPLE {
+		binary.BigEndian.PutUint32(c2[:4], p.serverTimeStamp)
+		copy(c2[8:], p.serverRandom)
+		return c2
+	}
+	_, _ = rand.Read(c2)
+	mac := hmac.New(sha256.New, FPkey)
+	mac.Write(p.serverDigest)
+	mac = hmac.New(sha256.New, mac.Sum(nil))
+	mac.Write(c2[:C2_LEN-handshakeDigestSize])
+	copy(c2[C2_LEN-handshakeDigestSize:], mac.Sum(nil))
+	return c2
+}
+
 func (p *Peer) parseC0(c0 []byte) {
 	p.clientVersion = uint8(c0[0])
 }
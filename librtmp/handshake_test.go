@@ -46,3 +46,41 @@ func TestHandshakeS1DigestVerifies(t *testing.T) {
 		}
 	}
 }
+
+// TestHandshakeComplexClient runs our client's C1/C2 against our
+// server's checks and the server's S1/S2 against the client's.
+func TestHandshakeComplexClient(t *testing.T) {
+	cli := &Peer{clientVersion: 3}
+	srv := &Peer{serverVersion: 3}
+	srv.parseC1(cli.makeC1())
+	if srv.handshakeMode != COMPLEX1 {
+		t.Fatalf("server took C1 for mode %d, want COMPLEX1", srv.handshakeMode)
+	}
+	s1, s2 := srv.makeS1(), srv.makeS2()
+	cli.parseS1(s1)
+	if cli.handshakeMode != COMPLEX1 {
+		t.Fatalf("client took S1 for mode %d, want COMPLEX1", cli.handshakeMode)
+	}
+	if err := cli.parseS2(s2); err != nil {
+		t.Errorf("S2: %v", err)
+	}
+	if err := srv.parseC2(cli.makeC2()); err != nil {
+		t.Errorf("C2: %v", err)
+	}
+
+	//A server that only knows the simple handshake.
+	cli = &Peer{clientVersion: 3}
+	c1 := cli.makeC1()
+	srv = &Peer{serverVersion: 3, handshakeMode: SIMPLE, clientRandom: c1[8:]}
+	s1, s2 = srv.makeS1(), srv.makeS2()
+	cli.parseS1(s1)
+	if cli.handshakeMode != SIMPLE {
+		t.Fatalf("client took a simple S1 for mode %d", cli.handshakeMode)
+	}
+	if err := cli.parseS2(s2); err != nil {
+		t.Errorf("simple S2: %v", err)
+	}
+	if err := srv.parseC2(cli.makeC2()); err != nil {
+		t.Errorf("simple C2: %v", err)
+	}
+}
@@ -10,9 +10,10 @@ import (
 	"github.com/SmartBrave/Athena/easyio"
 )
 
-// TestHandshake_ClientServerPipe drives both sides of the SIMPLE
-// handshake over a net.Pipe and asserts both finish without error.
-// This exercises the full C0/C1/C2 ↔ S0/S1/S2 sequence end-to-end.
+// TestHandshake_ClientServerPipe drives both sides of the handshake
+// over a net.Pipe and asserts both finish without error, having agreed
+// on the complex handshake. This exercises the full C0/C1/C2 ↔
+// S0/S1/S2 sequence end-to-end.
 func TestHandshake_ClientServerPipe(t *testing.T) {
 	a, b := net.Pipe()
 	defer a.Close()
@@ -59,6 +60,9 @@ func TestHandshake_ClientServerPipe(t *testing.T) {
 	if e := <-cliErr; e != nil {
 		t.Errorf("client handshake: %v", e)
 	}
+	if srv.handshakeMode != COMPLEX1 || cli.handshakeMode != COMPLEX1 {
+		t.Errorf("modes %d/%d, want COMPLEX1", srv.handshakeMode, cli.handshakeMode)
+	}
 }
 
 // TestParseMessage_ConnectCommand pre-loads a serialised AMF0
@@ -0,0 +1,418 @@
+package librtmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SmartBrave/Athena/easyerrors"
+	"github.com/sbraveyoung/GGmpeg/libdash"
+	"github.com/sbraveyoung/GGmpeg/libhls"
+	"github.com/sbraveyoung/GGmpeg/liblog"
+)
+
+// ErrServerClosed is returned by Run after Shutdown, and refuses any
+// publish or play that arrives while the server is shutting down.
+var ErrServerClosed = errors.New("server closed")
+
+// shutdownGrace bounds the drain when Run shuts the server down on its
+// own, i.e. because ctx was cancelled or a listener failed.
+const shutdownGrace = 10 * time.Second
+
+// Run opens every configured listener, starts the configured pulls and
+// serves until ctx is done, a listener fails, or Shutdown is called.
+// A listener that can't be opened fails Run before anything is served.
+// In the first two cases Run shuts the server down before returning
+// ctx.Err() or the listener's error; after Shutdown it returns
+// ErrServerClosed straight away, like net/http.
+func (s *server) Run(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running || s.closing() {
+		s.mu.Unlock()
+		return errors.New("server already started")
+	}
+	s.running = true
+	s.mu.Unlock()
+
+	errc := make(chan error, 1)
+	fail := func(name string, err error) {
+		s.logger.Error(name+" listener failed", liblog.Err(err))
+		select {
+		case errc <- fmt.Errorf("%s: %w", name, err):
+		default:
+		}
+	}
+	//Reload waits until the relays it diffs against are all running.
+	s.reloadMu.Lock()
+	err := s.listen(fail)
+	if err == nil {
+		s.startPulls()
+	}
+	s.reloadMu.Unlock()
+	if err != nil {
+		s.shutdownWithGrace()
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		s.shutdownWithGrace()
+		return ctx.Err()
+	case err := <-errc:
+		s.shutdownWithGrace()
+		return err
+	case <-s.done:
+		return ErrServerClosed
+	}
+}
+
+// connContextKey keys the net.Conn of an HTTP request in its context.
+type connContextKey struct{}
+
+// withConn is the http.Server ConnContext that puts the connection in
+// every request's context, for handlers that set write deadlines on it.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// listen opens every listener and starts serving each. fail is called
+// if one of them stops for any reason other than Shutdown.
+func (s *server) listen(fail func(name string, err error)) error {
+	serve := func(name string, l io.Closer, fn func() error) {
+		if !s.goTracked(&s.workers, func() {
+			if err := fn(); err != nil {
+				fail(name, err)
+			}
+		}) {
+			_ = l.Close()
+		}
+	}
+
+	rtmpListener, err := s.openTCP("rtmp", s.rtmpAddress)
+	if err != nil {
+		return err
+	}
+	serve("rtmp", rtmpListener, func() error { return s.serveRTMP(rtmpListener, nil) })
+
+	if s.rtmpsAddress != "" {
+		rtmpsListener, err := s.openTCP("rtmps", s.rtmpsAddress)
+		if err != nil {
+			return err
+		}
+		serve("rtmps", rtmpsListener, func() error { return s.serveRTMP(rtmpsListener, s.rtmpsTLS) })
+	}
+
+	if s.rtspAddress != "" {
+		rtspListener, err := s.openTCP("rtsp", s.rtspAddress)
+		if err != nil {
+			return err
+		}
+		serve("rtsp", rtspListener, func() error { return s.serveRTSP(rtspListener) })
+	}
+
+	type httpListener struct {
+		name    string
+		address string
+		handler http.Handler
+	}
+	var httpListeners []httpListener
+	if s.flvAddress != "" {
+		httpListeners = append(httpListeners, httpListener{"http-flv", s.flvAddress, s.flvMux()})
+	}
+	if s.hlsAddress != "" {
+		httpListeners = append(httpListeners, httpListener{"hls", s.hlsAddress, s.hlsMux()})
+	}
+	if s.adminAddress != "" {
+		httpListeners = append(httpListeners, httpListener{"admin", s.adminAddress, s.adminMux()})
+	}
+	for _, h := range httpListeners {
+		l, err := newTCPListener(h.address)
+		if err != nil {
+			s.logger.Error(h.name+" listen failed", liblog.F("address", h.address), liblog.Err(err))
+			return err
+		}
+		hs := &http.Server{Handler: h.handler, ConnContext: withConn}
+		s.mu.Lock()
+		s.httpServers = append(s.httpServers, hs)
+		s.mu.Unlock()
+		serve(h.name, l, func() error {
+			if err := hs.Serve(l); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		})
+	}
+
+	for _, spec := range s.srtSpecs {
+		if err := s.startSRTRelay(spec, fail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *server) openTCP(name, address string) (*net.TCPListener, error) {
+	l, err := newTCPListener(address)
+	if err != nil {
+		s.logger.Error(name+" listen failed", liblog.F("address", address), liblog.Err(err))
+		return nil, err
+	}
+	s.addListener(l)
+	return l, nil
+}
+
+func (s *server) addListener(l io.Closer) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+}
+
+// startPulls runs every WithRTMPPull spec.
+func (s *server) startPulls() {
+	for _, spec := range s.pulls {
+		s.startPull(spec)
+	}
+}
+
+// startPull runs one pull, reconnecting with exponential backoff until
+// Shutdown or stopPull.
+func (s *server) startPull(spec pullSpec) {
+	stop := make(chan struct{})
+	s.mu.Lock()
+	s.pullStops[spec] = stop
+	s.mu.Unlock()
+	s.goTracked(&s.workers, func() {
+		backoff := time.Second
+		for {
+			if err := newPullClient(s, spec, stop).Run(); err != nil && !s.closing() {
+				s.logger.Warn("rtmp pull failed", liblog.App(spec.app), liblog.Stream(spec.streamID), liblog.F("url", spec.remoteURL), liblog.Err(err))
+			}
+			select {
+			case <-s.done:
+				return
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+	})
+}
+
+// stopPull stops the pull for spec, dropping its upstream connection;
+// the local room is torn down as on any upstream disconnect.
+func (s *server) stopPull(spec pullSpec) {
+	s.mu.Lock()
+	stop, ok := s.pullStops[spec]
+	delete(s.pullStops, spec)
+	s.mu.Unlock()
+	if ok {
+		close(stop)
+	}
+}
+
+// Shutdown stops the server gracefully:
+//
+//  1. listeners close and pulls stop reconnecting;
+//  2. every room is unpublished: RTMP players are sent
+//     NetStream.Play.UnpublishNotify, FLV/RTSP viewers reach the end
+//     of the stream, HLS/DASH finalise their in-flight segment and
+//     recordings are closed;
+//  3. in-flight HTTP requests finish;
+//  4. remaining connections (publishers, RTMP and RTSP players, pulls)
+//     are closed and clean up as on any disconnect.
+//
+// It returns once every goroutine the server started has exited. If
+// ctx ends first, connections are closed anyway and ctx's error is
+// returned. Calling Shutdown more than once is safe.
+func (s *server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdownOnce.Do(func() { close(s.done) })
+	listeners, servers := s.listeners, s.httpServers
+	for _, relay := range s.srtRelays {
+		listeners = append(listeners, relay.listener)
+	}
+	s.listeners, s.httpServers = nil, nil
+	s.mu.Unlock()
+
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+
+	s.forEachRoom(func(app *App, room *Room) { room.Close() })
+	var errs []error
+	if err := wait(ctx, &s.streams); err != nil {
+		errs = append(errs, err)
+	}
+	//Including those still waiting for their publisher to reconnect.
+	for _, app := range s.appList() {
+		s.closeRecordings(app)
+	}
+
+	for _, hs := range servers {
+		if err := hs.Shutdown(ctx); err != nil {
+			_ = hs.Close()
+			errs = append(errs, err)
+		}
+	}
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	if err := wait(ctx, &s.workers); err != nil {
+		return easyerrors.HandleMultiError(easyerrors.Simple(), append(errs, err)...)
+	}
+
+	//SRT publishers have no connection of their own to drop; tear
+	//their rooms down now that the listeners have stopped feeding them.
+	s.forEachRoom(func(app *App, room *Room) {
+		if room.Publisher != nil {
+			room.Publisher.cleanup()
+		} else {
+			app.Delete(room.RoomID)
+		}
+	})
+	return easyerrors.HandleMultiError(easyerrors.Simple(), errs...)
+}
+
+func (s *server) shutdownWithGrace() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		s.logger.Warn("shutdown incomplete", liblog.Err(err))
+	}
+}
+
+// closing reports whether Shutdown has begun.
+func (s *server) closing() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// goTracked runs fn on a goroutine counted in wg, unless Shutdown has
+// begun, in which case it reports false and fn never runs.
+func (s *server) goTracked(wg *sync.WaitGroup, fn func()) bool {
+	s.mu.Lock()
+	if s.closing() {
+		s.mu.Unlock()
+		return false
+	}
+	wg.Add(1)
+	s.mu.Unlock()
+	go func() {
+		defer wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// trackConn registers conn so Shutdown can close it. It reports false
+// once Shutdown has begun.
+func (s *server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing() {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// serveConn runs fn for an accepted connection on a tracked goroutine,
+// or closes the connection if the server is shutting down.
+func (s *server) serveConn(conn net.Conn, fn func()) {
+	if !s.trackConn(conn) {
+		_ = conn.Close()
+		return
+	}
+	if !s.goTracked(&s.workers, func() {
+		defer s.untrackConn(conn)
+		fn()
+	}) {
+		s.untrackConn(conn)
+		_ = conn.Close()
+	}
+}
+
+// startSegmenters starts the HLS and DASH segmenters app runs from the
+// moment room is published.
+func (s *server) startSegmenters(app *App, room *Room) {
+	if app.hlsMode == libhls.IMMEDIATELY {
+		hls := s.newHLS(app, room.RoomID)
+		app.StoreHLS(room.RoomID, hls)
+		s.startHLS(hls, room)
+	}
+	if app.dashEnabled {
+		dash := s.newDASH(app, room.RoomID)
+		app.StoreDASH(room.RoomID, dash)
+		s.startDASH(dash, room)
+	}
+}
+
+// startHLS runs hls's segmenter over room. Shutdown waits for it so the
+// in-flight segment is finalised.
+func (s *server) startHLS(hls *libhls.HLS, room *Room) {
+	reader := room.newGOPReader()
+	if !s.goTracked(&s.streams, func() {
+		if err := hls.Start(reader); err != nil {
+			s.logger.Warn("hls segmenter failed", liblog.Stream(room.RoomID), liblog.Err(err))
+		}
+	}) {
+		hls.Stop()
+	}
+}
+
+// startDASH is startHLS for DASH.
+func (s *server) startDASH(dash *libdash.DASH, room *Room) {
+	reader := room.newGOPReader()
+	if !s.goTracked(&s.streams, func() {
+		if err := dash.Start(reader); err != nil {
+			s.logger.Warn("dash segmenter failed", liblog.Stream(room.RoomID), liblog.Err(err))
+		}
+	}) {
+		dash.Stop()
+	}
+}
+
+func (s *server) forEachRoom(fn func(app *App, room *Room)) {
+	for _, app := range s.appList() {
+		app.Range(func(_ string, room *Room) bool {
+			fn(app, room)
+			return true
+		})
+	}
+}
+
+// wait blocks until wg drains or ctx ends.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
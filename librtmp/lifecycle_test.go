@@ -0,0 +1,122 @@
+package librtmp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+func TestRun_ContextCancel(t *testing.T) {
+	srv := NewServer("127.0.0.1:0", "live").WithHTTPFlv("127.0.0.1:0").WithAdminAPI("127.0.0.1:0")
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Run(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after cancel")
+	}
+	if err := srv.Run(context.Background()); err == nil {
+		t.Error("second Run succeeded")
+	}
+}
+
+func TestRun_ListenError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	srv := NewServer("127.0.0.1:0", "live").WithHTTPFlv(busy.Addr().String())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Run(context.Background()) }()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Run = nil, want listen error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't fail")
+	}
+}
+
+func TestShutdown_NotifiesPlayersAndDrains(t *testing.T) {
+	srv := NewServer(":0", "live")
+
+	pubConn, pubPeer := net.Pipe()
+	defer pubPeer.Close()
+	pub := NewRTMP(pubConn, "10.0.0.1:1935", srv)
+	pub.app, pub.role = "live", rolePublisher
+	room := NewRoom(pub, "x")
+	pub.room = room
+	srv.apps["live"].Store("x", room)
+	for i := 0; i < 3; i++ {
+		room.GOP.WriteMeta(&libflv.VideoTag{
+			TagBase:       libflv.TagBase{TagType: libflv.VIDEO_TAG},
+			FrameType:     libflv.KEY_FRAME,
+			CodecID:       libflv.FLV_VIDEO_AVC,
+			AVCPacketType: libflv.AVC_SEQUENCE_HEADER,
+			VideoData:     []byte{0x01},
+		})
+	}
+	//Stand-ins for HandlerServer: block until the connection drops,
+	//then clean up.
+	srv.serveConn(pubConn, func() {
+		_, _ = io.Copy(io.Discard, pubConn)
+		pub.cleanup()
+	})
+
+	plConn, plPeer := net.Pipe()
+	pl := NewRTMP(plConn, "10.0.0.2:4000", srv)
+	pl.app, pl.role, pl.room = "live", rolePlayer, room
+	pl.session = room.addSession(ProtocolRTMP, pl.peer, func() { pl.kick() })
+	srv.serveConn(plConn, func() {
+		_, _ = io.Copy(io.Discard, plConn)
+		pl.cleanup()
+	})
+	received := make(chan []byte, 1)
+	go func() {
+		var buf bytes.Buffer
+		_, _ = io.Copy(&buf, plPeer)
+		received <- buf.Bytes()
+	}()
+	room.RTMPJoin(pl)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	select {
+	case b := <-received:
+		if !strings.Contains(string(b), "NetStream.Play.UnpublishNotify") {
+			t.Error("player never got NetStream.Play.UnpublishNotify")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("player connection still open after Shutdown")
+	}
+	if srv.apps["live"].Load("x") != nil {
+		t.Error("room still registered after Shutdown")
+	}
+	if err := srv.authorize(context.Background(), ActionPlay, "live", "x", nil, ""); err != ErrServerClosed {
+		t.Errorf("authorize after Shutdown = %v, want ErrServerClosed", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+}
@@ -1,9 +1,8 @@
 package librtmp
 
 import (
-	"fmt"
-
 	"github.com/sbraveyoung/GGmpeg/libamf"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 	"github.com/SmartBrave/Athena/easyerrors"
 	"github.com/pkg/errors"
 )
@@ -31,6 +30,18 @@ func (mb *MessageBase) Append(chunk *Chunk) {
 	mb.messagePayload = append(mb.messagePayload, chunk.Payload...)
 }
 
+// amfPayload is the payload to decode, without the leading format byte
+// (0, AMF0) of the AMF3 command and data message types.
+func (mb *MessageBase) amfPayload() []byte {
+	switch mb.messageType {
+	case DATA_MESSAGE_AMF3, COMMAND_MESSAGE_AMF3:
+		if len(mb.messagePayload) > 0 && mb.messagePayload[0] == 0x00 {
+			return mb.messagePayload[1:]
+		}
+	}
+	return mb.messagePayload
+}
+
 func (mb *MessageBase) Remain() uint32 {
 	// fmt.Printf("done? messageLength:%d, len(payload):%d\n", mb.messageLength, len(mb.messagePayload))
 	return mb.messageLength - uint32(len(mb.messagePayload))
@@ -155,25 +166,19 @@ func ParseMessage(rtmp *RTMP) (err error) {
 			case AGGREGATE_MESSAGE:
 				message = NewAggregateMessage(mb)
 
-			case DATA_MESSAGE_AMF3:
-				// mb.amf = libamf.AMF3
-				fallthrough
-			case DATA_MESSAGE_AMF0:
+			//The AMF3 types carry AMF0 too, behind a format byte: values
+			//switch to AMF3 one at a time with the avmplus-object marker.
+			//See amfPayload.
+			case DATA_MESSAGE_AMF3, DATA_MESSAGE_AMF0:
 				message = NewDataMessage(mb)
 
-			case SHARE_OBJECT_MESSAGE_AMF3:
-				// mb.amf = libamf.AMF3
-				fallthrough
-			case SHARE_OBJECT_MESSAGE_AMF0:
+			case SHARE_OBJECT_MESSAGE_AMF3, SHARE_OBJECT_MESSAGE_AMF0:
 				//Shared objects are a flash-era state-sync channel we
 				//don't implement. Drain the payload and move on rather
 				//than falling through into the default error branch.
 				message = NewDiscardMessage(mb)
 
-			case COMMAND_MESSAGE_AMF3:
-				// mb.amf = libamf.AMF3
-				fallthrough
-			case COMMAND_MESSAGE_AMF0:
+			case COMMAND_MESSAGE_AMF3, COMMAND_MESSAGE_AMF0:
 				message = NewCommandMessage(mb)
 
 			default:
@@ -197,7 +202,7 @@ func ParseMessage(rtmp *RTMP) (err error) {
 		if sendErr := ack.Send(); sendErr == nil {
 			rtmp.lastAcked = rtmp.bytesReceived
 		} else {
-			fmt.Println("send acknowledgement error:", sendErr)
+			rtmp.log().Warn("send acknowledgement failed", liblog.Err(sendErr))
 		}
 	}
 
@@ -0,0 +1,100 @@
+package librtmp
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/sbraveyoung/GGmpeg/libmetrics"
+)
+
+var (
+	handshakeFailures = libmetrics.Default.NewCounterVec(
+		"ggmpeg_rtmp_handshake_failures_total",
+		"RTMP handshakes that failed, or whose C2 didn't verify, by handshake mode.",
+		"side", "mode", "reason")
+	parseErrors = libmetrics.Default.NewCounterVec(
+		"ggmpeg_rtmp_parse_errors_total", "RTMP chunk/message parse errors that ended a connection.", "side")
+	rtspSessions = libmetrics.Default.NewGaugeVec(
+		"ggmpeg_rtsp_sessions", "RTSP sessions that completed SETUP, by RTP transport.", "transport")
+	droppedFrames = libmetrics.Default.NewCounterVec(
+		"ggmpeg_dropped_frames_total", "Media tags dropped for subscribers too far behind, by protocol.", "protocol")
+)
+
+func handshakeModeLabel(m HandshakeMode) string {
+	if m == SIMPLE {
+		return "simple"
+	}
+	return "complex"
+}
+
+// serverMetrics are the series refreshed from a server's apps at
+// scrape time. Each server has its own registry, so that servers in one
+// process don't reset each other's rooms.
+type serverMetrics struct {
+	mu             sync.Mutex //held while refreshing and writing out
+	registry       *libmetrics.Registry
+	publishers     *libmetrics.GaugeVec
+	players        *libmetrics.GaugeVec
+	roomBytesIn    *libmetrics.CounterVec
+	roomBytesOut   *libmetrics.CounterVec
+	roomCacheBytes *libmetrics.GaugeVec
+}
+
+func newServerMetrics() *serverMetrics {
+	r := libmetrics.NewRegistry()
+	return &serverMetrics{
+		registry: r,
+		publishers: r.NewGaugeVec(
+			"ggmpeg_publishers", "Active publishers by protocol.", "protocol"),
+		players: r.NewGaugeVec(
+			"ggmpeg_players", "Active subscribers by protocol.", "protocol"),
+		roomBytesIn: r.NewCounterVec(
+			"ggmpeg_room_bytes_in_total", "Media bytes received from the publisher.", "app", "stream"),
+		roomBytesOut: r.NewCounterVec(
+			"ggmpeg_room_bytes_out_total", "Media bytes sent to subscribers.", "app", "stream"),
+		roomCacheBytes: r.NewGaugeVec(
+			"ggmpeg_room_cache_bytes", "Media bytes held for subscribers, by the GOP cache.", "app", "stream"),
+	}
+}
+
+// serveMetrics refreshes the server's series and writes them out after
+// the process-wide ones. Scrapes are serialised: one mustn't see the
+// series another is rebuilding.
+func (s *server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	m := s.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.refreshMetrics()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := libmetrics.Default.WriteTo(w); err != nil {
+		return
+	}
+	_, _ = m.registry.WriteTo(w)
+}
+
+// refreshMetrics rebuilds the per-room and per-protocol series from
+// the live apps, so rooms that went away stop being exported. Call with
+// s.metrics.mu held.
+func (s *server) refreshMetrics() {
+	m := s.metrics
+	m.publishers.Reset()
+	m.players.Reset()
+	m.roomBytesIn.Reset()
+	m.roomBytesOut.Reset()
+	m.roomCacheBytes.Reset()
+	for _, app := range s.appList() {
+		name := app.appName
+		app.Range(func(roomID string, room *Room) bool {
+			m.publishers.With(string(room.protocol)).Inc()
+			for _, sess := range room.Sessions() {
+				m.players.With(string(sess.Protocol)).Inc()
+			}
+			in, _ := room.bytesIn.snapshot()
+			out, _ := room.bytesOut.snapshot()
+			m.roomBytesIn.With(name, roomID).Set(float64(in))
+			m.roomBytesOut.With(name, roomID).Set(float64(out))
+			m.roomCacheBytes.With(name, roomID).Set(float64(room.cacheBytes()))
+			return true
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package librtmp
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
+)
+
+const (
+	// playLead is how far ahead of the wall clock a paced player is
+	// fed, so its buffer fills on start and after a seek.
+	playLead = time.Second
+	// playMaxGap is the largest jump in timestamps played out in real
+	// time; past it, as after falling out of a DVR window, the clock
+	// starts over.
+	playMaxGap = 5 * time.Second
+)
+
+// playSource is what a pacedPlayer plays: a recording or a room's DVR
+// window.
+type playSource interface {
+	// next returns the next tag. A source at its live edge returns no
+	// tag but a channel closed once there may be one; io.EOF ends it.
+	next() (libflv.Tag, <-chan struct{}, error)
+	// seekTo moves to the last keyframe at or before t, or the nearest
+	// one there is, and returns its time.
+	seekTo(t time.Duration) (time.Duration, error)
+	headers() []libflv.Tag
+	close()
+}
+
+// pacedPlayer plays a source to an RTMP player at the pace of its
+// timestamps. Seek and pause commands reach it from the connection's
+// read loop.
+type pacedPlayer struct {
+	rtmp     *RTMP
+	src      playSource
+	name     string
+	live     bool            //a DVR window: the end is the publisher leaving
+	ended    <-chan struct{} //closed when the publisher leaves; nil for recordings
+	seek     chan time.Duration
+	pause    chan bool
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newPacedPlayer(rtmp *RTMP, src playSource, name string, live bool) *pacedPlayer {
+	return &pacedPlayer{
+		rtmp:  rtmp,
+		src:   src,
+		name:  name,
+		live:  live,
+		seek:  make(chan time.Duration, 1),
+		pause: make(chan bool, 1),
+		stop:  make(chan struct{}),
+	}
+}
+
+// SeekTo asks the player to go on from the keyframe before t.
+func (p *pacedPlayer) SeekTo(t time.Duration) {
+	select {
+	case <-p.seek: //only the latest seek matters
+	default:
+	}
+	select {
+	case p.seek <- t:
+	case <-p.stop:
+	}
+}
+
+func (p *pacedPlayer) Pause(paused bool) {
+	select {
+	case p.pause <- paused:
+	case <-p.stop:
+	}
+}
+
+func (p *pacedPlayer) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// run plays from start until stopped. At the end of a recording it
+// tells the player so and waits for a seek back; at the end of a live
+// stream it stops.
+func (p *pacedPlayer) run(start time.Duration) {
+	defer p.src.close()
+
+	var base time.Time //wall time of media time from
+	var from time.Duration
+	restart := func(t time.Duration, notify bool) bool {
+		at, err := p.src.seekTo(t)
+		if err != nil {
+			p.rtmp.log().Warn("seek failed", liblog.Err(err))
+			return false
+		}
+		if notify {
+			p.status("NetStream.Seek.Notify", "Seeking "+at.String())
+			p.status("NetStream.Play.Start", "Start play")
+		}
+		base, from = time.Now(), at
+		return p.sendHeaders(uint32(at/time.Millisecond)) == nil
+	}
+	if !restart(start, false) {
+		return
+	}
+
+	for {
+		tag, more, err := p.src.next()
+		if err == io.EOF {
+			if p.live {
+				p.unpublished()
+				return
+			}
+			_ = NewUserControlMessage(MessageBase{rtmp: p.rtmp}, StreamEOF).Send()
+			p.status("NetStream.Play.Stop", "Stopped playing")
+			t, ok := p.waitSeek()
+			if !ok || !restart(t, true) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			p.rtmp.log().Warn("read failed", liblog.Err(err))
+			return
+		}
+
+		//Hold the tag until it is due, or wait at the live edge,
+		//minding commands meanwhile.
+		var ts time.Duration
+		if tag != nil {
+			ts = time.Duration(tag.GetTagInfo().TimeStamp) * time.Millisecond
+			if ts-from-time.Since(base) > playMaxGap {
+				base, from = time.Now(), ts
+			}
+		}
+		seeked := false
+		for !seeked {
+			var due <-chan time.Time
+			if tag != nil {
+				wait := time.Until(base.Add(ts - from - playLead))
+				if wait <= 0 {
+					break
+				}
+				due = time.After(wait) //at most playMaxGap+playLead
+			}
+			select {
+			case <-due:
+			case <-more:
+			case t := <-p.seek:
+				if !restart(t, true) {
+					return
+				}
+				seeked = true
+			case paused := <-p.pause:
+				if !paused {
+					continue
+				}
+				pausedAt := time.Now()
+				if !p.waitUnpause() {
+					return
+				}
+				base = base.Add(time.Since(pausedAt))
+			case <-p.ended:
+				p.unpublished()
+				return
+			case <-p.stop:
+				return
+			}
+			if tag == nil {
+				break
+			}
+		}
+		if seeked || tag == nil {
+			continue
+		}
+		if err := p.send(tag, tag.GetTagInfo().TimeStamp); err != nil {
+			p.rtmp.log().Debug("send to player failed", liblog.Err(err))
+			return
+		}
+	}
+}
+
+// waitSeek blocks at the end of a recording until a seek; false means
+// stopped.
+func (p *pacedPlayer) waitSeek() (time.Duration, bool) {
+	for {
+		select {
+		case t := <-p.seek:
+			return t, true
+		case <-p.pause: //nothing left to pause
+		case <-p.stop:
+			return 0, false
+		}
+	}
+}
+
+// waitUnpause blocks while paused; false means stopped.
+func (p *pacedPlayer) waitUnpause() bool {
+	for {
+		select {
+		case paused := <-p.pause:
+			if !paused {
+				return true
+			}
+		case <-p.ended:
+			p.unpublished()
+			return false
+		case <-p.stop:
+			return false
+		}
+	}
+}
+
+func (p *pacedPlayer) sendHeaders(ts uint32) error {
+	//Headers may be shared by other players: stamped here, not changed.
+	for _, tag := range p.src.headers() {
+		if err := p.send(tag, ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends tag if the player takes its track, with the track's
+// sequence header first if it was just turned back on.
+func (p *pacedPlayer) send(tag libflv.Tag, ts uint32) error {
+	ok, resume := p.rtmp.tracks.pass(tag)
+	if !ok {
+		return nil
+	}
+	if resume {
+		for _, hdr := range p.src.headers() {
+			if hdr.GetTagInfo().TagType == tag.GetTagInfo().TagType {
+				if err := p.write(hdr, ts); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return p.write(tag, ts)
+}
+
+func (p *pacedPlayer) write(tag libflv.Tag, ts uint32) error {
+	mb := MessageBase{
+		rtmp:          p.rtmp,
+		messageTime:   ts,
+		messageLength: tag.GetTagInfo().DataSize,
+		messageType:   MessageType(tag.GetTagInfo().TagType),
+	}
+	switch t := tag.(type) {
+	case *libflv.AudioTag:
+		return NewAudioMessage(mb, t).Send()
+	case *libflv.VideoTag:
+		return NewVideoMessage(mb, t).Send()
+	case *libflv.MetaTag:
+		return NewDataMessage(mb, t).Send()
+	}
+	return nil
+}
+
+// unpublished tells a player of a live stream that it is over, even if
+// it was behind: the window goes with the room.
+func (p *pacedPlayer) unpublished() {
+	p.status("NetStream.Play.UnpublishNotify", "Stream unpublished")
+}
+
+func (p *pacedPlayer) status(code, description string) {
+	_ = (&CommandMessageResponse{
+		MessageBase:     MessageBase{rtmp: p.rtmp},
+		CommandName:     PLAY,
+		CommandRespName: ON_STATUS,
+		CommandObject: ConnectRespCommandObject{
+			Level:       "status",
+			Code:        code,
+			Description: description,
+		},
+	}).Send()
+}
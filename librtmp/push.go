@@ -0,0 +1,291 @@
+package librtmp
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/liblog"
+)
+
+// pushSpec is one destination of a WithRTMPPush: every room of app
+// whose stream ID matches stream is published to remoteURL.
+type pushSpec struct {
+	app       string
+	stream    string //stream ID or path.Match pattern
+	remoteURL string //rtmp[s]://host[:port]/app[/stream]
+	query     string //added to the published name's query, e.g. a token
+}
+
+func (spec pushSpec) matches(app, roomID string) bool {
+	if app != spec.app {
+		return false
+	}
+	ok, _ := path.Match(spec.stream, roomID)
+	return ok
+}
+
+// PushState is where a push destination is at.
+type PushState string
+
+const (
+	PushConnecting PushState = "connecting"
+	PushPublishing PushState = "publishing"
+	PushRetrying   PushState = "retrying" //waiting to reconnect after a failure
+)
+
+// PushStatus reports one push destination of one room.
+type PushStatus struct {
+	App       string    `json:"app"`
+	Stream    string    `json:"stream"`
+	URL       string    `json:"url"`
+	State     PushState `json:"state"`
+	Since     time.Time `json:"since"`    //when State was entered
+	Connects  int       `json:"connects"` //publishes the destination accepted
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// pusher republishes one room to one destination, reconnecting on its
+// own until the room closes or the push is removed.
+type pusher struct {
+	spec   pushSpec
+	urls   []string //spec.remoteURL, then the ones to fail over to
+	next   int      //index in urls of the one to connect to
+	server *server
+	room   *Room
+	stop   chan struct{}
+	log    liblog.Logger
+
+	mu     sync.Mutex
+	status PushStatus
+}
+
+// startPushes starts the pushes of every destination room matches.
+// Call it once the room is stored in app.
+func (s *server) startPushes(app *App, room *Room) {
+	s.mu.Lock()
+	specs := s.pushes
+	s.mu.Unlock()
+	for _, spec := range specs {
+		if spec.matches(app.appName, room.RoomID) {
+			s.startPush(spec, room)
+		}
+	}
+}
+
+// startPush pushes room to spec's destination, unless it already is.
+// When a connection fails before the destination accepted the publish,
+// the next one goes to the next of fallbacks, round-robin.
+func (s *server) startPush(spec pushSpec, room *Room, fallbacks ...string) {
+	p := &pusher{
+		spec:   spec,
+		urls:   append([]string{spec.remoteURL}, fallbacks...),
+		server: s,
+		room:   room,
+		stop:   make(chan struct{}),
+		log:    s.logger.With(liblog.App(spec.app), liblog.Stream(room.RoomID), liblog.F("url", spec.remoteURL)),
+		status: PushStatus{
+			App:    spec.app,
+			Stream: room.RoomID,
+			URL:    spec.remoteURL,
+			State:  PushConnecting,
+			Since:  time.Now(),
+		},
+	}
+	s.mu.Lock()
+	for other := range s.pushers {
+		if other.spec == spec && other.room == room {
+			s.mu.Unlock()
+			return
+		}
+	}
+	s.pushers[p] = struct{}{}
+	s.mu.Unlock()
+	remove := func() {
+		s.mu.Lock()
+		delete(s.pushers, p)
+		s.mu.Unlock()
+	}
+	if !s.goTracked(&s.workers, func() {
+		defer remove()
+		p.run()
+	}) {
+		remove()
+	}
+}
+
+// stopPushes stops every push to spec's destination.
+func (s *server) stopPushes(spec pushSpec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range s.pushers {
+		if p.spec == spec {
+			delete(s.pushers, p)
+			close(p.stop)
+		}
+	}
+}
+
+// Pushes reports every running push, by app, stream and destination.
+func (s *server) Pushes() []PushStatus {
+	s.mu.Lock()
+	out := make([]PushStatus, 0, len(s.pushers))
+	for p := range s.pushers {
+		p.mu.Lock()
+		out = append(out, p.status)
+		p.mu.Unlock()
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].App != out[j].App {
+			return out[i].App < out[j].App
+		}
+		if out[i].Stream != out[j].Stream {
+			return out[i].Stream < out[j].Stream
+		}
+		return out[i].URL < out[j].URL
+	})
+	return out
+}
+
+func (p *pusher) setState(state PushState, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.URL = p.urls[p.next]
+	if p.status.State != state {
+		p.status.State, p.status.Since = state, time.Now()
+	}
+	if state == PushPublishing {
+		p.status.Connects++
+	}
+	if err != nil {
+		p.status.LastError = err.Error()
+	}
+}
+
+// run pushes until the room closes, the push is stopped or the server
+// shuts down, reconnecting with exponential backoff up to 30 s.
+func (p *pusher) run() {
+	backoff := time.Second
+	for {
+		published, err := p.publish()
+		if p.over() {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("destination went away")
+		}
+		p.log.Warn("rtmp push failed", liblog.Err(err))
+		p.setState(PushRetrying, err)
+		if published {
+			backoff = time.Second
+		} else {
+			p.mu.Lock()
+			p.next = (p.next + 1) % len(p.urls)
+			p.mu.Unlock()
+		}
+		select {
+		case <-p.room.done:
+			return
+		case <-p.stop:
+			return
+		case <-p.server.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// over reports whether the push has nothing left to do.
+func (p *pusher) over() bool {
+	select {
+	case <-p.room.done:
+		return true
+	case <-p.stop:
+		return true
+	case <-p.server.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// publish runs one connection to the destination, a client Conn
+// publishing the room's tags until either end goes away. published
+// reports whether the destination accepted the publish.
+func (p *pusher) publish() (published bool, err error) {
+	p.setState(PushConnecting, nil)
+	u, err := url.Parse(p.urls[p.next])
+	if err != nil {
+		return false, fmt.Errorf("parse remote URL: %w", err)
+	}
+	conn, err := dialURL(u, 10*time.Second, nil)
+	if err != nil {
+		return false, err
+	}
+	if !p.server.trackConn(conn) {
+		_ = conn.Close()
+		return false, ErrServerClosed
+	}
+	defer p.server.untrackConn(conn)
+	defer conn.Close()
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-p.stop:
+		case <-p.room.done:
+		case <-finished:
+			return
+		}
+		_ = conn.Close()
+	}()
+
+	c, err := newConn(conn, u, DialOptions{}, p.server)
+	if err != nil {
+		return false, err
+	}
+	name := c.streamName("")
+	if name == "" {
+		name = p.room.RoomID
+		if u.RawQuery != "" {
+			name += "?" + u.RawQuery
+		}
+	}
+	if p.spec.query != "" {
+		if strings.Contains(name, "?") {
+			name += "&" + p.spec.query
+		} else {
+			name += "?" + p.spec.query
+		}
+	}
+	if err := c.Publish(name); err != nil {
+		return false, err
+	}
+	defer c.Close()
+	p.setState(PushPublishing, nil)
+	p.log.Info("rtmp push start")
+	return true, p.forward(c)
+}
+
+// forward sends the room's tags, from where its viewers would start
+// and headers first, until the room closes.
+func (p *pusher) forward(c *Conn) error {
+	sub := p.room.subscribe()
+	for {
+		tag, alive := sub.read()
+		if !alive {
+			return nil
+		}
+		if err := c.WriteTag(tag); err != nil {
+			return err
+		}
+	}
+}
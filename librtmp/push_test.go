@@ -0,0 +1,155 @@
+package librtmp
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// freeAddr returns a loopback address nothing listens on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// runServer runs srv until the test ends or stop is called.
+func runServer(t *testing.T, srv *server) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Run(ctx) }()
+	done := false
+	stop = func() {
+		if !done {
+			done = true
+			cancel()
+			<-errc
+		}
+	}
+	t.Cleanup(stop)
+	time.Sleep(50 * time.Millisecond)
+	return stop
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPush(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	dstA := NewServer(addrA, "ingest")
+	runServer(t, dstA)
+	stopB := runServer(t, NewServer(addrB, "ingest"))
+
+	urlA, urlB := "rtmp://"+addrA+"/ingest", "rtmp://"+addrB+"/ingest/renamed?key=k"
+	origin := NewServer("127.0.0.1:0", "live").WithRTMPPush("live", "*", urlA, urlB)
+	runServer(t, origin)
+
+	//A publisher as PUBLISH sets it up.
+	conn, peer := net.Pipe()
+	pub := NewRTMP(conn, "10.0.0.1:1935", origin)
+	pub.app, pub.role = "live", rolePublisher
+	room := NewRoom(pub, "x")
+	pub.room = room
+	app, _ := origin.app("live")
+	app.Store("x", room)
+	origin.serveConn(conn, func() {
+		_, _ = io.Copy(io.Discard, conn)
+		pub.cleanup()
+	})
+	meta := &libflv.MetaTag{TagBase: libflv.TagBase{TagType: libflv.SCRIPT_DATA_TAG}, Width: 1280}
+	video := &libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG}, FrameType: libflv.KEY_FRAME,
+		CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_SEQUENCE_HEADER, VideoData: []byte{1, 0x4d, 0x40, 0x28, 0xff, 0xe0, 0}}
+	audio := &libflv.AudioTag{TagBase: libflv.TagBase{TagType: libflv.AUDIO_TAG}, SoundFormat: libflv.FLV_AUDIO_AAC, SoundRate: 3, SoundSize: 1,
+		SoundType: libflv.SND_STEREO, AACPacketType: libflv.AAC_SEQUENCE_HEADER, SoundData: []byte{0x12, 0x10}}
+	room.setMeta(meta)
+	room.setVideoSequenceHeader(video)
+	room.setAudioSequenceHeader(audio)
+	for _, tag := range []libflv.Tag{meta, video, audio} {
+		room.GOP.WriteMeta(tag)
+	}
+	origin.startPushes(app, room)
+
+	status := func(url string) PushStatus {
+		for _, st := range origin.Pushes() {
+			if st.URL == url {
+				return st
+			}
+		}
+		return PushStatus{}
+	}
+	waitFor(t, "both destinations publishing", func() bool {
+		return status(urlA).State == PushPublishing && status(urlB).State == PushPublishing
+	})
+	ingestA, _ := dstA.app("ingest")
+	waitFor(t, "the stream and its sequence header at A", func() bool {
+		r := ingestA.Load("x")
+		if r == nil {
+			return false
+		}
+		_, video, _ := r.snapshotHeaders()
+		return video != nil
+	})
+	//A frame every 20 ms, a keyframe every second, like a live encoder.
+	frames := make(chan struct{})
+	framesDone := make(chan struct{})
+	go func() {
+		defer close(framesDone)
+		for ts := uint32(0); ; ts += 20 {
+			select {
+			case <-frames:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			frame := uint8(libflv.INTER_FRAME)
+			if ts%1000 == 0 {
+				frame = libflv.KEY_FRAME
+			}
+			room.writeTag(&libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG, TimeStamp: ts, DataSize: 5}, FrameType: frame,
+				CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_NALU, VideoData: []byte{0, 0, 0, 1, 0x65}}, frame == libflv.KEY_FRAME)
+		}
+	}()
+	defer func() {
+		close(frames)
+		<-framesDone
+	}()
+	waitFor(t, "the keyframe at A", func() bool {
+		total, _ := ingestA.Load("x").bytesIn.snapshot()
+		return total > 0
+	})
+
+	//B going away leaves A alone; B comes back on its own.
+	stopB()
+	waitFor(t, "B retrying", func() bool { return status(urlB).State == PushRetrying })
+	if st := status(urlB); st.LastError == "" || st.Connects != 1 {
+		t.Errorf("B after it went away: %+v", st)
+	}
+	dstB := NewServer(addrB, "ingest")
+	runServer(t, dstB)
+	waitFor(t, "B publishing again", func() bool { return status(urlB).Connects == 2 && status(urlB).State == PushPublishing })
+	ingestB, _ := dstB.app("ingest")
+	if ingestB.Load("renamed") == nil {
+		t.Error("B has no stream \"renamed\"")
+	}
+	if st := status(urlA); st.State != PushPublishing || st.Connects != 1 {
+		t.Errorf("A while B was away: %+v", st)
+	}
+
+	//The pushes end with the room.
+	peer.Close()
+	waitFor(t, "the pushes to stop", func() bool { return len(origin.Pushes()) == 0 })
+	waitFor(t, "the stream to end at A", func() bool { return ingestA.Load("x") == nil })
+}
@@ -0,0 +1,200 @@
+package librtmp
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/liblog"
+	"github.com/sbraveyoung/GGmpeg/librecord"
+)
+
+// Publishing types from the RTMP publish command.
+const (
+	publishLive   = "live"
+	publishRecord = "record"
+	publishAppend = "append"
+)
+
+// recordReconnectGrace is how long a recording stays open after its
+// publisher goes away, so a publisher that reconnects carries on in
+// the same file.
+const recordReconnectGrace = 30 * time.Second
+
+// RecordConfig turns on recording for an app. Publishes of type
+// "record" (new file) and "append" (continue the existing one) are
+// recorded to <Dir>/<app>/<stream>.flv; with Always every publish is,
+// to <stream>-<start time>.flv. Files rotate to <name>-1.flv,
+// <name>-2.flv… on the first keyframe past MaxDuration or MaxSize.
+//
+// Format "mp4" records fragmented .mp4 files instead, which Faststart
+// rewrites as progressive ones when they are complete. An mp4 file
+// can't be added to, so "append" goes on in a new one.
+type RecordConfig struct {
+	Dir         string   `json:"dir"`    //default "./record"
+	Format      string   `json:"format"` //flv (default) or mp4
+	Faststart   bool     `json:"faststart"`
+	Always      bool     `json:"always"`
+	MaxDuration Duration `json:"max_duration"` //0: no rotation on duration
+	MaxSize     int64    `json:"max_size"`     //bytes; 0: no rotation on size
+}
+
+// WithRecord enables recording on appName. See RecordConfig.
+func (s *server) WithRecord(appName string, cfg RecordConfig) *server {
+	if _, ok := s.apps[appName]; !ok {
+		panic("appName does not exist.")
+	}
+	s.apps[appName].record = &cfg
+	return s
+}
+
+// recordings holds an app's open recordings by stream. It outlives
+// rooms so a reconnecting publisher finds its recording again.
+type recordings struct {
+	mu sync.Mutex
+	m  map[string]*recording
+}
+
+type recording struct {
+	file    librecord.Recorder
+	session int         //bumped for every publisher attached
+	idle    *time.Timer //closes the recording once the grace expires
+}
+
+func newRecordings() *recordings {
+	return &recordings{m: map[string]*recording{}}
+}
+
+// startRecording records room if publishingType asks for it or app
+// records everything, or if a recording of the same stream is still
+// waiting for its publisher to come back.
+func (s *server) startRecording(app *App, room *Room, publishingType string) {
+	set := app.recordings
+	set.mu.Lock()
+	rec := set.m[room.RoomID]
+	if rec == nil {
+		rec = s.newRecording(app, room.RoomID, publishingType)
+		if rec == nil {
+			set.mu.Unlock()
+			return
+		}
+		set.m[room.RoomID] = rec
+	}
+	if rec.idle != nil {
+		rec.idle.Stop()
+		rec.idle = nil
+	}
+	rec.session++
+	session := rec.session
+	set.mu.Unlock()
+
+	log := s.logger.With(liblog.App(app.appName), liblog.Stream(room.RoomID))
+	reader := room.newGOPReader()
+	if !s.goTracked(&s.streams, func() {
+		if err := rec.file.Record(reader); err != nil {
+			log.Warn("recording failed", liblog.Err(err))
+		}
+		s.detachRecording(set, room.RoomID, rec, session)
+	}) {
+		s.detachRecording(set, room.RoomID, rec, session)
+	}
+}
+
+// newRecording returns nil if nothing should be recorded.
+func (s *server) newRecording(app *App, roomID, publishingType string) *recording {
+	cfg := app.record
+	if cfg == nil {
+		if publishingType == publishRecord || publishingType == publishAppend {
+			s.logger.Debug("recording not enabled; publishing live", liblog.App(app.appName), liblog.Stream(roomID))
+		}
+		return nil
+	}
+	name, mode := roomID, librecord.Record
+	switch {
+	case publishingType == publishRecord:
+	case publishingType == publishAppend:
+		mode = librecord.Append
+	case cfg.Always:
+		name = roomID + "-" + time.Now().Format("20060102-150405")
+	default:
+		return nil
+	}
+	dir, log := filepath.Join(cfg.dir(), app.appName), s.logger.With(liblog.App(app.appName))
+	if err := librecord.CheckName(dir, name); err != nil {
+		log.Warn("not recording", liblog.Stream(roomID), liblog.Err(err))
+		return nil
+	}
+	if cfg.Format == "mp4" {
+		return &recording{
+			file: librecord.NewMP4().
+				WithDir(dir).
+				WithName(name).
+				WithMode(mode).
+				WithMaxDuration(time.Duration(cfg.MaxDuration)).
+				WithMaxSize(cfg.MaxSize).
+				WithFaststart(cfg.Faststart).
+				WithLogger(log),
+		}
+	}
+	return &recording{
+		file: librecord.NewFLV().
+			WithDir(dir).
+			WithName(name).
+			WithMode(mode).
+			WithMaxDuration(time.Duration(cfg.MaxDuration)).
+			WithMaxSize(cfg.MaxSize).
+			WithLogger(log),
+	}
+}
+
+// detachRecording runs when a publisher's stream ends: unless another
+// one has taken the recording over, it is closed after the grace, or
+// straight away if the server is shutting down.
+func (s *server) detachRecording(set *recordings, roomID string, rec *recording, session int) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if rec.session != session || set.m[roomID] != rec {
+		return
+	}
+	if s.closing() {
+		delete(set.m, roomID)
+		s.closeRecording(rec)
+		return
+	}
+	rec.idle = time.AfterFunc(recordReconnectGrace, func() {
+		set.mu.Lock()
+		defer set.mu.Unlock()
+		if rec.session != session || set.m[roomID] != rec {
+			return
+		}
+		delete(set.m, roomID)
+		s.closeRecording(rec)
+	})
+}
+
+func (s *server) closeRecording(rec *recording) {
+	if err := rec.file.Close(); err != nil {
+		s.logger.Warn("recording not finalised", liblog.Err(err))
+	}
+}
+
+// closeRecordings closes every recording of app, waiting or not.
+func (s *server) closeRecordings(app *App) {
+	set := app.recordings
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	for roomID, rec := range set.m {
+		if rec.idle != nil {
+			rec.idle.Stop()
+		}
+		delete(set.m, roomID)
+		s.closeRecording(rec)
+	}
+}
+
+func (c *RecordConfig) dir() string {
+	if c.Dir == "" {
+		return "./record"
+	}
+	return c.Dir
+}
@@ -0,0 +1,104 @@
+package librtmp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+func TestRecording_SurvivesReconnect(t *testing.T) {
+	dir := t.TempDir()
+	srv := NewServer(":0", "live").WithRecord("live", RecordConfig{Dir: dir, Always: true})
+	app, _ := srv.app("live")
+
+	//One publisher session of a three-frame GOP, its clock starting at 0.
+	publish := func() {
+		pub := &RTMP{server: srv, role: rolePublisher, app: "live"}
+		pub.room = NewRoom(pub, "x")
+		app.Store("x", pub.room)
+		srv.startRecording(app, pub.room, publishLive)
+		pub.room.GOP.WriteMeta(&libflv.MetaTag{TagBase: libflv.TagBase{TagType: libflv.SCRIPT_DATA_TAG}})
+		pub.room.GOP.WriteMeta(&libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG}, FrameType: libflv.KEY_FRAME,
+			CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_SEQUENCE_HEADER, VideoData: []byte{1}})
+		pub.room.GOP.WriteMeta(&libflv.AudioTag{TagBase: libflv.TagBase{TagType: libflv.AUDIO_TAG}, SoundFormat: libflv.FLV_AUDIO_AAC,
+			AACPacketType: libflv.AAC_SEQUENCE_HEADER, SoundData: []byte{0x12, 0x10}})
+		for _, ts := range []uint32{0, 1000, 2000} {
+			frame := uint8(libflv.INTER_FRAME)
+			if ts == 0 {
+				frame = libflv.KEY_FRAME
+			}
+			pub.room.writeTag(&libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG, TimeStamp: ts}, FrameType: frame,
+				CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_NALU, VideoData: []byte{0, 0, 0, 1, 0x65}}, ts == 0)
+		}
+		pub.cleanup()
+
+		//Wait for the recording to wind down to its reconnect grace.
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			app.recordings.mu.Lock()
+			rec := app.recordings.m["x"]
+			waiting := rec != nil && rec.idle != nil
+			app.recordings.mu.Unlock()
+			if waiting {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("recording never went idle")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	publish()
+	publish()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "live", "x-*.flv"))
+	if len(files) != 1 {
+		t.Fatalf("recorded files = %v, want one", files)
+	}
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []uint32
+	for i := 13; i+11 <= len(b); {
+		n := int(b[i+1])<<16 | int(b[i+2])<<8 | int(b[i+3])
+		if b[i] == libflv.VIDEO_TAG && b[i+12] == libflv.AVC_NALU {
+			frames = append(frames, uint32(b[i+7])<<24|uint32(b[i+4])<<16|uint32(b[i+5])<<8|uint32(b[i+6]))
+		}
+		i += 11 + n + 4
+	}
+	if len(frames) != 6 {
+		t.Fatalf("recorded %d frames, want both sessions' 6", len(frames))
+	}
+	for i := 1; i < len(frames); i++ {
+		if frames[i] <= frames[i-1] {
+			t.Errorf("frame timestamps %v don't keep going up across the reconnect", frames)
+			break
+		}
+	}
+}
+
+func TestRecording_BadName(t *testing.T) {
+	srv := NewServer(":0", "live").WithRecord("live", RecordConfig{Dir: t.TempDir(), Always: true})
+	app, _ := srv.app("live")
+	for _, name := range []string{"../../x", "a/b", ".."} {
+		for _, publishingType := range []string{publishRecord, publishLive} {
+			if rec := srv.newRecording(app, name, publishingType); rec != nil {
+				t.Errorf("recording %q, published %s", name, publishingType)
+			}
+		}
+	}
+	if srv.newRecording(app, "x", publishRecord) == nil {
+		t.Error("not recording a plain name")
+	}
+}
@@ -0,0 +1,277 @@
+package librtmp
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/SmartBrave/Athena/easyerrors"
+	"github.com/sbraveyoung/GGmpeg/liblog"
+)
+
+// Reload applies cfg to the running server without dropping streams
+// that cfg leaves alone:
+//
+//   - apps missing from cfg are removed: their publishers are
+//     disconnected and their players see the stream end;
+//   - new apps are added, and apps whose settings changed use the new
+//     ones for rooms published from now on. Live rooms are not touched;
+//     they keep the HLS/DASH segmenters they were started with;
+//   - pulls and SRT listeners that are gone are stopped, tearing down
+//     the room they fed, and new ones are started. Unchanged ones keep
+//     running;
+//   - push destinations that are gone are disconnected, and new ones
+//     start on the live rooms they match as well as on later ones.
+//
+// Listener addresses, the log level and webhooks are fixed when the
+// server starts; changes to them are logged and ignored. An invalid cfg
+// is rejected as a whole. A new SRT listener that can't be opened is
+// reported in the returned error; the rest of cfg is still applied.
+//
+// On a server built with NewServer and the With* options, the settings
+// those gave an app stay, under whatever sections of the app cfg sets.
+// The server keeps cfg, so don't modify it afterwards.
+func (s *server) Reload(cfg *Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.mu.Lock()
+	running := s.running
+	s.mu.Unlock()
+	if !running {
+		return errors.New("server not running")
+	}
+	if s.closing() {
+		return ErrServerClosed
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.warnRestartOnly(cfg)
+
+	removed, apps := s.reloadApps(cfg)
+	for _, app := range removed {
+		app.Range(func(roomID string, room *Room) bool {
+			app.Delete(roomID)
+			room.Close()
+			if room.Publisher != nil {
+				room.Publisher.kick()
+			}
+			return true
+		})
+		s.closeRecordings(app)
+	}
+
+	//Relays are keyed by their whole spec: one that moved to another
+	//app or stream is stopped and started again.
+	pulls := make(map[pullSpec]bool, len(cfg.Pulls))
+	for _, p := range cfg.Pulls {
+		pulls[pullSpec{remoteURL: p.URL, app: p.App, streamID: p.Stream}] = true
+	}
+	srts := make(map[srtSpec]bool, len(cfg.SRT))
+	for _, r := range cfg.SRT {
+		srts[srtSpec{address: r.Address, app: r.App, streamID: r.Stream}] = true
+	}
+	pushes := map[pushSpec]bool{}
+	var pushList []pushSpec
+	for _, p := range cfg.Pushes {
+		for _, u := range p.URLs {
+			spec := pushSpec{app: p.App, stream: p.Stream, remoteURL: u}
+			if !pushes[spec] {
+				pushes[spec] = true
+				pushList = append(pushList, spec)
+			}
+		}
+	}
+	s.mu.Lock()
+	var stopPushes, startPushes []pushSpec
+	for _, spec := range s.pushes {
+		if !pushes[spec] {
+			stopPushes = append(stopPushes, spec)
+		}
+	}
+	pushing := make(map[pushSpec]bool, len(s.pushes))
+	for _, spec := range s.pushes {
+		pushing[spec] = true
+	}
+	for _, spec := range pushList {
+		if !pushing[spec] {
+			startPushes = append(startPushes, spec)
+		}
+	}
+	s.pushes = pushList
+	var stopPulls, startPulls []pullSpec
+	for spec := range s.pullStops {
+		if !pulls[spec] {
+			stopPulls = append(stopPulls, spec)
+		}
+	}
+	for spec := range pulls {
+		if _, ok := s.pullStops[spec]; !ok {
+			startPulls = append(startPulls, spec)
+		}
+	}
+	var stopSRTs, startSRTs []srtSpec
+	for spec := range s.srtRelays {
+		if !srts[spec] {
+			stopSRTs = append(stopSRTs, spec)
+		}
+	}
+	for spec := range srts {
+		if _, ok := s.srtRelays[spec]; !ok {
+			startSRTs = append(startSRTs, spec)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, spec := range stopPulls {
+		s.stopPull(spec)
+		s.logger.Info("pull removed", liblog.App(spec.app), liblog.Stream(spec.streamID), liblog.F("url", spec.remoteURL))
+	}
+	for _, spec := range startPulls {
+		s.startPull(spec)
+		s.logger.Info("pull added", liblog.App(spec.app), liblog.Stream(spec.streamID), liblog.F("url", spec.remoteURL))
+	}
+	for _, spec := range stopPushes {
+		s.stopPushes(spec)
+		s.logger.Info("push removed", liblog.App(spec.app), liblog.Stream(spec.stream), liblog.F("url", spec.remoteURL))
+	}
+	for _, spec := range startPushes {
+		if app, ok := s.app(spec.app); ok {
+			app.Range(func(roomID string, room *Room) bool {
+				if spec.matches(app.appName, roomID) {
+					s.startPush(spec, room)
+				}
+				return true
+			})
+		}
+		s.logger.Info("push added", liblog.App(spec.app), liblog.Stream(spec.stream), liblog.F("url", spec.remoteURL))
+	}
+	//Stop before starting so a listener can move to another app or
+	//stream on the same address.
+	for _, spec := range stopSRTs {
+		s.stopSRTRelay(spec)
+		s.logger.Info("srt listener removed", liblog.App(spec.app), liblog.Stream(spec.streamID), liblog.F("address", spec.address))
+	}
+	var errs []error
+	for _, spec := range startSRTs {
+		err := s.startSRTRelay(spec, func(name string, err error) {
+			s.logger.Error(name+" listener failed", liblog.Err(err))
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("srt %s: %w", spec.address, err))
+			continue
+		}
+		s.logger.Info("srt listener added", liblog.App(spec.app), liblog.Stream(spec.streamID), liblog.F("address", spec.address))
+	}
+
+	//Remember what is actually running, so the next Reload warns
+	//about an ignored setting again.
+	applied := *cfg
+	applied.Apps = apps
+	if old := s.config; old != nil {
+		applied.RTMP, applied.HTTPFLV, applied.HLS = old.RTMP, old.HTTPFLV, old.HLS
+		applied.RTSP, applied.Admin, applied.RTMPS = old.RTSP, old.Admin, old.RTMPS
+		applied.LogLevel, applied.Webhooks = old.LogLevel, old.Webhooks
+		if applied.path == "" {
+			applied.path = old.path
+		}
+	}
+	s.config = &applied
+	return easyerrors.HandleMultiError(easyerrors.Simple(), errs...)
+}
+
+// ReloadFile re-reads the file the server was loaded from with
+// LoadConfig and applies it with Reload.
+func (s *server) ReloadFile() error {
+	s.reloadMu.Lock()
+	path := ""
+	if s.config != nil {
+		path = s.config.path
+	}
+	s.reloadMu.Unlock()
+	if path == "" {
+		return errors.New("server was not loaded from a config file")
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	return s.Reload(cfg)
+}
+
+// reloadApps swaps in cfg's apps and returns the ones it removed, and
+// the configs of the apps now running. An app whose settings changed is
+// replaced by one sharing its rooms, HLS/DASH segmenters and
+// recordings, so connections holding the old *App see the same rooms.
+func (s *server) reloadApps(cfg *Config) (removed []*App, running []AppConfig) {
+	s.appsMu.Lock()
+	previous := map[string]AppConfig{}
+	if s.config != nil {
+		for _, a := range s.config.Apps {
+			previous[a.Name] = a
+		}
+	} else if s.builtApps == nil {
+		//First Reload of a server set up with the With* options.
+		s.builtApps = make(map[string]AppConfig, len(s.apps))
+		for name, app := range s.apps {
+			s.builtApps[name] = appConfigOf(app)
+			previous[name] = s.builtApps[name]
+		}
+	}
+
+	apps := make(map[string]*App, len(cfg.Apps))
+	for _, a := range cfg.Apps {
+		if built, ok := s.builtApps[a.Name]; ok {
+			a = a.orRunning(built)
+		}
+		running = append(running, a)
+		old, ok := s.apps[a.Name]
+		switch {
+		case !ok:
+			apps[a.Name] = newAppFromConfig(a)
+			s.logger.Info("app added", liblog.App(a.Name))
+		case reflect.DeepEqual(previous[a.Name], a):
+			apps[a.Name] = old
+		default:
+			app := newAppFromConfig(a)
+			app.rooms, app.hls, app.hlsAudio, app.dash, app.recordings = old.rooms, old.hls, old.hlsAudio, old.dash, old.recordings
+			apps[a.Name] = app
+			s.logger.Info("app updated", liblog.App(a.Name))
+		}
+	}
+	for name, app := range s.apps {
+		if _, ok := apps[name]; !ok {
+			removed = append(removed, app)
+			s.logger.Info("app removed", liblog.App(name))
+		}
+	}
+	s.apps = apps
+	s.appsMu.Unlock()
+	return removed, running
+}
+
+// warnRestartOnly logs every setting in cfg that Reload can't apply.
+func (s *server) warnRestartOnly(cfg *Config) {
+	if s.config == nil {
+		return
+	}
+	old := s.config
+	for _, f := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"rtmp", old.RTMP, cfg.RTMP},
+		{"http_flv", old.HTTPFLV, cfg.HTTPFLV},
+		{"hls", old.HLS, cfg.HLS},
+		{"rtsp", old.RTSP, cfg.RTSP},
+		{"admin", old.Admin, cfg.Admin},
+		{"rtmps", old.RTMPS, cfg.RTMPS},
+		{"log_level", old.LogLevel, cfg.LogLevel},
+		{"webhooks", old.Webhooks, cfg.Webhooks},
+	} {
+		if !reflect.DeepEqual(f.old, f.new) {
+			s.logger.Warn("config change needs a restart; ignored", liblog.F("setting", f.name))
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package librtmp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	cfg, err := ParseConfig(strings.NewReader(`{
+		"rtmp": "127.0.0.1:0",
+		"apps": [{"name": "live"}, {"name": "old"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServerFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Reload(cfg); err == nil {
+		t.Error("Reload before Run succeeded")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	publish := func(appName, stream string) (*Room, net.Conn) {
+		conn, peer := net.Pipe()
+		pub := NewRTMP(conn, "10.0.0.1:1935", srv)
+		pub.app, pub.role = appName, rolePublisher
+		room := NewRoom(pub, stream)
+		pub.room = room
+		app, _ := srv.app(appName)
+		app.Store(stream, room)
+		srv.serveConn(conn, func() {
+			_, _ = io.Copy(io.Discard, conn)
+			pub.cleanup()
+		})
+		return room, peer
+	}
+	closed := func(room *Room) bool {
+		room.mu.RLock()
+		defer room.mu.RUnlock()
+		return room.closed
+	}
+	liveRoom, livePeer := publish("live", "a")
+	defer livePeer.Close()
+	oldRoom, oldPeer := publish("old", "b")
+	oldLive, _ := srv.app("live")
+
+	next, err := ParseConfig(strings.NewReader(`{
+		"rtmp": "127.0.0.1:0",
+		"hls": "127.0.0.1:0",
+		"apps": [{"name": "live"}, {"name": "new", "hls": {"mode": "delay"}}],
+		"pulls": [{"url": "rtmp://127.0.0.1:1/live/x", "app": "new", "stream": "x"}],
+		"pushes": [{"app": "live", "stream": "*", "urls": ["rtmp://127.0.0.1:1/live"]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.RTMPS = rtmpsFiles(t, "127.0.0.1:0")
+	if err := srv.Reload(next); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	if live, _ := srv.app("live"); live != oldLive || live.Load("a") != liveRoom {
+		t.Error("unchanged app or its live room was replaced")
+	}
+	if closed(liveRoom) {
+		t.Error("room of an unchanged app was closed")
+	}
+	if _, ok := srv.app("new"); !ok {
+		t.Error("new app not added")
+	}
+	if _, ok := srv.app("old"); ok {
+		t.Error("removed app still configured")
+	}
+	if !closed(oldRoom) {
+		t.Error("room of a removed app still open")
+	}
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, oldPeer)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("publisher of a removed app still connected")
+	}
+
+	srv.mu.Lock()
+	pulls := len(srv.pullStops)
+	srv.mu.Unlock()
+	if pulls != 1 {
+		t.Errorf("running pulls = %d, want 1", pulls)
+	}
+	if pushes := srv.Pushes(); len(pushes) != 1 || pushes[0].Stream != "a" {
+		t.Errorf("pushes = %+v, want one of the live room", pushes)
+	}
+	if srv.config.HLS != "" {
+		t.Error("hls listener change recorded as applied")
+	}
+	if srv.config.RTMPS != nil {
+		t.Error("rtmps listener change recorded as applied")
+	}
+
+	//Changing an app's settings keeps its rooms.
+	next, err = ParseConfig(strings.NewReader(`{
+		"rtmp": "127.0.0.1:0",
+		"apps": [{"name": "live", "token": {"secret": "k"}}, {"name": "new"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Reload(next); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	live, _ := srv.app("live")
+	if live == oldLive || live.token == nil || live.Load("a") != liveRoom {
+		t.Error("updated app didn't keep its rooms or take the new settings")
+	}
+	srv.mu.Lock()
+	pulls = len(srv.pullStops)
+	srv.mu.Unlock()
+	if pulls != 0 {
+		t.Errorf("running pulls = %d, want 0", pulls)
+	}
+	if pushes := srv.Pushes(); len(pushes) != 0 {
+		t.Errorf("pushes = %+v, want none", pushes)
+	}
+
+	if err := srv.Reload(&Config{Apps: []AppConfig{{Name: "live"}, {}}}); err == nil {
+		t.Error("invalid config accepted")
+	}
+	if _, ok := srv.app("new"); !ok {
+		t.Error("invalid config partly applied")
+	}
+}
+
+func TestReload_Builder(t *testing.T) {
+	srv := NewServer("127.0.0.1:0", "live", "edge").
+		WithToken("live", TokenConfig{Secret: []byte("k"), Sign: SignPath | SignIP}).
+		WithRecord("live", RecordConfig{Dir: t.TempDir()}).
+		WithGOPCache("live", GOPCacheConfig{Mode: "gops", GOPs: 2}).
+		WithDVR("live", DVRConfig{Window: Duration(time.Minute)}).
+		WithSendQueue("live", SendQueueConfig{MaxTags: 100}).
+		WithEdge("edge", EdgeConfig{Origins: []string{"rtmp://127.0.0.1:1"}})
+	runServer(t, srv)
+	oldLive, _ := srv.app("live")
+	oldEdge, _ := srv.app("edge")
+
+	//A config that only adds an app leaves the others as built.
+	next, err := ParseConfig(strings.NewReader(`{
+		"rtmp": "127.0.0.1:0",
+		"apps": [{"name": "live"}, {"name": "edge"}, {"name": "new"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := srv.Reload(next); err != nil {
+			t.Fatalf("Reload: %v", err)
+		}
+		if live, _ := srv.app("live"); live != oldLive {
+			t.Errorf("reload %d replaced an app the config leaves alone", i)
+		}
+		if edge, _ := srv.app("edge"); edge != oldEdge {
+			t.Errorf("reload %d replaced an edge the config leaves alone", i)
+		}
+	}
+	if _, ok := srv.app("new"); !ok {
+		t.Error("new app not added")
+	}
+
+	//Changing one section keeps the rest.
+	next, err = ParseConfig(strings.NewReader(`{
+		"rtmp": "127.0.0.1:0",
+		"apps": [{"name": "live", "send_queue": {"max_tags": 10}}, {"name": "edge"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Reload(next); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	live, _ := srv.app("live")
+	switch {
+	case live == oldLive || live.sendQueue == nil || live.sendQueue.MaxTags != 10:
+		t.Error("updated app didn't take the new send queue")
+	case live.token == nil || string(live.token.Secret) != "k" || live.token.Sign != SignPath|SignIP:
+		t.Errorf("updated app lost its token: %+v", live.token)
+	case live.record == nil || live.gopCache == nil || live.gopCache.GOPs != 2 || live.dvr == nil:
+		t.Error("updated app lost its record, GOP cache or DVR settings")
+	}
+	if edge, _ := srv.app("edge"); edge != oldEdge || edge.edge == nil {
+		t.Error("edge app replaced or lost its origins")
+	}
+}
+
+// rtmpsFiles writes a self-signed certificate and its key to files and
+// returns an RTMPS listener on address using them.
+func rtmpsFiles(t *testing.T, address string) *RTMPSConfig {
+	cert, _ := selfSigned(t)
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cfg := &RTMPSConfig{Address: address, Cert: filepath.Join(dir, "cert.pem"), Key: filepath.Join(dir, "key.pem")}
+	for file, block := range map[string]*pem.Block{
+		cfg.Cert: {Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		cfg.Key:  {Type: "EC PRIVATE KEY", Bytes: der},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cfg
+}
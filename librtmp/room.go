@@ -1,19 +1,24 @@
 package librtmp
 
 import (
-	"fmt"
+	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/SmartBrave/Athena/broadcast"
 	"github.com/SmartBrave/Athena/easyio"
 	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 )
 
 type Room struct {
 	RoomID    string
 	Publisher *RTMP
 	GOP       *broadcast.Broadcast
+	cache     *gopCache  //where viewers start; set before the room is stored
+	dvr       *dvrBuffer //nil: no time-shift window; set before the room is stored
 
 	// Cached sequence headers. Populated by the publisher the first
 	// time it emits them and replayed to every new subscriber before
@@ -25,6 +30,15 @@ type Room struct {
 	audioSeqHdr *libflv.AudioTag
 	metaTag     *libflv.MetaTag
 	closed      bool
+	done        chan struct{} //closed by Close
+
+	// Bookkeeping for the admin API. protocol is how the publisher
+	// reached us; sessions are the subscribers currently attached.
+	protocol  Protocol
+	startTime time.Time
+	bytesIn   rateMeter
+	bytesOut  rateMeter //summed over every subscriber
+	sessions  map[string]*Session //session ID → subscriber
 }
 
 //NOTE: the room must be created by publisher
@@ -32,11 +46,92 @@ func NewRoom(rtmp *RTMP, roomID string) *Room {
 	r := &Room{
 		RoomID:    roomID,
 		Publisher: rtmp,
-		GOP:       broadcast.NewBroadcast(3),
+		GOP:       broadcast.NewBroadcast(gopMetaSlots),
+		cache:     newGOPCache(nil),
+		protocol:  ProtocolRTMP,
+		startTime: time.Now(),
+		sessions:  map[string]*Session{},
+		done:      make(chan struct{}),
 	}
 	return r
 }
 
+// writeTag pushes one media tag into the GOP broadcast, starting a new
+// GOP first when the tag is a keyframe, and counts it toward the
+// room's inbound bitrate.
+func (room *Room) writeTag(tag libflv.Tag, keyframe bool) {
+	room.bytesIn.add(int(tag.GetTagInfo().DataSize))
+	room.cache.mu.Lock()
+	defer room.cache.mu.Unlock()
+	room.cache.add(tag, keyframe)
+	if keyframe {
+		room.GOP.Reset()
+	}
+	room.GOP.Write(tag)
+}
+
+// addSession registers a subscriber. kick, if not nil, disconnects it.
+func (room *Room) addSession(proto Protocol, peer string, kick func()) *Session {
+	sess := newSession(proto, peer, kick)
+	room.mu.Lock()
+	room.sessions[sess.ID] = sess
+	room.mu.Unlock()
+	return sess
+}
+
+func (room *Room) removeSession(sess *Session) {
+	if sess == nil {
+		return
+	}
+	room.mu.Lock()
+	delete(room.sessions, sess.ID)
+	room.mu.Unlock()
+}
+
+// touchSession records a request from an HLS/DASH viewer, registering
+// it on first sight. Viewers are keyed by protocol and client IP.
+func (room *Room) touchSession(proto Protocol, peer string) {
+	host := peer
+	if h, _, err := net.SplitHostPort(peer); err == nil {
+		host = h
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	for _, sess := range room.sessions {
+		if sess.Protocol == proto && sess.Peer == host {
+			atomic.StoreInt64(&sess.lastSeen, time.Now().UnixNano())
+			return
+		}
+	}
+	sess := newSession(proto, host, nil)
+	room.sessions[sess.ID] = sess
+}
+
+// Sessions returns the attached subscribers, oldest first. HLS/DASH
+// viewers that stopped polling are dropped on the way.
+func (room *Room) Sessions() []*Session {
+	cutoff := time.Now().Add(-httpSessionIdle).UnixNano()
+	room.mu.Lock()
+	out := make([]*Session, 0, len(room.sessions))
+	for id, sess := range room.sessions {
+		if (sess.Protocol == ProtocolHLS || sess.Protocol == ProtocolDASH) && atomic.LoadInt64(&sess.lastSeen) < cutoff {
+			delete(room.sessions, id)
+			continue
+		}
+		out = append(out, sess)
+	}
+	room.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+// session looks up a subscriber by ID.
+func (room *Room) session(id string) *Session {
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	return room.sessions[id]
+}
+
 func (room *Room) setVideoSequenceHeader(tag *libflv.VideoTag) {
 	room.mu.Lock()
 	room.videoSeqHdr = tag
@@ -61,6 +156,38 @@ func (room *Room) snapshotHeaders() (meta *libflv.MetaTag, video *libflv.VideoTa
 	return room.metaTag, room.videoSeqHdr, room.audioSeqHdr
 }
 
+// sequenceHeader returns the cached sequence header of tag's track.
+func (room *Room) sequenceHeader(tag libflv.Tag) libflv.Tag {
+	_, video, audio := room.snapshotHeaders()
+	switch tag.(type) {
+	case *libflv.VideoTag:
+		if video != nil {
+			return video
+		}
+	case *libflv.AudioTag:
+		if audio != nil {
+			return audio
+		}
+	}
+	return nil
+}
+
+// retimed returns a copy of hdr, a sequence header, at ts; nil if hdr
+// is.
+func retimed(hdr libflv.Tag, ts uint32) libflv.Tag {
+	switch h := hdr.(type) {
+	case *libflv.VideoTag:
+		c := *h
+		c.TimeStamp = ts
+		return &c
+	case *libflv.AudioTag:
+		c := *h
+		c.TimeStamp = ts
+		return &c
+	}
+	return nil
+}
+
 // Close releases the broadcast so every subscriber wakes up with
 // alive=false. Safe to call multiple times.
 func (room *Room) Close() {
@@ -70,6 +197,9 @@ func (room *Room) Close() {
 		return
 	}
 	room.closed = true
+	if room.done != nil {
+		close(room.done)
+	}
 	room.mu.Unlock()
 	//DisAlive() wakes every BroadcastReader with alive=false so the
 	//RTMP/FLV/HLS join goroutines exit cleanly.
@@ -78,107 +208,179 @@ func (room *Room) Close() {
 
 //player join the room
 func (room *Room) RTMPJoin(rtmp *RTMP) {
-	go func() {
+	join := func() {
+		//Taken now: cleanup rewrites what it's made of once the player
+		//leaves.
+		log := rtmp.log()
+		q := rtmp.sendQueueOf()
+		sent := make(chan error, 1)
+		go func() {
+			sent <- q.run(func(tag libflv.Tag) error {
+				mb := MessageBase{
+					rtmp:            rtmp,
+					messageTime:     tag.GetTagInfo().TimeStamp,
+					messageLength:   tag.GetTagInfo().DataSize,
+					messageType:     MessageType(tag.GetTagInfo().TagType),
+					messageStreamID: 0,
+				}
+				var err error
+				if audioTag, oka := tag.(*libflv.AudioTag); oka {
+					err = NewAudioMessage(mb, audioTag).Send()
+				} else if videoTag, okv := tag.(*libflv.VideoTag); okv {
+					err = NewVideoMessage(mb, videoTag).Send()
+				} else if dataTag, okd := tag.(*libflv.MetaTag); okd {
+					err = NewDataMessage(mb, dataTag).Send()
+				}
+				if err == nil {
+					room.bytesOut.add(int(tag.GetTagInfo().DataSize))
+				}
+				return err
+			})
+		}()
+
 		//Backfill sequence headers so a player joining mid-GOP has the
 		//decoder configuration before the first video tag arrives.
 		meta, videoHdr, audioHdr := room.snapshotHeaders()
+		if ok, _ := rtmp.tracks.pass(videoHdr); !ok {
+			videoHdr = nil
+		}
+		if ok, _ := rtmp.tracks.pass(audioHdr); !ok {
+			audioHdr = nil
+		}
 		if meta != nil {
-			mb := MessageBase{
-				rtmp:          rtmp,
-				messageTime:   meta.GetTagInfo().TimeStamp,
-				messageLength: meta.GetTagInfo().DataSize,
-				messageType:   MessageType(meta.GetTagInfo().TagType),
-			}
-			_ = NewDataMessage(mb, meta).Send()
+			_ = q.push(meta)
 		}
 		if videoHdr != nil {
-			mb := MessageBase{
-				rtmp:          rtmp,
-				messageTime:   videoHdr.GetTagInfo().TimeStamp,
-				messageLength: videoHdr.GetTagInfo().DataSize,
-				messageType:   MessageType(videoHdr.GetTagInfo().TagType),
-			}
-			_ = NewVideoMessage(mb, videoHdr).Send()
+			_ = q.push(videoHdr)
 		}
 		if audioHdr != nil {
-			mb := MessageBase{
-				rtmp:          rtmp,
-				messageTime:   audioHdr.GetTagInfo().TimeStamp,
-				messageLength: audioHdr.GetTagInfo().DataSize,
-				messageType:   MessageType(audioHdr.GetTagInfo().TagType),
-			}
-			_ = NewAudioMessage(mb, audioHdr).Send()
+			_ = q.push(audioHdr)
 		}
 
-		var err error
-		gopReader := broadcast.NewBroadcastReader(room.GOP)
+		ended := false
+		sub := room.subscribe()
 		for {
-			p, alive := gopReader.Read()
+			tag, alive := sub.read()
 			if !alive {
-				fmt.Println("the publisher had been exit.")
+				ended = true
 				break
 			}
-			tag := p.(libflv.Tag)
-			fmt.Printf("read packet from gop, now:%v, tag:%+v\n", time.Now(), tag)
-			mb := MessageBase{
-				rtmp:            rtmp,
-				messageTime:     tag.GetTagInfo().TimeStamp,
-				messageLength:   tag.GetTagInfo().DataSize,
-				messageType:     MessageType(tag.GetTagInfo().TagType),
-				messageStreamID: 0,
+			ok, resume := rtmp.tracks.pass(tag)
+			if !ok {
+				continue
 			}
-			if audioTag, oka := tag.(*libflv.AudioTag); oka {
-				err = NewAudioMessage(mb, audioTag).Send()
-			} else if videoTag, okv := tag.(*libflv.VideoTag); okv {
-				err = NewVideoMessage(mb, videoTag).Send()
-			} else if dataTag, okd := tag.(*libflv.MetaTag); okd {
-				err = NewDataMessage(mb, dataTag).Send()
+			if resume {
+				//The track was off: its decoder may never have been set
+				//up. The header goes out at the tag's time.
+				if hdr := retimed(room.sequenceHeader(tag), tag.GetTagInfo().TimeStamp); hdr != nil {
+					_ = q.push(hdr)
+				}
 			}
-			if err != nil {
-				//A write error on a player socket generally means the
-				//player disconnected. Stop pushing — the outer handler
-				//will notice when the TCP read loop sees EOF.
-				fmt.Println("send data error:", err)
-				return
+			if q.push(tag) != nil {
+				break
 			}
 		}
-	}()
+		q.close()
+		err := <-sent
+		switch {
+		case err == errSlowConsumer:
+			log.Warn("player too far behind, disconnecting")
+			_ = rtmp.conn.Close()
+		case err != nil:
+			//A write error on a player socket generally means the
+			//player disconnected; one that timed out left a chunk half
+			//written. Either way the connection is done.
+			log.Debug("send to player failed", liblog.Err(err))
+			_ = rtmp.conn.Close()
+		case ended:
+			log.Debug("publisher gone")
+			_ = (&CommandMessageResponse{
+				MessageBase:     MessageBase{rtmp: rtmp},
+				CommandName:     PLAY,
+				CommandRespName: ON_STATUS,
+				CommandObject: ConnectRespCommandObject{
+					Level:       "status",
+					Code:        "NetStream.Play.UnpublishNotify",
+					Description: "Stream unpublished",
+				},
+			}).Send()
+		}
+	}
+	//Tracked so Shutdown waits for the UnpublishNotify to go out
+	//before it drops the connection.
+	if rtmp.server != nil {
+		rtmp.server.goTracked(&rtmp.server.streams, join)
+	} else {
+		go join()
+	}
 }
 
-func (room *Room) FLVJoin(writer easyio.EasyWriter) {
+// FLVJoin streams room as FLV to writer, for a viewer on conn, until
+// the stream ends or the viewer is gone. Like HTTP-FLV viewers, it
+// goes through the send queue of the room's app, with write deadlines
+// on conn, and shows among the room's sessions with its drop counters.
+// conn may be nil: no deadlines then.
+func (room *Room) FLVJoin(writer easyio.EasyWriter, conn net.Conn) {
+	peer, kick := "", func() {}
+	if conn != nil {
+		peer, kick = conn.RemoteAddr().String(), func() { _ = conn.Close() }
+	}
+	sess := room.addSession(ProtocolFLV, peer, kick)
+	defer room.removeSession(sess)
+	_ = room.flvJoin(writer, nil, newSendQueue(room.sendQueueConfig(), sess, conn))
+}
+
+// flvJoin is FLVJoin of the tracks passing tracks, sent through q. It
+// returns why the viewer is gone, nil if it's the stream that ended.
+func (room *Room) flvJoin(writer easyio.EasyWriter, tracks *trackFilter, q *sendQueue) error {
 	//FLV header + PreviousTagSize0 (always zero).
-	if err := writer.WriteFull([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}); err != nil {
-		return
+	if err := writer.WriteFull([]byte{0x46, 0x4c, 0x56, 0x01, tracks.flvFlags(true, true), 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}); err != nil {
+		return err
 	}
+	sent := make(chan error, 1)
+	go func() {
+		sent <- q.run(func(tag libflv.Tag) error {
+			b := libflv.FLVWrite(tag)
+			if err := writer.WriteFull(b); err != nil {
+				return err
+			}
+			room.bytesOut.add(len(b))
+			return nil
+		})
+	}()
 
 	//Backfill cached sequence headers for mid-GOP joiners.
 	meta, videoHdr, audioHdr := room.snapshotHeaders()
+	if ok, _ := tracks.pass(videoHdr); !ok {
+		videoHdr = nil
+	}
+	if ok, _ := tracks.pass(audioHdr); !ok {
+		audioHdr = nil
+	}
 	if meta != nil {
-		if err := writer.WriteFull(libflv.FLVWrite(meta)); err != nil {
-			return
-		}
+		_ = q.push(meta)
 	}
 	if videoHdr != nil {
-		if err := writer.WriteFull(libflv.FLVWrite(videoHdr)); err != nil {
-			return
-		}
+		_ = q.push(videoHdr)
 	}
 	if audioHdr != nil {
-		if err := writer.WriteFull(libflv.FLVWrite(audioHdr)); err != nil {
-			return
-		}
+		_ = q.push(audioHdr)
 	}
 
-	gopReader := broadcast.NewBroadcastReader(room.GOP)
+	sub := room.subscribe()
 	for {
-		p, alive := gopReader.Read()
+		tag, alive := sub.read()
 		if !alive {
-			fmt.Println("the publisher had been exit.")
-			return
+			break
 		}
-		if err := writer.WriteFull(libflv.FLVWrite(p.(libflv.Tag))); err != nil {
-			//Client disconnected; bail out of the loop.
-			return
+		if ok, _ := tracks.pass(tag); !ok {
+			continue
+		}
+		if q.push(tag) != nil {
+			//Client disconnected or too slow; bail out of the loop.
+			break
 		}
 	}
+	q.close()
+	return <-sent
 }
@@ -1,14 +1,17 @@
 package librtmp
 
 import (
-	"fmt"
 	"io"
 	"net"
+	"net/url"
 
 	"github.com/SmartBrave/Athena/easyio"
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 )
 
 type RTMP struct {
+	conn             net.Conn //nil for pseudo-publishers (SRT); closed to kick
 	readerConn       easyio.EasyReader
 	writerConn       easyio.EasyWriter
 	lastChunk        map[uint32]*Chunk //csid
@@ -20,6 +23,18 @@ type RTMP struct {
 	server           *server
 	playType         string
 	role             connRole
+	session          *Session     //set while playing; see Room.addSession
+	player           *pacedPlayer //set while playing a recording or a DVR window
+	tracks           trackFilter  //receiveAudio/receiveVideo
+	fourCCs          fourCCSet    //enhanced RTMP codecs the peer listed
+	objectEncoding   float64      //0 for AMF0, 3 for AMF3, as negotiated at connect
+	handshakeMode    HandshakeMode
+
+	// connectQuery holds the parameters carried on the connect
+	// command's app field and tcUrl. They're merged into the
+	// publish/play stream-name query before authorization so
+	// credentials work in either place.
+	connectQuery url.Values
 
 	// Peer-advertised flow control state.
 	peerWindowAckSize  uint32
@@ -35,12 +50,14 @@ type RTMP struct {
 
 	// Outbound (client) bookkeeping. connectApp is the app name passed
 	// in the connect cmd object; tcURL is the canonical RTMP URL;
-	// resultCount is incremented each time a _result message is
-	// processed so expectResultUntil can pace the connect/createStream
-	// handshake.
-	connectApp   string
-	tcURL        string
-	resultCount  uint32 //atomic
+	// reply is the last _result, _error or onStatus processed and
+	// replies counts them, so expectReply can pace the
+	// connect/createStream/publish exchange.
+	connectApp string
+	tcURL      string
+	reply      *CommandMessage
+	replies    uint32
+	onTag      func(libflv.Tag) //set while a Conn plays: takes the media instead of a room
 }
 
 type connRole uint8
@@ -53,6 +70,7 @@ const (
 
 func NewRTMP(conn net.Conn, peer string, server *server) (rtmp *RTMP) {
 	return &RTMP{
+		conn:             conn,
 		readerConn:       easyio.NewEasyReader(conn),
 		writerConn:       easyio.NewEasyWriter(conn),
 		lastChunk:        make(map[uint32]*Chunk),
@@ -69,19 +87,20 @@ func (rtmp *RTMP) HandlerServer() {
 
 	err := HandshakeServer(rtmp)
 	if err != nil {
-		fmt.Println("handshake error:", err)
+		rtmp.log().Warn("handshake failed", liblog.Err(err))
 		return
 	}
-	fmt.Println("handshake done...")
+	rtmp.log().Debug("handshake done")
 
 	for {
 		err = ParseMessage(rtmp)
 		if err == io.EOF {
-			fmt.Println("disconnect")
+			rtmp.log().Debug("disconnect")
 			break
 		}
 		if err != nil {
-			fmt.Println("ParseMessage error:", err)
+			rtmp.log().Warn("parse message failed", liblog.Err(err))
+			parseErrors.With("server").Inc()
 			//Parse errors on a TCP stream are usually unrecoverable:
 			//a framing desync leaves us unable to locate the next
 			//chunk boundary. Bail out and let cleanup run.
@@ -96,18 +115,67 @@ func (rtmp *RTMP) HandlerServer() {
 // room from the owning App. For players it's a no-op — their goroutine
 // observes the closed broadcast on its own.
 func (rtmp *RTMP) cleanup() {
+	if rtmp.player != nil {
+		rtmp.player.Stop()
+		if rtmp.room == nil { //a recording
+			rtmp.log().Info("play stop", liblog.Stream(rtmp.player.name))
+			rtmp.server.notify(WebhookPayload{Action: EventStop, App: rtmp.app, Stream: rtmp.player.name, Peer: rtmp.peer})
+		}
+		rtmp.player = nil
+	}
 	if rtmp.room == nil {
 		return
 	}
 	if rtmp.role == rolePublisher {
-		if app, ok := rtmp.server.apps[rtmp.app]; ok {
+		if app, ok := rtmp.server.app(rtmp.app); ok {
 			app.Delete(rtmp.room.RoomID)
 		}
 		rtmp.room.Close()
+		rtmp.log().Info("publish stop")
+		rtmp.server.notify(WebhookPayload{Action: EventUnpublish, App: rtmp.app, Stream: rtmp.room.RoomID, Peer: rtmp.peer})
+	} else if rtmp.role == rolePlayer {
+		rtmp.log().Info("play stop")
+		rtmp.room.removeSession(rtmp.session)
+		rtmp.session = nil
+		rtmp.server.notify(WebhookPayload{Action: EventStop, App: rtmp.app, Stream: rtmp.room.RoomID, Peer: rtmp.peer})
 	}
 	rtmp.room = nil
 }
 
+// log returns the server's logger tagged with whatever is known about
+// this connection so far.
+func (rtmp *RTMP) log() liblog.Logger {
+	if rtmp == nil || rtmp.server == nil {
+		return liblog.Nop
+	}
+	proto := ProtocolRTMP
+	if rtmp.role == rolePublisher && rtmp.room != nil {
+		proto = rtmp.room.protocol //RTSP/SRT pseudo-publishers
+	}
+	fields := []liblog.Field{liblog.Peer(rtmp.peer), liblog.Protocol(string(proto))}
+	if rtmp.app != "" {
+		fields = append(fields, liblog.App(rtmp.app))
+	}
+	if rtmp.room != nil {
+		fields = append(fields, liblog.Stream(rtmp.room.RoomID))
+	}
+	if rtmp.session != nil {
+		fields = append(fields, liblog.Session(rtmp.session.ID))
+	}
+	return rtmp.server.logger.With(fields...)
+}
+
+// kick drops the connection; the read loop then fails and cleanup runs
+// as for any disconnect. Reports false for pseudo-publishers that have
+// no connection of their own (SRT).
+func (rtmp *RTMP) kick() bool {
+	if rtmp.conn == nil {
+		return false
+	}
+	_ = rtmp.conn.Close()
+	return true
+}
+
 // HandlerClient connects outbound: handshakes as client, sends
 // connect → createStream → play, then loops on ParseMessage. Inbound
 // audio/video/data tags are absorbed into the configured Room (set up
@@ -117,23 +185,24 @@ func (rtmp *RTMP) HandlerClient() {
 	defer rtmp.cleanup()
 
 	if err := HandshakeClient(rtmp); err != nil {
-		fmt.Println("client handshake error:", err)
+		rtmp.log().Warn("client handshake failed", liblog.Err(err))
 		return
 	}
 
 	if err := rtmp.runClientCommands(); err != nil {
-		fmt.Println("client command error:", err)
+		rtmp.log().Warn("client command failed", liblog.Err(err))
 		return
 	}
 
 	for {
 		err := ParseMessage(rtmp)
 		if err == io.EOF {
-			fmt.Println("client disconnect")
+			rtmp.log().Info("upstream disconnect")
 			return
 		}
 		if err != nil {
-			fmt.Println("client ParseMessage error:", err)
+			rtmp.log().Warn("client parse message failed", liblog.Err(err))
+			parseErrors.With("client").Inc()
 			return
 		}
 	}
@@ -0,0 +1,193 @@
+package librtmp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/liblog"
+)
+
+// RTMPT tunnels RTMP through HTTP POSTs on the HTTP-FLV listener, for
+// clients on networks that only let HTTP out:
+//
+//	POST /open/1               → the session ID, then "\n"
+//	POST /send/<id>/<seq>      → body: RTMP bytes from the client
+//	POST /idle/<id>/<seq>      → nothing to send, just polling
+//	POST /close/<id>/<seq>     → end of the session
+//
+// Every answer but open's starts with a byte telling the client how
+// long to wait before polling again, 1 when busy and up to 0x21 when
+// idle, followed by the RTMP bytes the server has sent since the last
+// poll. Behind each session, one end of a net.Pipe is served like an
+// accepted RTMP connection; the other is fed the /send bodies and read
+// into the buffer the polls drain.
+const (
+	rtmptContentType = "application/x-fcs"
+	rtmptMaxDelay    = 0x21
+	rtmptIdleTimeout = 30 * time.Second //without a poll, the session is dropped
+	rtmptMaxPending  = 8 << 20          //unpolled bytes before the client counts as gone
+)
+
+type rtmptSession struct {
+	id     string
+	server *server
+	peer   net.Conn //the pipe end the RTMP connection talks to
+	timer  *time.Timer
+
+	mu      sync.Mutex
+	pending bytes.Buffer //sent by the server, not polled yet
+	delay   byte
+	closed  bool
+}
+
+// serveRTMPT answers one RTMPT request; see above.
+func (s *server) serveRTMPT(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	w.Header().Set("Content-Type", rtmptContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	switch {
+	case parts[0] == "open" && len(parts) == 2:
+		sess, err := s.openRTMPT(r.RemoteAddr)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, sess.id+"\n")
+		return
+	case (parts[0] == "send" || parts[0] == "idle" || parts[0] == "close") && len(parts) == 3:
+	default:
+		//Including /fcs/ident2, which Flash sends first and takes a
+		//404 for "no ident".
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.mu.Lock()
+	sess := s.rtmpt[parts[1]]
+	s.mu.Unlock()
+	if sess == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sess.timer.Reset(rtmptIdleTimeout)
+	switch parts[0] {
+	case "close":
+		sess.close()
+		_, _ = w.Write([]byte{0})
+		return
+	case "send":
+		//Blocks until the RTMP connection has read it all.
+		if _, err := io.Copy(sess.peer, r.Body); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	_, _ = w.Write(sess.poll(parts[0] == "send"))
+}
+
+// openRTMPT starts a session, serving its RTMP connection and pumping
+// what that connection sends into the session's buffer.
+func (s *server) openRTMPT(remoteAddr string) (*rtmptSession, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	conn, peer := net.Pipe()
+	sess := &rtmptSession{
+		id:     hex.EncodeToString(id),
+		server: s,
+		peer:   peer,
+		delay:  1,
+	}
+	sess.timer = time.AfterFunc(rtmptIdleTimeout, sess.close)
+	s.mu.Lock()
+	if s.closing() {
+		s.mu.Unlock()
+		sess.timer.Stop()
+		return nil, ErrServerClosed
+	}
+	s.rtmpt[sess.id] = sess
+	s.mu.Unlock()
+
+	if !s.goTracked(&s.workers, sess.pump) {
+		sess.close()
+		return nil, ErrServerClosed
+	}
+	s.serveConn(conn, func() {
+		NewRTMP(conn, remoteAddr, s).HandlerServer()
+		//Ends the pump, and with it the session.
+		_ = conn.Close()
+	})
+	s.logger.Debug("rtmpt open", liblog.Peer(remoteAddr), liblog.F("session", sess.id))
+	return sess, nil
+}
+
+// pump buffers what the RTMP connection sends until the pipe closes.
+func (sess *rtmptSession) pump() {
+	defer sess.close()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := sess.peer.Read(buf)
+		if err != nil {
+			return
+		}
+		sess.mu.Lock()
+		sess.pending.Write(buf[:n])
+		full := sess.pending.Len() > rtmptMaxPending
+		sess.mu.Unlock()
+		if full {
+			sess.server.logger.Warn("rtmpt client stopped polling", liblog.F("session", sess.id))
+			return
+		}
+	}
+}
+
+// poll returns the answer to a send or idle: the delay before the next
+// poll, then everything pending. While the session has nothing to say
+// the delay goes 0x01, 0x03, 0x05, 0x09, 0x11, 0x21, as other servers'
+// do, and it drops back to 1 as soon as it has.
+func (sess *rtmptSession) poll(sent bool) []byte {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	switch {
+	case sent || sess.pending.Len() > 0:
+		sess.delay = 1
+	case sess.delay == 1:
+		sess.delay = 3
+	case sess.delay < rtmptMaxDelay:
+		sess.delay = sess.delay*2 - 1
+		if sess.delay > rtmptMaxDelay {
+			sess.delay = rtmptMaxDelay
+		}
+	}
+	out := make([]byte, 1+sess.pending.Len())
+	out[0] = sess.delay
+	copy(out[1:], sess.pending.Bytes())
+	sess.pending.Reset()
+	return out
+}
+
+// close ends the session and its RTMP connection. Safe to call more
+// than once.
+func (sess *rtmptSession) close() {
+	sess.mu.Lock()
+	if sess.closed {
+		sess.mu.Unlock()
+		return
+	}
+	sess.closed = true
+	sess.mu.Unlock()
+	sess.timer.Stop()
+	_ = sess.peer.Close()
+	s := sess.server
+	s.mu.Lock()
+	delete(s.rtmpt, sess.id)
+	s.mu.Unlock()
+	s.logger.Debug("rtmpt close", liblog.F("session", sess.id))
+}
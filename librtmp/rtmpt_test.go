@@ -0,0 +1,170 @@
+package librtmp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// rtmptPost posts body to rawURL, returning the status and the body of
+// the answer, or 0 if there is none.
+func rtmptPost(rawURL string, body []byte) (int, []byte) {
+	resp, err := http.Post(rawURL, rtmptContentType, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, b
+}
+
+// dialRTMPT opens an RTMPT session at base, http://host:port, and
+// returns a connection tunnelled over it, polling as Flash does, and
+// the session ID. The session ends with the connection, or the test.
+func dialRTMPT(t *testing.T, base string) (net.Conn, string) {
+	code, b := rtmptPost(base+"/open/1", nil)
+	if code != http.StatusOK || !strings.HasSuffix(string(b), "\n") {
+		t.Fatalf("open: %d %q", code, b)
+	}
+	id := strings.TrimSpace(string(b))
+	local, remote := net.Pipe()
+	//What the server sends is handed over by another goroutine, so the
+	//poller never blocks on a client busy writing.
+	received := make(chan []byte, 1024)
+	delays := make(chan byte, 1024)
+	polling := make(chan struct{})
+	t.Cleanup(func() {
+		local.Close()
+		<-polling
+		close(delays)
+		for delay := range delays {
+			if delay < 1 || delay > rtmptMaxDelay {
+				t.Errorf("poll delay %d", delay)
+			}
+		}
+	})
+	go func() {
+		for data := range received {
+			if _, err := remote.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(polling)
+		defer close(received)
+		defer remote.Close()
+		buf := make([]byte, 64<<10)
+		for seq := 1; ; seq++ {
+			_ = remote.SetReadDeadline(time.Now().Add(5 * time.Millisecond))
+			n, err := remote.Read(buf)
+			var ne net.Error
+			if err != nil && !(errors.As(err, &ne) && ne.Timeout()) {
+				rtmptPost(fmt.Sprintf("%s/close/%s/%d", base, id, seq), nil)
+				return
+			}
+			cmd := "idle"
+			if n > 0 {
+				cmd = "send"
+			}
+			code, b := rtmptPost(fmt.Sprintf("%s/%s/%s/%d", base, cmd, id, seq), buf[:n])
+			if code != http.StatusOK || len(b) == 0 {
+				return
+			}
+			select {
+			case delays <- b[0]:
+			default:
+			}
+			if len(b) > 1 {
+				received <- b[1:]
+			}
+		}
+	}()
+	return local, id
+}
+
+func TestRTMPT(t *testing.T) {
+	addr, flvAddr := freeAddr(t), freeAddr(t)
+	srv := NewServer(addr, "live").WithHTTPFlv(flvAddr)
+	runServer(t, srv)
+	base := "http://" + flvAddr
+
+	if code, _ := rtmptPost(base+"/fcs/ident2", nil); code != http.StatusNotFound {
+		t.Errorf("ident2: %d", code)
+	}
+	if code, _ := rtmptPost(base+"/idle/nope/1", nil); code != http.StatusNotFound {
+		t.Errorf("idle of an unknown session: %d", code)
+	}
+
+	//Publish and play both through the tunnel, with the same client
+	//as over TCP.
+	u, _ := url.Parse("rtmpt://" + flvAddr + "/live/x")
+	conn, _ := dialRTMPT(t, base)
+	pub, err := newConn(conn, u, DialOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if err := pub.Publish(""); err != nil {
+		t.Fatal(err)
+	}
+	writeTestStream(t, pub)
+
+	conn, id := dialRTMPT(t, base)
+	play, err := newConn(conn, u, DialOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := play.Play(""); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		tag, err := play.ReadTag()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if video, ok := tag.(*libflv.VideoTag); ok && bytes.Equal(video.VideoData, testKeyframe) {
+			break
+		}
+	}
+	if room := srv.apps["live"].Load("x"); room == nil || len(room.Sessions()) != 1 {
+		t.Error("the player's session is missing")
+	}
+
+	//Closing the player closes its session, and the session its RTMP
+	//connection.
+	play.Close()
+	waitFor(t, "the RTMPT session to close", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return srv.rtmpt[id] == nil
+	})
+	waitFor(t, "the player to leave", func() bool { return len(srv.apps["live"].Load("x").Sessions()) == 0 })
+	if code, _ := rtmptPost(base+"/idle/"+id+"/99", nil); code != http.StatusNotFound {
+		t.Errorf("idle of a closed session: %d", code)
+	}
+}
+
+func TestRTMPTPollDelay(t *testing.T) {
+	sess := &rtmptSession{delay: 1}
+	var delays []byte
+	for i := 0; i < 7; i++ {
+		delays = append(delays, sess.poll(false)[0])
+	}
+	if want := []byte{0x03, 0x05, 0x09, 0x11, 0x21, 0x21, 0x21}; !bytes.Equal(delays, want) {
+		t.Errorf("idle delays % x, want % x", delays, want)
+	}
+	sess.pending.WriteString("x")
+	if out := sess.poll(false); out[0] != 1 || string(out[1:]) != "x" {
+		t.Errorf("busy poll % x", out)
+	}
+}
@@ -1,6 +1,7 @@
 package librtmp
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"net"
@@ -8,6 +9,7 @@ import (
 	"sync/atomic"
 
 	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 	"github.com/sbraveyoung/GGmpeg/librtsp"
 )
 
@@ -35,12 +37,18 @@ func (s *rtspSession) handleAnnounce(req *librtsp.Request, resp *librtsp.Respons
 		resp.Reason = "Bad Request"
 		return resp
 	}
-	a, ok := s.server.apps[app]
+	a, ok := s.server.app(app)
 	if !ok {
 		resp.StatusCode = 404
 		resp.Reason = "Not Found"
 		return resp
 	}
+	if err := s.server.admit(context.Background(), ActionPublish, app, room, parseRTSPQuery(req.URL), s.conn.RemoteAddr().String()); err != nil {
+		s.log().Info("publish rejected", liblog.App(app), liblog.Stream(room), liblog.Err(err))
+		resp.StatusCode = 401
+		resp.Reason = "Unauthorized"
+		return resp
+	}
 	if a.Load(room) != nil {
 		resp.StatusCode = 461
 		resp.Reason = "Stream Already Publishing"
@@ -58,13 +66,19 @@ func (s *rtspSession) handleAnnounce(req *librtsp.Request, resp *librtsp.Respons
 	//path (Room.Close on TCP disconnect) works the same as for real
 	//RTMP publishers.
 	rtmp := &RTMP{
+		conn:   s.conn,
 		peer:   s.conn.RemoteAddr().String(),
 		server: s.server,
 		role:   rolePublisher,
 		app:    app,
 	}
 	rtmp.room = NewRoom(rtmp, room)
+	rtmp.room.protocol = ProtocolRTSP
+	rtmp.room.cache = newGOPCache(a.gopCache)
+	s.server.startDVR(a, rtmp.room)
 	a.Store(room, rtmp.room)
+	s.server.startRecording(a, rtmp.room, publishLive)
+	s.server.startPushes(a, rtmp.room)
 
 	s.app, s.streamID = app, room
 	s.ingest = &rtspIngest{
@@ -74,6 +88,7 @@ func (s *rtspSession) handleAnnounce(req *librtsp.Request, resp *librtsp.Respons
 		videoRA: &librtsp.H264Reassembler{},
 	}
 	s.publishRTMP = rtmp
+	rtmp.log().Info("publish start")
 
 	//Emit the AVC + AAC sequence headers into the GOP so subscribers
 	//that join before any media tag arrives still receive the decoder
@@ -265,10 +280,7 @@ func (s *rtspSession) handleVideoRTP(pkt *librtsp.RTPPacket) {
 		VideoData:     avcc,
 	}
 	vt.DataSize = uint32(len(vt.Data()))
-	if frameType == libflv.KEY_FRAME {
-		s.publishRTMP.room.GOP.Reset()
-	}
-	s.publishRTMP.room.GOP.Write(vt)
+	s.publishRTMP.room.writeTag(vt, frameType == libflv.KEY_FRAME)
 }
 
 func (s *rtspSession) handleAudioRTP(pkt *librtsp.RTPPacket) {
@@ -293,7 +305,7 @@ func (s *rtspSession) handleAudioRTP(pkt *librtsp.RTPPacket) {
 			SoundData:     frame,
 		}
 		at.DataSize = uint32(len(at.Data()))
-		s.publishRTMP.room.GOP.Write(at)
+		s.publishRTMP.room.writeTag(at, false)
 	}
 }
 
@@ -2,17 +2,19 @@ package librtmp
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/SmartBrave/Athena/broadcast"
 	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 	"github.com/sbraveyoung/GGmpeg/librtsp"
 )
 
@@ -33,6 +35,8 @@ type rtspSession struct {
 	streamID   string
 	playing    int32 //atomic — 0 idle, 1 playing
 	recording  int32 //atomic — 0 idle, 1 receiving from publisher
+	admitted   bool  //DESCRIBE passed admit; raise on_stop when the session ends
+	transport  string //"tcp" or "udp" once the first SETUP succeeds; metrics label
 	wmu        sync.Mutex //serialise writes to conn (PLAY goroutine + replies)
 
 	// Negotiated tracks. Each track records the lower interleave
@@ -79,16 +83,34 @@ func newRTSPSession(conn net.Conn, srv *server) *rtspSession {
 	}
 }
 
+// log returns the server's logger tagged with this connection and, once
+// DESCRIBE or ANNOUNCE has resolved it, the stream.
+func (s *rtspSession) log() liblog.Logger {
+	fields := []liblog.Field{liblog.Peer(s.conn.RemoteAddr().String()), liblog.Protocol(string(ProtocolRTSP))}
+	if s.streamID != "" {
+		fields = append(fields, liblog.App(s.app), liblog.Stream(s.streamID))
+	}
+	return s.server.logger.With(fields...)
+}
+
 // run is the per-connection event loop: parse a request, dispatch it,
 // flush a response. Runs until either side closes the TCP connection
 // or PLAY's goroutine reports a write failure.
 func (s *rtspSession) run() {
 	defer s.conn.Close()
+	defer func() {
+		if s.transport != "" {
+			rtspSessions.With(s.transport).Dec()
+		}
+		if s.admitted {
+			s.server.notify(WebhookPayload{Action: EventStop, App: s.app, Stream: s.streamID, Peer: s.conn.RemoteAddr().String()})
+		}
+	}()
 	for {
 		req, err := librtsp.ReadRequest(s.br)
 		if err != nil {
 			if err != io.EOF {
-				fmt.Println("rtsp: read request:", err)
+				s.log().Debug("read request failed", liblog.Err(err))
 			}
 			return
 		}
@@ -161,19 +183,27 @@ func (s *rtspSession) handleDescribe(req *librtsp.Request, resp *librtsp.Respons
 		resp.Reason = "Bad Request"
 		return resp
 	}
-	a, ok := s.server.apps[app]
+	a, ok := s.server.app(app)
 	if !ok {
 		resp.StatusCode = 404
 		resp.Reason = "Not Found"
 		return resp
 	}
-	rm := a.Load(room)
+	if err := s.server.admit(context.Background(), ActionPlay, app, room, parseRTSPQuery(req.URL), s.conn.RemoteAddr().String()); err != nil {
+		s.log().Info("play rejected", liblog.App(app), liblog.Stream(room), liblog.Err(err))
+		resp.StatusCode = 401
+		resp.Reason = "Unauthorized"
+		return resp
+	}
+	rm := s.server.playRoom(a, room, parseRTSPQuery(req.URL))
 	if rm == nil {
+		s.server.notify(WebhookPayload{Action: EventStop, App: app, Stream: room, Peer: s.conn.RemoteAddr().String()})
 		resp.StatusCode = 404
 		resp.Reason = "Not Found"
 		return resp
 	}
 	s.app, s.streamID = app, room
+	s.admitted = true
 
 	sdp := buildSDPFromRoom(rm)
 	if sdp == nil {
@@ -285,6 +315,13 @@ func (s *rtspSession) handleSetup(req *librtsp.Request, resp *librtsp.Response)
 	if s.sessionID == "" {
 		s.sessionID = fmt.Sprintf("%d", time.Now().UnixNano())
 	}
+	if s.transport == "" {
+		s.transport = "udp"
+		if useTCP {
+			s.transport = "tcp"
+		}
+		rtspSessions.With(s.transport).Inc()
+	}
 	if useTCP {
 		resp.Headers.Set("Transport",
 			fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", rtpCh, rtcpCh))
@@ -371,7 +408,7 @@ func (s *rtspSession) handlePlay(req *librtsp.Request, resp *librtsp.Response) *
 		resp.Reason = "Method Not Valid In This State"
 		return resp
 	}
-	a, ok := s.server.apps[s.app]
+	a, ok := s.server.app(s.app)
 	if !ok {
 		resp.StatusCode = 404
 		resp.Reason = "Not Found"
@@ -398,6 +435,11 @@ func (s *rtspSession) handlePlay(req *librtsp.Request, resp *librtsp.Response) *
 // or the TCP connection's write side fails.
 func (s *rtspSession) streamLoop(room *Room) {
 	defer atomic.StoreInt32(&s.playing, 0)
+	sess := room.addSession(ProtocolRTSP, s.conn.RemoteAddr().String(), func() { _ = s.conn.Close() })
+	defer room.removeSession(sess)
+	log := s.server.sessionLogger(s.app, s.streamID, sess)
+	log.Info("play start", liblog.F("transport", s.transport))
+	defer log.Info("play stop")
 
 	//Backfill cached sequence headers as in-band data so any client
 	//that decodes off the wire rather than the SDP fmtp gets the
@@ -407,16 +449,13 @@ func (s *rtspSession) streamLoop(room *Room) {
 		s.sendVideoSeqHeader(videoHdr)
 	}
 
-	gopReader := broadcast.NewBroadcastReader(room.GOP)
+	sub := room.subscribe()
 	for atomic.LoadInt32(&s.playing) == 1 {
-		p, alive := gopReader.Read()
+		tag, alive := sub.read()
 		if !alive {
 			return
 		}
-		tag, ok := p.(libflv.Tag)
-		if !ok {
-			continue
-		}
+		room.bytesOut.add(int(tag.GetTagInfo().DataSize))
 		switch t := tag.(type) {
 		case *libflv.VideoTag:
 			if s.videoChan < 0 {
@@ -575,6 +614,25 @@ func parseRTSPURL(raw string) (string, string) {
 	return parts[0], parts[1]
 }
 
+// parseRTSPQuery returns the query parameters of an RTSP request URL,
+// or an empty set when there are none. Track suffixes that some
+// clients append after the query ("?token=x/trackID=0") are trimmed.
+func parseRTSPQuery(raw string) url.Values {
+	q := strings.Index(raw, "?")
+	if q < 0 {
+		return url.Values{}
+	}
+	rawQuery := raw[q+1:]
+	if slash := strings.Index(rawQuery, "/"); slash >= 0 {
+		rawQuery = rawQuery[:slash]
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return url.Values{}
+	}
+	return values
+}
+
 // parseInterleavedChannels pulls "interleaved=N-M" out of a Transport
 // header. RFC 2326 §12.39 syntax.
 func parseInterleavedChannels(transport string) (rtp, rtcp int, ok bool) {
@@ -0,0 +1,319 @@
+package librtmp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// SendQueueConfig bounds how far an RTMP, HTTP-FLV or WebSocket-FLV
+// viewer of an app's streams may fall behind: the lag is from the
+// oldest media tag it hasn't been sent yet to the newest the room has.
+// Past DropLag its inter frames are dropped up to the next keyframe;
+// past SkipLag everything queued for it is dropped and it starts again
+// at the next keyframe; past CloseLag, or once a single write has
+// taken WriteTimeout, it is disconnected.
+//
+// MaxTags and MaxBytes bound the queue itself, for streams whose
+// timestamps stop moving: past half of either, inter frames are
+// dropped; past either, the queue skips to the next keyframe; past
+// either again before the viewer has taken a single tag, it is
+// disconnected.
+type SendQueueConfig struct {
+	DropLag      Duration `json:"drop_lag"`      //default 3 s
+	SkipLag      Duration `json:"skip_lag"`      //default 6 s
+	CloseLag     Duration `json:"close_lag"`     //default 20 s
+	WriteTimeout Duration `json:"write_timeout"` //default 10 s
+	MaxTags      int      `json:"max_tags"`      //default 4096
+	MaxBytes     int64    `json:"max_bytes"`     //default 32 MiB
+}
+
+// WithSendQueue sets how far appName's viewers may fall behind. See
+// SendQueueConfig.
+func (s *server) WithSendQueue(appName string, cfg SendQueueConfig) *server {
+	if _, ok := s.apps[appName]; !ok {
+		panic("appName does not exist.")
+	}
+	s.apps[appName].sendQueue = &cfg
+	return s
+}
+
+// errSlowConsumer ends a viewer that fell CloseLag behind.
+var errSlowConsumer = errors.New("viewer too far behind")
+
+// sendQueue decouples a viewer from its room: the join loop pushes the
+// room's tags, which drops what the viewer is too slow for, and run
+// writes the rest to the viewer.
+type sendQueue struct {
+	dropLag, skipLag, closeLag, timeout time.Duration
+	maxTags                             int
+	maxBytes                            int64
+	sess                                *Session //nil: no counters
+	conn                                net.Conn //nil: no write deadline
+
+	mu       sync.Mutex
+	tags     []libflv.Tag
+	bytes    int64         //of tags
+	taken    int64         //tags run has taken
+	fullAt   int64         //taken when the queue last filled up, or -1
+	wake     chan struct{} //signalled on every push
+	sending  libflv.Tag    //being written
+	video    bool          //seen a video tag
+	dropping bool          //inter frames dropped up to a keyframe
+	skipping bool          //everything dropped up to a keyframe
+	closed   bool          //nothing more to push
+	err      error
+}
+
+// newSendQueue returns the queue of a viewer of an app with cfg, nil
+// for the defaults, writing to conn.
+func newSendQueue(cfg *SendQueueConfig, sess *Session, conn net.Conn) *sendQueue {
+	q := &sendQueue{
+		dropLag:  3 * time.Second,
+		skipLag:  6 * time.Second,
+		closeLag: 20 * time.Second,
+		timeout:  10 * time.Second,
+		maxTags:  4096,
+		maxBytes: 32 << 20,
+		fullAt:   -1,
+		sess:     sess,
+		conn:     conn,
+		wake:     make(chan struct{}, 1),
+	}
+	if cfg != nil {
+		if cfg.DropLag > 0 {
+			q.dropLag = time.Duration(cfg.DropLag)
+		}
+		if cfg.SkipLag > 0 {
+			q.skipLag = time.Duration(cfg.SkipLag)
+		}
+		if cfg.CloseLag > 0 {
+			q.closeLag = time.Duration(cfg.CloseLag)
+		}
+		if cfg.WriteTimeout > 0 {
+			q.timeout = time.Duration(cfg.WriteTimeout)
+		}
+		if cfg.MaxTags > 0 {
+			q.maxTags = cfg.MaxTags
+		}
+		if cfg.MaxBytes > 0 {
+			q.maxBytes = cfg.MaxBytes
+		}
+	}
+	return q
+}
+
+// sendQueueOf returns the queue of rtmp's play.
+func (rtmp *RTMP) sendQueueOf() *sendQueue {
+	var cfg *SendQueueConfig
+	if rtmp.server != nil {
+		if app, ok := rtmp.server.app(rtmp.app); ok {
+			cfg = app.sendQueue
+		}
+	}
+	return newSendQueue(cfg, rtmp.session, rtmp.conn)
+}
+
+// sendQueueConfig returns the send queue settings of room's app, nil
+// for the defaults.
+func (room *Room) sendQueueConfig() *SendQueueConfig {
+	if p := room.Publisher; p != nil && p.server != nil {
+		if app, ok := p.server.app(p.app); ok {
+			return app.sendQueue
+		}
+	}
+	return nil
+}
+
+// isMedia tells audio and video frames from metadata and sequence
+// headers, which are never dropped nor timed.
+func isMedia(tag libflv.Tag) bool {
+	switch t := tag.(type) {
+	case *libflv.VideoTag:
+		return t.AVCPacketType != libflv.AVC_SEQUENCE_HEADER
+	case *libflv.AudioTag:
+		return t.SoundFormat != libflv.FLV_AUDIO_AAC || t.AACPacketType != libflv.AAC_SEQUENCE_HEADER
+	}
+	return false
+}
+
+func isKeyframe(tag libflv.Tag) bool {
+	video, ok := tag.(*libflv.VideoTag)
+	return ok && video.FrameType == libflv.KEY_FRAME && video.AVCPacketType != libflv.AVC_SEQUENCE_HEADER
+}
+
+// push queues tag, or drops it if the viewer is behind. It returns an
+// error once the viewer is gone: a write failed, or it fell too far
+// behind, in which case its write in progress is cut short.
+func (q *sendQueue) push(tag libflv.Tag) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	if !isMedia(tag) {
+		q.enqueue(tag)
+		return nil
+	}
+	if _, ok := tag.(*libflv.VideoTag); ok {
+		q.video = true
+	}
+	lag := q.lag(tag)
+	full := q.over(1)
+	switch {
+	case lag >= q.closeLag || full && q.fullAt == q.taken:
+		q.err = errSlowConsumer
+		if q.conn != nil {
+			_ = q.conn.SetWriteDeadline(time.Now())
+		}
+		q.signal()
+		return q.err
+	case (lag >= q.skipLag || full) && !q.skipping:
+		if full {
+			q.fullAt = q.taken
+		}
+		kept := q.tags[:0]
+		for _, t := range q.tags {
+			if isMedia(t) {
+				q.bytes -= tagBytes(t)
+				q.drop()
+			} else {
+				kept = append(kept, t)
+			}
+		}
+		for i := len(kept); i < len(q.tags); i++ {
+			q.tags[i] = nil
+		}
+		q.tags = kept
+		//Audio alone has no keyframes: it goes on from the next tag.
+		q.skipping = q.video
+		if q.sess != nil {
+			atomic.AddInt64(&q.sess.skips, 1)
+		}
+	case (lag >= q.dropLag || q.over(2)) && !isKeyframe(tag):
+		if _, ok := tag.(*libflv.VideoTag); ok {
+			q.dropping = true
+		}
+	}
+	if isKeyframe(tag) {
+		q.dropping, q.skipping = false, false
+	}
+	if _, ok := tag.(*libflv.VideoTag); q.skipping || q.dropping && ok {
+		q.drop()
+		return nil
+	}
+	q.enqueue(tag)
+	return nil
+}
+
+// lag returns how far the viewer is behind tag, the newest. Call with
+// mu held.
+func (q *sendQueue) lag(tag libflv.Tag) time.Duration {
+	oldest := q.sending
+	if oldest == nil || !isMedia(oldest) {
+		oldest = nil
+		for _, t := range q.tags {
+			if isMedia(t) {
+				oldest = t
+				break
+			}
+		}
+	}
+	if oldest == nil {
+		return 0
+	}
+	//Signed, for timestamps that wrapped or went back.
+	ms := int32(tag.GetTagInfo().TimeStamp - oldest.GetTagInfo().TimeStamp)
+	if ms < 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// over tells whether the queue holds more than 1/part of MaxTags or
+// MaxBytes. Call with mu held.
+func (q *sendQueue) over(part int) bool {
+	return len(q.tags) >= q.maxTags/part || q.bytes >= q.maxBytes/int64(part)
+}
+
+func tagBytes(tag libflv.Tag) int64 {
+	return int64(tag.GetTagInfo().DataSize)
+}
+
+func (q *sendQueue) enqueue(tag libflv.Tag) {
+	q.tags = append(q.tags, tag)
+	q.bytes += tagBytes(tag)
+	q.signal()
+}
+
+func (q *sendQueue) drop() {
+	if q.sess != nil {
+		atomic.AddInt64(&q.sess.dropped, 1)
+		droppedFrames.With(string(q.sess.Protocol)).Inc()
+	}
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close tells run there's nothing more to push: it returns once it has
+// written what's queued.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+// run writes the queued tags with send, each within the write timeout,
+// until the queue is closed and drained or the viewer is gone, and
+// returns why it's gone.
+func (q *sendQueue) run(send func(libflv.Tag) error) error {
+	for {
+		q.mu.Lock()
+		q.sending = nil
+		for len(q.tags) == 0 && !q.closed && q.err == nil {
+			q.mu.Unlock()
+			<-q.wake
+			q.mu.Lock()
+		}
+		if q.err != nil || len(q.tags) == 0 {
+			err := q.err
+			q.mu.Unlock()
+			return err
+		}
+		tag := q.tags[0]
+		q.tags[0] = nil
+		q.tags = q.tags[1:]
+		q.bytes -= tagBytes(tag)
+		q.taken++
+		q.sending = tag
+		//Under mu, so push cutting the viewer off can't be undone.
+		if q.conn != nil {
+			_ = q.conn.SetWriteDeadline(time.Now().Add(q.timeout))
+		}
+		q.mu.Unlock()
+
+		err := send(tag)
+		if q.conn != nil {
+			_ = q.conn.SetWriteDeadline(time.Time{})
+		}
+		if err != nil {
+			q.mu.Lock()
+			if q.err == nil {
+				q.err = err
+			}
+			err = q.err
+			q.mu.Unlock()
+			return err
+		}
+	}
+}
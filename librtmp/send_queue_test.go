@@ -0,0 +1,188 @@
+package librtmp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SmartBrave/Athena/easyio"
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+func queueVideo(ts uint32, key bool) *libflv.VideoTag {
+	frame := uint8(libflv.INTER_FRAME)
+	if key {
+		frame = libflv.KEY_FRAME
+	}
+	return &libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG, TimeStamp: ts}, FrameType: frame,
+		CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_NALU, VideoData: []byte{0, 0, 0, 1, 0x41}}
+}
+
+func queueAudio(ts uint32) *libflv.AudioTag {
+	return &libflv.AudioTag{TagBase: libflv.TagBase{TagType: libflv.AUDIO_TAG, TimeStamp: ts},
+		SoundFormat: libflv.FLV_AUDIO_AAC, AACPacketType: libflv.AAC_RAW, SoundData: []byte{0x21}}
+}
+
+func TestSendQueue(t *testing.T) {
+	sess := newSession(ProtocolFLV, "10.0.0.1:5000", nil)
+	q := newSendQueue(&SendQueueConfig{
+		DropLag:  Duration(100 * time.Millisecond),
+		SkipLag:  Duration(300 * time.Millisecond),
+		CloseLag: Duration(500 * time.Millisecond),
+	}, sess, nil)
+
+	//Nothing is written meanwhile: the viewer falls further behind
+	//with every tag.
+	for _, tag := range []libflv.Tag{
+		queueVideo(0, true), queueAudio(10), queueVideo(40, false), queueVideo(80, false),
+		queueVideo(120, false), //past DropLag: dropped, up to the next keyframe
+		queueAudio(130),        //audio goes on
+		queueVideo(160, false),
+		queueVideo(200, true), //a keyframe gets through
+		queueVideo(240, false),
+		queueVideo(320, false), //past SkipLag: everything goes
+		queueAudio(330),
+		&libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG, TimeStamp: 340}, FrameType: libflv.KEY_FRAME,
+			CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_SEQUENCE_HEADER}, //but headers
+		queueVideo(400, true), //up to the next keyframe
+		queueAudio(410),
+	} {
+		if err := q.push(tag); err != nil {
+			t.Fatalf("push at %d: %v", tag.GetTagInfo().TimeStamp, err)
+		}
+	}
+	var times []uint32
+	for _, tag := range q.tags {
+		times = append(times, tag.GetTagInfo().TimeStamp)
+	}
+	if want := []uint32{340, 400, 410}; !equalTimes(times, want) {
+		t.Errorf("queued %v, want %v", times, want)
+	}
+	if sess.dropped != 11 || sess.skips != 1 {
+		t.Errorf("dropped %d, skips %d; want 11 and 1", sess.dropped, sess.skips)
+	}
+
+	//Past CloseLag, the viewer is gone.
+	if err := q.push(queueVideo(900, false)); err != errSlowConsumer {
+		t.Fatalf("push past CloseLag = %v", err)
+	}
+	if err := q.run(func(libflv.Tag) error { return nil }); err != errSlowConsumer {
+		t.Errorf("run = %v", err)
+	}
+}
+
+func TestSendQueueCaps(t *testing.T) {
+	sess := newSession(ProtocolFLV, "10.0.0.1:5000", nil)
+	q := newSendQueue(&SendQueueConfig{MaxTags: 8}, sess, nil)
+	//The publisher's clock is stuck: only the caps apply.
+	for _, tag := range []libflv.Tag{
+		queueVideo(0, true), queueVideo(0, false), queueAudio(0), queueVideo(0, false),
+		queueVideo(0, false), //past half: dropped, up to the next keyframe
+		queueAudio(0), queueAudio(0), queueAudio(0), queueAudio(0),
+		queueVideo(0, true), //full: everything queued goes, this keyframe starts again
+		queueAudio(0),
+	} {
+		if err := q.push(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(q.tags) != 2 || !isKeyframe(q.tags[0]) {
+		t.Errorf("queued %d tags, want the keyframe and an audio tag", len(q.tags))
+	}
+	if sess.dropped != 9 || sess.skips != 1 {
+		t.Errorf("dropped %d, skips %d; want 9 and 1", sess.dropped, sess.skips)
+	}
+
+	//Full again before the viewer took anything: it's gone.
+	var err error
+	for i := 0; i < 8 && err == nil; i++ {
+		err = q.push(queueAudio(0))
+	}
+	if err != errSlowConsumer {
+		t.Errorf("push to a stalled viewer = %v", err)
+	}
+
+	//Bytes count the same.
+	q = newSendQueue(&SendQueueConfig{MaxBytes: 100}, nil, nil)
+	big := queueAudio(0)
+	big.DataSize = 60
+	for i := 0; i < 3; i++ {
+		_ = q.push(big)
+	}
+	if len(q.tags) != 1 || q.bytes != 60 {
+		t.Errorf("queued %d tags, %d bytes, want the last one alone", len(q.tags), q.bytes)
+	}
+}
+
+func TestSendQueueDrains(t *testing.T) {
+	q := newSendQueue(nil, nil, nil)
+	for ts := uint32(0); ts < 10; ts++ {
+		_ = q.push(queueAudio(ts))
+	}
+	q.close()
+	n := 0
+	if err := q.run(func(libflv.Tag) error { n++; return nil }); err != nil || n != 10 {
+		t.Errorf("run = %v after %d tags, want nil after 10", err, n)
+	}
+}
+
+func TestSendQueueWriteTimeout(t *testing.T) {
+	//Nobody reads the other end.
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	q := newSendQueue(&SendQueueConfig{WriteTimeout: Duration(50 * time.Millisecond)}, nil, conn)
+	_ = q.push(queueVideo(0, true))
+	start := time.Now()
+	err := q.run(func(tag libflv.Tag) error {
+		_, err := conn.Write(libflv.FLVWrite(tag))
+		return err
+	})
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("run = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("the write took %v to time out", d)
+	}
+	//Pushing is over too.
+	if q.push(queueVideo(40, false)) == nil {
+		t.Error("push after the write failed")
+	}
+}
+
+func TestFLVJoinSendQueue(t *testing.T) {
+	srv := NewServer(":0", "live").WithSendQueue("live", SendQueueConfig{WriteTimeout: Duration(50 * time.Millisecond)})
+	room := NewRoom(&RTMP{server: srv, app: "live"}, "x")
+	for i := 0; i < gopMetaSlots; i++ {
+		room.GOP.WriteMeta(&libflv.MetaTag{TagBase: libflv.TagBase{TagType: libflv.SCRIPT_DATA_TAG}})
+	}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	done := make(chan struct{})
+	go func() {
+		room.FLVJoin(easyio.NewEasyWriter(conn), conn)
+		close(done)
+	}()
+	//The FLV header is read, then nothing.
+	if _, err := io.ReadFull(peer, make([]byte, 13)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the viewer's session", func() bool { return len(room.Sessions()) == 1 })
+	for ts := uint32(0); ; ts += 40 {
+		room.writeTag(queueVideo(ts, ts == 0), ts == 0)
+		select {
+		case <-done:
+			if n := len(room.Sessions()); n != 0 {
+				t.Errorf("%d sessions left after the viewer", n)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if ts > 40*200 {
+			t.Fatal("FLVJoin didn't time out on a viewer that stopped reading")
+		}
+	}
+}
@@ -1,39 +1,86 @@
 package librtmp
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/SmartBrave/Athena/broadcast"
 	"github.com/SmartBrave/Athena/easyerrors"
 	"github.com/SmartBrave/Athena/easyio"
 	"github.com/sbraveyoung/GGmpeg/libdash"
 	"github.com/sbraveyoung/GGmpeg/libhls"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 )
 
 type server struct {
-	rtmpAddress string          //default: ":1935"
-	flvAddress  string          //default: ""
-	hlsAddress  string          //default: ""
-	rtspAddress string          //default: ""
-	apps        map[string]*App //appName, roomID, *room
-	pulls       []pullSpec      //configured upstreams to pull on Handler() startup
-	srtSpecs    []srtSpec       //configured SRT publish endpoints
+	rtmpAddress  string          //default: ":1935"
+	flvAddress   string          //default: ""
+	hlsAddress   string          //default: ""
+	rtspAddress  string          //default: ""
+	adminAddress string          //default: ""
+	rtmpsAddress string          //default: ""
+	rtmpsTLS     *tls.Config     //certificates of the RTMPS listener
+	appsMu       sync.RWMutex    //guards apps once Run starts; see Reload
+	apps         map[string]*App //appName, roomID, *room
+	pulls        []pullSpec      //configured upstreams to pull when Run starts
+	pushes       []pushSpec      //destinations to republish rooms to; guarded by mu once Run starts
+	srtSpecs     []srtSpec       //configured SRT publish endpoints
+	authorizer   Authorizer      //nil: accept every publish/play
+	webhooks     *webhooks       //nil: no lifecycle callbacks
+	logger       liblog.Logger   //default: liblog.Nop
+	config       *Config         //set by NewServerFromConfig; Reload diffs against it
+	vods         *vodCache       //indexes of the recordings played
+	metrics      *serverMetrics  //the series exported from the apps
+
+	// The apps as the With* options set them up, kept by the first
+	// Reload of a server not built from a config; guarded by reloadMu.
+	builtApps map[string]AppConfig
+
+	// Lifecycle; see Run and Shutdown.
+	mu           sync.Mutex
+	running      bool
+	done         chan struct{} //closed once Shutdown starts
+	shutdownOnce sync.Once
+	listeners    []io.Closer           //RTMP/RTSP TCP sockets; SRT ones are in srtRelays
+	httpServers  []*http.Server        //HTTP-FLV, HLS/DASH, admin
+	conns        map[net.Conn]struct{} //accepted RTMP/RTSP and pull connections
+	workers      sync.WaitGroup        //accept loops, connections, pulls
+	streams      sync.WaitGroup        //RTMP joins and HLS/DASH segmenters
+
+	rtmpt     map[string]*rtmptSession //RTMPT sessions by ID; guarded by mu
+	edgePulls map[string]*edgePull     //by app/stream; guarded by mu
+
+	// Running relays, by spec, so Reload can stop them; guarded by mu.
+	reloadMu  sync.Mutex //serialises Reload
+	pullStops map[pullSpec]chan struct{}
+	srtRelays map[srtSpec]*srtRelay
+	pushers   map[*pusher]struct{}
 }
 
 func NewServer(address string, apps ...string) (s *server) {
 	s = &server{
 		rtmpAddress: address,
 		apps:        make(map[string]*App, len(apps)),
+		logger:      liblog.Nop,
+		done:        make(chan struct{}),
+		conns:       map[net.Conn]struct{}{},
+		pullStops:   map[pullSpec]chan struct{}{},
+		srtRelays:   map[srtSpec]*srtRelay{},
+		pushers:     map[*pusher]struct{}{},
+		rtmpt:       map[string]*rtmptSession{},
+		edgePulls:   map[string]*edgePull{},
+		vods:        newVODCache(),
+		metrics:     newServerMetrics(),
 	}
 	for _, appName := range apps {
 		s.apps[appName] = NewApp(appName)
@@ -41,6 +88,22 @@ func NewServer(address string, apps ...string) (s *server) {
 	return s
 }
 
+// WithLogger routes the server's logs, and those of the HLS/DASH muxers
+// and SRT listeners it creates, to l. The default is silent.
+func (s *server) WithLogger(l liblog.Logger) *server {
+	s.logger = liblog.OrNop(l)
+	return s
+}
+
+// WithRTMPS opens a second RTMP listener, on address, speaking RTMP
+// over TLS with config: rtmps://host:port/<app>/<stream>. Everything
+// past the TLS handshake is the same as on the plain listener.
+func (s *server) WithRTMPS(address string, config *tls.Config) *server {
+	s.rtmpsAddress = address
+	s.rtmpsTLS = config
+	return s
+}
+
 func (s *server) WithHTTPFlv(address string) *server {
 	s.flvAddress = address
 	return s
@@ -74,7 +137,7 @@ func (s *server) WithRTSP(address string) *server {
 	return s
 }
 
-// WithRTMPPull schedules an outbound RTMP pull. On Handler() start the
+// WithRTMPPull schedules an outbound RTMP pull. When Run starts the
 // server connects to remoteURL, performs connect→createStream→play,
 // and forwards every received audio/video/data tag into the local
 // apps[localApp]/rooms[localStream] broadcast — so HTTP-FLV / HLS /
@@ -89,6 +152,24 @@ func (s *server) WithRTMPPull(remoteURL, localApp, localStream string) *server {
 	return s
 }
 
+// WithRTMPPush republishes every room of localApp whose stream ID
+// matches localStream, a name or a path.Match pattern such as "*", to
+// each of remoteURLs, the way encoders restream to several platforms.
+// A URL without a stream (rtmp://host/app) publishes under the room's
+// own stream ID. Each destination connects when a matching room is
+// published, reconnects on its own with exponential backoff up to
+// 30 s, and stops when the room does; see Pushes for their status.
+func (s *server) WithRTMPPush(localApp, localStream string, remoteURLs ...string) *server {
+	for _, remoteURL := range remoteURLs {
+		s.pushes = append(s.pushes, pushSpec{
+			app:       localApp,
+			stream:    localStream,
+			remoteURL: remoteURL,
+		})
+	}
+	return s
+}
+
 // WithSRT enables a UDP-based SRT (Live mode, no encryption) listener
 // on the given address. When a publisher connects with `ffmpeg -f
 // mpegts -c copy -f srt 'srt://host:port?streamid=...'`, the
@@ -103,6 +184,24 @@ func (s *server) WithSRT(address, localApp, localStream string) *server {
 	return s
 }
 
+// WithAuthorizer installs a policy consulted on every publish and play
+// attempt, whatever the protocol. See Authorizer for how a rejection
+// surfaces on each wire.
+func (s *server) WithAuthorizer(fn Authorizer) *server {
+	s.authorizer = fn
+	return s
+}
+
+// WithToken requires every publish and play on appName to carry a
+// valid signed-URL token. See TokenConfig for the signature format.
+func (s *server) WithToken(appName string, cfg TokenConfig) *server {
+	if _, ok := s.apps[appName]; !ok {
+		panic("appName does not exist.")
+	}
+	s.apps[appName].token = &cfg
+	return s
+}
+
 func (s *server) SetHlsMode(appName string, mode libhls.HLS_MODE) *server {
 	if _, ok := s.apps[appName]; !ok {
 		panic("appName does not exist.")
@@ -121,83 +220,67 @@ func (s *server) SetHlsDir(appName string, dir string) *server {
 	return s
 }
 
-func (s *server) Handler() error {
-	wg := &sync.WaitGroup{}
-	if s.flvAddress != "" {
-		wg.Add(1)
-		go func() {
-			if err := s.handleHTTPFlv(wg); err != nil {
-				fmt.Println("handleHTTPFlv error:", err)
-				os.Exit(1)
-			}
-		}()
-	}
-
-	if s.hlsAddress != "" {
-		wg.Add(1)
-		go func() {
-			if err := s.handleHls(wg); err != nil {
-				fmt.Println("handleHls error:", err)
-				os.Exit(1)
-			}
-		}()
-	}
-
-	if s.rtspAddress != "" {
-		wg.Add(1)
-		go func() {
-			if err := s.handleRTSP(wg); err != nil {
-				fmt.Println("handleRTSP error:", err)
-				os.Exit(1)
-			}
-		}()
-	}
-	wg.Wait()
+// app returns the named app. Safe to call while Reload swaps apps.
+func (s *server) app(name string) (*App, bool) {
+	s.appsMu.RLock()
+	defer s.appsMu.RUnlock()
+	app, ok := s.apps[name]
+	return app, ok
+}
 
-	//Bring up SRT listeners (one per WithSRT call). Each owns a UDP
-	//socket and dispatches to its own bridge.
-	for i := range s.srtSpecs {
-		startSRT(s, s.srtSpecs[i])
-	}
-
-	//Schedule outbound pulls. Each gets its own goroutine that
-	//reconnects with exponential backoff if the upstream drops.
-	for i := range s.pulls {
-		spec := s.pulls[i]
-		go func() {
-			backoff := time.Second
-			for {
-				pc := newPullClient(s, spec)
-				if err := pc.Run(); err != nil {
-					fmt.Printf("rtmp pull %s: %v\n", spec.remoteURL, err)
-				}
-				time.Sleep(backoff)
-				if backoff < 30*time.Second {
-					backoff *= 2
-				}
-			}
-		}()
+// appList returns a snapshot of the configured apps, sorted by name.
+func (s *server) appList() []*App {
+	s.appsMu.RLock()
+	apps := make([]*App, 0, len(s.apps))
+	for _, app := range s.apps {
+		apps = append(apps, app)
 	}
+	s.appsMu.RUnlock()
+	sort.Slice(apps, func(i, j int) bool { return apps[i].appName < apps[j].appName })
+	return apps
+}
 
-	rtmpListener, err := newTCPListener(s.rtmpAddress)
-	if err != nil {
-		fmt.Println("New RTMP listener error:", err)
-		return err
-	}
+// Handler runs the server until a listener fails. It is Run with a
+// context that is never cancelled; use Run and Shutdown to stop it.
+func (s *server) Handler() error {
+	return s.Run(context.Background())
+}
 
+// serveRTMP accepts RTMP connections until l is closed, over TLS with
+// config unless it is nil.
+func (s *server) serveRTMP(l *net.TCPListener, config *tls.Config) error {
 	for {
-		var err1, err2 error
-		conn, err1 := rtmpListener.AcceptTCP()
-		if err := easyerrors.HandleMultiError(easyerrors.Simple(), err1, err2); err != nil {
-			fmt.Println("error:", err)
+		tcpConn, err := l.AcceptTCP()
+		if err != nil {
+			if s.closing() {
+				return nil
+			}
+			s.logger.Warn("rtmp accept failed", liblog.Err(err))
 			continue
 		}
-
+		var conn net.Conn = tcpConn
+		if config != nil {
+			//The TLS handshake runs on the first read, in the
+			//connection's own goroutine.
+			conn = tls.Server(tcpConn, config)
+		}
 		peer := conn.RemoteAddr().String()
-		go NewRTMP(conn, peer, s).HandlerServer()
+		s.serveConn(conn, NewRTMP(conn, peer, s).HandlerServer)
 	}
 }
 
+// sessionLogger tags the server's logger with everything that
+// identifies one subscriber.
+func (s *server) sessionLogger(app, stream string, sess *Session) liblog.Logger {
+	return s.logger.With(
+		liblog.App(app),
+		liblog.Stream(stream),
+		liblog.Peer(sess.Peer),
+		liblog.Protocol(string(sess.Protocol)),
+		liblog.Session(sess.ID),
+	)
+}
+
 // parseFlvURL normalises /app/stream.flv? paths into (appName, roomID).
 // Query strings are stripped and the ".flv" suffix must be present.
 func parseFlvURL(rawPath string) (appName, roomID string, ok bool) {
@@ -221,14 +304,15 @@ func parseFlvURL(rawPath string) (appName, roomID string, ok bool) {
 	return appName, roomID, true
 }
 
-func (s *server) handleHTTPFlv(wg *sync.WaitGroup) error {
-	flvListener, err := newTCPListener(s.flvAddress)
-	if err != nil {
-		fmt.Println("New flv listener error:", err)
-		return err
-	}
+// flvMux serves HTTP-FLV and WebSocket-FLV, and tunnels RTMPT.
+func (s *server) flvMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		//RTMPT clients POST; players GET.
+		if r.Method == http.MethodPost {
+			s.serveRTMPT(w, r)
+			return
+		}
 		//http://{domain}:{port}/{app}/{roomID}.flv[?query]
 		appName, roomID, ok := parseFlvURL(r.URL.Path)
 		if !ok {
@@ -236,14 +320,31 @@ func (s *server) handleHTTPFlv(wg *sync.WaitGroup) error {
 			return
 		}
 
-		app, ok := s.apps[appName]
+		app, ok := s.app(appName)
 		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		room := app.Load(roomID)
+		if err := s.admit(r.Context(), ActionPlay, appName, roomID, r.URL.Query(), r.RemoteAddr); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		//on_play went out: on_stop follows whatever happens next.
+		defer s.notify(WebhookPayload{Action: EventStop, App: appName, Stream: roomID, Peer: r.RemoteAddr})
+		//?only=audio|video drops the other track.
+		tracks, err := parseOnly(r.URL.Query().Get("only"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		room := s.playRoom(app, roomID, r.URL.Query())
 		if room == nil {
-			w.WriteHeader(http.StatusNotFound)
+			media, ok := s.openVOD(app, roomID)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			s.serveVODFLV(w, r, media, tracks)
 			return
 		}
 
@@ -253,10 +354,15 @@ func (s *server) handleHTTPFlv(wg *sync.WaitGroup) error {
 		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
 			ws, err := upgradeWebSocket(w, r)
 			if err != nil {
-				fmt.Println("websocket upgrade error:", err)
+				s.logger.Warn("websocket upgrade failed", liblog.App(appName), liblog.Stream(roomID), liblog.Peer(r.RemoteAddr), liblog.Err(err))
 				return
 			}
 			defer ws.Close()
+			sess := room.addSession(ProtocolWS, r.RemoteAddr, func() { _ = ws.conn.Close() })
+			defer room.removeSession(sess)
+			log := s.sessionLogger(appName, roomID, sess)
+			log.Info("play start")
+			defer log.Info("play stop")
 			stop := make(chan struct{})
 			//Drain client-originated frames (ping/close) in the
 			//background so the OS-level read buffer never stalls the
@@ -264,7 +370,9 @@ func (s *server) handleHTTPFlv(wg *sync.WaitGroup) error {
 			go ws.servePings(stop)
 			done := make(chan struct{})
 			go func() {
-				room.FLVJoin(easyio.NewEasyWriter(&wsWriter{ws: ws}))
+				if err := room.flvJoin(easyio.NewEasyWriter(&wsWriter{ws: ws}), tracks, newSendQueue(app.sendQueue, sess, ws.conn)); err == errSlowConsumer {
+					log.Warn("player too far behind, disconnecting")
+				}
 				close(done)
 			}()
 			select {
@@ -285,10 +393,23 @@ func (s *server) handleHTTPFlv(wg *sync.WaitGroup) error {
 		//tag via the wrapped writer below.
 
 		flusher, _ := w.(http.Flusher)
-		room.FLVJoin(newFlushingWriter(w, flusher))
+		kw := &kickableWriter{w: &flushingWriter{w: w, f: flusher}}
+		sess := room.addSession(ProtocolFLV, r.RemoteAddr, kw.kick)
+		defer room.removeSession(sess)
+		log := s.sessionLogger(appName, roomID, sess)
+		log.Info("play start")
+		defer log.Info("play stop")
+		if start := r.URL.Query().Get("start"); start != "" && room.dvr != nil {
+			room.dvrFLVJoin(easyio.NewEasyWriter(kw), start, tracks, r.Context().Done())
+			return
+		}
+		//The connection, for write deadlines; see listen.
+		conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+		if err := room.flvJoin(easyio.NewEasyWriter(kw), tracks, newSendQueue(app.sendQueue, sess, conn)); err == errSlowConsumer {
+			log.Warn("player too far behind, disconnecting")
+		}
 	})
-	wg.Done()
-	return http.Serve(flvListener, mux)
+	return mux
 }
 
 // flushingWriter wraps a http.ResponseWriter so every write triggers a
@@ -298,10 +419,6 @@ type flushingWriter struct {
 	f http.Flusher
 }
 
-func newFlushingWriter(w http.ResponseWriter, f http.Flusher) easyio.EasyWriter {
-	return easyio.NewEasyWriter(&flushingWriter{w: w, f: f})
-}
-
 func (fw *flushingWriter) Write(p []byte) (int, error) {
 	n, err := fw.w.Write(p)
 	if fw.f != nil {
@@ -328,12 +445,8 @@ func parseHlsURL(rawPath string) (appName, roomID, file string, ok bool) {
 	return appName, roomID, file, true
 }
 
-func (s *server) handleHls(wg *sync.WaitGroup) error {
-	hlsListener, err := newTCPListener(s.hlsAddress)
-	if err != nil {
-		fmt.Println("New hls listener error:", err)
-		return err
-	}
+// hlsMux serves HLS playlists and segments, and DASH when enabled.
+func (s *server) hlsMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		//http://{domain}:{port}/{app}/{roomID}/index.m3u8
@@ -344,26 +457,50 @@ func (s *server) handleHls(wg *sync.WaitGroup) error {
 			return
 		}
 
-		app, ok := s.apps[appName]
+		app, ok := s.app(appName)
 		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		room := app.Load(roomID)
+		//Playlists and segments are both checked: a leaked segment URL
+		//shouldn't be any more useful than a leaked playlist URL.
+		if err := s.authorize(r.Context(), ActionPlay, appName, roomID, r.URL.Query(), r.RemoteAddr); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		room := s.playRoom(app, roomID, r.URL.Query())
 		if room == nil {
+			if media, ok := s.openVOD(app, roomID); ok {
+				s.serveVODHLS(w, r, app, media, file)
+				return
+			}
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
+		//The audio-only rendition: audio.m3u8, or index.m3u8?only=audio,
+		//and its <roomID>-audio-<seq>.ts segments.
+		if file == "audio.m3u8" || file == "index.m3u8" && r.URL.Query().Get("only") == "audio" ||
+			strings.HasPrefix(file, roomID+"-audio-") && strings.HasSuffix(file, ".ts") {
+			hls := s.audioHLS(app, room, strings.HasSuffix(file, ".m3u8"))
+			if hls == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			room.touchSession(ProtocolHLS, r.RemoteAddr)
+			s.serveHLS(w, r, app, hls, file)
+			return
+		}
+
 		hls := app.LoadHLS(roomID)
 		if hls == nil {
 			//DELAY mode: lazy-start the transcoder on first playlist
 			//hit so no-one is paying for HLS segmentation when no viewer
 			//is attached.
 			if app.hlsMode == libhls.DELAY && strings.HasSuffix(file, ".m3u8") {
-				hls = libhls.NewHls().WithStreamID(roomID).WithDir(app.hlsDir)
+				hls = s.newHLS(app, roomID)
 				app.StoreHLS(roomID, hls)
-				go hls.Start(broadcast.NewBroadcastReader(room.GOP))
+				s.startHLS(hls, room)
 				hls.WaitFirstSegment()
 			} else {
 				w.WriteHeader(http.StatusNotFound)
@@ -379,69 +516,82 @@ func (s *server) handleHls(wg *sync.WaitGroup) error {
 			strings.HasSuffix(file, ".m4s"):
 			dash := app.LoadDASH(roomID)
 			if dash == nil && app.dashEnabled {
-				dash = libdash.NewDASH().WithStreamID(roomID).WithDir(app.dashDir)
+				dash = s.newDASH(app, roomID)
 				app.StoreDASH(roomID, dash)
-				go dash.Start(broadcast.NewBroadcastReader(room.GOP))
+				s.startDASH(dash, room)
 				dash.WaitFirstSegment()
 			}
 			if dash == nil {
 				w.WriteHeader(http.StatusNotFound)
 				return
 			}
-			s.serveDASH(w, r, dash, file)
+			room.touchSession(ProtocolDASH, r.RemoteAddr)
+			forward := ""
+			if app.token != nil {
+				forward = tokenQuery(r.URL.Query())
+			}
+			s.serveDASH(w, r, dash, file, forward)
 			return
 		}
 
-		switch {
-		case strings.HasSuffix(file, ".m3u8"):
-			//LL-HLS blocking playlist reload: clients append
-			//_HLS_msn=<seq>&_HLS_part=<idx> to ask the server to delay
-			//the response until that media-sequence/part has been
-			//produced. Falls back to a normal (non-blocking) reply
-			//when those params are absent or the segmenter doesn't
-			//have LL enabled.
-			q := r.URL.Query()
-			var playlist []byte
-			if msnStr := q.Get("_HLS_msn"); msnStr != "" {
-				msn, _ := strconv.Atoi(msnStr)
-				part, _ := strconv.Atoi(q.Get("_HLS_part"))
-				//Apple recommends timeout ~= 3 * PART-TARGET; use 3 s
-				//as a safe floor so even non-LL mode answers promptly.
-				timeout := 3 * hls.PartTargetDur()
-				if timeout < time.Second {
-					timeout = time.Second
-				}
-				playlist = hls.WaitForPlaylist(msn, part, timeout)
-			} else {
-				playlist = hls.Playlist()
-			}
-			if len(playlist) == 0 {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Cache-Control", "no-cache")
-			_, _ = w.Write(playlist)
-		case strings.HasSuffix(file, ".ts"):
-			//Resolve and re-clean the path under the segment dir to
-			//defeat path traversal attempts.
-			requested := filepath.Join(hls.Dir(), file)
-			rel, err := filepath.Rel(hls.Dir(), requested)
-			if err != nil || strings.HasPrefix(rel, "..") {
-				w.WriteHeader(http.StatusForbidden)
-				return
+		room.touchSession(ProtocolHLS, r.RemoteAddr)
+		s.serveHLS(w, r, app, hls, file)
+	})
+	return mux
+}
+
+// serveHLS answers a playlist or segment request of hls.
+func (s *server) serveHLS(w http.ResponseWriter, r *http.Request, app *App, hls *libhls.HLS, file string) {
+	switch {
+	case strings.HasSuffix(file, ".m3u8"):
+		//LL-HLS blocking playlist reload: clients append
+		//_HLS_msn=<seq>&_HLS_part=<idx> to ask the server to delay
+		//the response until that media-sequence/part has been
+		//produced. Falls back to a normal (non-blocking) reply
+		//when those params are absent or the segmenter doesn't
+		//have LL enabled.
+		q := r.URL.Query()
+		var playlist []byte
+		if msnStr := q.Get("_HLS_msn"); msnStr != "" {
+			msn, _ := strconv.Atoi(msnStr)
+			part, _ := strconv.Atoi(q.Get("_HLS_part"))
+			//Apple recommends timeout ~= 3 * PART-TARGET; use 3 s
+			//as a safe floor so even non-LL mode answers promptly.
+			timeout := 3 * hls.PartTargetDur()
+			if timeout < time.Second {
+				timeout = time.Second
 			}
-			w.Header().Set("Content-Type", "video/mp2t")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Cache-Control", "max-age=3600")
-			http.ServeFile(w, r, requested)
-		default:
+			playlist = hls.WaitForPlaylist(msn, part, timeout)
+		} else {
+			playlist = hls.Playlist()
+		}
+		if len(playlist) == 0 {
 			w.WriteHeader(http.StatusNotFound)
+			return
 		}
-	})
-	wg.Done()
-	return http.Serve(hlsListener, mux)
+		if app.token != nil {
+			playlist = libhls.AppendQuery(playlist, tokenQuery(q))
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write(playlist)
+	case strings.HasSuffix(file, ".ts"):
+		//Resolve and re-clean the path under the segment dir to
+		//defeat path traversal attempts.
+		requested := filepath.Join(hls.Dir(), file)
+		rel, err := filepath.Rel(hls.Dir(), requested)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		http.ServeFile(w, r, requested)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
 }
 
 // serveDASH handles the three URL shapes a DASH player asks for:
@@ -451,7 +601,7 @@ func (s *server) handleHls(wg *sync.WaitGroup) error {
 // Both file types are static under dash.Dir() so http.ServeFile is the
 // right tool — and it handles Range requests for free, which is useful
 // if/when we add CMAF byte-range chunked-transfer mode.
-func (s *server) serveDASH(w http.ResponseWriter, r *http.Request, dash *libdash.DASH, file string) {
+func (s *server) serveDASH(w http.ResponseWriter, r *http.Request, dash *libdash.DASH, file, forward string) {
 	switch {
 	case file == "index.mpd":
 		mpd := dash.Manifest()
@@ -459,6 +609,7 @@ func (s *server) serveDASH(w http.ResponseWriter, r *http.Request, dash *libdash
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		mpd = libdash.AppendQuery(mpd, forward)
 		w.Header().Set("Content-Type", "application/dash+xml")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Cache-Control", "no-cache")
@@ -488,21 +639,18 @@ func (s *server) serveDASH(w http.ResponseWriter, r *http.Request, dash *libdash
 	}
 }
 
-// handleRTSP runs the RTSP TCP listener. Each accepted connection
-// becomes one rtspSession running in its own goroutine.
-func (s *server) handleRTSP(wg *sync.WaitGroup) error {
-	listener, err := newTCPListener(s.rtspAddress)
-	if err != nil {
-		fmt.Println("New RTSP listener error:", err)
-		return err
-	}
-	wg.Done()
+// serveRTSP accepts RTSP connections until l is closed. Each one
+// becomes an rtspSession running in its own goroutine.
+func (s *server) serveRTSP(l *net.TCPListener) error {
 	for {
-		conn, err := listener.AcceptTCP()
+		conn, err := l.AcceptTCP()
 		if err != nil {
+			if s.closing() {
+				return nil
+			}
 			return err
 		}
-		go newRTSPSession(conn, s).run()
+		s.serveConn(conn, newRTSPSession(conn, s).run)
 	}
 }
 
@@ -0,0 +1,112 @@
+package librtmp
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Protocol names the wire a publisher or subscriber is using.
+type Protocol string
+
+const (
+	ProtocolRTMP Protocol = "rtmp"
+	ProtocolFLV  Protocol = "flv"
+	ProtocolWS   Protocol = "ws-flv"
+	ProtocolHLS  Protocol = "hls"
+	ProtocolDASH Protocol = "dash"
+	ProtocolRTSP Protocol = "rtsp"
+	ProtocolSRT  Protocol = "srt"
+)
+
+// httpSessionIdle is how long an HLS/DASH viewer stays listed after its
+// last request. Those protocols have no connection to watch, so a
+// viewer is "present" while it keeps polling the playlist.
+const httpSessionIdle = 30 * time.Second
+
+var sessionSeq uint64 //atomic
+
+// Session is one subscriber attached to a Room.
+type Session struct {
+	ID       string
+	Protocol Protocol
+	Peer     string
+	Start    time.Time
+
+	lastSeen int64  //unix nanoseconds, atomic; HLS/DASH only
+	kick     func() //nil: the session can't be disconnected server-side
+	dropped  int64  //atomic: media tags dropped for being behind; see sendQueue
+	skips    int64  //atomic: times the queue was dropped up to a keyframe
+}
+
+func newSession(proto Protocol, peer string, kick func()) *Session {
+	now := time.Now()
+	return &Session{
+		ID:       strconv.FormatUint(atomic.AddUint64(&sessionSeq, 1), 10),
+		Protocol: proto,
+		Peer:     peer,
+		Start:    now,
+		lastSeen: now.UnixNano(),
+		kick:     kick,
+	}
+}
+
+// errKicked is returned by kickableWriter once its session was kicked.
+var errKicked = errors.New("session kicked")
+
+// kickableWriter fails every write after kick(), which ends a Join
+// loop on the next tag. Used for HTTP-FLV, where the handler can't
+// close the underlying connection itself.
+type kickableWriter struct {
+	w      io.Writer
+	kicked int32 //atomic
+}
+
+func (kw *kickableWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&kw.kicked) != 0 {
+		return 0, errKicked
+	}
+	return kw.w.Write(p)
+}
+
+func (kw *kickableWriter) kick() { atomic.StoreInt32(&kw.kicked, 1) }
+
+// rateMeter counts bytes and keeps the rate over the last complete
+// one-second window.
+type rateMeter struct {
+	mu          sync.Mutex
+	total       int64
+	windowStart time.Time
+	windowBytes int64
+	bps         float64 //bits per second over the last full window
+}
+
+func (m *rateMeter) add(n int) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total += int64(n)
+	if m.windowStart.IsZero() {
+		m.windowStart = now
+	}
+	m.windowBytes += int64(n)
+	if elapsed := now.Sub(m.windowStart); elapsed >= time.Second {
+		m.bps = float64(m.windowBytes*8) / elapsed.Seconds()
+		m.windowStart = now
+		m.windowBytes = 0
+	}
+}
+
+// snapshot returns the byte total and the current bitrate. A meter
+// that hasn't seen data for two windows reports 0 bps.
+func (m *rateMeter) snapshot() (total int64, bps float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.windowStart) > 2*time.Second {
+		return m.total, 0
+	}
+	return m.total, m.bps
+}
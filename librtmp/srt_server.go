@@ -1,12 +1,15 @@
 package librtmp
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"net"
 	"sync"
 	"time"
 
 	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 	"github.com/sbraveyoung/GGmpeg/libsrt"
 )
 
@@ -41,9 +44,16 @@ type srtBridge struct {
 	cachedPPS          []byte
 }
 
-// startSRT installs the listener; called from server.Handler() once
-// per WithSRT spec.
-func startSRT(srv *server, spec srtSpec) {
+// srtRelay is one running WithSRT listener, kept so Reload can stop it.
+type srtRelay struct {
+	listener *libsrt.Listener
+	bridge   *srtBridge
+	stopped  chan struct{} //closed by stopSRTRelay before the listener
+	done     chan struct{} //closed once listener.Run has returned
+}
+
+// startSRT opens the listener for one WithSRT spec; Run drives it.
+func startSRT(srv *server, spec srtSpec) (*srtRelay, error) {
 	br := &srtBridge{
 		spec:   spec,
 		server: srv,
@@ -54,14 +64,70 @@ func startSRT(srv *server, spec srtSpec) {
 
 	listener, err := libsrt.Listen(spec.address, spec.streamID, br.onData)
 	if err != nil {
-		fmt.Printf("srt listen %s: %v\n", spec.address, err)
-		return
+		return nil, err
 	}
-	go func() {
-		if err := listener.Run(); err != nil {
-			fmt.Printf("srt run %s: %v\n", spec.address, err)
+	listener.WithLogger(srv.logger.With(liblog.App(spec.app))).WithAccept(func(streamID string, peer *net.UDPAddr) error {
+		//The room is fixed by the spec; the caller's StreamID only
+		//contributes its query ("x?expires=…&sign=…") for the check.
+		_, query := splitStreamName(streamID)
+		return srv.admit(context.Background(), ActionPublish, spec.app, spec.streamID, query, peer.String())
+	})
+	return &srtRelay{
+		listener: listener,
+		bridge:   br,
+		stopped:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// startSRTRelay opens the listener for spec and serves it on a tracked
+// goroutine. fail is called if it stops other than through Shutdown or
+// stopSRTRelay.
+func (s *server) startSRTRelay(spec srtSpec, fail func(name string, err error)) error {
+	relay, err := startSRT(s, spec)
+	if err != nil {
+		s.logger.Error("srt listen failed", liblog.F("address", spec.address), liblog.Err(err))
+		return err
+	}
+	s.mu.Lock()
+	s.srtRelays[spec] = relay
+	s.mu.Unlock()
+	if !s.goTracked(&s.workers, func() {
+		err := relay.listener.Run()
+		close(relay.done)
+		select {
+		case <-relay.stopped:
+		default:
+			if err != nil && !s.closing() {
+				fail("srt", err)
+			}
 		}
-	}()
+	}) {
+		_ = relay.listener.Close()
+		close(relay.done)
+	}
+	return nil
+}
+
+// stopSRTRelay closes the listener for spec and unpublishes whatever it
+// was feeding.
+func (s *server) stopSRTRelay(spec srtSpec) {
+	s.mu.Lock()
+	relay, ok := s.srtRelays[spec]
+	delete(s.srtRelays, spec)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	close(relay.stopped)
+	_ = relay.listener.Close()
+	<-relay.done
+	relay.bridge.mu.Lock()
+	room := relay.bridge.room
+	relay.bridge.mu.Unlock()
+	if room != nil && room.Publisher != nil {
+		room.Publisher.cleanup()
+	}
 }
 
 // onData feeds raw TS bytes from the SRT listener into the demuxer.
@@ -70,7 +136,7 @@ func startSRT(srv *server, spec srtSpec) {
 func (br *srtBridge) onData(streamID string, payload []byte) error {
 	br.mu.Lock()
 	if br.room == nil {
-		app, ok := br.server.apps[br.spec.app]
+		app, ok := br.server.app(br.spec.app)
 		if !ok {
 			br.mu.Unlock()
 			return fmt.Errorf("srt: app %q missing", br.spec.app)
@@ -87,8 +153,14 @@ func (br *srtBridge) onData(streamID string, payload []byte) error {
 			app:    br.spec.app,
 		}
 		ps.room = NewRoom(ps, br.spec.streamID)
+		ps.room.protocol = ProtocolSRT
+		ps.room.cache = newGOPCache(app.gopCache)
 		br.room = ps.room
+		br.server.startDVR(app, br.room)
 		app.Store(br.spec.streamID, br.room)
+		br.server.startRecording(app, br.room, publishLive)
+		br.server.startPushes(app, br.room)
+		ps.log().Info("publish start")
 	}
 	br.mu.Unlock()
 	br.demux.Feed(payload)
@@ -162,10 +234,7 @@ func (br *srtBridge) onVideo(au libsrt.AccessUnit) {
 		VideoData:     avcc,
 	}
 	vt.DataSize = uint32(len(vt.Data()))
-	if au.Key {
-		br.room.GOP.Reset()
-	}
-	br.room.GOP.Write(vt)
+	br.room.writeTag(vt, au.Key)
 }
 
 // onAudio converts an ADTS-prefixed AAC frame into one FLV audio tag.
@@ -223,7 +292,7 @@ func (br *srtBridge) onAudio(af libsrt.AudioFrame) {
 		SoundData:     af.Data[7:], //strip 7-byte ADTS header
 	}
 	at.DataSize = uint32(len(at.Data()))
-	br.room.GOP.Write(at)
+	br.room.writeTag(at, false)
 }
 
 // splitAnnexB walks an AnnexB-formatted byte stream and yields one
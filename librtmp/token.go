@@ -0,0 +1,119 @@
+package librtmp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenSign selects which request attributes a signed URL covers.
+// Flags combine with |.
+type TokenSign uint8
+
+const (
+	SignPath   TokenSign = 1 << iota //"/<app>/<stream>"
+	SignExpiry                       //the expires parameter (unix seconds)
+	SignIP                           //the client IP, without port
+)
+
+// Query parameters carrying the token. Only these two are forwarded
+// into HLS / DASH segment URIs.
+const (
+	tokenExpiresKey = "expires"
+	tokenSignKey    = "sign"
+)
+
+var (
+	ErrTokenMissing = errors.New("token: missing sign parameter")
+	ErrTokenExpired = errors.New("token: expired")
+	ErrTokenInvalid = errors.New("token: bad signature")
+)
+
+// TokenConfig configures the built-in signed-URL check for an App.
+// The expected signature is the lower-case hex HMAC-SHA256, keyed with
+// Secret, over the selected attributes joined by '\n' in the order
+// path, expiry, IP. The signed path is "/<app>/<stream>" whatever the
+// protocol, so one token works for RTMP, HTTP-FLV, every HLS/DASH
+// segment, RTSP and SRT alike.
+type TokenConfig struct {
+	Secret []byte
+	Skew   time.Duration //tolerance applied to expires, for clock drift
+	Sign   TokenSign
+}
+
+// SignToken returns the query parameters a front-end should append to
+// a URL for app/stream. expires and ip are only used when the matching
+// flag is set in cfg.Sign.
+func SignToken(cfg TokenConfig, app, stream string, expires time.Time, ip string) url.Values {
+	q := url.Values{}
+	exp := ""
+	if cfg.Sign&SignExpiry != 0 {
+		exp = strconv.FormatInt(expires.Unix(), 10)
+		q.Set(tokenExpiresKey, exp)
+	}
+	q.Set(tokenSignKey, cfg.signature(app, stream, exp, ip))
+	return q
+}
+
+func (cfg TokenConfig) signature(app, stream, expires, ip string) string {
+	var parts []string
+	if cfg.Sign&SignPath != 0 {
+		parts = append(parts, "/"+app+"/"+stream)
+	}
+	if cfg.Sign&SignExpiry != 0 {
+		parts = append(parts, expires)
+	}
+	if cfg.Sign&SignIP != 0 {
+		parts = append(parts, ip)
+	}
+	mac := hmac.New(sha256.New, cfg.Secret)
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the token carried in query for app/stream requested by
+// peer (host:port or bare host).
+func (cfg TokenConfig) verify(app, stream string, query url.Values, peer string, now time.Time) error {
+	sign := query.Get(tokenSignKey)
+	if sign == "" {
+		return ErrTokenMissing
+	}
+	exp := query.Get(tokenExpiresKey)
+	if cfg.Sign&SignExpiry != 0 {
+		sec, err := strconv.ParseInt(exp, 10, 64)
+		if err != nil {
+			return ErrTokenInvalid
+		}
+		if now.After(time.Unix(sec, 0).Add(cfg.Skew)) {
+			return ErrTokenExpired
+		}
+	}
+	ip := peer
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		ip = host
+	}
+	want := cfg.signature(app, stream, exp, ip)
+	if !hmac.Equal([]byte(strings.ToLower(sign)), []byte(want)) {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+// tokenQuery extracts the token parameters from query so they can be
+// carried onto segment URIs without dragging along unrelated ones
+// (LL-HLS _HLS_msn etc.). Returns "" when there's nothing to forward.
+func tokenQuery(query url.Values) string {
+	q := url.Values{}
+	for _, k := range []string{tokenExpiresKey, tokenSignKey} {
+		if v := query.Get(k); v != "" {
+			q.Set(k, v)
+		}
+	}
+	return q.Encode()
+}
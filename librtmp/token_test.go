@@ -0,0 +1,70 @@
+package librtmp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestToken_SignVerifyRoundTrip(t *testing.T) {
+	cfg := TokenConfig{Secret: []byte("s3cret"), Skew: 5 * time.Second, Sign: SignPath | SignExpiry | SignIP}
+	now := time.Unix(1700000000, 0)
+	q := SignToken(cfg, "live", "x", now.Add(time.Minute), "10.0.0.1")
+
+	if err := cfg.verify("live", "x", q, "10.0.0.1:5555", now); err != nil {
+		t.Fatalf("fresh token rejected: %v", err)
+	}
+	if err := cfg.verify("live", "y", q, "10.0.0.1:5555", now); err != ErrTokenInvalid {
+		t.Errorf("other stream: err = %v, want ErrTokenInvalid", err)
+	}
+	if err := cfg.verify("live", "x", q, "10.0.0.2:5555", now); err != ErrTokenInvalid {
+		t.Errorf("other IP: err = %v, want ErrTokenInvalid", err)
+	}
+	if err := cfg.verify("live", "x", q, "10.0.0.1:5555", now.Add(time.Minute+3*time.Second)); err != nil {
+		t.Errorf("within skew: %v", err)
+	}
+	if err := cfg.verify("live", "x", q, "10.0.0.1:5555", now.Add(time.Minute+6*time.Second)); err != ErrTokenExpired {
+		t.Errorf("past skew: err = %v, want ErrTokenExpired", err)
+	}
+	q.Del(tokenSignKey)
+	if err := cfg.verify("live", "x", q, "10.0.0.1:5555", now); err != ErrTokenMissing {
+		t.Errorf("no sign: err = %v, want ErrTokenMissing", err)
+	}
+}
+
+func TestToken_PathOnlyIgnoresPeer(t *testing.T) {
+	cfg := TokenConfig{Secret: []byte("k"), Sign: SignPath}
+	q := SignToken(cfg, "live", "x", time.Time{}, "")
+	if q.Get(tokenExpiresKey) != "" {
+		t.Errorf("expires set without SignExpiry: %v", q)
+	}
+	if err := cfg.verify("live", "x", q, "1.2.3.4:1", time.Now()); err != nil {
+		t.Errorf("path-only token rejected: %v", err)
+	}
+}
+
+func TestToken_EnforcedByAuthorize(t *testing.T) {
+	cfg := TokenConfig{Secret: []byte("k"), Sign: SignPath | SignExpiry}
+	srv := NewServer(":0", "live", "open").WithToken("live", cfg)
+	ctx := context.Background()
+
+	if err := srv.authorize(ctx, ActionPlay, "live", "x", nil, "1.2.3.4:1"); err == nil {
+		t.Error("unsigned request to a token app was accepted")
+	}
+	q := SignToken(cfg, "live", "x", time.Now().Add(time.Minute), "")
+	if err := srv.authorize(ctx, ActionPublish, "live", "x", q, "1.2.3.4:1"); err != nil {
+		t.Errorf("signed request rejected: %v", err)
+	}
+	if err := srv.authorize(ctx, ActionPlay, "open", "x", nil, "1.2.3.4:1"); err != nil {
+		t.Errorf("app without token rejected: %v", err)
+	}
+}
+
+func TestTokenQuery_OnlyTokenParams(t *testing.T) {
+	q := SignToken(TokenConfig{Secret: []byte("k"), Sign: SignPath | SignExpiry}, "live", "x", time.Unix(100, 0), "")
+	q.Set("_HLS_msn", "3")
+	got := tokenQuery(q)
+	if got != "expires=100&sign="+q.Get(tokenSignKey) {
+		t.Errorf("tokenQuery = %q", got)
+	}
+}
@@ -0,0 +1,123 @@
+package librtmp
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/libhls"
+)
+
+// trackFilter is what a player subscribed to: both tracks unless it
+// sent receiveAudio/receiveVideo false or asked for ?only=audio|video.
+// The zero value, and a nil one, pass everything. The on/off switches
+// may come from the connection's read loop while pass is called from
+// the sending goroutine.
+type trackFilter struct {
+	noAudio, noVideo int32
+	//Set when a track comes back on: its next frame is preceded by
+	//its sequence header, and video waits for a keyframe.
+	resumeAudio, resumeVideo int32
+}
+
+// parseOnly builds the filter of an ?only= query value.
+func parseOnly(only string) (*trackFilter, error) {
+	f := &trackFilter{}
+	switch only {
+	case "":
+	case "audio":
+		f.noVideo = 1
+	case "video":
+		f.noAudio = 1
+	default:
+		return nil, errors.New("only must be audio or video")
+	}
+	return f, nil
+}
+
+func (f *trackFilter) setAudio(on bool) {
+	if on {
+		if atomic.CompareAndSwapInt32(&f.noAudio, 1, 0) {
+			atomic.StoreInt32(&f.resumeAudio, 1)
+		}
+		return
+	}
+	atomic.StoreInt32(&f.noAudio, 1)
+}
+
+func (f *trackFilter) setVideo(on bool) {
+	if on {
+		if atomic.CompareAndSwapInt32(&f.noVideo, 1, 0) {
+			atomic.StoreInt32(&f.resumeVideo, 1)
+		}
+		return
+	}
+	atomic.StoreInt32(&f.noVideo, 1)
+}
+
+// pass tells whether tag goes to the player, and whether the track's
+// sequence header has to go right before it, the track having been
+// off. A nil tag doesn't pass.
+func (f *trackFilter) pass(tag libflv.Tag) (ok, resume bool) {
+	if f == nil {
+		f = &trackFilter{}
+	}
+	switch t := tag.(type) {
+	case *libflv.AudioTag:
+		if t == nil || atomic.LoadInt32(&f.noAudio) == 1 {
+			return false, false
+		}
+		if t.SoundFormat == libflv.FLV_AUDIO_AAC && t.AACPacketType == libflv.AAC_SEQUENCE_HEADER {
+			atomic.StoreInt32(&f.resumeAudio, 0)
+			return true, false
+		}
+		return true, atomic.CompareAndSwapInt32(&f.resumeAudio, 1, 0)
+	case *libflv.VideoTag:
+		if t == nil || atomic.LoadInt32(&f.noVideo) == 1 {
+			return false, false
+		}
+		if t.AVCPacketType == libflv.AVC_SEQUENCE_HEADER {
+			return true, false
+		}
+		if atomic.LoadInt32(&f.resumeVideo) == 1 {
+			if t.FrameType != libflv.KEY_FRAME {
+				return false, false
+			}
+			return true, atomic.CompareAndSwapInt32(&f.resumeVideo, 1, 0)
+		}
+		return true, false
+	}
+	return true, false
+}
+
+// flvFlags is the FLV header's type flags for what passes.
+func (f *trackFilter) flvFlags(hasAudio, hasVideo bool) byte {
+	var flags byte
+	if hasAudio && (f == nil || atomic.LoadInt32(&f.noAudio) == 0) {
+		flags |= 0x04
+	}
+	if hasVideo && (f == nil || atomic.LoadInt32(&f.noVideo) == 0) {
+		flags |= 0x01
+	}
+	return flags
+}
+
+// audioHLS returns room's audio-only HLS rendition, started on the
+// first playlist request if start is set and app serves HLS at all.
+// Its segments are <roomID>-audio-<seq>.ts beside the A/V ones.
+func (s *server) audioHLS(app *App, room *Room, start bool) *libhls.HLS {
+	if h, ok := app.hlsAudio.Load(room.RoomID); ok {
+		return h.(*libhls.HLS)
+	}
+	if !start || app.hlsMode == libhls.NONE {
+		return nil
+	}
+	hls := s.newHLS(app, room.RoomID+"-audio").WithAudioOnly(true)
+	if h, loaded := app.hlsAudio.LoadOrStore(room.RoomID, hls); loaded {
+		hls = h.(*libhls.HLS)
+	} else {
+		s.startHLS(hls, room)
+	}
+	hls.WaitFirstSegment()
+	return hls
+}
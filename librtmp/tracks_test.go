@@ -0,0 +1,139 @@
+package librtmp
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SmartBrave/Athena/easyio"
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+func TestTrackFilter(t *testing.T) {
+	key := &libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG}, FrameType: libflv.KEY_FRAME,
+		CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_NALU}
+	inter := &libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG}, FrameType: libflv.INTER_FRAME,
+		CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_NALU}
+	audio := &libflv.AudioTag{TagBase: libflv.TagBase{TagType: libflv.AUDIO_TAG}, SoundFormat: libflv.FLV_AUDIO_AAC, AACPacketType: libflv.AAC_RAW}
+
+	var f trackFilter
+	for _, tag := range []libflv.Tag{key, inter, audio} {
+		if ok, resume := f.pass(tag); !ok || resume {
+			t.Errorf("zero filter: pass = %v, %v; want true, false", ok, resume)
+		}
+	}
+
+	f.setVideo(false)
+	if ok, _ := f.pass(key); ok {
+		t.Error("video passed with receiveVideo false")
+	}
+	if ok, _ := f.pass(audio); !ok {
+		t.Error("audio dropped with receiveVideo false")
+	}
+	f.setVideo(true)
+	if ok, _ := f.pass(inter); ok {
+		t.Error("video came back on an inter frame")
+	}
+	if ok, resume := f.pass(key); !ok || !resume {
+		t.Errorf("first keyframe back: pass = %v, %v; want true, true", ok, resume)
+	}
+	if ok, resume := f.pass(inter); !ok || resume {
+		t.Errorf("frame after it: pass = %v, %v; want true, false", ok, resume)
+	}
+
+	f.setAudio(false)
+	if ok, _ := f.pass(audio); ok {
+		t.Error("audio passed with receiveAudio false")
+	}
+	f.setAudio(true)
+	if ok, resume := f.pass(audio); !ok || !resume {
+		t.Errorf("first audio back: pass = %v, %v; want true, true", ok, resume)
+	}
+
+	if _, err := parseOnly("subtitles"); err == nil {
+		t.Error("parseOnly accepted an unknown track")
+	}
+	only, _ := parseOnly("audio")
+	if flags := only.flvFlags(true, true); flags != 0x04 {
+		t.Errorf("audio-only FLV flags %#x, want 0x04", flags)
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func TestFLVJoinOnlyAudio(t *testing.T) {
+	room := NewRoom(nil, "x")
+	room.GOP.WriteMeta(&libflv.MetaTag{TagBase: libflv.TagBase{TagType: libflv.SCRIPT_DATA_TAG}})
+	room.GOP.WriteMeta(&libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG}, FrameType: libflv.KEY_FRAME,
+		CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_SEQUENCE_HEADER, VideoData: []byte{1}})
+	room.GOP.WriteMeta(&libflv.AudioTag{TagBase: libflv.TagBase{TagType: libflv.AUDIO_TAG}, SoundFormat: libflv.FLV_AUDIO_AAC,
+		AACPacketType: libflv.AAC_SEQUENCE_HEADER, SoundData: []byte{0x12, 0x10}})
+	for _, ts := range []uint32{0, 40, 80} {
+		frame := uint8(libflv.INTER_FRAME)
+		if ts == 0 {
+			frame = libflv.KEY_FRAME
+		}
+		room.writeTag(&libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG, TimeStamp: ts}, FrameType: frame,
+			CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_NALU, VideoData: []byte{0, 0, 0, 1, 0x65}}, ts == 0)
+		room.writeTag(&libflv.AudioTag{TagBase: libflv.TagBase{TagType: libflv.AUDIO_TAG, TimeStamp: ts}, SoundFormat: libflv.FLV_AUDIO_AAC,
+			AACPacketType: libflv.AAC_RAW, SoundData: []byte{0x21}}, false)
+	}
+
+	tracks, _ := parseOnly("audio")
+	out := &lockedBuffer{}
+	done := make(chan struct{})
+	go func() {
+		room.flvJoin(easyio.NewEasyWriter(out), tracks, newSendQueue(nil, nil, nil))
+		close(done)
+	}()
+	//Closed once the GOP is through: the sequence header and three
+	//frames.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if audio, _ := countTags(out.bytes()); audio == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("GOP not through in 5s")
+		}
+	}
+	room.Close()
+	<-done
+	b := out.bytes()
+	if len(b) < 13 || b[4] != 0x04 {
+		t.Fatalf("FLV header %x, want audio flags only", b)
+	}
+	if audio, video := countTags(b); audio != 4 || video != 0 {
+		t.Errorf("%d audio and %d video tags, want 4 and none", audio, video)
+	}
+}
+
+// countTags counts the tags of an FLV stream.
+func countTags(b []byte) (audio, video int) {
+	for i := 13; i+11 <= len(b); {
+		n := int(b[i+1])<<16 | int(b[i+2])<<8 | int(b[i+3])
+		switch b[i] {
+		case libflv.AUDIO_TAG:
+			audio++
+		case libflv.VIDEO_TAG:
+			video++
+		}
+		i += 11 + n + 4
+	}
+	return audio, video
+}
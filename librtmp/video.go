@@ -1,9 +1,8 @@
 package librtmp
 
 import (
-	"fmt"
-
 	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/liblog"
 )
 
 type VideoCodec float64
@@ -26,6 +25,41 @@ const (
 	SUPPORT_VID_CLIENT_SEEK VideoFunction = 1
 )
 
+// enhancedFourCCs are the enhanced RTMP codecs taken from publishers
+// and relayed to players.
+var enhancedFourCCs = []string{"avc1", "hvc1", "av01", "vp09"}
+
+// fourCCSet is the fourCcList of a connect; nil if there was none.
+type fourCCSet map[uint32]bool
+
+func (rtmp *RTMP) setFourCCs(list []string) {
+	rtmp.fourCCs = fourCCSet{}
+	for _, s := range list {
+		if s == "*" {
+			for _, e := range enhancedFourCCs {
+				fourCC, _ := libflv.ParseFourCC(e)
+				rtmp.fourCCs[fourCC] = true
+			}
+		} else if fourCC, ok := libflv.ParseFourCC(s); ok {
+			rtmp.fourCCs[fourCC] = true
+		}
+	}
+}
+
+// videoFor returns tag in the form the peer takes: enhanced if it
+// listed the codec's FourCC, else legacy where there is a legacy form.
+// AVC goes legacy to everyone.
+func (rtmp *RTMP) videoFor(tag *libflv.VideoTag) *libflv.VideoTag {
+	fourCC := libflv.CodecFourCC(tag.CodecID)
+	if tag.CodecID != libflv.FLV_VIDEO_AVC && rtmp.fourCCs[fourCC] {
+		return tag.Enhance()
+	}
+	if legacy := tag.Legacy(); legacy != nil {
+		return legacy
+	}
+	return tag
+}
+
 type VideoMessage struct {
 	MessageBase
 	videoTag *libflv.VideoTag
@@ -39,6 +73,8 @@ func NewVideoMessage(mb MessageBase, fields ...interface{}) (vm *VideoMessage) {
 		var ok bool
 		if vm.videoTag, ok = fields[0].(*libflv.VideoTag); !ok {
 			//TODO
+		} else if mb.rtmp != nil {
+			vm.messagePayload = mb.rtmp.videoFor(vm.videoTag).Marshal()
 		} else {
 			vm.messagePayload = vm.videoTag.Marshal()
 		}
@@ -82,6 +118,10 @@ func (vm *VideoMessage) Parse() (err error) {
 }
 
 func (vm *VideoMessage) Do() (err error) {
+	if vm.rtmp.onTag != nil {
+		vm.rtmp.onTag(vm.videoTag)
+		return nil
+	}
 	if vm.rtmp.room == nil {
 		return nil
 	}
@@ -89,13 +129,12 @@ func (vm *VideoMessage) Do() (err error) {
 		if vm.videoTag.AVCPacketType == libflv.AVC_SEQUENCE_HEADER {
 			vm.rtmp.room.setVideoSequenceHeader(vm.videoTag)
 			vm.rtmp.room.GOP.WriteMeta(vm.videoTag)
+			vm.rtmp.log().Debug("video sequence header", liblog.F("codec", vm.videoTag.CodecID))
 		} else {
-			vm.rtmp.room.GOP.Reset()
-			vm.rtmp.room.GOP.Write(vm.videoTag)
+			vm.rtmp.room.writeTag(vm.videoTag, true)
 		}
-		fmt.Printf("write packet video :%+v\n", vm.videoTag)
 	} else {
-		vm.rtmp.room.GOP.Write(vm.videoTag)
+		vm.rtmp.room.writeTag(vm.videoTag, false)
 	}
 	return nil
 }
@@ -0,0 +1,38 @@
+package librtmp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/goinggo/mapstructure"
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+func TestVideoFor(t *testing.T) {
+	var obj ConnectReqCommandObject
+	if err := mapstructure.Decode(map[string]interface{}{"app": "live", "fourCcList": []interface{}{"hvc1", "av01"}}, &obj); err != nil {
+		t.Fatal(err)
+	}
+	modern, old := &RTMP{}, &RTMP{}
+	modern.setFourCCs(obj.FourCcList)
+
+	hevc := &libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG}, FrameType: libflv.KEY_FRAME,
+		CodecID: libflv.FLV_VIDEO_HEVC, AVCPacketType: libflv.AVC_NALU, Cts: 40, VideoData: []byte{0, 0, 0, 1}}
+	if v := modern.videoFor(hevc); !v.Enhanced || v.FourCC != libflv.FOURCC_HVC1 {
+		t.Errorf("to a peer listing hvc1: %+v, want enhanced", v)
+	}
+	enhanced := hevc.Enhance()
+	if v := old.videoFor(enhanced); v.Enhanced || !bytes.Equal(v.Marshal(), hevc.Marshal()) {
+		t.Errorf("to a peer without fourCcList: %x, want the legacy %x", v.Marshal(), hevc.Marshal())
+	}
+	avc := &libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG}, FrameType: libflv.KEY_FRAME,
+		CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_NALU, VideoData: []byte{0, 0, 0, 1}}
+	if v := modern.videoFor(avc.Enhance()); v.Enhanced {
+		t.Error("AVC went enhanced")
+	}
+	all := &RTMP{}
+	all.setFourCCs([]string{"*"})
+	if !all.fourCCs[libflv.FOURCC_VP09] {
+		t.Error(`"*" doesn't take vp09`)
+	}
+}
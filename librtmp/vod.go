@@ -0,0 +1,319 @@
+package librtmp
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SmartBrave/Athena/easyerrors"
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/libhls"
+	"github.com/sbraveyoung/GGmpeg/liblog"
+	"github.com/sbraveyoung/GGmpeg/libvod"
+)
+
+// VODConfig serves recorded files of an app when no live stream has
+// the requested name: RTMP play in real time with seek and pause,
+// HTTP-FLV with ?start=<seconds>, and HLS as a VOD playlist. A name
+// is looked up as <Dir>/<app>/<name>, where recordings are written,
+// trying .flv then .mp4 if it has no extension. RTMP names may carry
+// an "flv:" or "mp4:" prefix.
+type VODConfig struct {
+	Dir string `json:"dir"` //default "./record"
+}
+
+// WithVOD enables VOD playback on appName. See VODConfig.
+func (s *server) WithVOD(appName string, cfg VODConfig) *server {
+	if _, ok := s.apps[appName]; !ok {
+		panic("appName does not exist.")
+	}
+	s.apps[appName].vod = &cfg
+	return s
+}
+
+func (c *VODConfig) dir() string {
+	if c.Dir == "" {
+		return "./record"
+	}
+	return c.Dir
+}
+
+// vodPath resolves name to a file under app's VOD directory.
+func vodPath(app *App, name string) (string, bool) {
+	if app.vod == nil {
+		return "", false
+	}
+	for _, prefix := range []string{"flv:", "mp4:"} {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	dir := filepath.Join(app.vod.dir(), app.appName)
+	full := filepath.Join(dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dir, full)
+	if name == "" || err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	candidates := []string{full + ".flv", full + ".mp4"}
+	if filepath.Ext(full) != "" {
+		candidates = []string{full}
+	}
+	for _, c := range candidates {
+		if fi, err := os.Stat(c); err == nil && fi.Mode().IsRegular() {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// vodCacheSize is how many files' indexes a vodCache keeps.
+const vodCacheSize = 64
+
+// vodCache keeps the indexes of the files played last, until a file
+// changes or goes, so seeks and HLS segment requests don't rescan it.
+type vodCache struct {
+	max int
+	mu  sync.Mutex
+	m   map[string]*vodEntry //path
+}
+
+type vodEntry struct {
+	size    int64
+	modTime time.Time
+	media   *libvod.Media
+	used    time.Time
+}
+
+func newVODCache() *vodCache {
+	return &vodCache{max: vodCacheSize, m: map[string]*vodEntry{}}
+}
+
+func (c *vodCache) open(path string) (*libvod.Media, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		c.mu.Lock()
+		delete(c.m, path)
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.mu.Lock()
+	e, ok := c.m[path]
+	if ok && e.size == fi.Size() && e.modTime.Equal(fi.ModTime()) {
+		e.used = time.Now()
+		c.mu.Unlock()
+		return e.media, nil
+	}
+	c.mu.Unlock()
+	//Indexed outside the lock: a scan of a long FLV takes a while.
+	media, err := libvod.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[path] = &vodEntry{size: fi.Size(), modTime: fi.ModTime(), media: media, used: time.Now()}
+	//Past the limit, the least recently played goes.
+	for len(c.m) > c.max {
+		oldest := ""
+		for p, e := range c.m {
+			if oldest == "" || e.used.Before(c.m[oldest].used) {
+				oldest = p
+			}
+		}
+		delete(c.m, oldest)
+	}
+	return media, nil
+}
+
+// openVOD returns the indexed recording playing as name on app, if
+// there is one.
+func (s *server) openVOD(app *App, name string) (*libvod.Media, bool) {
+	path, ok := vodPath(app, name)
+	if !ok {
+		return nil, false
+	}
+	media, err := s.vods.open(path)
+	if err != nil {
+		s.logger.Warn("vod open failed", liblog.App(app.appName), liblog.Stream(name), liblog.Err(err))
+		return nil, false
+	}
+	return media, true
+}
+
+// playVOD answers a play of a recording and starts playing it from
+// the play command's start, in milliseconds.
+func (cm *CommandMessage) playVOD(media *libvod.Media) error {
+	reader, err := media.NewReader()
+	if err != nil {
+		return err
+	}
+	rtmp := cm.rtmp
+	if rtmp.player != nil {
+		rtmp.player.Stop()
+	}
+	rtmp.role = rolePlayer
+	rtmp.player = newPacedPlayer(rtmp, &vodSource{media: media, reader: reader}, cm.PublishingName, false)
+	rtmp.log().Info("play start", liblog.Stream(cm.PublishingName), liblog.F("vod", true))
+
+	var errs []error
+	for _, code := range []string{"NetStream.Play.Reset", "NetStream.Play.Start", "NetStream.Data.Start"} {
+		errs = append(errs, (&CommandMessageResponse{
+			MessageBase:     cm.MessageBase,
+			CommandName:     cm.CommandName,
+			CommandRespName: ON_STATUS,
+			TranscationID:   cm.TranscationID,
+			CommandObject: ConnectRespCommandObject{
+				Level:       "status",
+				Code:        code,
+				Description: "Start play",
+			},
+		}).Send())
+	}
+	errs = append(errs, NewUserControlMessage(cm.MessageBase, StreamIsRecorded).Send())
+
+	start := time.Duration(0)
+	if cm.Start > 0 {
+		start = time.Duration(cm.Start) * time.Millisecond
+	}
+	//A worker, not a stream: it ends with the connection, which
+	//Shutdown closes after the streams are done.
+	player := rtmp.player
+	if !rtmp.server.goTracked(&rtmp.server.workers, func() { player.run(start) }) {
+		player.src.close()
+	}
+	return easyerrors.HandleMultiError(easyerrors.Simple(), errs...)
+}
+
+// vodSource plays a recording.
+type vodSource struct {
+	media  *libvod.Media
+	reader *libvod.Reader
+}
+
+func (v *vodSource) next() (libflv.Tag, <-chan struct{}, error) {
+	tag, err := v.reader.ReadTag()
+	return tag, nil, err
+}
+
+func (v *vodSource) seekTo(t time.Duration) (time.Duration, error) {
+	return v.reader.SeekTo(t)
+}
+
+func (v *vodSource) headers() []libflv.Tag {
+	return v.media.Headers()
+}
+
+func (v *vodSource) close() {
+	_ = v.reader.Close()
+}
+
+// serveVODFLV sends the tracks of a recording passing tracks as
+// HTTP-FLV, as fast as the client takes it, from the keyframe before
+// ?start=<seconds>.
+func (s *server) serveVODFLV(w http.ResponseWriter, r *http.Request, media *libvod.Media, tracks *trackFilter) {
+	reader, err := media.NewReader()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	if secs, err := strconv.ParseFloat(r.URL.Query().Get("start"), 64); err == nil && secs > 0 {
+		if _, err := reader.SeekTo(time.Duration(secs * float64(time.Second))); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if _, err := w.Write([]byte{0x46, 0x4c, 0x56, 0x01, tracks.flvFlags(media.HasAudio, media.HasVideo), 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}); err != nil {
+		return
+	}
+	for _, tag := range media.Headers() {
+		if ok, _ := tracks.pass(tag); !ok {
+			continue
+		}
+		if _, err := w.Write(libflv.FLVWrite(tag)); err != nil {
+			return
+		}
+	}
+	for {
+		tag, err := reader.ReadTag()
+		if err != nil {
+			if err != io.EOF {
+				s.logger.Warn("vod read failed", liblog.Err(err))
+			}
+			return
+		}
+		if ok, _ := tracks.pass(tag); !ok {
+			continue
+		}
+		if _, err := w.Write(libflv.FLVWrite(tag)); err != nil {
+			return
+		}
+	}
+}
+
+// serveVODHLS serves a recording as a VOD playlist whose segments,
+// <i>.ts, are muxed from the file on request.
+func (s *server) serveVODHLS(w http.ResponseWriter, r *http.Request, app *App, media *libvod.Media, file string) {
+	segments := libhls.SplitVOD(media.Keyframes, media.Duration, app.hlsTargetDur)
+	if file == "index.m3u8" {
+		playlist := libhls.VODPlaylist(segments)
+		if app.token != nil {
+			playlist = libhls.AppendQuery(playlist, tokenQuery(r.URL.Query()))
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		_, _ = w.Write(playlist)
+		return
+	}
+	i, err := strconv.Atoi(strings.TrimSuffix(file, ".ts"))
+	if !strings.HasSuffix(file, ".ts") || err != nil || i < 0 || i >= len(segments) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	seg := segments[i]
+
+	reader, err := media.NewReader()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	if _, err := reader.SeekTo(seg.Start); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	tw := libhls.NewTSWriter(w)
+	for _, tag := range media.Headers() {
+		if err := tw.WriteTag(tag); err != nil {
+			return
+		}
+	}
+	last := i == len(segments)-1
+	for {
+		tag, err := reader.ReadTag()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			s.logger.Warn("vod read failed", liblog.Err(err))
+			return
+		}
+		if !last && time.Duration(tag.GetTagInfo().TimeStamp)*time.Millisecond >= seg.End {
+			break
+		}
+		if err := tw.WriteTag(tag); err != nil {
+			return
+		}
+	}
+	_ = tw.Close()
+}
@@ -0,0 +1,169 @@
+package librtmp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// writeRecording writes <dir>/live/rec.flv: 6 s of video with a
+// keyframe every 2 s.
+func writeRecording(t *testing.T, dir string) {
+	b := []byte{'F', 'L', 'V', 1, 0x01, 0, 0, 0, 9, 0, 0, 0, 0}
+	tags := []libflv.Tag{
+		&libflv.MetaTag{TagBase: libflv.TagBase{TagType: libflv.SCRIPT_DATA_TAG}, Duration: 6},
+		&libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG}, FrameType: libflv.KEY_FRAME,
+			CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_SEQUENCE_HEADER, VideoData: []byte{1, 0x4d, 0x40, 0x28, 0xff, 0xe0, 0}},
+	}
+	for ts := uint32(0); ts <= 6000; ts += 500 {
+		frame := uint8(libflv.INTER_FRAME)
+		if ts%2000 == 0 {
+			frame = libflv.KEY_FRAME
+		}
+		tags = append(tags, &libflv.VideoTag{TagBase: libflv.TagBase{TagType: libflv.VIDEO_TAG, TimeStamp: ts}, FrameType: frame,
+			CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_NALU, VideoData: []byte{0, 0, 0, 1, 0x65}})
+	}
+	for _, tag := range tags {
+		b = append(b, libflv.FLVWrite(tag)...)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "live"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "live", "rec.flv"), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, b
+}
+
+func TestVODPath(t *testing.T) {
+	dir := t.TempDir()
+	writeRecording(t, dir)
+	app := NewApp("live")
+	if _, ok := vodPath(app, "rec"); ok {
+		t.Error("resolved a name without VOD enabled")
+	}
+	app.vod = &VODConfig{Dir: dir}
+	for name, want := range map[string]bool{
+		"rec":          true,
+		"rec.flv":      true,
+		"flv:rec":      true,
+		"rec.mp4":      false,
+		"../other/rec": false,
+		"../../etc/pw": false,
+		"":             false,
+	} {
+		if _, ok := vodPath(app, name); ok != want {
+			t.Errorf("vodPath(%q) found = %v, want %v", name, ok, want)
+		}
+	}
+}
+
+func TestVODCache(t *testing.T) {
+	dir := t.TempDir()
+	writeRecording(t, dir)
+	b, err := os.ReadFile(filepath.Join(dir, "live", "rec.flv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := func(name string) string { return filepath.Join(dir, name+".flv") }
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(path(name), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newVODCache()
+	c.max = 2
+	for _, name := range []string{"a", "b", "a", "c"} {
+		if _, err := c.open(path(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached := func(name string) bool {
+		_, ok := c.m[path(name)]
+		return ok
+	}
+	if !cached("a") || cached("b") || !cached("c") {
+		t.Errorf("cached a %v, b %v, c %v; want the two played last, a and c", cached("a"), cached("b"), cached("c"))
+	}
+
+	//A file gone goes from the cache too.
+	if err := os.Remove(path("c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.open(path("c")); err == nil {
+		t.Error("opened a removed file")
+	}
+	if cached("c") {
+		t.Error("a removed file is still cached")
+	}
+}
+
+func TestVOD_HTTPFLV(t *testing.T) {
+	dir := t.TempDir()
+	writeRecording(t, dir)
+	srv := NewServer(":0", "live").WithVOD("live", VODConfig{Dir: dir})
+	ts := httptest.NewServer(srv.flvMux())
+	defer ts.Close()
+
+	if code, _ := get(t, ts.URL+"/live/missing.flv"); code != http.StatusNotFound {
+		t.Errorf("missing file: status %d, want 404", code)
+	}
+	code, b := get(t, ts.URL+"/live/rec.flv?start=4.5")
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	var frames []uint32
+	for i := 13; i+11 <= len(b); {
+		n := int(b[i+1])<<16 | int(b[i+2])<<8 | int(b[i+3])
+		if b[i] == libflv.VIDEO_TAG && b[i+12] == libflv.AVC_NALU {
+			frames = append(frames, uint32(b[i+7])<<24|uint32(b[i+4])<<16|uint32(b[i+5])<<8|uint32(b[i+6]))
+		}
+		i += 11 + n + 4
+	}
+	//From the keyframe at 4 s on, original timestamps kept.
+	if len(frames) != 5 || frames[0] != 4000 {
+		t.Errorf("frames %v, want 5 from 4000", frames)
+	}
+}
+
+func TestVOD_HLS(t *testing.T) {
+	dir := t.TempDir()
+	writeRecording(t, dir)
+	srv := NewServer(":0", "live").WithVOD("live", VODConfig{Dir: dir})
+	ts := httptest.NewServer(srv.hlsMux())
+	defer ts.Close()
+
+	code, playlist := get(t, ts.URL+"/live/rec/index.m3u8")
+	if code != http.StatusOK {
+		t.Fatalf("playlist status %d", code)
+	}
+	if n := strings.Count(string(playlist), "#EXTINF:"); n != 3 || !strings.HasSuffix(string(playlist), "#EXT-X-ENDLIST\n") {
+		t.Errorf("playlist has %d segments, want 3 and an end:\n%s", n, playlist)
+	}
+	code, segment := get(t, ts.URL+"/live/rec/1.ts")
+	if code != http.StatusOK || len(segment) == 0 || len(segment)%188 != 0 || segment[0] != 0x47 {
+		t.Errorf("segment: status %d, %d bytes; want whole TS packets", code, len(segment))
+	}
+	if code, _ := get(t, ts.URL+"/live/rec/3.ts"); code != http.StatusNotFound {
+		t.Errorf("segment past the end: status %d, want 404", code)
+	}
+}
@@ -0,0 +1,226 @@
+package librtmp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libdash"
+	"github.com/sbraveyoung/GGmpeg/libhls"
+	"github.com/sbraveyoung/GGmpeg/liblog"
+)
+
+// Event names a stream lifecycle callback. The string value is the
+// "action" field of the JSON body POSTed to the webhook.
+type Event string
+
+const (
+	EventConnect     Event = "on_connect"
+	EventPublish     Event = "on_publish"
+	EventUnpublish   Event = "on_unpublish"
+	EventPlay        Event = "on_play"
+	EventStop        Event = "on_stop"
+	EventHLSSegment  Event = "on_hls_segment"
+	EventDASHSegment Event = "on_dash_segment"
+)
+
+// WebhookPayload is the JSON body of every webhook request. Segment
+// fields are only set for on_hls_segment / on_dash_segment.
+type WebhookPayload struct {
+	Action   Event   `json:"action"`
+	App      string  `json:"app"`
+	Stream   string  `json:"stream,omitempty"`
+	Peer     string  `json:"peer,omitempty"`
+	Query    string  `json:"query,omitempty"`
+	Time     int64   `json:"time"`
+	File     string  `json:"file,omitempty"`
+	Seq      int     `json:"seq,omitempty"`
+	Duration float64 `json:"duration,omitempty"` //seconds
+}
+
+// webhooks holds the configured URLs per event and the delivery policy.
+type webhooks struct {
+	urls    map[Event][]string
+	timeout time.Duration
+	retries int           //extra attempts after the first
+	backoff time.Duration //doubled after every failed attempt
+	client  *http.Client
+}
+
+func newWebhooks() *webhooks {
+	return &webhooks{
+		urls:    map[Event][]string{},
+		timeout: 3 * time.Second,
+		retries: 2,
+		backoff: 200 * time.Millisecond,
+		client:  &http.Client{},
+	}
+}
+
+// WithWebhook POSTs a JSON WebhookPayload to hookURL whenever event
+// happens. May be called several times per event; every URL is
+// notified. on_publish and on_play are blocking: the publish or play
+// is rejected unless every URL answers 2xx. The other events are fire-
+// and-forget. HLS and DASH are served per request with no session to
+// start or stop, so they trigger on_hls_segment / on_dash_segment but
+// never on_play / on_stop.
+func (s *server) WithWebhook(event Event, hookURL string) *server {
+	if s.webhooks == nil {
+		s.webhooks = newWebhooks()
+	}
+	s.webhooks.urls[event] = append(s.webhooks.urls[event], hookURL)
+	return s
+}
+
+// WithWebhookPolicy sets the per-attempt timeout, how many times a
+// failed delivery (transport error or 5xx) is retried, and the initial
+// retry backoff. A 4xx answer is final and never retried. Defaults are
+// 3 s, 2 retries, 200 ms.
+func (s *server) WithWebhookPolicy(timeout time.Duration, retries int, backoff time.Duration) *server {
+	if s.webhooks == nil {
+		s.webhooks = newWebhooks()
+	}
+	s.webhooks.timeout = timeout
+	s.webhooks.retries = retries
+	s.webhooks.backoff = backoff
+	return s
+}
+
+// call delivers p to every URL registered for p.Action and returns the
+// first failure.
+func (w *webhooks) call(ctx context.Context, p WebhookPayload) error {
+	urls := w.urls[p.Action]
+	if len(urls) == 0 {
+		return nil
+	}
+	if p.Time == 0 {
+		p.Time = time.Now().Unix()
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	for _, u := range urls {
+		if err := w.post(ctx, u, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post sends one request, retrying transport errors and 5xx answers.
+func (w *webhooks) post(ctx context.Context, hookURL string, body []byte) error {
+	backoff := w.backoff
+	var lastErr error
+	for attempt := 0; attempt <= w.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		status, err := w.postOnce(ctx, hookURL, body)
+		switch {
+		case err != nil:
+			lastErr = fmt.Errorf("webhook %s: %v", hookURL, err)
+		case status >= 200 && status < 300:
+			return nil
+		case status >= 500:
+			lastErr = fmt.Errorf("webhook %s: status %d", hookURL, status)
+		default:
+			return fmt.Errorf("webhook %s: status %d", hookURL, status)
+		}
+	}
+	return lastErr
+}
+
+func (w *webhooks) postOnce(ctx context.Context, hookURL string, body []byte) (int, error) {
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// notify delivers a fire-and-forget event in the background.
+func (s *server) notify(p WebhookPayload) {
+	if s.webhooks == nil || len(s.webhooks.urls[p.Action]) == 0 {
+		return
+	}
+	if p.Time == 0 {
+		p.Time = time.Now().Unix()
+	}
+	go func() {
+		if err := s.webhooks.call(context.Background(), p); err != nil {
+			s.logger.Warn("webhook failed", liblog.F("action", p.Action), liblog.App(p.App), liblog.Stream(p.Stream), liblog.Peer(p.Peer), liblog.Err(err))
+		}
+	}()
+}
+
+// admit is authorize plus the blocking on_publish / on_play webhook.
+// It's the gate for every protocol that has a session start; HLS and
+// DASH, which don't, call authorize directly.
+func (s *server) admit(ctx context.Context, action Action, app, stream string, query url.Values, peer string) error {
+	if err := s.authorize(ctx, action, app, stream, query, peer); err != nil {
+		return err
+	}
+	if s.webhooks == nil {
+		return nil
+	}
+	event := EventPlay
+	if action == ActionPublish {
+		event = EventPublish
+	}
+	return s.webhooks.call(ctx, WebhookPayload{
+		Action: event,
+		App:    app,
+		Stream: stream,
+		Peer:   peer,
+		Query:  query.Encode(),
+	})
+}
+
+// hlsSegmentHook returns the libhls callback that raises on_hls_segment.
+func (s *server) hlsSegmentHook(app string) func(libhls.Segment) {
+	return func(seg libhls.Segment) {
+		s.notify(WebhookPayload{
+			Action:   EventHLSSegment,
+			App:      app,
+			Stream:   seg.StreamID,
+			File:     seg.Path,
+			Seq:      seg.Seq,
+			Duration: seg.Duration.Seconds(),
+		})
+	}
+}
+
+// dashSegmentHook returns the libdash callback that raises on_dash_segment.
+func (s *server) dashSegmentHook(app string) func(libdash.Segment) {
+	return func(seg libdash.Segment) {
+		s.notify(WebhookPayload{
+			Action:   EventDASHSegment,
+			App:      app,
+			Stream:   seg.StreamID,
+			File:     seg.Path,
+			Seq:      seg.Seq,
+			Duration: seg.Duration.Seconds(),
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package librtmp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhook_PublishBlocking(t *testing.T) {
+	var got WebhookPayload
+	allow := int32(1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		if atomic.LoadInt32(&allow) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer hook.Close()
+
+	srv := NewServer(":0", "live").WithWebhook(EventPublish, hook.URL)
+	ctx := context.Background()
+	if err := srv.admit(ctx, ActionPublish, "live", "x", url.Values{"k": {"v"}}, "1.2.3.4:5"); err != nil {
+		t.Fatalf("2xx hook rejected publish: %v", err)
+	}
+	if got.Action != EventPublish || got.App != "live" || got.Stream != "x" || got.Peer != "1.2.3.4:5" || got.Query != "k=v" {
+		t.Errorf("payload = %+v", got)
+	}
+
+	atomic.StoreInt32(&allow, 0)
+	if err := srv.admit(ctx, ActionPublish, "live", "x", nil, "1.2.3.4:5"); err == nil {
+		t.Error("403 hook accepted publish")
+	}
+	//No on_play hook configured: play is unaffected.
+	if err := srv.admit(ctx, ActionPlay, "live", "x", nil, "1.2.3.4:5"); err != nil {
+		t.Errorf("play without hook rejected: %v", err)
+	}
+}
+
+func TestWebhook_RetriesServerErrors(t *testing.T) {
+	var calls int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer hook.Close()
+
+	srv := NewServer(":0", "live").
+		WithWebhook(EventPlay, hook.URL).
+		WithWebhookPolicy(time.Second, 2, time.Millisecond)
+	if err := srv.admit(context.Background(), ActionPlay, "live", "x", nil, ""); err != nil {
+		t.Fatalf("play rejected after retry: %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("hook called %d times, want 2", n)
+	}
+}
+
+func TestWebhook_ClientErrorNotRetried(t *testing.T) {
+	var calls int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer hook.Close()
+
+	srv := NewServer(":0", "live").
+		WithWebhook(EventPlay, hook.URL).
+		WithWebhookPolicy(time.Second, 3, time.Millisecond)
+	if err := srv.admit(context.Background(), ActionPlay, "live", "x", nil, ""); err == nil {
+		t.Fatal("401 hook accepted play")
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("hook called %d times, want 1", n)
+	}
+}
+
+func TestWebhook_UnpublishOnCleanup(t *testing.T) {
+	got := make(chan WebhookPayload, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p WebhookPayload
+		_ = json.NewDecoder(r.Body).Decode(&p)
+		got <- p
+	}))
+	defer hook.Close()
+
+	srv := NewServer(":0", "live").WithWebhook(EventUnpublish, hook.URL)
+	pub := &RTMP{server: srv, app: "live", role: rolePublisher, peer: "1.2.3.4:5"}
+	pub.room = NewRoom(pub, "x")
+	srv.apps["live"].Store("x", pub.room)
+	pub.cleanup()
+
+	select {
+	case p := <-got:
+		if p.Action != EventUnpublish || p.Stream != "x" {
+			t.Errorf("payload = %+v", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("on_unpublish not delivered")
+	}
+}
+
+func TestWebhook_StopAfterPlayNotFound(t *testing.T) {
+	got := make(chan Event, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p WebhookPayload
+		_ = json.NewDecoder(r.Body).Decode(&p)
+		got <- p.Action
+	}))
+	defer hook.Close()
+
+	addr := freeAddr(t)
+	srv := NewServer(addr, "live").WithWebhook(EventPlay, hook.URL).WithWebhook(EventStop, hook.URL)
+	runServer(t, srv)
+	expect := func(what string) {
+		t.Helper()
+		for _, want := range []Event{EventPlay, EventStop} {
+			select {
+			case e := <-got:
+				if e != want {
+					t.Errorf("%s: got %s, want %s", what, e, want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%s: no %s", what, want)
+			}
+		}
+	}
+
+	flv := httptest.NewServer(srv.flvMux())
+	defer flv.Close()
+	resp, err := http.Get(flv.URL + "/live/nope.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HTTP-FLV status %d, want 404", resp.StatusCode)
+	}
+	expect("HTTP-FLV")
+
+	play, err := Dial("rtmp://"+addr+"/live", DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer play.Close()
+	if err := play.Play("nope"); err == nil {
+		t.Error("played a missing stream")
+	}
+	expect("RTMP")
+}
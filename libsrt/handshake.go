@@ -3,6 +3,7 @@ package libsrt
 import (
 	"encoding/binary"
 	"errors"
+	"strings"
 )
 
 // Handshake body geometry per draft-sharabayko-srt §3.2.1. Caller
@@ -80,3 +81,51 @@ func (h *Handshake) Marshal() []byte {
 func (h *Handshake) IsInduction() bool {
 	return h.HandshakeType == HSTypeAgreement || h.Version == srtVersion4
 }
+
+// hsExtSID is the handshake extension type carrying the caller's
+// StreamID (SRT_CMD_SID, draft-sharabayko-srt §3.2.1.3).
+const hsExtSID = 5
+
+// ParseStreamID scans the extension blocks that follow the 48-byte
+// base body of a CONCLUSION handshake and returns the StreamID, if the
+// caller sent one. Each block is a 16-bit type, a 16-bit length in
+// 32-bit words, then the payload; the SID payload is the string with
+// every 4-byte word byte-swapped and zero-padded at the end.
+func ParseStreamID(body []byte) (string, bool) {
+	if len(body) <= HandshakeBodySize {
+		return "", false
+	}
+	ext := body[HandshakeBodySize:]
+	for len(ext) >= 4 {
+		typ := binary.BigEndian.Uint16(ext[:2])
+		n := int(binary.BigEndian.Uint16(ext[2:4])) * 4
+		ext = ext[4:]
+		if n > len(ext) {
+			return "", false
+		}
+		if typ == hsExtSID {
+			sid := make([]byte, 0, n)
+			for i := 0; i+4 <= n; i += 4 {
+				sid = append(sid, ext[i+3], ext[i+2], ext[i+1], ext[i])
+			}
+			return strings.TrimRight(string(sid), "\x00"), true
+		}
+		ext = ext[n:]
+	}
+	return "", false
+}
+
+// MarshalStreamID renders sid as a SRT_CMD_SID extension block ready
+// to append after a handshake body. Mirrors ParseStreamID.
+func MarshalStreamID(sid string) []byte {
+	words := (len(sid) + 3) / 4
+	out := make([]byte, 4+words*4)
+	binary.BigEndian.PutUint16(out[:2], hsExtSID)
+	binary.BigEndian.PutUint16(out[2:4], uint16(words))
+	padded := make([]byte, words*4)
+	copy(padded, sid)
+	for i := 0; i < len(padded); i += 4 {
+		out[4+i], out[5+i], out[6+i], out[7+i] = padded[i+3], padded[i+2], padded[i+1], padded[i]
+	}
+	return out
+}
@@ -0,0 +1,30 @@
+package libsrt
+
+import "testing"
+
+func TestStreamID_RoundTrip(t *testing.T) {
+	for _, sid := range []string{"x", "live/x", "live/x?expires=1&sign=abcdef"} {
+		body := append((&Handshake{HandshakeType: HSTypeConclusion}).Marshal(), MarshalStreamID(sid)...)
+		got, ok := ParseStreamID(body)
+		if !ok || got != sid {
+			t.Errorf("ParseStreamID(%q) = %q, %v", sid, got, ok)
+		}
+	}
+}
+
+func TestStreamID_Absent(t *testing.T) {
+	if _, ok := ParseStreamID((&Handshake{}).Marshal()); ok {
+		t.Error("expected no StreamID on a bare handshake body")
+	}
+}
+
+func TestStreamID_SkipsOtherExtensions(t *testing.T) {
+	body := (&Handshake{}).Marshal()
+	//HSREQ block: type 1, 3 words of payload.
+	body = append(body, 0x00, 0x01, 0x00, 0x03)
+	body = append(body, make([]byte, 12)...)
+	body = append(body, MarshalStreamID("room")...)
+	if got, ok := ParseStreamID(body); !ok || got != "room" {
+		t.Errorf("ParseStreamID = %q, %v", got, ok)
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"hash/crc32"
 	"math/rand"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/sbraveyoung/GGmpeg/liblog"
 )
 
 // AES-CTR encryption support is intentionally a no-op in this minimal
@@ -17,9 +21,17 @@ import (
 // DataHandler is invoked once per data packet with the unwrapped
 // payload bytes (typically 188-byte aligned MPEG-TS packets when the
 // publisher is FFmpeg / OBS / GStreamer in their default Live mode).
-// Returning an error stops the session.
+// Returning an error stops the session. streamID is the caller's
+// StreamID without any query.
 type DataHandler func(streamID string, payload []byte) error
 
+// AcceptHandler is consulted once per caller when its CONCLUSION
+// handshake arrives. Returning an error answers the caller with a
+// rejection handshake and forgets the session, so no data is ever
+// delivered to the DataHandler for it. streamID is the caller's
+// StreamID as sent, query and all, for the check.
+type AcceptHandler func(streamID string, peer *net.UDPAddr) error
+
 // Listener owns one UDP socket and demultiplexes packets across many
 // SRT sessions keyed by (peer addr, our destSocketID). Sessions live
 // in memory until the peer Shuts down or stops sending for a while.
@@ -27,6 +39,8 @@ type Listener struct {
 	conn       *net.UDPConn
 	streamID   string
 	onData     DataHandler
+	onAccept   AcceptHandler
+	logger     liblog.Logger
 
 	mu       sync.Mutex
 	sessions map[string]*session
@@ -56,8 +70,8 @@ type session struct {
 
 // Listen opens a UDP socket on addr and dispatches data packets via
 // onData. streamID is the logical name applied to every accepted
-// session (since the SRT spec carries an optional StreamID extension
-// we don't parse, the fallback is the listener-supplied default).
+// session that doesn't send its own StreamID extension in the
+// CONCLUSION handshake.
 func Listen(addr, streamID string, onData DataHandler) (*Listener, error) {
 	uaddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
@@ -73,10 +87,33 @@ func Listen(addr, streamID string, onData DataHandler) (*Listener, error) {
 		onData:   onData,
 		sessions: map[string]*session{},
 		socketID: rand.Uint32() | 0x40000000, //bit 30 set so it doesn't look like 0
+		logger:   liblog.Nop,
 	}
 	return l, nil
 }
 
+// WithAccept installs an AcceptHandler. Must be called before Run.
+func (l *Listener) WithAccept(fn AcceptHandler) *Listener {
+	l.onAccept = fn
+	return l
+}
+
+// WithLogger routes session lifecycle logs to l. The default is silent.
+// Must be called before Run.
+func (l *Listener) WithLogger(logger liblog.Logger) *Listener {
+	l.logger = liblog.OrNop(logger)
+	return l
+}
+
+func (l *Listener) log(sess *session) liblog.Logger {
+	return l.logger.With(
+		liblog.Stream(sess.streamID),
+		liblog.Peer(sess.peerAddr.String()),
+		liblog.Protocol("srt"),
+		liblog.Session(strconv.FormatUint(uint64(sess.ourSocketID), 10)),
+	)
+}
+
 // Run drives the receive loop until the underlying socket closes.
 // Caller is responsible for invoking Close().
 func (l *Listener) Run() error {
@@ -119,6 +156,7 @@ func (l *Listener) handlePacket(peer *net.UDPAddr, raw []byte) {
 				l.mu.Lock()
 				delete(l.sessions, key)
 				l.mu.Unlock()
+				l.log(sess).Info("session shutdown")
 			}
 		case CtrlKeepAlive:
 			if sess != nil {
@@ -159,6 +197,7 @@ func (l *Listener) handleDataPacket(sess *session, hdr *Header, body []byte) {
 	case diff < 0:
 		//Late retransmit — already delivered, drop quietly.
 		sess.mu.Unlock()
+		dataPackets.With("late").Inc()
 		return
 	case diff > 0:
 		//Loss detected: gap is [expectedSeq, hdr.SeqNumber-1]. Emit a
@@ -168,10 +207,12 @@ func (l *Listener) handleDataPacket(sess *session, hdr *Header, body []byte) {
 		to := hdr.SeqNumber - 1
 		sess.expectedSeq = hdr.SeqNumber + 1
 		sess.mu.Unlock()
+		dataPackets.With("gap").Inc()
 		l.sendNAK(sess, from, to)
 	default:
 		sess.expectedSeq++
 		sess.mu.Unlock()
+		dataPackets.With("in_order").Inc()
 	}
 	if l.onData != nil {
 		_ = l.onData(sess.streamID, body)
@@ -182,6 +223,7 @@ func (l *Listener) handleDataPacket(sess *session, hdr *Header, body []byte) {
 // sendNAK emits a single-range NAK loss-list.
 func (l *Listener) sendNAK(sess *session, from, to uint32) {
 	body := MarshalNAK([]LossRange{{From: from, To: to}})
+	naksSent.With().Inc()
 	l.sendControl(sess.peerAddr, CtrlNAK, 0, 0, sess, body)
 }
 
@@ -199,6 +241,7 @@ func (l *Listener) maybeSendACK(sess *session) {
 	ackNum := sess.ackNum
 	body := (&ACKBody{LastAckedSeq: sess.expectedSeq}).Marshal()
 	sess.mu.Unlock()
+	acksSent.With().Inc()
 	l.sendControl(sess.peerAddr, CtrlACK, 0, ackNum, sess, body)
 }
 
@@ -246,10 +289,38 @@ func (l *Listener) handleHandshake(peer *net.UDPAddr, hdr *Header, body []byte)
 	case HSTypeConclusion:
 		if hs.SyncCookie != sess.cookie {
 			//Wrong cookie — quietly drop. Real SRT rejects.
+			l.log(sess).Debug("handshake cookie mismatch")
 			return
 		}
 		sess.peerSocketID = hs.SrtSocketID
+		//A caller's StreamID may carry credentials after '?': they're
+		//for onAccept only, and the session goes by the name before.
+		sid := sess.streamID
+		if s, ok := ParseStreamID(body); ok && s != "" {
+			sid = s
+			sess.streamID = s
+			if i := strings.IndexByte(s, '?'); i >= 0 {
+				sess.streamID = s[:i]
+			}
+		}
+		if l.onAccept != nil && !sess.concluded {
+			if err := l.onAccept(sid, peer); err != nil {
+				l.log(sess).Info("session rejected", liblog.Err(err))
+				reply := *hs
+				reply.HandshakeType = HSTypeRejection
+				reply.SrtSocketID = sess.ourSocketID
+				reply.ExtensionField = 0
+				l.sendControl(peer, CtrlHandshake, 0, 0, sess, reply.Marshal())
+				l.mu.Lock()
+				delete(l.sessions, key)
+				l.mu.Unlock()
+				return
+			}
+		}
 		sess.expectedSeq = hs.InitialSequence
+		if !sess.concluded {
+			l.log(sess).Info("session accepted")
+		}
 		sess.concluded = true
 
 		reply := *hs
@@ -2,6 +2,7 @@ package libsrt
 
 import (
 	"encoding/binary"
+	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -298,3 +299,140 @@ func TestListener_E2EKeepalive(t *testing.T) {
 	}
 	_ = binary.BigEndian
 }
+
+// TestListener_E2EAcceptRejects installs an AcceptHandler that refuses
+// every caller and asserts the CONCLUSION is answered with a rejection
+// handshake and that subsequent data never reaches onData.
+func TestListener_E2EAcceptRejects(t *testing.T) {
+	var delivered int32
+	l, _ := Listen("127.0.0.1:0", "denied", func(string, []byte) error {
+		atomic.AddInt32(&delivered, 1)
+		return nil
+	})
+	defer l.Close()
+	seen := make(chan string, 1)
+	l.WithAccept(func(streamID string, peer *net.UDPAddr) error {
+		seen <- streamID
+		return errors.New("nope")
+	})
+	go l.Run()
+
+	cli, _ := net.DialUDP("udp", nil, l.conn.LocalAddr().(*net.UDPAddr))
+	defer cli.Close()
+	_ = cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	send := func(hs *Handshake, dest uint32) {
+		body := hs.Marshal()
+		out := make([]byte, HeaderSize+len(body))
+		MarshalControlHeader(out, CtrlHandshake, 0, 0, 0, dest)
+		copy(out[HeaderSize:], body)
+		cli.Write(out)
+	}
+	recv := func() *Handshake {
+		buf := make([]byte, 1500)
+		n, err := cli.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		_, body, err := ParseHeader(buf[:n])
+		if err != nil {
+			t.Fatalf("parse header: %v", err)
+		}
+		hs, err := ParseHandshake(body)
+		if err != nil {
+			t.Fatalf("parse handshake: %v", err)
+		}
+		return hs
+	}
+
+	send(&Handshake{Version: srtVersion5, HandshakeType: HSTypeAgreement, SrtSocketID: 7}, 0)
+	rep := recv()
+	send(&Handshake{
+		Version: srtVersion5, HandshakeType: HSTypeConclusion, SrtSocketID: 7,
+		SyncCookie: rep.SyncCookie, InitialSequence: 1,
+	}, rep.SrtSocketID)
+	if got := recv(); got.HandshakeType != HSTypeRejection {
+		t.Fatalf("conclusion reply type = %d, want %d", got.HandshakeType, HSTypeRejection)
+	}
+	if got := <-seen; got != "denied" {
+		t.Errorf("accept saw streamID %q, want \"denied\"", got)
+	}
+
+	dataPkt := make([]byte, HeaderSize+2)
+	MarshalDataHeader(dataPkt, 1, 0, 0, rep.SrtSocketID)
+	cli.Write(dataPkt)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&delivered); n != 0 {
+		t.Errorf("onData fired %d times for a rejected caller", n)
+	}
+}
+
+// TestListener_E2EStreamIDQuery sends a StreamID carrying a query and
+// asserts only the AcceptHandler sees it; onData gets the bare name.
+func TestListener_E2EStreamIDQuery(t *testing.T) {
+	data := make(chan string, 1)
+	l, _ := Listen("127.0.0.1:0", "default", func(streamID string, _ []byte) error {
+		select {
+		case data <- streamID:
+		default:
+		}
+		return nil
+	})
+	defer l.Close()
+	seen := make(chan string, 1)
+	l.WithAccept(func(streamID string, peer *net.UDPAddr) error {
+		seen <- streamID
+		return nil
+	})
+	go l.Run()
+
+	cli, _ := net.DialUDP("udp", nil, l.conn.LocalAddr().(*net.UDPAddr))
+	defer cli.Close()
+	_ = cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	send := func(body []byte, dest uint32) {
+		out := make([]byte, HeaderSize+len(body))
+		MarshalControlHeader(out, CtrlHandshake, 0, 0, 0, dest)
+		copy(out[HeaderSize:], body)
+		cli.Write(out)
+	}
+	recv := func() *Handshake {
+		buf := make([]byte, 1500)
+		n, err := cli.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		_, body, _ := ParseHeader(buf[:n])
+		hs, err := ParseHandshake(body)
+		if err != nil {
+			t.Fatalf("parse handshake: %v", err)
+		}
+		return hs
+	}
+
+	send((&Handshake{Version: srtVersion5, HandshakeType: HSTypeAgreement, SrtSocketID: 7}).Marshal(), 0)
+	rep := recv()
+	conclusion := (&Handshake{
+		Version: srtVersion5, HandshakeType: HSTypeConclusion, SrtSocketID: 7,
+		SyncCookie: rep.SyncCookie, InitialSequence: 1,
+	}).Marshal()
+	send(append(conclusion, MarshalStreamID("cam?sign=abc")...), rep.SrtSocketID)
+	if got := recv(); got.HandshakeType != HSTypeConclusion {
+		t.Fatalf("conclusion reply type = %d, want %d", got.HandshakeType, HSTypeConclusion)
+	}
+	if got := <-seen; got != "cam?sign=abc" {
+		t.Errorf("accept saw streamID %q, want the caller's whole StreamID", got)
+	}
+
+	dataPkt := make([]byte, HeaderSize+2)
+	MarshalDataHeader(dataPkt, 1, 0, 0, rep.SrtSocketID)
+	cli.Write(dataPkt)
+	select {
+	case got := <-data:
+		if got != "cam" {
+			t.Errorf("onData saw streamID %q, want \"cam\"", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("onData never fired")
+	}
+}
@@ -0,0 +1,12 @@
+package libsrt
+
+import "github.com/sbraveyoung/GGmpeg/libmetrics"
+
+var (
+	naksSent = libmetrics.Default.NewCounterVec(
+		"ggmpeg_srt_naks_sent_total", "SRT NAK control packets sent to publishers.")
+	acksSent = libmetrics.Default.NewCounterVec(
+		"ggmpeg_srt_acks_sent_total", "SRT ACK control packets sent to publishers.")
+	dataPackets = libmetrics.Default.NewCounterVec(
+		"ggmpeg_srt_data_packets_total", "SRT data packets received, by outcome.", "outcome")
+)
@@ -0,0 +1,96 @@
+package libvod
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// indexFLV reads the headers, then takes the keyframes from
+// onMetaData's index if it has one, or scans the file for them.
+func (m *Media) indexFLV(f io.Reader) error {
+	fr, err := libflv.NewReader(f)
+	if err != nil {
+		return ErrFormat
+	}
+	m.HasAudio, m.HasVideo = fr.TypeFlagsAudio, fr.TypeFlagsVideo
+
+	var meta *libflv.MetaTag
+	var first libflv.Tag
+	for first == nil {
+		at := fr.Offset()
+		tag, err := fr.ReadTag()
+		if err == io.EOF || errors.Is(err, libflv.ErrTruncated) {
+			m.dataStart = fr.Offset()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tag.(type) {
+		case *libflv.MetaTag:
+			if meta == nil && t.IsMetaData() {
+				meta = t
+				m.headers = append(m.headers, t)
+				continue
+			}
+		case *libflv.VideoTag:
+			if t.FrameType == libflv.KEY_FRAME && t.AVCPacketType == libflv.AVC_SEQUENCE_HEADER {
+				m.headers = append(m.headers, t)
+				continue
+			}
+		case *libflv.AudioTag:
+			if t.SoundFormat == libflv.FLV_AUDIO_AAC && t.AACPacketType == libflv.AAC_SEQUENCE_HEADER {
+				m.headers = append(m.headers, t)
+				continue
+			}
+		}
+		m.dataStart, first = at, tag
+	}
+
+	if index := fr.Keyframes(); len(index) > 0 && meta != nil && meta.Duration > 0 {
+		for _, k := range index {
+			m.Keyframes = append(m.Keyframes, k.Time)
+			m.positions = append(m.positions, k.Position)
+		}
+		m.Duration = time.Duration(meta.Duration) * time.Second
+		return nil
+	}
+	return m.scanFLV(fr, first, m.dataStart)
+}
+
+// scanFLV reads the rest of the file for its keyframes and duration;
+// tag was read from at.
+func (m *Media) scanFLV(fr *libflv.Reader, tag libflv.Tag, at int64) error {
+	var last uint32
+	for {
+		ts := tag.GetTagInfo().TimeStamp
+		if ts > last {
+			last = ts
+		}
+		switch t := tag.(type) {
+		case *libflv.VideoTag:
+			m.HasVideo = true
+			if t.FrameType == libflv.KEY_FRAME && t.AVCPacketType != libflv.AVC_SEQUENCE_HEADER {
+				m.Keyframes = append(m.Keyframes, time.Duration(ts)*time.Millisecond)
+				m.positions = append(m.positions, at)
+			}
+		case *libflv.AudioTag:
+			m.HasAudio = true
+		}
+
+		var err error
+		at = fr.Offset()
+		tag, err = fr.ReadTag()
+		if err == io.EOF || errors.Is(err, libflv.ErrTruncated) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	m.Duration = time.Duration(last) * time.Millisecond
+	return nil
+}
@@ -0,0 +1,153 @@
+package libvod
+
+import (
+	"io"
+	"sort"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/libmp4"
+)
+
+// sample is an MP4 sample, with its times in milliseconds.
+type sample struct {
+	video  bool
+	key    bool
+	codec  uint8 //FLV codec ID or sound format
+	time   uint32
+	cts    uint32
+	offset int64
+	size   uint32
+}
+
+// videoCodecs maps sample entry types to FLV codec IDs.
+var videoCodecs = map[string]uint8{
+	"avc1": libflv.FLV_VIDEO_AVC,
+	"avc3": libflv.FLV_VIDEO_AVC,
+	"hvc1": libflv.FLV_VIDEO_HEVC,
+	"hev1": libflv.FLV_VIDEO_HEVC,
+}
+
+// indexMP4 takes the first H.264/H.265 track and the first AAC track
+// of the file, merging their samples into one timeline.
+func (m *Media) indexMP4(f io.ReadSeeker) error {
+	tracks, err := libmp4.ReadMovie(f)
+	if err != nil {
+		return err
+	}
+	m.isMP4 = true
+	meta := &libflv.MetaTag{TagBase: libflv.TagBase{TagType: libflv.SCRIPT_DATA_TAG}}
+	var headers []libflv.Tag
+	for _, t := range tracks {
+		codec, isVideo := videoCodecs[t.Codec]
+		switch {
+		case isVideo && !m.HasVideo && t.Config != nil:
+			m.HasVideo = true
+			meta.VideoCodecID, meta.Width, meta.Height = float64(codec), int(t.Width), int(t.Height)
+			headers = append(headers, &libflv.VideoTag{
+				TagBase:       libflv.TagBase{TagType: libflv.VIDEO_TAG},
+				FrameType:     libflv.KEY_FRAME,
+				CodecID:       codec,
+				AVCPacketType: libflv.AVC_SEQUENCE_HEADER,
+				VideoData:     t.Config,
+			})
+		case t.Codec == "mp4a" && !m.HasAudio && t.Config != nil:
+			m.HasAudio = true
+			codec, meta.AudioCodecID = libflv.FLV_AUDIO_AAC, libflv.FLV_AUDIO_AAC
+			if rate, _, err := libmp4.ParseAudioSpecificConfig(t.Config); err == nil {
+				meta.AudioSampleRate = int(rate)
+			}
+			headers = append(headers, aacTag(libflv.AAC_SEQUENCE_HEADER, t.Config))
+		default:
+			continue
+		}
+		for _, s := range t.Samples {
+			ms := func(ticks uint64) uint32 { return uint32(ticks * 1000 / uint64(t.Timescale)) }
+			cts := uint32(0)
+			if s.CompositionTimeOffset > 0 {
+				cts = ms(s.DecodeTime+uint64(s.CompositionTimeOffset)) - ms(s.DecodeTime)
+			}
+			m.samples = append(m.samples, sample{
+				video:  isVideo,
+				key:    s.IsKey,
+				codec:  codec,
+				time:   ms(s.DecodeTime),
+				cts:    cts,
+				offset: int64(s.Offset),
+				size:   s.Size,
+			})
+			if end := time.Duration(ms(s.DecodeTime+uint64(s.Duration))) * time.Millisecond; end > m.Duration {
+				m.Duration = end
+			}
+		}
+	}
+	if !m.HasVideo && !m.HasAudio {
+		return ErrFormat
+	}
+	//Video first where the times are the same, so a seek lands on the
+	//keyframe.
+	sort.SliceStable(m.samples, func(i, j int) bool {
+		a, b := m.samples[i], m.samples[j]
+		return a.time < b.time || a.time == b.time && a.video && !b.video
+	})
+	for _, s := range m.samples {
+		if s.video && s.key {
+			m.Keyframes = append(m.Keyframes, time.Duration(s.time)*time.Millisecond)
+		}
+	}
+	meta.Duration = int(m.Duration.Round(time.Second) / time.Second)
+	m.headers = append([]libflv.Tag{meta}, headers...)
+	for _, tag := range m.headers {
+		tag.GetTagInfo().DataSize = uint32(len(tag.Marshal()))
+	}
+	return nil
+}
+
+func aacTag(packetType uint8, data []byte) *libflv.AudioTag {
+	return &libflv.AudioTag{
+		TagBase:       libflv.TagBase{TagType: libflv.AUDIO_TAG},
+		SoundFormat:   libflv.FLV_AUDIO_AAC,
+		SoundRate:     3, //44 kHz, as always for AAC
+		SoundSize:     libflv.SND_16_BIT,
+		SoundType:     libflv.SND_STEREO,
+		AACPacketType: packetType,
+		SoundData:     data,
+	}
+}
+
+// readSample reads the next MP4 sample as an FLV tag.
+func (r *Reader) readSample() (libflv.Tag, error) {
+	if r.next >= len(r.m.samples) {
+		return nil, io.EOF
+	}
+	s := r.m.samples[r.next]
+	r.next++
+	data := make([]byte, s.size)
+	if _, err := r.f.ReadAt(data, s.offset); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	var tag libflv.Tag
+	if s.video {
+		frameType := uint8(libflv.INTER_FRAME)
+		if s.key {
+			frameType = libflv.KEY_FRAME
+		}
+		tag = &libflv.VideoTag{
+			TagBase:       libflv.TagBase{TagType: libflv.VIDEO_TAG, TimeStamp: s.time},
+			FrameType:     frameType,
+			CodecID:       s.codec,
+			AVCPacketType: libflv.AVC_NALU,
+			Cts:           s.cts,
+			VideoData:     data,
+		}
+	} else {
+		audio := aacTag(libflv.AAC_RAW, data)
+		audio.TimeStamp = s.time
+		tag = audio
+	}
+	tag.GetTagInfo().DataSize = uint32(len(tag.Marshal()))
+	return tag, nil
+}
@@ -0,0 +1,161 @@
+// Package libvod plays recorded FLV and MP4 files back as FLV tags,
+// from any keyframe.
+package libvod
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+)
+
+// ErrFormat is returned by Open for files it can't play.
+var ErrFormat = errors.New("vod: unsupported file")
+
+// Media is a recorded file, indexed for playback. It is safe for
+// concurrent use: each playback opens a Reader of its own.
+type Media struct {
+	Path      string
+	Duration  time.Duration
+	Keyframes []time.Duration //video keyframes, in order
+	HasAudio  bool
+	HasVideo  bool
+
+	headers []libflv.Tag //onMetaData and sequence headers
+
+	// FLV: where each keyframe's tag, and the first tag after the
+	// headers, are in the file.
+	positions []int64
+	dataStart int64
+
+	// MP4: every sample, in decode order.
+	samples []sample
+	isMP4   bool
+}
+
+// Open indexes the FLV or MP4 file at path, by its extension.
+func Open(path string) (*Media, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &Media{Path: path}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flv":
+		err = m.indexFLV(f)
+	case ".mp4", ".m4v", ".mov":
+		err = m.indexMP4(f)
+	default:
+		err = ErrFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Headers returns the tags a player needs before any media: onMetaData
+// and the audio and video sequence headers, those the file has.
+func (m *Media) Headers() []libflv.Tag {
+	return m.headers
+}
+
+// keyframeAt returns the index of the last keyframe at or before t,
+// or -1 if there is none.
+func (m *Media) keyframeAt(t time.Duration) int {
+	return sort.Search(len(m.Keyframes), func(i int) bool { return m.Keyframes[i] > t }) - 1
+}
+
+// Reader reads a Media's tags in order, from wherever it was last
+// seeked to.
+type Reader struct {
+	m    *Media
+	f    *os.File
+	flv  *libflv.Reader
+	next int    //MP4: index of the next sample
+	from uint32 //tags before this timestamp are dropped
+}
+
+// NewReader opens the file for playback, at its start.
+func (m *Media) NewReader() (*Reader, error) {
+	f, err := os.Open(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{m: m, f: f}
+	if !m.isMP4 {
+		if r.flv, err = libflv.NewReader(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if _, err := r.SeekTo(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// SeekTo moves to the last keyframe at or before t and returns its time.
+// Without video, it moves to t itself.
+func (r *Reader) SeekTo(t time.Duration) (time.Duration, error) {
+	if t < 0 {
+		t = 0
+	}
+	start := t
+	if k := r.m.keyframeAt(t); k >= 0 {
+		start = r.m.Keyframes[k]
+	} else if r.m.HasVideo {
+		start = 0
+	}
+	r.from = uint32(start / time.Millisecond)
+	if r.m.isMP4 {
+		r.next = sort.Search(len(r.m.samples), func(i int) bool {
+			s := r.m.samples[i]
+			return s.time > r.from || s.time == r.from && (s.key || !s.video)
+		})
+		return start, nil
+	}
+	at := r.m.dataStart
+	if k := r.m.keyframeAt(t); k >= 0 && k < len(r.m.positions) {
+		at = r.m.positions[k]
+	}
+	return start, r.flv.SeekTo(at)
+}
+
+// ReadTag returns the next tag, or io.EOF after the last. A file that
+// ends part way through a tag, because it is still being recorded say,
+// ends there.
+func (r *Reader) ReadTag() (libflv.Tag, error) {
+	for {
+		var (
+			tag libflv.Tag
+			err error
+		)
+		if r.m.isMP4 {
+			tag, err = r.readSample()
+		} else {
+			tag, err = r.flv.ReadTag()
+			if errors.Is(err, libflv.ErrTruncated) {
+				err = io.EOF
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := tag.(*libflv.MetaTag); !ok && tag.GetTagInfo().TimeStamp < r.from {
+			continue
+		}
+		return tag, nil
+	}
+}
+
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,158 @@
+package libvod
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sbraveyoung/GGmpeg/libflv"
+	"github.com/sbraveyoung/GGmpeg/libmp4"
+)
+
+var avcConfig = []byte{1, 0x4d, 0x40, 0x28, 0xff, 0xe0, 0}
+
+func video(ts uint32, key bool) *libflv.VideoTag {
+	frameType := uint8(libflv.INTER_FRAME)
+	if key {
+		frameType = libflv.KEY_FRAME
+	}
+	return &libflv.VideoTag{TagBase: libflv.TagBase{TimeStamp: ts}, FrameType: frameType, CodecID: libflv.FLV_VIDEO_AVC,
+		AVCPacketType: libflv.AVC_NALU, VideoData: []byte{0, 0, 0, 1, byte(ts / 1000)}}
+}
+
+func audio(ts uint32) *libflv.AudioTag {
+	a := aacTag(libflv.AAC_RAW, []byte{0x21})
+	a.TimeStamp = ts
+	return a
+}
+
+// writeFLV writes 4 s of video, a keyframe a second, and audio.
+func writeFLV(t *testing.T) string {
+	b := []byte{'F', 'L', 'V', 1, 0x05, 0, 0, 0, 9, 0, 0, 0, 0}
+	tags := []libflv.Tag{
+		&libflv.MetaTag{Duration: 4},
+		&libflv.VideoTag{FrameType: libflv.KEY_FRAME, CodecID: libflv.FLV_VIDEO_AVC, AVCPacketType: libflv.AVC_SEQUENCE_HEADER, VideoData: avcConfig},
+		aacTag(libflv.AAC_SEQUENCE_HEADER, []byte{0x12, 0x10}),
+	}
+	for ts := uint32(0); ts <= 4000; ts += 500 {
+		tags = append(tags, video(ts, ts%1000 == 0))
+		tags = append(tags, audio(ts+20))
+	}
+	for _, tag := range tags {
+		b = append(b, libflv.FLVWrite(tag)...)
+	}
+	path := filepath.Join(t.TempDir(), "x.flv")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readAll(t *testing.T, r *Reader) (tags []libflv.Tag) {
+	t.Helper()
+	for {
+		tag, err := r.ReadTag()
+		if err == io.EOF {
+			return tags
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, tag)
+	}
+}
+
+func TestOpen_FLV(t *testing.T) {
+	m, err := Open(writeFLV(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Headers()) != 3 {
+		t.Errorf("%d headers, want onMetaData and two sequence headers", len(m.Headers()))
+	}
+	if len(m.Keyframes) != 5 || m.Keyframes[2] != 2*time.Second || m.Duration != 4020*time.Millisecond {
+		t.Errorf("keyframes %v, duration %v; want 5, one a second, and 4.02s", m.Keyframes, m.Duration)
+	}
+
+	r, err := m.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if n := len(readAll(t, r)); n != 18 {
+		t.Errorf("read %d tags, want 18", n)
+	}
+	start, err := r.SeekTo(2700 * time.Millisecond)
+	if err != nil || start != 2*time.Second {
+		t.Fatalf("SeekTo = %v, %v; want 2s", start, err)
+	}
+	tags := readAll(t, r)
+	if len(tags) != 10 || tags[0].GetTagInfo().TimeStamp != 2000 {
+		t.Errorf("after seek read %d tags from %d ms, want 10 from 2000", len(tags), tags[0].GetTagInfo().TimeStamp)
+	}
+}
+
+func TestOpen_MP4(t *testing.T) {
+	data := []byte("K0pK1A")
+	head := libmp4.BuildMovie(libmp4.InitSegmentParams{
+		TrackID:    1,
+		Timescale:  90000,
+		AVCCRecord: avcConfig,
+		Samples: []libmp4.Sample{
+			{Duration: 45000, Size: 2, IsKey: true, Offset: 0},
+			{Duration: 45000, Size: 1, Offset: 2, CompositionTimeOffset: 9000},
+			{Duration: 45000, Size: 2, IsKey: true, Offset: 3},
+		},
+		Audio: &libmp4.AudioParams{
+			TrackID:    2,
+			SampleRate: 44100,
+			Channels:   2,
+			Config:     []byte{0x12, 0x10},
+			Samples:    []libmp4.Sample{{Duration: 44100, Size: 1, IsKey: true, Offset: 5}},
+		},
+	})
+	path := filepath.Join(t.TempDir(), "x.mp4")
+	if err := os.WriteFile(path, append(head, data...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasVideo || !m.HasAudio || len(m.Keyframes) != 2 || m.Keyframes[1] != time.Second || m.Duration != 1500*time.Millisecond {
+		t.Errorf("media = %+v", m)
+	}
+	headers := m.Headers()
+	if meta, ok := headers[0].(*libflv.MetaTag); !ok || meta.Duration != 2 {
+		t.Errorf("first header = %+v, want onMetaData", headers[0])
+	}
+	if v, ok := headers[1].(*libflv.VideoTag); !ok || !bytes.Equal(v.VideoData, avcConfig) {
+		t.Errorf("second header = %+v, want the avcC record", headers[1])
+	}
+
+	r, err := m.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	tags := readAll(t, r)
+	if len(tags) != 4 {
+		t.Fatalf("read %d tags, want 4", len(tags))
+	}
+	if a, ok := tags[1].(*libflv.AudioTag); !ok || string(a.SoundData) != "A" || a.TimeStamp != 0 {
+		t.Errorf("second tag = %+v, want the audio frame", tags[1])
+	}
+	if v, ok := tags[2].(*libflv.VideoTag); !ok || v.Cts != 100 || string(v.VideoData) != "p" {
+		t.Errorf("third tag = %+v, want the B-frame 100 ms ahead", tags[2])
+	}
+	if _, err := r.SeekTo(1200 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if tags := readAll(t, r); len(tags) != 1 || string(tags[0].(*libflv.VideoTag).VideoData) != "K1" {
+		t.Errorf("after seek read %v, want the second keyframe", tags)
+	}
+}